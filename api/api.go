@@ -7,11 +7,16 @@ import (
 	"golang.org/x/net/context"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
 	"github.com/lomik/go-carbon/cache"
 	"github.com/lomik/go-carbon/helper"
 	"github.com/lomik/go-carbon/helper/carbonpb"
+	"github.com/lomik/go-carbon/helper/tlsconfig"
+	"github.com/lomik/go-carbon/persister"
+	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/stop"
 )
 
@@ -23,9 +28,16 @@ type Api struct {
 		cacheRequestMetrics  uint32 // atomic
 		cacheResponseMetrics uint32 // atomic
 		cacheResponsePoints  uint32 // atomic
+		backfillRequests     uint32 // atomic
+		backfillMetrics      uint32 // atomic
+		backfillPoints       uint32 // atomic
+		backfillRejected     uint32 // atomic
+		backfillErrors       uint32 // atomic
 	}
 	cache    *cache.Cache
+	backfill func(*points.Points) *persister.BackfillResult
 	listener *net.TCPListener
+	tls      *tlsconfig.Config
 }
 
 func New(c *cache.Cache) *Api {
@@ -34,6 +46,11 @@ func New(c *cache.Cache) *Api {
 	}
 }
 
+// SetBackfill enables Backfill method. Points of every metric are written with fn
+func (api *Api) SetBackfill(fn func(*points.Points) *persister.BackfillResult) {
+	api.backfill = fn
+}
+
 // Addr returns binded socket address. For bind port 0 in tests
 func (api *Api) Addr() net.Addr {
 	if api.listener == nil {
@@ -42,12 +59,41 @@ func (api *Api) Addr() net.Addr {
 	return api.listener.Addr()
 }
 
+// SetTLS enables TLS on listener. Nil config disables TLS
+func (api *Api) SetTLS(config *tlsconfig.Config) {
+	if config != nil {
+		// gRPC clients require HTTP/2 negotiated with ALPN
+		config.SetNextProtos([]string{"h2"})
+	}
+	api.tls = config
+}
+
+// ReloadTLS reads certificate files again. Used on SIGHUP
+func (api *Api) ReloadTLS() error {
+	if api.tls == nil {
+		return nil
+	}
+	return api.tls.Reload()
+}
+
 // Collect cache metrics
 func (api *Api) Stat(send helper.StatCallback) {
 	helper.SendAndSubstractUint32("cacheRequests", &api.stat.cacheRequests, send)
 	helper.SendAndSubstractUint32("cacheRequestMetrics", &api.stat.cacheRequestMetrics, send)
 	helper.SendAndSubstractUint32("cacheResponseMetrics", &api.stat.cacheResponseMetrics, send)
 	helper.SendAndSubstractUint32("cacheResponsePoints", &api.stat.cacheResponsePoints, send)
+
+	if api.backfill != nil {
+		helper.SendAndSubstractUint32("backfillRequests", &api.stat.backfillRequests, send)
+		helper.SendAndSubstractUint32("backfillMetrics", &api.stat.backfillMetrics, send)
+		helper.SendAndSubstractUint32("backfillPoints", &api.stat.backfillPoints, send)
+		helper.SendAndSubstractUint32("backfillRejected", &api.stat.backfillRejected, send)
+		helper.SendAndSubstractUint32("backfillErrors", &api.stat.backfillErrors, send)
+	}
+
+	if api.tls != nil {
+		send("tlsHandshakeErrors", float64(api.tls.HandshakeErrors()))
+	}
 }
 
 // Listen bind port. Receive messages and send to out channel
@@ -59,6 +105,11 @@ func (api *Api) Listen(addr *net.TCPAddr) error {
 			return err
 		}
 
+		var listener net.Listener = tcpListener
+		if api.tls != nil {
+			listener = tlsconfig.NewListener(tcpListener, api.tls)
+		}
+
 		s := grpc.NewServer()
 		carbonpb.RegisterCarbonServer(s, api)
 		// Register reflection service on gRPC server.
@@ -72,7 +123,7 @@ func (api *Api) Listen(addr *net.TCPAddr) error {
 		api.Go(func(exit chan struct{}) {
 			defer s.Stop()
 
-			if err := s.Serve(tcpListener); err != nil {
+			if err := s.Serve(listener); err != nil {
 				// may be stopped - not error
 				// zapwriter.Logger("api").Fatal("failed to serve", zap.Error(err))
 			}
@@ -120,3 +171,44 @@ func (api *Api) CacheQuery(ctx context.Context, req *carbonpb.CacheRequest) (*ca
 
 	return res, nil
 }
+
+// Backfill writes historic points directly to whisper files, bypassing cache
+func (api *Api) Backfill(ctx context.Context, req *carbonpb.Payload) (*carbonpb.BackfillResponse, error) {
+	if api.backfill == nil {
+		return nil, status.Errorf(codes.Unimplemented, "backfill is not enabled")
+	}
+
+	res := &carbonpb.BackfillResponse{
+		Results: make([]*carbonpb.BackfillResult, 0, len(req.Metrics)),
+	}
+
+	for _, m := range req.Metrics {
+		values := &points.Points{
+			Metric: m.Metric,
+			Data:   make([]points.Point, len(m.Points)),
+		}
+		for j := 0; j < len(m.Points); j++ {
+			values.Data[j].Timestamp = int64(m.Points[j].Timestamp)
+			values.Data[j].Value = m.Points[j].Value
+		}
+		r := api.backfill(values)
+
+		if r.Error != "" {
+			atomic.AddUint32(&api.stat.backfillErrors, 1)
+		}
+		atomic.AddUint32(&api.stat.backfillPoints, uint32(r.Written))
+		atomic.AddUint32(&api.stat.backfillRejected, uint32(r.Rejected))
+
+		res.Results = append(res.Results, &carbonpb.BackfillResult{
+			Metric:   r.Metric,
+			Written:  uint32(r.Written),
+			Rejected: uint32(r.Rejected),
+			Error:    r.Error,
+		})
+	}
+
+	atomic.AddUint32(&api.stat.backfillRequests, 1)
+	atomic.AddUint32(&api.stat.backfillMetrics, uint32(len(req.Metrics)))
+
+	return res, nil
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/lomik/go-carbon/helper/carbonpb"
+	"github.com/lomik/go-carbon/persister"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestBackfill(t *testing.T) {
+	assert := assert.New(t)
+
+	var received []*points.Points
+	api := New(nil)
+	api.SetBackfill(func(p *points.Points) *persister.BackfillResult {
+		received = append(received, p)
+		if p.Metric == "" {
+			return &persister.BackfillResult{Error: "invalid metric name"}
+		}
+		return &persister.BackfillResult{Metric: p.Metric, Written: len(p.Data) - 1, Rejected: 1}
+	})
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	if !assert.NoError(api.Listen(addr)) {
+		return
+	}
+	defer api.Stop()
+
+	conn, err := grpc.Dial(api.Addr().String(), grpc.WithInsecure(), grpc.WithTimeout(time.Second))
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := carbonpb.NewCarbonClient(conn).Backfill(ctx, &carbonpb.Payload{Metrics: []*carbonpb.Metric{
+		{Metric: "hello.world", Points: []carbonpb.Point{{Timestamp: 1500000000, Value: 42}, {Timestamp: 1400000000, Value: 1}}},
+		{Metric: ""},
+	}})
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal([]*carbonpb.BackfillResult{
+		{Metric: "hello.world", Written: 1, Rejected: 1},
+		{Error: "invalid metric name"},
+	}, res.Results)
+
+	if assert.Equal(2, len(received)) {
+		assert.Equal(points.OnePoint("hello.world", 42, 1500000000).Add(1, 1400000000), received[0])
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/lomik/go-carbon/helper"
 	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/go-carbon/tags"
+	"github.com/lomik/go-carbon/wal"
 )
 
 type WriteStrategy int
@@ -22,19 +23,41 @@ const (
 	MaximumLength WriteStrategy = iota
 	TimestampOrder
 	Noop
+	Priority
 )
 
 const shardCount = 1024
 
+// estimated memory of cache items
+const (
+	pointSize    = 16  // value and timestamp of points.Point
+	itemOverhead = 128 // map entry, key string header, points.Points struct and pointer
+)
+
+// itemSize returns estimated memory of cache item in bytes
+func itemSize(p *points.Points) int64 {
+	return int64(itemOverhead+len(p.Metric)) + int64(cap(p.Data))*pointSize
+}
+
 type cacheSettings struct {
-	maxSize     int32
-	xlog        io.Writer
-	tagsEnabled bool
+	maxSize         int32
+	maxMemory       int64
+	overflow        *Overflow
+	xlog            io.Writer
+	wal             *wal.WAL
+	tagsEnabled     bool
+	quotas          []*Quota
+	seriesExists    func(metric string) bool
+	priorityRules   PriorityRules
+	priorityAging   time.Duration
+	priorityVersion int // changed by SetPriority, invalidates weights cached in shards
 }
 
 // A "thread" safe map of type string:Anything.
 // To avoid lock bottlenecks this map is dived to several (shardCount) map shards.
 type Cache struct {
+	memory int64 // estimated memory of items in bytes, changing via atomic. First field for 64-bit alignment
+
 	sync.Mutex
 
 	queueLastBuild time.Time
@@ -54,6 +77,8 @@ type Cache struct {
 		overflowCnt         uint32 // drop packages if cache full
 		queryCnt            uint32 // number of queries
 		tagsNormalizeErrors uint32 // tags normalize errors count
+		quotaDropped        uint32 // points dropped by quotas
+		walErrors           uint32 // points accepted to cache without wal record
 	}
 }
 
@@ -61,8 +86,12 @@ type Cache struct {
 type Shard struct {
 	sync.RWMutex     // Read Write mutex, guards access to internal map.
 	items            map[string]*points.Points
-	notConfirmed     []*points.Points // linear search for value/slot
-	notConfirmedUsed int              // search value in notConfirmed[:notConfirmedUsed]
+	notConfirmed     []*points.Points         // linear search for value/slot
+	notConfirmedUsed int                      // search value in notConfirmed[:notConfirmedUsed]
+	walSegments      map[string]int64         // oldest wal segment of items
+	walNotConfirmed  map[*points.Points]int64 // oldest wal segment of notConfirmed
+	weights          map[string]int64         // weights of priority rules, cached by makeQueue
+	weightsVersion   int                      // priorityVersion of settings of weights
 }
 
 // Creates a new cache instance
@@ -74,8 +103,10 @@ func New() *Cache {
 
 	for i := 0; i < shardCount; i++ {
 		c.data[i] = &Shard{
-			items:        make(map[string]*points.Points),
-			notConfirmed: make([]*points.Points, 4),
+			items:           make(map[string]*points.Points),
+			notConfirmed:    make([]*points.Points, 4),
+			walSegments:     make(map[string]int64),
+			walNotConfirmed: make(map[*points.Points]int64),
 		}
 	}
 
@@ -103,8 +134,10 @@ func (c *Cache) SetWriteStrategy(s string) (err error) {
 		c.writeStrategy = TimestampOrder
 	case "noop":
 		c.writeStrategy = Noop
+	case "priority":
+		c.writeStrategy = Priority
 	default:
-		return fmt.Errorf("Unknown write strategy '%s', should be one of: max, sorted, noop", s)
+		return fmt.Errorf("Unknown write strategy '%s', should be one of: max, sorted, noop, priority", s)
 	}
 	return nil
 }
@@ -117,6 +150,37 @@ func (c *Cache) SetMaxSize(maxSize uint32) {
 	c.settings.Store(&newSettings)
 }
 
+// SetPriority sets weight rules and aging interval of priority write strategy. Zero aging disables aging
+func (c *Cache) SetPriority(rules PriorityRules, aging time.Duration) {
+	s := c.settings.Load().(*cacheSettings)
+	newSettings := *s
+	newSettings.priorityRules = rules
+	newSettings.priorityAging = aging
+	newSettings.priorityVersion++
+	c.settings.Store(&newSettings)
+}
+
+// SetMaxMemory sets limit of estimated cache memory in bytes. 0 - unlimited
+func (c *Cache) SetMaxMemory(maxMemory int64) {
+	s := c.settings.Load().(*cacheSettings)
+	newSettings := *s
+	newSettings.maxMemory = maxMemory
+	c.settings.Store(&newSettings)
+}
+
+// SetOverflow enables on-disk buffer for points which do not fit into max-size or max-memory. Without overflow such points are dropped
+func (c *Cache) SetOverflow(o *Overflow) {
+	s := c.settings.Load().(*cacheSettings)
+	newSettings := *s
+	newSettings.overflow = o
+	c.settings.Store(&newSettings)
+}
+
+// Overflow returns on-disk buffer of cache or nil
+func (c *Cache) Overflow() *Overflow {
+	return c.settings.Load().(*cacheSettings).overflow
+}
+
 func (c *Cache) SetTagsEnabled(value bool) {
 	s := c.settings.Load().(*cacheSettings)
 	newSettings := *s
@@ -124,7 +188,20 @@ func (c *Cache) SetTagsEnabled(value bool) {
 	c.settings.Store(&newSettings)
 }
 
-func (c *Cache) Stop() {}
+// SetWAL enables write-ahead log for all accepted points
+func (c *Cache) SetWAL(w *wal.WAL) {
+	s := c.settings.Load().(*cacheSettings)
+	newSettings := *s
+	newSettings.wal = w
+	c.settings.Store(&newSettings)
+}
+
+// Stop closes current segment of overflow, so it is drained after restart
+func (c *Cache) Stop() {
+	if o := c.Overflow(); o != nil {
+		o.Flush()
+	}
+}
 
 // Collect cache metrics
 func (c *Cache) Stat(send helper.StatCallback) {
@@ -133,14 +210,25 @@ func (c *Cache) Stat(send helper.StatCallback) {
 	send("size", float64(c.Size()))
 	send("metrics", float64(c.Len()))
 	send("maxSize", float64(s.maxSize))
+	send("memory", float64(c.Memory()))
+	send("maxMemory", float64(s.maxMemory))
 
 	helper.SendAndSubstractUint32("queries", &c.stat.queryCnt, send)
 	helper.SendAndSubstractUint32("tagsNormalizeErrors", &c.stat.tagsNormalizeErrors, send)
 	helper.SendAndSubstractUint32("overflow", &c.stat.overflowCnt, send)
+	helper.SendAndSubstractUint32("quotaDropped", &c.stat.quotaDropped, send)
 
 	helper.SendAndSubstractUint32("queueBuildCount", &c.stat.queueBuildCnt, send)
 	helper.SendAndSubstractUint32("queueBuildTimeMs", &c.stat.queueBuildTimeMs, send)
 	helper.SendUint32("queueWriteoutTime", &c.stat.queueWriteoutTime, send)
+
+	if s.overflow != nil {
+		s.overflow.Stat(send)
+	}
+
+	if s.wal != nil {
+		helper.SendAndSubstractUint32("walErrors", &c.stat.walErrors, send)
+	}
 }
 
 // hash function
@@ -205,6 +293,7 @@ func (c *Cache) Confirm(p *points.Points) {
 			shard.notConfirmedUsed--
 		}
 	}
+	delete(shard.walNotConfirmed, p)
 	shard.Unlock()
 }
 
@@ -223,6 +312,11 @@ func (c *Cache) Size() int32 {
 	return atomic.LoadInt32(&c.stat.size)
 }
 
+// Memory returns estimated memory of cache items in bytes
+func (c *Cache) Memory() int64 {
+	return atomic.LoadInt64(&c.memory)
+}
+
 func (c *Cache) DivertToXlog(w io.Writer) {
 	s := c.settings.Load().(*cacheSettings)
 	newSettings := *s
@@ -248,25 +342,60 @@ func (c *Cache) Add(p *points.Points) {
 		}
 	}
 
+	if len(s.quotas) > 0 && !c.checkQuotas(s, p) {
+		return
+	}
+
 	// Get map shard.
 	count := len(p.Data)
 
-	if s.maxSize > 0 && c.Size() > s.maxSize {
-		atomic.AddUint32(&c.stat.overflowCnt, uint32(count))
+	if (s.maxSize > 0 && c.Size() > s.maxSize) || (s.maxMemory > 0 && c.Memory() > s.maxMemory) {
+		if s.overflow == nil || s.overflow.Write(p) != nil {
+			atomic.AddUint32(&c.stat.overflowCnt, uint32(count))
+		}
 		return
 	}
 
 	shard := c.GetShard(p.Metric)
 
+	// write without shard lock. Wal keeps segment until Release, so WALWatermark never misses written but unregistered points.
+	// Points failed to write are still accepted to cache, but they are lost on crash
+	var segment int64
+	walWritten := false
+	if s.wal != nil {
+		var err error
+		if segment, err = s.wal.Write(p); err == nil {
+			walWritten = true
+		} else {
+			atomic.AddUint32(&c.stat.walErrors, uint32(count))
+		}
+	}
+
 	shard.Lock()
+	if walWritten {
+		// concurrent Add of same metric can register newer segment first
+		if prev, exists := shard.walSegments[p.Metric]; !exists || segment < prev {
+			shard.walSegments[p.Metric] = segment
+		}
+	}
+
+	var memory int64
 	if values, exists := shard.items[p.Metric]; exists {
+		prevCap := cap(values.Data)
 		values.Data = append(values.Data, p.Data...)
+		memory = int64(cap(values.Data)-prevCap) * pointSize
 	} else {
 		shard.items[p.Metric] = p
+		memory = itemSize(p)
 	}
 	shard.Unlock()
 
+	if walWritten {
+		s.wal.Release(segment)
+	}
+
 	atomic.AddInt32(&c.stat.size, int32(count))
+	atomic.AddInt64(&c.memory, memory)
 }
 
 // Pop removes an element from the map and returns it
@@ -276,10 +405,12 @@ func (c *Cache) Pop(key string) (p *points.Points, exists bool) {
 	shard.Lock()
 	p, exists = shard.items[key]
 	delete(shard.items, key)
+	delete(shard.walSegments, key)
 	shard.Unlock()
 
 	if exists {
 		atomic.AddInt32(&c.stat.size, -int32(len(p.Data)))
+		atomic.AddInt64(&c.memory, -itemSize(p))
 	}
 
 	return p, exists
@@ -299,16 +430,45 @@ func (c *Cache) PopNotConfirmed(key string) (p *points.Points, exists bool) {
 			shard.notConfirmed = append(shard.notConfirmed, p)
 		}
 		shard.notConfirmedUsed++
+
+		if segment, ok := shard.walSegments[key]; ok {
+			shard.walNotConfirmed[p] = segment
+			delete(shard.walSegments, key)
+		}
 	}
 	shard.Unlock()
 
 	if exists {
 		atomic.AddInt32(&c.stat.size, -int32(len(p.Data)))
+		atomic.AddInt64(&c.memory, -itemSize(p))
 	}
 
 	return p, exists
 }
 
+// WALWatermark returns id of the oldest wal segment with not confirmed points or 0 if all points are confirmed
+func (c *Cache) WALWatermark() int64 {
+	var watermark int64
+
+	for i := 0; i < shardCount; i++ {
+		shard := c.data[i]
+		shard.Lock()
+		for _, segment := range shard.walSegments {
+			if watermark == 0 || segment < watermark {
+				watermark = segment
+			}
+		}
+		for _, segment := range shard.walNotConfirmed {
+			if watermark == 0 || segment < watermark {
+				watermark = segment
+			}
+		}
+		shard.Unlock()
+	}
+
+	return watermark
+}
+
 func (c *Cache) WriteoutQueue() *WriteoutQueue {
 	return c.writeoutQueue
 }
@@ -12,6 +12,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/helper/tlsconfig"
 	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/graphite-pickle/framing"
 	"github.com/lomik/zapwriter"
@@ -144,6 +145,7 @@ type CarbonlinkListener struct {
 	cache       *Cache
 	readTimeout time.Duration
 	tcpListener *net.TCPListener
+	tls         *tlsconfig.Config
 }
 
 // NewCarbonlinkListener create new instance of CarbonlinkListener
@@ -159,6 +161,33 @@ func (listener *CarbonlinkListener) SetReadTimeout(timeout time.Duration) {
 	listener.readTimeout = timeout
 }
 
+// SetTLS enables TLS on listener. Nil config disables TLS
+func (listener *CarbonlinkListener) SetTLS(config *tlsconfig.Config) {
+	listener.tls = config
+}
+
+// ReloadTLS reads certificate files again. Used on SIGHUP
+func (listener *CarbonlinkListener) ReloadTLS() error {
+	if listener.tls == nil {
+		return nil
+	}
+	return listener.tls.Reload()
+}
+
+// Stat sends internal statistics
+func (listener *CarbonlinkListener) Stat(send helper.StatCallback) {
+	if listener.tls != nil {
+		send("tlsHandshakeErrors", float64(listener.tls.HandshakeErrors()))
+	}
+}
+
+// resetConn drops connection without waiting for unsent data
+func resetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+}
+
 func pickleWriteMemo(b *bytes.Buffer, memo *uint32) {
 	if *memo < 256 {
 		b.WriteByte('q')
@@ -224,7 +253,7 @@ func (listener *CarbonlinkListener) HandleConnection(conn framing.Conn) {
 		reqData, err := conn.ReadFrame()
 
 		if err != nil {
-			conn.Conn.(*net.TCPConn).SetLinger(0)
+			resetConn(conn.Conn)
 			logger.Debug("request read failed", zap.Error(err))
 			break
 		}
@@ -232,7 +261,7 @@ func (listener *CarbonlinkListener) HandleConnection(conn framing.Conn) {
 		req, err := ParseCarbonlinkRequest(reqData)
 
 		if err != nil {
-			conn.Conn.(*net.TCPConn).SetLinger(0)
+			resetConn(conn.Conn)
 			logger.Warn("request parse failed", zap.Error(err))
 			break
 		}
@@ -277,6 +306,11 @@ func (listener *CarbonlinkListener) Listen(addr *net.TCPAddr) error {
 
 		listener.tcpListener = tcpListener
 
+		var netListener net.Listener = tcpListener
+		if listener.tls != nil {
+			netListener = tlsconfig.NewListener(tcpListener, listener.tls)
+		}
+
 		listener.Go(func(exit chan bool) {
 			select {
 			case <-exit:
@@ -288,7 +322,7 @@ func (listener *CarbonlinkListener) Listen(addr *net.TCPAddr) error {
 			defer tcpListener.Close()
 
 			for {
-				conn, err := tcpListener.Accept()
+				conn, err := netListener.Accept()
 				if err != nil {
 					if strings.Contains(err.Error(), "use of closed network connection") {
 						break
@@ -1,8 +1,21 @@
 package cache
 
-import "io"
+import (
+	"fmt"
+	"io"
+	"time"
+)
 
+// Dump writes all points of cache in plain text format. With priority write strategy every metric
+// waiting for write is preceded by "# priority <value> <metric>" line, which is skipped on restore
 func (c *Cache) Dump(w io.Writer) error {
+	c.Lock()
+	writeStrategy := c.writeStrategy
+	c.Unlock()
+
+	s := c.settings.Load().(*cacheSettings)
+	now := time.Now().Unix()
+
 	for i := 0; i < shardCount; i++ {
 		shard := c.data[i]
 		shard.Lock()
@@ -18,6 +31,12 @@ func (c *Cache) Dump(w io.Writer) error {
 		}
 
 		for _, p := range shard.items {
+			if writeStrategy == Priority {
+				if _, err := fmt.Fprintf(w, "# priority %d %s\n", priority(s, p, now), p.Metric); err != nil {
+					shard.Unlock()
+					return err
+				}
+			}
 			if _, err := p.WriteTo(w); err != nil {
 				shard.Unlock()
 				return err
@@ -0,0 +1,325 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+)
+
+const overflowSuffix = ".bin"
+const overflowTmpSuffix = ".tmp"
+
+// Overflow is on-disk buffer of points which did not fit into cache. Points are written to segment
+// files in binary format. Segment is written with .tmp suffix and renamed on close, so only complete
+// segments are read. Persister reads segments one by one with Next, Pop and Confirm before cache
+type Overflow struct {
+	pending int32 // 0 if overflow was found empty and nothing was written since, changing via atomic
+
+	dir         string
+	segmentSize int64
+
+	writeMutex sync.Mutex
+	file       *os.File
+	writer     *bufio.Writer
+	tmpPath    string
+	written    int64
+	lastID     int64
+
+	readMutex sync.Mutex
+	segment   string                    // segment being drained, removed when all points are taken and confirmed
+	batch     map[string]*points.Points // not taken points of segment
+	queue     []string                  // not returned by Next metrics of segment
+	taken     int                       // taken but not confirmed points of segment
+
+	stat struct {
+		spilled     uint32 // counter
+		drained     uint32 // counter
+		writeErrors uint32 // counter
+		readErrors  uint32 // counter
+	}
+}
+
+// NewOverflow creates overflow buffer in dir
+func NewOverflow(dir string) *Overflow {
+	return &Overflow{
+		pending:     1, // segments of previous run are looked up on first Next
+		dir:         dir,
+		segmentSize: 16 * 1024 * 1024,
+	}
+}
+
+// SetSegmentSize sets max size of one segment file in bytes
+func (o *Overflow) SetSegmentSize(size int64) {
+	o.segmentSize = size
+}
+
+// Dir returns directory of segments
+func (o *Overflow) Dir() string {
+	return o.dir
+}
+
+// Write appends points to current segment
+func (o *Overflow) Write(p *points.Points) error {
+	o.writeMutex.Lock()
+	defer o.writeMutex.Unlock()
+
+	if o.file == nil {
+		if err := o.open(); err != nil {
+			atomic.AddUint32(&o.stat.writeErrors, 1)
+			return err
+		}
+	}
+
+	n, err := p.WriteBinaryTo(o.writer)
+	o.written += int64(n)
+	if err != nil {
+		atomic.AddUint32(&o.stat.writeErrors, 1)
+		return err
+	}
+	atomic.AddUint32(&o.stat.spilled, uint32(len(p.Data)))
+	atomic.StoreInt32(&o.pending, 1)
+
+	if o.written >= o.segmentSize {
+		return o.close()
+	}
+	return nil
+}
+
+// open creates new segment. Called with locked writeMutex
+func (o *Overflow) open() error {
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return err
+	}
+
+	id := time.Now().UnixNano()
+	if id <= o.lastID {
+		id = o.lastID + 1
+	}
+
+	tmpPath := filepath.Join(o.dir, fmt.Sprintf("%d%s%s", id, overflowSuffix, overflowTmpSuffix))
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	o.lastID = id
+	o.file = file
+	o.writer = bufio.NewWriterSize(file, 65536)
+	o.tmpPath = tmpPath
+	o.written = 0
+	return nil
+}
+
+// close flushes and renames current segment. Called with locked writeMutex
+func (o *Overflow) close() error {
+	if o.file == nil {
+		return nil
+	}
+
+	err := o.writer.Flush()
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(o.tmpPath, strings.TrimSuffix(o.tmpPath, overflowTmpSuffix))
+	}
+
+	o.file = nil
+	o.writer = nil
+	o.written = 0
+	return err
+}
+
+// Flush closes current segment, so it becomes available for read
+func (o *Overflow) Flush() error {
+	o.writeMutex.Lock()
+	defer o.writeMutex.Unlock()
+	return o.close()
+}
+
+// Recover makes segments left unfinished by previous run available for read
+func (o *Overflow) Recover() error {
+	o.writeMutex.Lock()
+	defer o.writeMutex.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(o.dir, "*"+overflowSuffix+overflowTmpSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, tmpPath := range files {
+		if tmpPath == o.tmpPath && o.file != nil {
+			continue
+		}
+		if err = os.Rename(tmpPath, strings.TrimSuffix(tmpPath, overflowTmpSuffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list returns complete segments sorted from oldest
+func (o *Overflow) list() ([]string, error) {
+	files, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	res := make([]string, 0)
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), overflowSuffix) {
+			res = append(res, filepath.Join(o.dir, file.Name()))
+		}
+	}
+
+	// names are nanosecond timestamps with same length
+	sort.Strings(res)
+	return res, nil
+}
+
+// load reads oldest complete segment into batch. Current segment is closed if there are no complete segments.
+// Called with locked readMutex
+func (o *Overflow) load() {
+	if atomic.LoadInt32(&o.pending) == 0 {
+		return
+	}
+	// reset before lookup, so concurrent Write is not missed
+	atomic.StoreInt32(&o.pending, 0)
+
+	files, err := o.list()
+	if err == nil && len(files) == 0 {
+		o.writeMutex.Lock()
+		written := o.written
+		o.writeMutex.Unlock()
+
+		if written == 0 {
+			return
+		}
+		if err = o.Flush(); err == nil {
+			files, err = o.list()
+		}
+	}
+
+	if err != nil {
+		atomic.AddUint32(&o.stat.readErrors, 1)
+		atomic.StoreInt32(&o.pending, 1)
+		return
+	}
+
+	if len(files) == 0 {
+		return
+	}
+
+	batch := make(map[string]*points.Points)
+	queue := make([]string, 0)
+
+	// unfinished segment of crashed process can be truncated, so read errors are counted but points are kept
+	err = points.ReadFromFile(files[0], func(p *points.Points) {
+		if values, exists := batch[p.Metric]; exists {
+			values.Data = append(values.Data, p.Data...)
+			return
+		}
+		batch[p.Metric] = p
+		queue = append(queue, p.Metric)
+	})
+	if err != nil {
+		atomic.AddUint32(&o.stat.readErrors, 1)
+	}
+
+	o.segment = files[0]
+	o.batch = batch
+	o.queue = queue
+
+	// more segments can be left after this one
+	atomic.StoreInt32(&o.pending, 1)
+}
+
+// Next returns metric with points in oldest segment or empty string if there is nothing to take now.
+// Points of metric should be taken with Pop and confirmed with Confirm when written.
+// Metrics not taken after Next (e.g. with throttled creation) are returned again after empty string,
+// so points of cache are written meanwhile
+func (o *Overflow) Next() string {
+	o.readMutex.Lock()
+	defer o.readMutex.Unlock()
+
+	for {
+		for len(o.queue) > 0 {
+			metric := o.queue[0]
+			o.queue = o.queue[1:]
+			if _, exists := o.batch[metric]; exists {
+				return metric
+			}
+		}
+
+		if o.segment != "" {
+			if len(o.batch) > 0 {
+				o.queue = make([]string, 0, len(o.batch))
+				for metric := range o.batch {
+					o.queue = append(o.queue, metric)
+				}
+				sort.Strings(o.queue)
+				return ""
+			}
+
+			// points are lost on crash if segment is removed before they are written
+			if o.taken > 0 {
+				return ""
+			}
+
+			if err := os.Remove(o.segment); err != nil && !os.IsNotExist(err) {
+				atomic.AddUint32(&o.stat.readErrors, 1)
+			}
+			o.segment = ""
+			o.batch = nil
+		}
+
+		o.load()
+		if o.segment == "" {
+			return ""
+		}
+	}
+}
+
+// Pop takes points of metric from segment being drained. Segment is kept until taken points are confirmed
+func (o *Overflow) Pop(metric string) (p *points.Points, exists bool) {
+	o.readMutex.Lock()
+	p, exists = o.batch[metric]
+	if exists {
+		delete(o.batch, metric)
+		o.taken++
+	}
+	o.readMutex.Unlock()
+
+	if exists {
+		atomic.AddUint32(&o.stat.drained, uint32(len(p.Data)))
+	}
+	return p, exists
+}
+
+// Confirm marks points taken with Pop as written or dropped
+func (o *Overflow) Confirm(p *points.Points) {
+	o.readMutex.Lock()
+	o.taken--
+	o.readMutex.Unlock()
+}
+
+// Stat callback
+func (o *Overflow) Stat(send helper.StatCallback) {
+	helper.SendAndSubstractUint32("overflowSpilled", &o.stat.spilled, send)
+	helper.SendAndSubstractUint32("overflowDrained", &o.stat.drained, send)
+	helper.SendAndSubstractUint32("overflowWriteErrors", &o.stat.writeErrors, send)
+	helper.SendAndSubstractUint32("overflowReadErrors", &o.stat.readErrors, send)
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestCacheMaxMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	c := New()
+	c.SetMaxMemory(1)
+
+	c.Add(points.OnePoint("hello.world", 42, 10))
+	memory := c.Memory()
+	assert.True(memory >= int64(itemOverhead+len("hello.world")+pointSize))
+
+	// cache is full, points are dropped without overflow
+	c.Add(points.OnePoint("hello.world", 43, 11))
+	assert.Equal(int32(1), c.Size())
+	assert.Equal(memory, c.Memory())
+
+	c.Pop("hello.world")
+	assert.Equal(int64(0), c.Memory())
+
+	c.SetMaxMemory(0)
+	for i := 0; i < 100; i++ {
+		c.Add(points.OnePoint("hello.world", 42, int64(i)))
+	}
+	assert.True(c.Memory() >= int64(itemOverhead+len("hello.world")+100*pointSize))
+
+	c.PopNotConfirmed("hello.world")
+	assert.Equal(int64(0), c.Memory())
+}
+
+func TestCacheOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		dir := filepath.Join(root, "overflow")
+
+		c := New()
+		c.SetMaxSize(1)
+		c.SetOverflow(NewOverflow(dir))
+
+		o := c.Overflow()
+		assert.Equal("", o.Next())
+
+		c.Add(points.OnePoint("hello.world", 1, 10))
+		c.Add(points.OnePoint("hello.world", 2, 11))
+		c.Add(points.OnePoint("hello.world", 3, 12))
+		c.Add(points.OnePoint("foo.bar", 4, 13))
+		c.Add(points.OnePoint("hello.world", 5, 14))
+
+		// points over max-size are spilled, not dropped
+		assert.Equal(int32(2), c.Size())
+
+		stat := make(map[string]float64)
+		c.Stat(func(metric string, value float64) { stat[metric] = value })
+		assert.Equal(float64(0), stat["overflow"])
+		assert.Equal(float64(3), stat["overflowSpilled"])
+
+		// current segment is closed on first read
+		assert.Equal("hello.world", o.Next())
+		p, exists := o.Pop("hello.world")
+		assert.True(exists)
+		assert.Equal([]points.Point{{Value: 3, Timestamp: 12}, {Value: 5, Timestamp: 14}}, p.Data)
+		o.Confirm(p)
+
+		// metric not taken after Next is returned again in next pass
+		assert.Equal("foo.bar", o.Next())
+		assert.Equal("", o.Next())
+		assert.Equal("foo.bar", o.Next())
+		p, _ = o.Pop("foo.bar")
+		assert.Equal(1, len(p.Data))
+
+		// segment is kept until taken points are confirmed
+		assert.Equal("", o.Next())
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		assert.NoError(err)
+		assert.Equal(1, len(files))
+
+		o.Confirm(p)
+		assert.Equal("", o.Next())
+
+		files, err = filepath.Glob(filepath.Join(dir, "*"))
+		assert.NoError(err)
+		assert.Equal(0, len(files))
+
+		// segment is closed on stop and drained after restart
+		c.Add(points.OnePoint("foo.bar", 6, 15))
+		o.Write(points.OnePoint("foo.bar", 7, 16))
+
+		files, _ = filepath.Glob(filepath.Join(dir, "*.tmp"))
+		assert.Equal(1, len(files))
+
+		c.Stop()
+
+		restarted := NewOverflow(dir)
+		assert.NoError(restarted.Recover())
+		assert.Equal("foo.bar", restarted.Next())
+		p, _ = restarted.Pop("foo.bar")
+		assert.Equal(2, len(p.Data))
+	})
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+)
+
+// PriorityRule sets weight of metrics matched by pattern for priority write strategy
+type PriorityRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Weight  int64
+}
+
+// PriorityRules is ordered list of rules. First matched rule sets weight, not matched metrics have weight 0
+type PriorityRules []*PriorityRule
+
+// ReadPriorityRules reads priority rules file in storage-schemas.conf like format
+func ReadPriorityRules(filename string) (PriorityRules, error) {
+	config, err := helper.ParseIniFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(PriorityRules, 0, len(config))
+
+	for _, section := range config {
+		rule := &PriorityRule{Name: section["name"]}
+
+		if section["pattern"] == "" {
+			return nil, fmt.Errorf("empty pattern for [%s]", rule.Name)
+		}
+
+		rule.Pattern, err = regexp.Compile(section["pattern"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pattern %#v for [%s]: %s",
+				section["pattern"], rule.Name, err.Error())
+		}
+
+		rule.Weight, err = strconv.ParseInt(section["weight"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse weight %#v for [%s]: %s",
+				section["weight"], rule.Name, err.Error())
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Weight returns weight of first matched rule or 0
+func (rules PriorityRules) Weight(metric string) int64 {
+	for _, rule := range rules {
+		if rule.Pattern.MatchString(metric) {
+			return rule.Weight
+		}
+	}
+	return 0
+}
+
+// priority returns weight of metric increased by 1 for every aging interval passed since oldest unwritten point.
+// Aging moves metrics with old unwritten points ahead of metrics with higher weight, so they are not starved during backlog
+func priority(s *cacheSettings, p *points.Points, now int64) int64 {
+	return s.priorityRules.Weight(p.Metric) + priorityAge(s, p, now)
+}
+
+// priorityAge returns aging part of priority
+func priorityAge(s *cacheSettings, p *points.Points, now int64) int64 {
+	if s.priorityAging > 0 && len(p.Data) > 0 {
+		if age := now - p.Data[0].Timestamp; age > 0 {
+			return int64(time.Duration(age) * time.Second / s.priorityAging)
+		}
+	}
+	return 0
+}
+
+// priorityQueue appends metrics of shard with priority to q. Weights of rules are cached in shard,
+// weights of new metrics are calculated without shard lock, so Add is not blocked by regexps
+func (shard *Shard) priorityQueue(s *cacheSettings, q queue, now int64) queue {
+	var missing []queueItem // metric with aging part of priority
+
+	shard.Lock()
+	if shard.weightsVersion != s.priorityVersion || len(shard.weights) > 2*len(shard.items) {
+		// rules are changed or most of cached weights are of metrics already written
+		shard.weights = make(map[string]int64, len(shard.items))
+		shard.weightsVersion = s.priorityVersion
+	}
+	for _, p := range shard.items {
+		if weight, ok := shard.weights[p.Metric]; ok {
+			q = append(q, queueItem{p.Metric, weight + priorityAge(s, p, now)})
+		} else {
+			missing = append(missing, queueItem{p.Metric, priorityAge(s, p, now)})
+		}
+	}
+	shard.Unlock()
+
+	if len(missing) == 0 {
+		return q
+	}
+
+	weights := make([]int64, len(missing))
+	for i := range missing {
+		weights[i] = s.priorityRules.Weight(missing[i].metric)
+		q = append(q, queueItem{missing[i].metric, weights[i] + missing[i].orderKey})
+	}
+
+	shard.Lock()
+	if shard.weightsVersion == s.priorityVersion {
+		for i := range missing {
+			shard.weights[missing[i].metric] = weights[i]
+		}
+	}
+	shard.Unlock()
+
+	return q
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestPriorityWriteStrategy(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		filename := filepath.Join(root, "cache-priority.conf")
+
+		ioutil.WriteFile(filename, []byte(`
+[business]
+pattern = ^business\.
+weight = 100
+
+[debug]
+pattern = \.debug\.
+weight = -10
+`), 0644)
+
+		rules, err := ReadPriorityRules(filename)
+		assert.NoError(err)
+		assert.Equal(2, len(rules))
+		assert.Equal(int64(100), rules.Weight("business.orders"))
+		assert.Equal(int64(-10), rules.Weight("app.debug.x"))
+		assert.Equal(int64(0), rules.Weight("app.cpu"))
+
+		ioutil.WriteFile(filename, []byte("[bad]\npattern = ^a\nweight = high\n"), 0644)
+		_, err = ReadPriorityRules(filename)
+		assert.Error(err)
+
+		now := time.Now().Unix()
+
+		c := New()
+		assert.NoError(c.SetWriteStrategy("priority"))
+		c.SetPriority(rules, time.Minute)
+
+		c.Add(points.OnePoint("app.debug.x", 1, now))
+		c.Add(points.OnePoint("app.cpu", 1, now))
+		c.Add(points.OnePoint("business.orders", 1, now))
+		// weight 0 + 200 minutes of aging
+		c.Add(points.OnePoint("app.lagging", 1, now-200*60))
+
+		queue := c.makeQueue()
+		order := make([]string, 0)
+		for len(queue) > 0 {
+			order = append(order, <-queue)
+		}
+		assert.Equal([]string{"app.lagging", "business.orders", "app.cpu", "app.debug.x"}, order)
+
+		// weights of rules are cached in shard until rules are changed
+		shard := c.GetShard("app.cpu")
+		shard.Lock()
+		assert.Equal(int64(0), shard.weights["app.cpu"])
+		shard.weights["app.cpu"] = 1000
+		shard.Unlock()
+
+		drain := func() []string {
+			queue := c.makeQueue()
+			order := make([]string, 0)
+			for len(queue) > 0 {
+				order = append(order, <-queue)
+			}
+			return order
+		}
+		assert.Equal("app.cpu", drain()[0])
+
+		c.SetPriority(rules, time.Minute)
+		assert.Equal([]string{"app.lagging", "business.orders", "app.cpu", "app.debug.x"}, drain())
+
+		buf := new(bytes.Buffer)
+		assert.NoError(c.Dump(buf))
+		assert.True(strings.Contains(buf.String(), "# priority 100 business.orders\n"))
+		assert.True(strings.Contains(buf.String(), "# priority -10 app.debug.x\n"))
+
+		// priority lines are skipped on restore
+		restored := 0
+		points.ReadPlain(buf, func(p *points.Points) { restored++ })
+		assert.Equal(4, restored)
+	})
+}
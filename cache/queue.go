@@ -59,6 +59,17 @@ func (c *Cache) makeQueue() chan string {
 	}
 
 	size := c.Len() * 2
+
+	if writeStrategy == Priority {
+		s := c.settings.Load().(*cacheSettings)
+		now := time.Now().Unix()
+		q := make(queue, 0, size)
+		for i := 0; i < shardCount; i++ {
+			q = c.data[i].priorityQueue(s, q, now)
+		}
+		return sortedQueue(q, writeStrategy)
+	}
+
 	q := make(queue, size)
 	index := int32(0)
 
@@ -79,10 +90,13 @@ func (c *Cache) makeQueue() chan string {
 		shard.Unlock()
 	}
 
-	q = q[:index]
+	return sortedQueue(q[:index], writeStrategy)
+}
 
+// sortedQueue returns channel with metrics of q in order of write strategy
+func sortedQueue(q queue, writeStrategy WriteStrategy) chan string {
 	switch writeStrategy {
-	case MaximumLength:
+	case MaximumLength, Priority:
 		sort.Sort(sort.Reverse(byOrderKey(q)))
 	case TimestampOrder:
 		sort.Sort(byOrderKey(q))
@@ -0,0 +1,309 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+)
+
+// knownSeriesTTL is time after which idle series are forgotten by quota without MaxSeries and checked on disk again
+const knownSeriesTTL = time.Hour
+
+// Quota limits ingestion of metrics with one prefix or one tagged name.
+// Series are counted since start of process, only if MaxSeries is set. Series with existing whisper file are not counted as new
+type Quota struct {
+	Name                  string
+	Prefix                string // plain metrics and tagged names with prefix
+	TaggedName            string // tagged metrics with this name
+	MaxSeries             int
+	MaxPointsPerSecond    int
+	MaxNewSeriesPerMinute int
+
+	mu         sync.Mutex
+	series     map[string]struct{} // series seen since start, kept only with MaxSeries
+	recent     map[string]struct{} // series seen in current period of knownSeriesTTL, used instead of series without MaxSeries
+	previous   map[string]struct{} // series seen in previous period, moved to recent on next point
+	period     int64               // current period of knownSeriesTTL
+	second     int64               // current second
+	points     int                 // points in current second
+	lastPoints int                 // points in previous second
+	minute     int64               // current minute
+	newSeries  int                 // new series in current minute
+	lastNew    int                 // new series in previous minute
+	dropped    uint64
+}
+
+// QuotaState is current state of quota
+type QuotaState struct {
+	Name                  string `json:"name"`
+	Prefix                string `json:"prefix,omitempty"`
+	TaggedName            string `json:"tagged-name,omitempty"`
+	Series                int    `json:"series"`
+	MaxSeries             int    `json:"max-series"`
+	PointsPerSecond       int    `json:"points-per-second"`
+	MaxPointsPerSecond    int    `json:"max-points-per-second"`
+	NewSeriesPerMinute    int    `json:"new-series-per-minute"`
+	MaxNewSeriesPerMinute int    `json:"max-new-series-per-minute"`
+	DroppedPoints         uint64 `json:"dropped-points"`
+}
+
+// ReadQuotas reads quotas file in storage-schemas.conf like format
+func ReadQuotas(filename string) ([]*Quota, error) {
+	config, err := helper.ParseIniFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	quotas := make([]*Quota, 0, len(config))
+
+	for _, section := range config {
+		q := &Quota{
+			Name:       section["name"],
+			Prefix:     section["prefix"],
+			TaggedName: section["tagged-name"],
+		}
+
+		if (q.Prefix == "") == (q.TaggedName == "") {
+			return nil, fmt.Errorf("one of prefix or tagged-name should be set for [%s]", q.Name)
+		}
+
+		for key, value := range map[string]*int{
+			"max-series":                &q.MaxSeries,
+			"max-points-per-second":     &q.MaxPointsPerSecond,
+			"max-new-series-per-minute": &q.MaxNewSeriesPerMinute,
+		} {
+			if section[key] == "" {
+				continue
+			}
+			if *value, err = strconv.Atoi(section[key]); err != nil {
+				return nil, fmt.Errorf("failed to parse %s %#v for [%s]: %s", key, section[key], q.Name, err.Error())
+			}
+		}
+
+		quotas = append(quotas, q)
+	}
+
+	return quotas, nil
+}
+
+func (q *Quota) match(metric string) bool {
+	name := metric
+	tagged := false
+	if i := strings.IndexByte(metric, ';'); i >= 0 {
+		name = metric[:i]
+		tagged = true
+	}
+
+	if q.TaggedName != "" {
+		return tagged && name == q.TaggedName
+	}
+	return strings.HasPrefix(name, q.Prefix)
+}
+
+// rotate moves counters to current second and minute. Called with locked mutex
+func (q *Quota) rotate(now time.Time) {
+	if second := now.Unix(); second != q.second {
+		if second == q.second+1 {
+			q.lastPoints = q.points
+		} else {
+			q.lastPoints = 0
+		}
+		q.second = second
+		q.points = 0
+	}
+
+	if minute := now.Unix() / 60; minute != q.minute {
+		if minute == q.minute+1 {
+			q.lastNew = q.newSeries
+		} else {
+			q.lastNew = 0
+		}
+		q.minute = minute
+		q.newSeries = 0
+	}
+
+	if period := now.Unix() / int64(knownSeriesTTL/time.Second); period != q.period {
+		if period == q.period+1 {
+			q.previous = q.recent
+		} else {
+			q.previous = nil
+		}
+		q.period = period
+		q.recent = nil
+	}
+}
+
+// known returns true if series is already counted. Called with locked mutex
+func (q *Quota) known(metric string) bool {
+	var ok bool
+	if q.MaxSeries > 0 {
+		_, ok = q.series[metric]
+		return ok
+	}
+	if _, ok = q.recent[metric]; ok {
+		return true
+	}
+	if _, ok = q.previous[metric]; ok {
+		delete(q.previous, metric)
+		q.remember(metric)
+	}
+	return ok
+}
+
+// remember adds series to known series of current period. Called with locked mutex
+func (q *Quota) remember(metric string) {
+	if q.recent == nil {
+		q.recent = make(map[string]struct{})
+	}
+	q.recent[metric] = struct{}{}
+}
+
+// allow returns false if points should be dropped
+func (q *Quota) allow(p *points.Points, exists func(string) bool, now time.Time) bool {
+	q.mu.Lock()
+	q.rotate(now)
+
+	if q.MaxPointsPerSecond > 0 && q.points+len(p.Data) > q.MaxPointsPerSecond {
+		q.mu.Unlock()
+		return q.drop(p)
+	}
+
+	if q.MaxSeries == 0 && q.MaxNewSeriesPerMinute == 0 {
+		q.points += len(p.Data)
+		q.mu.Unlock()
+		return true
+	}
+
+	if q.known(p.Metric) {
+		q.points += len(p.Data)
+		q.mu.Unlock()
+		return true
+	}
+
+	if q.MaxSeries > 0 && len(q.series) >= q.MaxSeries {
+		q.mu.Unlock()
+		return q.drop(p)
+	}
+	q.mu.Unlock()
+
+	// check disk without lock
+	isNew := true
+	if q.MaxNewSeriesPerMinute > 0 && exists != nil {
+		isNew = !exists(p.Metric)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.known(p.Metric) {
+		if q.MaxSeries > 0 && len(q.series) >= q.MaxSeries {
+			return q.drop(p)
+		}
+		if isNew && q.MaxNewSeriesPerMinute > 0 && q.newSeries >= q.MaxNewSeriesPerMinute {
+			return q.drop(p)
+		}
+		if isNew {
+			q.newSeries++
+		}
+		if q.MaxSeries > 0 {
+			q.series[p.Metric] = struct{}{}
+		} else {
+			// existing and admitted series are not checked on disk again until idle for knownSeriesTTL
+			q.remember(p.Metric)
+		}
+	}
+
+	q.points += len(p.Data)
+	return true
+}
+
+func (q *Quota) drop(p *points.Points) bool {
+	atomic.AddUint64(&q.dropped, uint64(len(p.Data)))
+	return false
+}
+
+func (q *Quota) state() QuotaState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rotate(time.Now())
+
+	return QuotaState{
+		Name:                  q.Name,
+		Prefix:                q.Prefix,
+		TaggedName:            q.TaggedName,
+		Series:                len(q.series),
+		MaxSeries:             q.MaxSeries,
+		PointsPerSecond:       q.lastPoints,
+		MaxPointsPerSecond:    q.MaxPointsPerSecond,
+		NewSeriesPerMinute:    q.lastNew,
+		MaxNewSeriesPerMinute: q.MaxNewSeriesPerMinute,
+		DroppedPoints:         atomic.LoadUint64(&q.dropped),
+	}
+}
+
+// SetQuotas replaces quotas. Known series and counters are inherited from previous quota with same name
+func (c *Cache) SetQuotas(quotas []*Quota, exists func(metric string) bool) {
+	s := c.settings.Load().(*cacheSettings)
+
+	old := make(map[string]*Quota)
+	for _, q := range s.quotas {
+		old[q.Name] = q
+	}
+
+	for _, q := range quotas {
+		q.mu.Lock()
+		if prev, ok := old[q.Name]; ok && prev != q && prev.Prefix == q.Prefix && prev.TaggedName == q.TaggedName {
+			prev.mu.Lock()
+			if q.MaxSeries > 0 {
+				q.series = prev.series
+			} else {
+				q.recent, q.previous, q.period = prev.recent, prev.previous, prev.period
+			}
+			prev.series = make(map[string]struct{})
+			prev.recent, prev.previous = nil, nil
+			prev.mu.Unlock()
+			atomic.StoreUint64(&q.dropped, atomic.LoadUint64(&prev.dropped))
+		}
+		if q.series == nil {
+			q.series = make(map[string]struct{})
+		}
+		q.mu.Unlock()
+	}
+
+	newSettings := *s
+	newSettings.quotas = quotas
+	newSettings.seriesExists = exists
+	c.settings.Store(&newSettings)
+}
+
+// checkQuotas returns false if points are over quota. First matched quota is applied
+func (c *Cache) checkQuotas(s *cacheSettings, p *points.Points) bool {
+	for _, q := range s.quotas {
+		if q.match(p.Metric) {
+			if q.allow(p, s.seriesExists, time.Now()) {
+				return true
+			}
+			atomic.AddUint32(&c.stat.quotaDropped, uint32(len(p.Data)))
+			return false
+		}
+	}
+	return true
+}
+
+// QuotaState returns state of all quotas
+func (c *Cache) QuotaState() []QuotaState {
+	s := c.settings.Load().(*cacheSettings)
+
+	res := make([]QuotaState, 0, len(s.quotas))
+	for _, q := range s.quotas {
+		res = append(res, q.state())
+	}
+	return res
+}
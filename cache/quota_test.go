@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestReadQuotas(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		filename := filepath.Join(root, "quotas.conf")
+
+		ioutil.WriteFile(filename, []byte(`
+[servers]
+prefix = servers.
+max-series = 10
+max-points-per-second = 100
+
+[cpu]
+tagged-name = cpu
+max-new-series-per-minute = 5
+`), 0644)
+
+		quotas, err := ReadQuotas(filename)
+		assert.NoError(err)
+		assert.Equal(2, len(quotas))
+		assert.Equal("servers.", quotas[0].Prefix)
+		assert.Equal(10, quotas[0].MaxSeries)
+		assert.Equal(100, quotas[0].MaxPointsPerSecond)
+		assert.Equal("cpu", quotas[1].TaggedName)
+		assert.Equal(5, quotas[1].MaxNewSeriesPerMinute)
+
+		ioutil.WriteFile(filename, []byte("[bad]\nmax-series = 10\n"), 0644)
+		_, err = ReadQuotas(filename)
+		assert.Error(err)
+
+		ioutil.WriteFile(filename, []byte("[bad]\nprefix = a.\nmax-series = ten\n"), 0644)
+		_, err = ReadQuotas(filename)
+		assert.Error(err)
+	})
+}
+
+func TestQuotaMaxSeries(t *testing.T) {
+	assert := assert.New(t)
+
+	c := New()
+	c.SetQuotas([]*Quota{
+		{Name: "servers", Prefix: "servers.", MaxSeries: 2},
+		{Name: "cpu", TaggedName: "cpu", MaxSeries: 1},
+	}, nil)
+
+	for i := 0; i < 4; i++ {
+		c.Add(points.OnePoint(fmt.Sprintf("servers.host%d.cpu", i), 1, 10))
+	}
+	c.Add(points.OnePoint("servers.host0.cpu", 2, 11))
+	c.Add(points.OnePoint("other.metric", 1, 10))
+	c.Add(points.OnePoint("cpu;host=a", 1, 10))
+	c.Add(points.OnePoint("cpu;host=b", 1, 10))
+
+	assert.Equal(int32(5), c.Size())
+	assert.Nil(c.Get("servers.host2.cpu"))
+	assert.Nil(c.Get("cpu;host=b"))
+
+	state := c.QuotaState()
+	assert.Equal(2, len(state))
+	assert.Equal(2, state[0].Series)
+	assert.Equal(uint64(2), state[0].DroppedPoints)
+	assert.Equal(uint64(1), state[1].DroppedPoints)
+
+	stat := make(map[string]float64)
+	c.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	assert.Equal(float64(3), stat["quotaDropped"])
+
+	// series are inherited on reload
+	c.SetQuotas([]*Quota{
+		{Name: "servers", Prefix: "servers.", MaxSeries: 3},
+	}, nil)
+	state = c.QuotaState()
+	assert.Equal(2, state[0].Series)
+	assert.Equal(uint64(2), state[0].DroppedPoints)
+
+	c.Add(points.OnePoint("servers.host2.cpu", 1, 10))
+	c.Add(points.OnePoint("servers.host3.cpu", 1, 10))
+	assert.Equal(3, c.QuotaState()[0].Series)
+}
+
+func TestQuotaNewSeries(t *testing.T) {
+	assert := assert.New(t)
+
+	c := New()
+	c.SetQuotas([]*Quota{
+		{Name: "servers", Prefix: "servers.", MaxNewSeriesPerMinute: 1},
+	}, func(metric string) bool {
+		return metric == "servers.old"
+	})
+
+	c.Add(points.OnePoint("servers.old", 1, 10))
+	c.Add(points.OnePoint("servers.new1", 1, 10))
+	c.Add(points.OnePoint("servers.new1", 2, 11))
+	c.Add(points.OnePoint("servers.new2", 1, 10))
+
+	assert.NotNil(c.Get("servers.old"))
+	assert.Equal(2, len(c.Get("servers.new1")))
+	assert.Nil(c.Get("servers.new2"))
+	// series are not kept without max-series
+	assert.Equal(0, c.QuotaState()[0].Series)
+}
+
+func TestQuotaNewSeriesKnown(t *testing.T) {
+	assert := assert.New(t)
+
+	checked := make(map[string]int)
+	exists := func(metric string) bool {
+		checked[metric]++
+		return metric == "servers.old"
+	}
+
+	q := &Quota{Name: "servers", Prefix: "servers.", MaxNewSeriesPerMinute: 1}
+	now := time.Unix(3600, 0)
+
+	for i := 0; i < 3; i++ {
+		assert.True(q.allow(points.OnePoint("servers.old", 1, 10), exists, now))
+		assert.True(q.allow(points.OnePoint("servers.new", 1, 10), exists, now))
+	}
+	assert.Equal(map[string]int{"servers.old": 1, "servers.new": 1}, checked)
+
+	// admitted series is not counted as new in next minute
+	now = now.Add(time.Minute)
+	assert.True(q.allow(points.OnePoint("servers.other", 1, 10), exists, now))
+	assert.True(q.allow(points.OnePoint("servers.new", 1, 10), exists, now))
+	assert.False(q.allow(points.OnePoint("servers.third", 1, 10), exists, now))
+
+	// series active in previous period are still known
+	now = now.Add(knownSeriesTTL)
+	assert.True(q.allow(points.OnePoint("servers.old", 1, 10), exists, now))
+	assert.Equal(1, checked["servers.old"])
+
+	// series idle for whole period are checked on disk again
+	now = now.Add(knownSeriesTTL)
+	assert.True(q.allow(points.OnePoint("servers.old", 1, 10), exists, now))
+	assert.True(q.allow(points.OnePoint("servers.new", 1, 10), exists, now))
+	assert.Equal(1, checked["servers.old"])
+	assert.Equal(2, checked["servers.new"])
+}
+
+func TestQuotaPointsPerSecond(t *testing.T) {
+	assert := assert.New(t)
+
+	q := &Quota{Name: "servers", Prefix: "servers.", MaxPointsPerSecond: 3}
+	now := time.Unix(1000, 0)
+
+	assert.True(q.allow(points.OnePoint("servers.a", 1, 10).Add(2, 11), nil, now))
+	assert.False(q.allow(points.OnePoint("servers.b", 1, 10).Add(2, 11), nil, now))
+	assert.True(q.allow(points.OnePoint("servers.b", 1, 10), nil, now))
+	assert.False(q.allow(points.OnePoint("servers.a", 3, 12), nil, now))
+
+	now = now.Add(time.Second)
+	assert.True(q.allow(points.OnePoint("servers.a", 3, 12), nil, now))
+
+	q.rotate(now.Add(time.Second))
+	assert.Equal(1, q.lastPoints)
+	assert.Equal(uint64(3), q.dropped)
+	assert.Equal(0, len(q.series))
+}
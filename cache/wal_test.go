@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/wal"
+)
+
+func TestWALWatermark(t *testing.T) {
+	qa.Root(t, func(root string) {
+		c := New()
+
+		w := wal.New(root, c.WALWatermark)
+		w.SetSegmentSize(1) // every write in new segment
+		if err := w.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+
+		c.SetWAL(w)
+
+		if c.WALWatermark() != 0 {
+			t.FailNow()
+		}
+
+		c.Add(points.OnePoint("hello.world", 42, 10))
+		first := c.WALWatermark()
+		if first == 0 {
+			t.FailNow()
+		}
+
+		c.Add(points.OnePoint("hello.world", 43, 11))
+		if c.WALWatermark() != first {
+			t.FailNow()
+		}
+
+		p1, _ := c.PopNotConfirmed("hello.world")
+		if c.WALWatermark() != first {
+			t.FailNow()
+		}
+
+		c.Add(points.OnePoint("hello.world", 44, 12))
+		if c.WALWatermark() != first {
+			t.FailNow()
+		}
+
+		c.Confirm(p1)
+		if c.WALWatermark() <= first {
+			t.FailNow()
+		}
+
+		c.Pop("hello.world")
+		if c.WALWatermark() != 0 {
+			t.FailNow()
+		}
+	})
+}
@@ -5,7 +5,10 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 
@@ -15,22 +18,34 @@ import (
 	"github.com/lomik/go-carbon/api"
 	"github.com/lomik/go-carbon/cache"
 	"github.com/lomik/go-carbon/carbonserver"
+	"github.com/lomik/go-carbon/forwarder"
+	"github.com/lomik/go-carbon/helper/hashing"
+	"github.com/lomik/go-carbon/helper/tlsconfig"
 	"github.com/lomik/go-carbon/persister"
+	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/go-carbon/receiver"
+	"github.com/lomik/go-carbon/rewrite"
 	"github.com/lomik/go-carbon/tags"
+	"github.com/lomik/go-carbon/tenant"
+	"github.com/lomik/go-carbon/wal"
 	"github.com/lomik/zapwriter"
 
 	// register receivers
 	_ "github.com/lomik/go-carbon/receiver/http"
+	_ "github.com/lomik/go-carbon/receiver/influx"
 	_ "github.com/lomik/go-carbon/receiver/kafka"
+	_ "github.com/lomik/go-carbon/receiver/opentsdb"
+	_ "github.com/lomik/go-carbon/receiver/prometheus"
 	_ "github.com/lomik/go-carbon/receiver/pubsub"
+	_ "github.com/lomik/go-carbon/receiver/statsd"
 	_ "github.com/lomik/go-carbon/receiver/tcp"
 	_ "github.com/lomik/go-carbon/receiver/udp"
 )
 
 type NamedReceiver struct {
 	receiver.Receiver
-	Name string
+	Name    string
+	options map[string]interface{} // options receiver was started with, used on config reload
 }
 
 type App struct {
@@ -39,6 +54,11 @@ type App struct {
 	Config         *Config
 	Api            *api.Api
 	Cache          *cache.Cache
+	WAL            *wal.WAL
+	Rewriter       *rewrite.Rewriter
+	Forwarder      *forwarder.Forwarder
+	Router         *tenant.Router
+	Tenants        map[string]*Tenant
 	Receivers      []*NamedReceiver
 	CarbonLink     *cache.CarbonlinkListener
 	Persister      *persister.Whisper
@@ -93,11 +113,81 @@ func (app *App) configure() error {
 		} else {
 			cfg.Whisper.Aggregation = persister.NewWhisperAggregation()
 		}
+
+		if cfg.Whisper.BackfillEnabled && cfg.Whisper.BackfillWorkers < 1 {
+			return fmt.Errorf("whisper: backfill-workers should be positive")
+		}
+	}
+	if cfg.Rewrite.Enabled {
+		cfg.Rewrite.Rules, err = rewrite.ReadRules(cfg.Rewrite.RulesFilename)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Quota.Enabled {
+		cfg.Quota.Quotas, err = cache.ReadQuotas(cfg.Quota.QuotasFilename)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = configureTenants(cfg); err != nil {
+		return err
+	}
+
+	if cfg.Carbonserver.AuthFilename != "" {
+		cfg.Carbonserver.Principals, err = carbonserver.ReadPrincipals(cfg.Carbonserver.AuthFilename)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Carbonserver.HtpasswdFilename != "" {
+		cfg.Carbonserver.Htpasswd, err = carbonserver.ReadHtpasswd(cfg.Carbonserver.HtpasswdFilename)
+		if err != nil {
+			return err
+		}
 	}
+
+	if cfg.Carbonserver.PeerScheme != "http" && cfg.Carbonserver.PeerScheme != "https" {
+		return fmt.Errorf("carbonserver: unknown peer-scheme %#v", cfg.Carbonserver.PeerScheme)
+	}
+
+	if cfg.Carbonserver.Cluster.Enabled {
+		cfg.Carbonserver.Cluster.Cluster, err = configureCluster(&cfg.Carbonserver.Cluster)
+		if err != nil {
+			return fmt.Errorf("carbonserver.cluster: %s", err.Error())
+		}
+	}
+
+	if cfg.Carbonserver.AntiEntropy.Enabled && cfg.Carbonserver.AntiEntropy.Peer == "" {
+		return fmt.Errorf("carbonserver.anti-entropy: peer is not set")
+	}
+
 	if !(cfg.Cache.WriteStrategy == "max" ||
 		cfg.Cache.WriteStrategy == "sorted" ||
-		cfg.Cache.WriteStrategy == "noop") {
-		return fmt.Errorf("go-carbon support only \"max\", \"sorted\"  or \"noop\" write-strategy")
+		cfg.Cache.WriteStrategy == "noop" ||
+		cfg.Cache.WriteStrategy == "priority") {
+		return fmt.Errorf("go-carbon support only \"max\", \"sorted\", \"noop\" or \"priority\" write-strategy")
+	}
+
+	if cfg.Cache.PriorityFilename != "" {
+		cfg.Cache.PriorityRules, err = cache.ReadPriorityRules(cfg.Cache.PriorityFilename)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !(cfg.Wal.Fsync == wal.FsyncAlways ||
+		cfg.Wal.Fsync == wal.FsyncInterval ||
+		cfg.Wal.Fsync == wal.FsyncNone) {
+		return fmt.Errorf("go-carbon support only \"always\", \"interval\" or \"none\" wal fsync")
+	}
+
+	if cfg.Forwarder.Enabled && !(cfg.Forwarder.Hashing == forwarder.HashingAll ||
+		cfg.Forwarder.Hashing == forwarder.HashingCarbonCH) {
+		return fmt.Errorf("go-carbon support only \"all\" or \"carbon_ch\" forwarder hashing")
 	}
 
 	if cfg.Common.MetricEndpoint == "" {
@@ -121,6 +211,92 @@ func (app *App) configure() error {
 	return nil
 }
 
+// configureCluster builds hash ring of nodes of carbonserver cluster section
+func configureCluster(cfg *carbonserverClusterConfig) (*hashing.Cluster, error) {
+	self, err := hashing.ParseNodeAddress(cfg.Self)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]hashing.NodeAddress, 0, len(cfg.Nodes))
+	for _, s := range cfg.Nodes {
+		n, err := hashing.ParseNodeAddress(s)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+
+	return hashing.NewCluster(cfg.Hashing, cfg.ReplicationFactor, self, nodes)
+}
+
+// configureTenants checks tenants config and loads schemas, aggregation and quotas of tenants.
+// Schemas and aggregation of whisper section are used if tenant files are not set
+func configureTenants(cfg *Config) error {
+	var err error
+
+	dataDirs := map[string]string{filepath.Clean(cfg.Whisper.DataDir): "whisper"}
+	prefixes := make(map[string]string)
+
+	names := make([]string, 0, len(cfg.Tenant))
+	for name := range cfg.Tenant {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := cfg.Tenant[name]
+
+		if err = tenant.ValidateName(name); err != nil {
+			return err
+		}
+
+		if t.DataDir == "" {
+			return fmt.Errorf("data-dir of tenant %#v is empty", name)
+		}
+
+		// tenant files should not be found by carbonserver of other tenant
+		dataDir := filepath.Clean(t.DataDir)
+		for other, owner := range dataDirs {
+			if strings.HasPrefix(dataDir+"/", other+"/") || strings.HasPrefix(other+"/", dataDir+"/") {
+				return fmt.Errorf("data-dir of tenant %#v overlaps with data-dir of %s", name, owner)
+			}
+		}
+		dataDirs[dataDir] = fmt.Sprintf("tenant %#v", name)
+
+		if t.Prefix != "" {
+			if owner, exists := prefixes[t.Prefix]; exists {
+				return fmt.Errorf("prefix %#v of tenant %#v already used by tenant %#v", t.Prefix, name, owner)
+			}
+			prefixes[t.Prefix] = name
+		}
+
+		if cfg.Whisper.Enabled {
+			t.Schemas = cfg.Whisper.Schemas
+			if t.SchemasFilename != "" {
+				if t.Schemas, err = persister.ReadWhisperSchemas(t.SchemasFilename); err != nil {
+					return err
+				}
+			}
+
+			t.Aggregation = cfg.Whisper.Aggregation
+			if t.AggregationFilename != "" {
+				if t.Aggregation, err = persister.ReadWhisperAggregation(t.AggregationFilename); err != nil {
+					return err
+				}
+			}
+		}
+
+		if t.QuotasFilename != "" {
+			if t.Quotas, err = cache.ReadQuotas(t.QuotasFilename); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // ParseConfig loads config from config file, schemas.conf, aggregation.conf
 func (app *App) ParseConfig() error {
 	app.Lock()
@@ -138,11 +314,16 @@ func (app *App) ParseConfig() error {
 	return err
 }
 
-// ReloadConfig reloads some settings from config
+// ReloadConfig reloads some settings from config. Receivers, carbonserver and carbonlink
+// are restarted only if their settings were changed
 func (app *App) ReloadConfig() error {
 	app.Lock()
 	defer app.Unlock()
 
+	logger := zapwriter.Logger("app")
+
+	oldConfig := app.Config
+
 	var err error
 	if err = app.configure(); err != nil {
 		return err
@@ -150,9 +331,8 @@ func (app *App) ReloadConfig() error {
 
 	runtime.GOMAXPROCS(app.Config.Common.MaxCPU)
 
-	app.Cache.SetMaxSize(app.Config.Cache.MaxSize)
-	app.Cache.SetWriteStrategy(app.Config.Cache.WriteStrategy)
-	app.Cache.SetTagsEnabled(app.Config.Tags.Enabled)
+	app.configureCache(app.Cache, app.Config.Quota.Quotas, app.Config.Whisper.DataDir)
+	app.Rewriter.SetRules(app.Config.Rewrite.Rules)
 
 	if app.Persister != nil {
 		app.Persister.Stop()
@@ -166,6 +346,65 @@ func (app *App) ReloadConfig() error {
 
 	app.startPersister()
 
+	restarted := make([]string, 0)
+	defer func() {
+		logger.Info("listeners reloaded", zap.Strings("restarted", restarted))
+	}()
+
+	tenants, err := app.startTenants(oldConfig)
+	restarted = append(restarted, tenants...)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(oldConfig.Forwarder, app.Config.Forwarder) {
+		if err = app.startForwarder(); err != nil {
+			return err
+		}
+		restarted = append(restarted, "forwarder")
+	}
+
+	receivers, err := app.startReceivers()
+	for _, name := range receivers {
+		restarted = append(restarted, "receiver."+name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if app.Carbonserver == nil || carbonserverChanged(oldConfig, app.Config) {
+		running := app.Carbonserver != nil
+		if running {
+			// synchronous stop releases listen address
+			app.Carbonserver.Stop()
+			app.Carbonserver = nil
+		}
+		err = app.startCarbonserver()
+		if running || app.Carbonserver != nil {
+			restarted = append(restarted, "carbonserver")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if app.CarbonLink == nil || !reflect.DeepEqual(oldConfig.Carbonlink, app.Config.Carbonlink) {
+		running := app.CarbonLink != nil
+		if running {
+			app.CarbonLink.Stop()
+			app.CarbonLink = nil
+		}
+		err = app.startCarbonlink()
+		if running || app.CarbonLink != nil {
+			restarted = append(restarted, "carbonlink")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	app.reloadTLS()
+
 	if app.Collector != nil {
 		app.Collector.Stop()
 		app.Collector = nil
@@ -176,6 +415,51 @@ func (app *App) ReloadConfig() error {
 	return nil
 }
 
+// tlsReloader is implemented by listeners with TLS support
+type tlsReloader interface {
+	ReloadTLS() error
+}
+
+// reloadTLS reads certificates of running listeners again. Listeners restarted with new config
+// already use new certificates, so only failures are logged
+func (app *App) reloadTLS() {
+	logger := zapwriter.Logger("app")
+
+	reload := func(name string, r tlsReloader) {
+		if err := r.ReloadTLS(); err != nil {
+			logger.Error("tls certificates reload failed", zap.String("name", name), zap.Error(err))
+		}
+	}
+
+	for _, r := range app.Receivers {
+		if rl, ok := r.Receiver.(tlsReloader); ok {
+			reload("receiver."+r.Name, rl)
+		}
+	}
+
+	if app.Carbonserver != nil {
+		reload("carbonserver", app.Carbonserver)
+	}
+
+	if app.CarbonLink != nil {
+		reload("carbonlink", app.CarbonLink)
+	}
+
+	if app.Api != nil {
+		reload("grpc", app.Api)
+	}
+}
+
+// carbonserverChanged returns true if carbonserver should be restarted to apply new config
+func carbonserverChanged(oldConfig, newConfig *Config) bool {
+	return !reflect.DeepEqual(oldConfig.Carbonserver, newConfig.Carbonserver) ||
+		oldConfig.Whisper.DataDir != newConfig.Whisper.DataDir ||
+		oldConfig.Whisper.FLock != newConfig.Whisper.FLock ||
+		oldConfig.Whisper.Compressed != newConfig.Whisper.Compressed ||
+		oldConfig.Whisper.HashFilenames != newConfig.Whisper.HashFilenames ||
+		oldConfig.Prometheus.Enabled != newConfig.Prometheus.Enabled
+}
+
 // Stop all socket listeners
 func (app *App) stopListeners() {
 	logger := zapwriter.Logger("app")
@@ -201,6 +485,18 @@ func (app *App) stopListeners() {
 		app.Carbonserver = nil
 	}
 
+	for _, t := range app.Tenants {
+		if t.Carbonserver != nil {
+			carbonserver := t.Carbonserver
+			name := t.Name
+			go func() {
+				carbonserver.Stop()
+				logger.Debug("carbonserver stopped", zap.String("tenant", name))
+			}()
+			t.Carbonserver = nil
+		}
+	}
+
 	if app.Receivers != nil {
 		for i := 0; i < len(app.Receivers); i++ {
 			app.Receivers[i].Stop()
@@ -215,18 +511,36 @@ func (app *App) stopAll() {
 
 	logger := zapwriter.Logger("app")
 
+	if app.Forwarder != nil {
+		app.Forwarder.Stop()
+		app.Forwarder = nil
+		logger.Debug("forwarder stopped")
+	}
+
 	if app.Persister != nil {
 		app.Persister.Stop()
 		app.Persister = nil
 		logger.Debug("persister stopped")
 	}
 
+	for name, t := range app.Tenants {
+		t.stop()
+		delete(app.Tenants, name)
+		logger.Debug("tenant stopped", zap.String("tenant", name))
+	}
+
 	if app.Tags != nil {
 		app.Tags.Stop()
 		app.Tags = nil
 		logger.Debug("tags stopped")
 	}
 
+	if app.WAL != nil {
+		app.WAL.Stop()
+		app.WAL = nil
+		logger.Debug("wal stopped")
+	}
+
 	if app.Cache != nil {
 		app.Cache.Stop()
 		app.Cache = nil
@@ -265,208 +579,552 @@ func (app *App) startPersister() {
 	}
 
 	if app.Config.Whisper.Enabled {
-		p := persister.NewWhisper(
-			app.Config.Whisper.DataDir,
-			app.Config.Whisper.Schemas,
-			app.Config.Whisper.Aggregation,
-			app.Cache.WriteoutQueue().Get,
-			app.Cache.PopNotConfirmed,
-			app.Cache.Confirm,
-		)
-		p.SetMaxUpdatesPerSecond(app.Config.Whisper.MaxUpdatesPerSecond)
-		p.SetMaxCreatesPerSecond(app.Config.Whisper.MaxCreatesPerSecond)
-		p.SetHardMaxCreatesPerSecond(app.Config.Whisper.HardMaxCreatesPerSecond)
-		p.SetSparse(app.Config.Whisper.Sparse)
-		p.SetFLock(app.Config.Whisper.FLock)
-		p.SetCompressed(app.Config.Whisper.Compressed)
-		p.SetWorkers(app.Config.Whisper.Workers)
-		p.SetHashFilenames(app.Config.Whisper.HashFilenames)
+		p := app.newPersister(app.Cache, app.Config.Whisper.DataDir, app.Config.Whisper.Schemas, app.Config.Whisper.Aggregation)
 
 		if app.Tags != nil {
 			p.SetTagsEnabled(true)
 			p.SetTaggedFn(app.Tags.Add)
 		}
 
+		if app.Config.Whisper.BackfillEnabled {
+			p.SetBackfill(app.Config.Whisper.BackfillWorkers, app.Config.Whisper.BackfillMaxUpdates)
+		}
+
 		p.Start()
 
 		app.Persister = p
 	}
 }
 
-// Start starts
-func (app *App) Start() (err error) {
-	app.Lock()
-	defer app.Unlock()
+// backfill writes points directly to whisper files with current persister of whisper data-dir
+func (app *App) backfill(p *points.Points) *persister.BackfillResult {
+	app.RLock()
+	w := app.Persister
+	app.RUnlock()
 
-	defer func() {
-		if err != nil {
-			app.stopAll()
-		}
-	}()
+	if w == nil {
+		return &persister.BackfillResult{Metric: p.Metric, Error: "whisper is disabled"}
+	}
+	return w.Backfill(p)
+}
 
-	conf := app.Config
+// lockMetric holds store lock of metric in persister. Persister is not locked if whisper is disabled
+func (app *App) lockMetric(metric string) func() {
+	app.RLock()
+	p := app.Persister
+	app.RUnlock()
 
-	runtime.GOMAXPROCS(conf.Common.MaxCPU)
+	if p == nil {
+		return func() {}
+	}
+	return p.LockMetric(metric)
+}
 
-	core := cache.New()
-	core.SetMaxSize(conf.Cache.MaxSize)
-	core.SetWriteStrategy(conf.Cache.WriteStrategy)
-	core.SetTagsEnabled(conf.Tags.Enabled)
+// newPersister creates persister of cache with settings of whisper section
+func (app *App) newPersister(c *cache.Cache, dataDir string, schemas persister.WhisperSchemas, aggregation *persister.WhisperAggregation) *persister.Whisper {
+	p := persister.NewWhisper(
+		dataDir,
+		schemas,
+		aggregation,
+		c.WriteoutQueue().Get,
+		c.PopNotConfirmed,
+		c.Confirm,
+	)
+	p.SetMaxUpdatesPerSecond(app.Config.Whisper.MaxUpdatesPerSecond)
+	p.SetMaxCreatesPerSecond(app.Config.Whisper.MaxCreatesPerSecond)
+	p.SetHardMaxCreatesPerSecond(app.Config.Whisper.HardMaxCreatesPerSecond)
+	p.SetSparse(app.Config.Whisper.Sparse)
+	p.SetFLock(app.Config.Whisper.FLock)
+	p.SetCompressed(app.Config.Whisper.Compressed)
+	p.SetWorkers(app.Config.Whisper.Workers)
+	p.SetHashFilenames(app.Config.Whisper.HashFilenames)
+	if app.Config.Whisper.AdaptiveThrottling {
+		p.SetAdaptiveThrottling(app.Config.Whisper.AdaptiveTargetLatency.Value(), app.Config.Whisper.AdaptiveMaxIOWait, app.Config.Whisper.AdaptiveMinUpdates)
+	}
+	if app.Config.Whisper.ResizeEnabled {
+		p.SetResize(app.Config.Whisper.ResizeInterval.Value(), app.Config.Whisper.ResizeMaxFilesPerSecond)
+	}
+	if app.Config.Whisper.AggrEnabled {
+		p.SetAggregationReconcile(app.Config.Whisper.AggrInterval.Value(), app.Config.Whisper.AggrMaxFilesPerSecond)
+	}
 
-	app.Cache = core
+	if o := c.Overflow(); o != nil {
+		p.SetOverflow(o.Next, o.Pop, o.Confirm)
+	}
 
-	/* API start */
-	if conf.Grpc.Enabled {
-		var grpcAddr *net.TCPAddr
-		grpcAddr, err = net.ResolveTCPAddr("tcp", conf.Grpc.Listen)
+	return p
+}
+
+// configureCache applies cache section and quotas to cache
+func (app *App) configureCache(c *cache.Cache, quotas []*cache.Quota, dataDir string) {
+	c.SetMaxSize(app.Config.Cache.MaxSize)
+	c.SetMaxMemory(app.Config.Cache.MaxMemory)
+	c.SetWriteStrategy(app.Config.Cache.WriteStrategy)
+	c.SetPriority(app.Config.Cache.PriorityRules, app.Config.Cache.PriorityAging.Value())
+	c.SetTagsEnabled(app.Config.Tags.Enabled)
+	c.SetQuotas(quotas, seriesExists(app.Config, dataDir))
+}
+
+// seriesExists returns function to check that whisper file of metric exists in dataDir. Used by quotas to detect new series
+func seriesExists(conf *Config, dataDir string) func(metric string) bool {
+	if !conf.Whisper.Enabled {
+		return nil
+	}
+
+	rootPath := dataDir
+	tagsEnabled := conf.Tags.Enabled
+	hashFilenames := conf.Whisper.HashFilenames
+
+	return func(metric string) bool {
+		_, err := os.Stat(persister.MetricPath(rootPath, metric, tagsEnabled, hashFilenames))
+		return err == nil
+	}
+}
+
+// receiverOptions returns options of all enabled receivers by name
+func receiverOptions(conf *Config) (map[string]map[string]interface{}, error) {
+	res := make(map[string]map[string]interface{})
+
+	builtin := []struct {
+		name    string
+		enabled bool
+		options interface{}
+		tenant  string
+	}{
+		{"udp", conf.Udp.Enabled, conf.Udp, conf.builtinTenants.Udp.Tenant},
+		{"tcp", conf.Tcp.Enabled, conf.Tcp, conf.builtinTenants.Tcp.Tenant},
+		{"pickle", conf.Pickle.Enabled, conf.Pickle, conf.builtinTenants.Pickle.Tenant},
+	}
+
+	for _, b := range builtin {
+		if !b.enabled {
+			continue
+		}
+		options, err := receiver.WithProtocol(b.options, b.name)
 		if err != nil {
-			return
+			return nil, err
 		}
+		if b.tenant != "" {
+			options["tenant"] = b.tenant
+		}
+		res[b.name] = options
+	}
 
-		grpcApi := api.New(core)
-
-		if err = grpcApi.Listen(grpcAddr); err != nil {
-			return
+	for name, options := range conf.Receiver {
+		if _, exists := res[name]; exists {
+			return nil, fmt.Errorf("receiver %#v already defined", name)
 		}
+		res[name] = copyOptions(options)
+	}
 
-		app.Api = grpcApi
+	return res, nil
+}
+
+func copyOptions(options map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(options))
+	for k, v := range options {
+		res[k] = v
 	}
-	/* API end */
+	return res
+}
 
-	/* WHISPER and TAGS start */
-	app.startPersister()
-	/* WHISPER and TAGS end */
+// startReceivers starts receivers from config. Running receivers with unchanged options are kept,
+// removed and changed receivers are stopped. Returns names of stopped and started receivers
+func (app *App) startReceivers() ([]string, error) {
+	logger := zapwriter.Logger("app")
 
-	app.Receivers = make([]*NamedReceiver, 0)
-	var rcv receiver.Receiver
-	var rcvOptions map[string]interface{}
+	options, err := receiverOptions(app.Config)
+	if err != nil {
+		return nil, err
+	}
 
-	/* UDP start */
-	if conf.Udp.Enabled {
-		if rcvOptions, err = receiver.WithProtocol(conf.Udp, "udp"); err != nil {
-			return
-		}
+	restarted := make([]string, 0)
+	stopped := make(map[string]bool)
+	running := make(map[string]bool)
+	receivers := make([]*NamedReceiver, 0, len(options))
 
-		if rcv, err = receiver.New("udp", rcvOptions, core.Add); err != nil {
-			return
+	for _, r := range app.Receivers {
+		if opts, exists := options[r.Name]; exists && reflect.DeepEqual(opts, r.options) {
+			running[r.Name] = true
+			receivers = append(receivers, r)
+			continue
 		}
-
-		app.Receivers = append(app.Receivers, &NamedReceiver{
-			Receiver: rcv,
-			Name:     "udp",
-		})
+		r.Stop()
+		stopped[r.Name] = true
+		restarted = append(restarted, r.Name)
+		logger.Debug("receiver stopped", zap.String("name", r.Name))
 	}
-	/* UDP end */
 
-	/* TCP start */
-	if conf.Tcp.Enabled {
-		if rcvOptions, err = receiver.WithProtocol(conf.Tcp, "tcp"); err != nil {
-			return
+	// stopped receivers are removed from app before start of new ones
+	app.Receivers = receivers
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		if !running[name] {
+			names = append(names, name)
 		}
+	}
+	sort.Strings(names)
 
-		if rcv, err = receiver.New("tcp", rcvOptions, core.Add); err != nil {
-			return
+	for _, name := range names {
+		// receiver.New modifies options
+		rcv, err := receiver.New(name, copyOptions(options[name]), app.Rewriter.Store(app.Forwarder.Store(app.Router.Store(app.Cache.Add))))
+		if err != nil {
+			return restarted, err
 		}
 
 		app.Receivers = append(app.Receivers, &NamedReceiver{
 			Receiver: rcv,
-			Name:     "tcp",
+			Name:     name,
+			options:  options[name],
 		})
-	}
-	/* TCP end */
 
-	/* PICKLE start */
-	if conf.Pickle.Enabled {
-		if rcvOptions, err = receiver.WithProtocol(conf.Pickle, "pickle"); err != nil {
-			return
+		if !stopped[name] {
+			restarted = append(restarted, name)
 		}
+	}
 
-		if rcv, err = receiver.New("pickle", rcvOptions, core.Add); err != nil {
-			return
+	return restarted, nil
+}
+
+// startForwarder replaces forwarder destinations with destinations from config
+func (app *App) startForwarder() error {
+	conf := app.Config.Forwarder
+
+	hashing := forwarder.HashingAll
+	destinations := make([]*forwarder.Destination, 0)
+
+	if conf.Enabled {
+		hashing = conf.Hashing
+
+		for _, dc := range conf.Destinations {
+			protocol := dc.Protocol
+			if protocol == "" {
+				protocol = forwarder.ProtocolPlain
+			}
+
+			d, err := forwarder.NewDestination(dc.Address, protocol, conf.SpoolDir)
+			if err != nil {
+				return err
+			}
+			d.SetInstance(dc.Instance)
+			d.SetQueueSize(conf.QueueSize)
+			d.SetMaxDiskQueueSize(conf.MaxQueueSize)
+			d.SetChunkSize(conf.ChunkSize)
+			d.SetChunkInterval(conf.ChunkInterval.Value())
+			d.SetTimeout(conf.Timeout.Value())
+			d.SetMaxBackoff(conf.MaxBackoff.Value())
+
+			destinations = append(destinations, d)
 		}
+	}
 
-		app.Receivers = append(app.Receivers, &NamedReceiver{
-			Receiver: rcv,
-			Name:     "pickle",
-		})
+	prev, err := app.Forwarder.SetDestinations(hashing, conf.ReplicationFactor, destinations)
+	if err != nil {
+		return err
 	}
-	/* PICKLE end */
 
-	/* CUSTOM RECEIVERS start */
-	for receiverName, receiverOptions := range conf.Receiver {
-		if rcv, err = receiver.New(receiverName, receiverOptions, core.Add); err != nil {
-			return
+	// unsent points of previous destinations are moved to disk queue and sent by new ones
+	for _, d := range prev {
+		d.Stop()
+	}
+
+	for _, d := range destinations {
+		if err = d.Start(); err != nil {
+			// detach destinations and stop started ones. Stop of not started destination
+			// only moves points received meanwhile to disk queue
+			app.Forwarder.SetDestinations(forwarder.HashingAll, 1, nil)
+			for _, started := range destinations {
+				started.Stop()
+			}
+			return err
 		}
+	}
 
-		app.Receivers = append(app.Receivers, &NamedReceiver{
-			Receiver: rcv,
-			Name:     receiverName,
-		})
+	return nil
+}
+
+func (app *App) startCarbonserver() error {
+	conf := app.Config
+
+	if !conf.Carbonserver.Enabled {
+		return nil
 	}
-	/* CUSTOM RECEIVERS end */
 
-	/* CARBONSERVER start */
-	if conf.Carbonserver.Enabled {
+	var reg prometheus.Registerer
+	if conf.Prometheus.Enabled {
+		reg = app.PromRegisterer
+	}
+
+	carbonserver, err := app.newCarbonserver(app.Cache, conf.Whisper.DataDir, conf.Carbonserver.Listen, true, reg)
+	if err != nil {
+		return err
+	}
+
+	app.Carbonserver = carbonserver
+	return nil
+}
+
+// newCarbonserver starts carbonserver of cache and dataDir with settings of carbonserver section.
+// Cluster, anti-entropy and backfill are enabled only for primary carbonserver of whisper data-dir.
+// Prometheus metrics are disabled if reg is nil
+func (app *App) newCarbonserver(c *cache.Cache, dataDir string, listen string, primary bool, reg prometheus.Registerer) (*carbonserver.CarbonserverListener, error) {
+	conf := app.Config
+
+	antiEntropy := &carbonserver.AntiEntropyOptions{
+		Peer:                conf.Carbonserver.AntiEntropy.Peer,
+		Interval:            conf.Carbonserver.AntiEntropy.Interval.Value(),
+		Window:              conf.Carbonserver.AntiEntropy.Window.Value(),
+		Delay:               conf.Carbonserver.AntiEntropy.Delay.Value(),
+		MaxMetricsPerSecond: conf.Carbonserver.AntiEntropy.MaxMetricsPerSecond,
+		Timeout:             conf.Carbonserver.AntiEntropy.Timeout.Value(),
+		Token:               conf.Carbonserver.AntiEntropy.Token,
+	}
+
+	carbonserver := carbonserver.NewCarbonserverListener(c.Get)
+	carbonserver.SetWhisperData(dataDir)
+	carbonserver.SetMaxGlobs(conf.Carbonserver.MaxGlobs)
+	carbonserver.SetFLock(conf.Whisper.FLock)
+	carbonserver.SetCompressed(conf.Whisper.Compressed)
+	carbonserver.SetFailOnMaxGlobs(conf.Carbonserver.FailOnMaxGlobs)
+	carbonserver.SetBuckets(conf.Carbonserver.Buckets)
+	carbonserver.SetMetricsAsCounters(conf.Carbonserver.MetricsAsCounters)
+	carbonserver.SetScanFrequency(conf.Carbonserver.ScanFrequency.Value())
+	carbonserver.SetReadTimeout(conf.Carbonserver.ReadTimeout.Value())
+	carbonserver.SetIdleTimeout(conf.Carbonserver.IdleTimeout.Value())
+	carbonserver.SetWriteTimeout(conf.Carbonserver.WriteTimeout.Value())
+	carbonserver.SetQueryCacheEnabled(conf.Carbonserver.QueryCacheEnabled)
+	carbonserver.SetFindCacheEnabled(conf.Carbonserver.FindCacheEnabled)
+	carbonserver.SetQueryCacheSizeMB(conf.Carbonserver.QueryCacheSizeMB)
+	carbonserver.SetTrigramIndex(conf.Carbonserver.TrigramIndex)
+	carbonserver.SetInternalStatsDir(conf.Carbonserver.InternalStatsDir)
+	carbonserver.SetPercentiles(conf.Carbonserver.Percentiles)
+	carbonserver.SetHashOnly(conf.Whisper.HashFilenames)
+	carbonserver.SetQuotaState(c.QuotaState)
+
+	tlsConfig, err := tlsconfig.New(conf.Carbonserver.TLSOptions)
+	if err != nil {
+		return nil, err
+	}
+	carbonserver.SetTLS(tlsConfig)
+	carbonserver.SetPeerScheme(conf.Carbonserver.PeerScheme)
+	carbonserver.SetMaxBodySize(conf.Carbonserver.MaxBodySize)
+
+	if err := carbonserver.SetAuth(conf.Carbonserver.Principals, conf.Carbonserver.Htpasswd); err != nil {
+		return nil, err
+	}
+	// carbonserver.SetQueryTimeout(conf.Carbonserver.QueryTimeout.Value())
+
+	if primary && conf.Carbonserver.Cluster.Cluster != nil {
+		carbonserver.SetCluster(conf.Carbonserver.Cluster.Cluster, conf.Carbonserver.Cluster.Timeout.Value())
+	}
+
+	if primary && conf.Carbonserver.AntiEntropy.Enabled {
+		carbonserver.SetAntiEntropy(antiEntropy)
+		carbonserver.SetRepairWriter(c.Add)
+	}
+
+	if primary && conf.Whisper.BackfillEnabled {
+		carbonserver.SetBackfill(app.backfill)
+	}
+
+	if primary && conf.Carbonserver.MergeEnabled {
+		carbonserver.SetMerge(conf.Carbonserver.MergeMaxSize, app.lockMetric)
+	}
+
+	if reg != nil {
+		carbonserver.InitPrometheus(reg)
+	}
+
+	if err := carbonserver.Listen(listen); err != nil {
+		return nil, err
+	}
+
+	return carbonserver, nil
+}
+
+func (app *App) startCarbonlink() error {
+	conf := app.Config
+
+	if !conf.Carbonlink.Enabled {
+		return nil
+	}
+
+	linkAddr, err := net.ResolveTCPAddr("tcp", conf.Carbonlink.Listen)
+	if err != nil {
+		return err
+	}
+
+	carbonlink := cache.NewCarbonlinkListener(app.Cache)
+	carbonlink.SetReadTimeout(conf.Carbonlink.ReadTimeout.Value())
+
+	tlsConfig, err := tlsconfig.New(conf.Carbonlink.TLSOptions)
+	if err != nil {
+		return err
+	}
+	carbonlink.SetTLS(tlsConfig)
+	// carbonlink.SetQueryTimeout(conf.Carbonlink.QueryTimeout.Value())
+
+	if err = carbonlink.Listen(linkAddr); err != nil {
+		return err
+	}
+
+	app.CarbonLink = carbonlink
+	return nil
+}
+
+// startWAL starts write-ahead log of cache in dir. Returns segments left from previous run
+func (app *App) startWAL(c *cache.Cache, dir string) (*wal.WAL, []string, error) {
+	conf := app.Config
+
+	// segments left from previous run. Should be listed before new segment is created
+	segments, err := wal.ListSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := wal.New(dir, c.WALWatermark)
+	w.SetSegmentSize(conf.Wal.SegmentSize)
+	w.SetRetention(conf.Wal.Retention.Value())
+	if err = w.SetFsync(conf.Wal.Fsync, conf.Wal.FsyncInterval.Value()); err != nil {
+		return nil, nil, err
+	}
+
+	if err = w.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	c.SetWAL(w)
+	return w, segments, nil
+}
+
+// startOverflow enables on-disk overflow buffer of cache in dir. Segments left from previous run are drained by persister
+func (app *App) startOverflow(c *cache.Cache, dir string) error {
+	o := cache.NewOverflow(dir)
+	if err := o.Recover(); err != nil {
+		return err
+	}
+
+	c.SetOverflow(o)
+	return nil
+}
+
+// Start starts
+func (app *App) Start() (err error) {
+	app.Lock()
+	defer app.Unlock()
+
+	defer func() {
 		if err != nil {
-			return
+			app.stopAll()
 		}
+	}()
 
-		carbonserver := carbonserver.NewCarbonserverListener(core.Get)
-		carbonserver.SetWhisperData(conf.Whisper.DataDir)
-		carbonserver.SetMaxGlobs(conf.Carbonserver.MaxGlobs)
-		carbonserver.SetFLock(app.Config.Whisper.FLock)
-		carbonserver.SetCompressed(app.Config.Whisper.Compressed)
-		carbonserver.SetFailOnMaxGlobs(conf.Carbonserver.FailOnMaxGlobs)
-		carbonserver.SetBuckets(conf.Carbonserver.Buckets)
-		carbonserver.SetMetricsAsCounters(conf.Carbonserver.MetricsAsCounters)
-		carbonserver.SetScanFrequency(conf.Carbonserver.ScanFrequency.Value())
-		carbonserver.SetReadTimeout(conf.Carbonserver.ReadTimeout.Value())
-		carbonserver.SetIdleTimeout(conf.Carbonserver.IdleTimeout.Value())
-		carbonserver.SetWriteTimeout(conf.Carbonserver.WriteTimeout.Value())
-		carbonserver.SetQueryCacheEnabled(conf.Carbonserver.QueryCacheEnabled)
-		carbonserver.SetFindCacheEnabled(conf.Carbonserver.FindCacheEnabled)
-		carbonserver.SetQueryCacheSizeMB(conf.Carbonserver.QueryCacheSizeMB)
-		carbonserver.SetTrigramIndex(conf.Carbonserver.TrigramIndex)
-		carbonserver.SetInternalStatsDir(conf.Carbonserver.InternalStatsDir)
-		carbonserver.SetPercentiles(conf.Carbonserver.Percentiles)
-		carbonserver.SetHashOnly(app.Config.Whisper.HashFilenames)
-		// carbonserver.SetQueryTimeout(conf.Carbonserver.QueryTimeout.Value())
-
-		if conf.Prometheus.Enabled {
-			carbonserver.InitPrometheus(app.PromRegisterer)
-		}
-
-		if err = carbonserver.Listen(conf.Carbonserver.Listen); err != nil {
+	conf := app.Config
+
+	runtime.GOMAXPROCS(conf.Common.MaxCPU)
+
+	core := cache.New()
+	app.configureCache(core, conf.Quota.Quotas, conf.Whisper.DataDir)
+
+	app.Cache = core
+
+	if conf.Cache.OverflowDir != "" {
+		if err = app.startOverflow(core, conf.Cache.OverflowDir); err != nil {
 			return
 		}
+	}
 
-		app.Carbonserver = carbonserver
+	// receivers are always started with rewriter, so rules can be enabled on config reload
+	app.Rewriter = rewrite.New()
+	app.Rewriter.SetRules(conf.Rewrite.Rules)
+	app.Forwarder = forwarder.New()
+	app.Router = tenant.New()
+	app.Tenants = make(map[string]*Tenant)
+
+	/* WAL start */
+	var walSegments []string
+	if conf.Wal.Enabled {
+		if app.WAL, walSegments, err = app.startWAL(core, conf.Wal.Path); err != nil {
+			return
+		}
 	}
-	/* CARBONSERVER end */
+	/* WAL end */
 
-	/* CARBONLINK start */
-	if conf.Carbonlink.Enabled {
-		var linkAddr *net.TCPAddr
-		linkAddr, err = net.ResolveTCPAddr("tcp", conf.Carbonlink.Listen)
+	/* API start */
+	if conf.Grpc.Enabled {
+		var grpcAddr *net.TCPAddr
+		grpcAddr, err = net.ResolveTCPAddr("tcp", conf.Grpc.Listen)
 		if err != nil {
 			return
 		}
 
-		carbonlink := cache.NewCarbonlinkListener(core)
-		carbonlink.SetReadTimeout(conf.Carbonlink.ReadTimeout.Value())
-		// carbonlink.SetQueryTimeout(conf.Carbonlink.QueryTimeout.Value())
+		grpcApi := api.New(core)
+		if conf.Whisper.BackfillEnabled {
+			grpcApi.SetBackfill(app.backfill)
+		}
+
+		var tlsConfig *tlsconfig.Config
+		if tlsConfig, err = tlsconfig.New(conf.Grpc.TLSOptions); err != nil {
+			return
+		}
+		grpcApi.SetTLS(tlsConfig)
 
-		if err = carbonlink.Listen(linkAddr); err != nil {
+		if err = grpcApi.Listen(grpcAddr); err != nil {
 			return
 		}
 
-		app.CarbonLink = carbonlink
+		app.Api = grpcApi
+	}
+	/* API end */
+
+	/* WHISPER and TAGS start */
+	app.startPersister()
+	/* WHISPER and TAGS end */
+
+	/* TENANTS start */
+	if _, err = app.startTenants(nil); err != nil {
+		return
+	}
+	/* TENANTS end */
+
+	/* FORWARDER start */
+	if err = app.startForwarder(); err != nil {
+		return
+	}
+	/* FORWARDER end */
+
+	/* RECEIVERS start */
+	if _, err = app.startReceivers(); err != nil {
+		return
+	}
+	/* RECEIVERS end */
+
+	/* CARBONSERVER start */
+	if err = app.startCarbonserver(); err != nil {
+		return
+	}
+	/* CARBONSERVER end */
+
+	/* CARBONLINK start */
+	if err = app.startCarbonlink(); err != nil {
+		return
 	}
 	/* CARBONLINK end */
 
 	/* RESTORE start */
 	if conf.Dump.Enabled {
 		go app.Restore(core.Add, conf.Dump.Path, conf.Dump.RestorePerSecond)
+
+		for _, t := range app.Tenants {
+			if dumpPath := tenantPath(conf.Dump.Path, t.Name); dirExists(dumpPath) {
+				go app.Restore(t.Cache.Add, dumpPath, conf.Dump.RestorePerSecond)
+			}
+		}
+	}
+
+	if len(walSegments) > 0 {
+		go app.RestoreWAL(core.Add, walSegments)
 	}
 	/* RESTORE end */
 
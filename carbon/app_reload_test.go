@@ -0,0 +1,94 @@
+package carbon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+)
+
+func TestReloadReceivers(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		configFile := TestConfig(root)
+
+		app := New(configFile)
+		assert.NoError(app.ParseConfig())
+		assert.NoError(app.Start())
+		defer app.Stop()
+
+		byName := func() map[string]*NamedReceiver {
+			res := make(map[string]*NamedReceiver)
+			for _, r := range app.Receivers {
+				res[r.Name] = r
+			}
+			return res
+		}
+
+		before := byName()
+		carbonlink := app.CarbonLink
+
+		// nothing changed
+		assert.NoError(app.ReloadConfig())
+		after := byName()
+		for name, r := range before {
+			assert.True(r == after[name], name)
+		}
+		assert.True(carbonlink == app.CarbonLink)
+
+		// change tcp listen address and disable pickle
+		cfg, err := ReadConfig(configFile)
+		assert.NoError(err)
+		cfg.Tcp.Listen = "127.0.0.1:0"
+		cfg.Pickle.Enabled = false
+
+		buf := new(bytes.Buffer)
+		assert.NoError(toml.NewEncoder(buf).Encode(cfg))
+		assert.NoError(ioutil.WriteFile(configFile, buf.Bytes(), 0644))
+
+		assert.NoError(app.ReloadConfig())
+		after = byName()
+
+		assert.True(before["udp"] == after["udp"])
+		assert.NotNil(after["tcp"])
+		assert.False(before["tcp"] == after["tcp"])
+		assert.Nil(after["pickle"])
+		assert.True(carbonlink == app.CarbonLink)
+	})
+}
+
+func TestReloadRewrite(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		configFile := TestConfig(root)
+
+		app := New(configFile)
+		assert.NoError(app.ParseConfig())
+		assert.NoError(app.Start())
+		defer app.Stop()
+
+		assert.Equal("app.debug.count", app.Rewriter.Rewrite("app.debug.count"))
+
+		rulesFile := filepath.Join(root, "rewrite.conf")
+		assert.NoError(ioutil.WriteFile(rulesFile, []byte("[debug]\npattern = \\.debug\\.\naction = drop\n"), 0644))
+
+		cfg, err := ReadConfig(configFile)
+		assert.NoError(err)
+		cfg.Rewrite.Enabled = true
+		cfg.Rewrite.RulesFilename = rulesFile
+
+		buf := new(bytes.Buffer)
+		assert.NoError(toml.NewEncoder(buf).Encode(cfg))
+		assert.NoError(ioutil.WriteFile(configFile, buf.Bytes(), 0644))
+
+		assert.NoError(app.ReloadConfig())
+		assert.Equal("", app.Rewriter.Rewrite("app.debug.count"))
+	})
+}
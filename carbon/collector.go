@@ -170,10 +170,26 @@ func NewCollector(app *App) *Collector {
 		c.stats = append(c.stats, moduleCallback("cache", app.Cache))
 	}
 
+	if app.WAL != nil {
+		c.stats = append(c.stats, moduleCallback("wal", app.WAL))
+	}
+
+	if app.Rewriter != nil && app.Config.Rewrite.Enabled {
+		c.stats = append(c.stats, moduleCallback("rewrite", app.Rewriter))
+	}
+
+	if app.Forwarder != nil && app.Config.Forwarder.Enabled {
+		c.stats = append(c.stats, moduleCallback("forwarder", app.Forwarder))
+	}
+
 	if app.Carbonserver != nil {
 		c.stats = append(c.stats, moduleCallback("carbonserver", app.Carbonserver))
 	}
 
+	if app.CarbonLink != nil {
+		c.stats = append(c.stats, moduleCallback("carbonlink", app.CarbonLink))
+	}
+
 	if app.Receivers != nil {
 		for i := 0; i < len(app.Receivers); i++ {
 			c.stats = append(c.stats, moduleCallback(app.Receivers[i].Name, app.Receivers[i]))
@@ -192,6 +208,24 @@ func NewCollector(app *App) *Collector {
 		c.stats = append(c.stats, moduleCallback("tags", app.Tags))
 	}
 
+	if app.Router != nil && len(app.Tenants) > 0 {
+		c.stats = append(c.stats, moduleCallback("router", app.Router))
+	}
+
+	for name, t := range app.Tenants {
+		prefix := "tenant." + name + "."
+		c.stats = append(c.stats, moduleCallback(prefix+"cache", t.Cache))
+		if t.WAL != nil {
+			c.stats = append(c.stats, moduleCallback(prefix+"wal", t.WAL))
+		}
+		if t.Persister != nil {
+			c.stats = append(c.stats, moduleCallback(prefix+"persister", t.Persister))
+		}
+		if t.Carbonserver != nil {
+			c.stats = append(c.stats, moduleCallback(prefix+"carbonserver", t.Carbonserver))
+		}
+	}
+
 	// collector worker
 	c.Go(func(exit chan bool) {
 		ticker := time.NewTicker(c.metricInterval)
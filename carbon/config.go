@@ -10,9 +10,14 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/lomik/go-carbon/cache"
+	"github.com/lomik/go-carbon/carbonserver"
+	"github.com/lomik/go-carbon/helper/hashing"
+	"github.com/lomik/go-carbon/helper/tlsconfig"
 	"github.com/lomik/go-carbon/persister"
 	"github.com/lomik/go-carbon/receiver/tcp"
 	"github.com/lomik/go-carbon/receiver/udp"
+	"github.com/lomik/go-carbon/rewrite"
 	"github.com/lomik/zapwriter"
 )
 
@@ -53,36 +58,56 @@ type commonConfig struct {
 }
 
 type whisperConfig struct {
-	DataDir                 string `toml:"data-dir"`
-	SchemasFilename         string `toml:"schemas-file"`
-	AggregationFilename     string `toml:"aggregation-file"`
-	Workers                 int    `toml:"workers"`
-	MaxUpdatesPerSecond     int    `toml:"max-updates-per-second"`
-	MaxCreatesPerSecond     int    `toml:"max-creates-per-second"`
-	HardMaxCreatesPerSecond bool   `toml:"hard-max-creates-per-second"`
-	Sparse                  bool   `toml:"sparse-create"`
-	FLock                   bool   `toml:"flock"`
-	Compressed              bool   `toml:"compressed"`
-	Enabled                 bool   `toml:"enabled"`
-	HashFilenames           bool   `toml:"hash-filenames"`
+	DataDir                 string    `toml:"data-dir"`
+	SchemasFilename         string    `toml:"schemas-file"`
+	AggregationFilename     string    `toml:"aggregation-file"`
+	Workers                 int       `toml:"workers"`
+	MaxUpdatesPerSecond     int       `toml:"max-updates-per-second"`
+	MaxCreatesPerSecond     int       `toml:"max-creates-per-second"`
+	HardMaxCreatesPerSecond bool      `toml:"hard-max-creates-per-second"`
+	Sparse                  bool      `toml:"sparse-create"`
+	FLock                   bool      `toml:"flock"`
+	Compressed              bool      `toml:"compressed"`
+	Enabled                 bool      `toml:"enabled"`
+	HashFilenames           bool      `toml:"hash-filenames"`
+	AdaptiveThrottling      bool      `toml:"adaptive-throttling"`
+	AdaptiveTargetLatency   *Duration `toml:"adaptive-target-latency"`
+	AdaptiveMaxIOWait       float64   `toml:"adaptive-max-iowait"`
+	AdaptiveMinUpdates      int       `toml:"adaptive-min-updates-per-second"`
+	ResizeEnabled           bool      `toml:"resize-enabled"`
+	ResizeInterval          *Duration `toml:"resize-interval"`
+	ResizeMaxFilesPerSecond int       `toml:"resize-max-files-per-second"`
+	AggrEnabled             bool      `toml:"reconcile-aggregation"`
+	AggrInterval            *Duration `toml:"reconcile-aggregation-interval"`
+	AggrMaxFilesPerSecond   int       `toml:"reconcile-aggregation-max-files-per-second"`
+	BackfillEnabled         bool      `toml:"backfill-enabled"`
+	BackfillWorkers         int       `toml:"backfill-workers"`
+	BackfillMaxUpdates      int       `toml:"backfill-max-updates-per-second"`
 	Schemas                 persister.WhisperSchemas
 	Aggregation             *persister.WhisperAggregation
 }
 
 type cacheConfig struct {
-	MaxSize       uint32 `toml:"max-size"`
-	WriteStrategy string `toml:"write-strategy"`
+	MaxSize          uint32    `toml:"max-size"`
+	MaxMemory        int64     `toml:"max-memory"`
+	OverflowDir      string    `toml:"overflow-dir"`
+	WriteStrategy    string    `toml:"write-strategy"`
+	PriorityFilename string    `toml:"priority-file"`
+	PriorityAging    *Duration `toml:"priority-aging"`
+	PriorityRules    cache.PriorityRules
 }
 
 type carbonlinkConfig struct {
 	Listen      string    `toml:"listen"`
 	Enabled     bool      `toml:"enabled"`
 	ReadTimeout *Duration `toml:"read-timeout"`
+	tlsconfig.TLSOptions
 }
 
 type grpcConfig struct {
 	Listen  string `toml:"listen"`
 	Enabled bool   `toml:"enabled"`
+	tlsconfig.TLSOptions
 }
 
 type receiverConfig struct {
@@ -115,6 +140,39 @@ type carbonserverConfig struct {
 	TrigramIndex      bool      `toml:"trigram-index"`
 	InternalStatsDir  string    `toml:"internal-stats-dir"`
 	Percentiles       []int     `toml:"stats-percentiles"`
+	AuthFilename      string    `toml:"auth-file"`
+	HtpasswdFilename  string    `toml:"htpasswd-file"`
+	MergeEnabled      bool      `toml:"merge-enabled"`
+	MergeMaxSize      int64     `toml:"merge-max-size"`
+	PeerScheme        string    `toml:"peer-scheme"`
+	MaxBodySize       int64     `toml:"max-body-size"`
+	tlsconfig.TLSOptions
+	Principals []*carbonserver.Principal
+	Htpasswd   map[string]string
+
+	Cluster     carbonserverClusterConfig     `toml:"cluster"`
+	AntiEntropy carbonserverAntiEntropyConfig `toml:"anti-entropy"`
+}
+
+type carbonserverClusterConfig struct {
+	Enabled           bool      `toml:"enabled"`
+	Hashing           string    `toml:"hashing"`
+	ReplicationFactor int       `toml:"replication-factor"`
+	Self              string    `toml:"self"`
+	Nodes             []string  `toml:"nodes"`
+	Timeout           *Duration `toml:"timeout"`
+	Cluster           *hashing.Cluster
+}
+
+type carbonserverAntiEntropyConfig struct {
+	Enabled             bool      `toml:"enabled"`
+	Peer                string    `toml:"peer"`
+	Interval            *Duration `toml:"interval"`
+	Window              *Duration `toml:"window"`
+	Delay               *Duration `toml:"delay"`
+	MaxMetricsPerSecond int       `toml:"max-metrics-per-second"`
+	Timeout             *Duration `toml:"timeout"`
+	Token               string    `toml:"token"`
 }
 
 type pprofConfig struct {
@@ -128,6 +186,71 @@ type dumpConfig struct {
 	RestorePerSecond int    `toml:"restore-per-second"`
 }
 
+type walConfig struct {
+	Enabled       bool      `toml:"enabled"`
+	Path          string    `toml:"path"`
+	SegmentSize   int64     `toml:"segment-size"`
+	Fsync         string    `toml:"fsync"`
+	FsyncInterval *Duration `toml:"fsync-interval"`
+	Retention     *Duration `toml:"retention"`
+}
+
+type rewriteConfig struct {
+	Enabled       bool   `toml:"enabled"`
+	RulesFilename string `toml:"rules-file"`
+	Rules         rewrite.Rules
+}
+
+type quotaConfig struct {
+	Enabled        bool   `toml:"enabled"`
+	QuotasFilename string `toml:"quotas-file"`
+	Quotas         []*cache.Quota
+}
+
+type forwarderDestinationConfig struct {
+	Address  string `toml:"address"`
+	Protocol string `toml:"protocol"`
+	Instance string `toml:"instance"`
+}
+
+type forwarderConfig struct {
+	Enabled           bool                         `toml:"enabled"`
+	Hashing           string                       `toml:"hashing"`
+	ReplicationFactor int                          `toml:"replication-factor"`
+	QueueSize         int                          `toml:"queue-size"`
+	SpoolDir          string                       `toml:"spool-dir"`
+	MaxQueueSize      int64                        `toml:"max-queue-size"`
+	ChunkSize         int                          `toml:"chunk-size"`
+	ChunkInterval     *Duration                    `toml:"chunk-interval"`
+	Timeout           *Duration                    `toml:"timeout"`
+	MaxBackoff        *Duration                    `toml:"max-backoff"`
+	Destinations      []forwarderDestinationConfig `toml:"destination"`
+}
+
+type tenantConfig struct {
+	Prefix              string `toml:"prefix"`
+	DataDir             string `toml:"data-dir"`
+	SchemasFilename     string `toml:"schemas-file"`
+	AggregationFilename string `toml:"aggregation-file"`
+	QuotasFilename      string `toml:"quotas-file"`
+	CarbonserverListen  string `toml:"carbonserver-listen"`
+	Schemas             persister.WhisperSchemas
+	Aggregation         *persister.WhisperAggregation
+	Quotas              []*cache.Quota
+}
+
+type receiverTenantConfig struct {
+	Tenant string `toml:"tenant"`
+}
+
+// builtinTenantsConfig is tenant option of [udp], [tcp] and [pickle] sections.
+// Options of these sections are decoded to structs of receiver packages, which know nothing about tenants
+type builtinTenantsConfig struct {
+	Udp    receiverTenantConfig `toml:"udp"`
+	Tcp    receiverTenantConfig `toml:"tcp"`
+	Pickle receiverTenantConfig `toml:"pickle"`
+}
+
 type prometheusConfig struct {
 	Enabled  bool              `toml:"enabled"`
 	Endpoint string            `toml:"endpoint"`
@@ -148,9 +271,16 @@ type Config struct {
 	Tags         tagsConfig                          `toml:"tags"`
 	Carbonserver carbonserverConfig                  `toml:"carbonserver"`
 	Dump         dumpConfig                          `toml:"dump"`
+	Wal          walConfig                           `toml:"wal"`
+	Rewrite      rewriteConfig                       `toml:"rewrite"`
+	Quota        quotaConfig                         `toml:"quota"`
+	Forwarder    forwarderConfig                     `toml:"forwarder"`
+	Tenant       map[string]*tenantConfig            `toml:"tenant"`
 	Pprof        pprofConfig                         `toml:"pprof"`
 	Logging      []zapwriter.Config                  `toml:"logging"`
 	Prometheus   prometheusConfig                    `toml:"prometheus"`
+
+	builtinTenants builtinTenantsConfig
 }
 
 func NewLoggingConfig() zapwriter.Config {
@@ -181,10 +311,26 @@ func NewConfig() *Config {
 			Sparse:              false,
 			FLock:               false,
 			HashFilenames:       true,
+			AdaptiveTargetLatency: &Duration{
+				Duration: 50 * time.Millisecond,
+			},
+			AdaptiveMinUpdates: 100,
+			ResizeInterval: &Duration{
+				Duration: time.Hour,
+			},
+			ResizeMaxFilesPerSecond: 100,
+			AggrInterval: &Duration{
+				Duration: time.Hour,
+			},
+			AggrMaxFilesPerSecond: 100,
+			BackfillWorkers:       2,
 		},
 		Cache: cacheConfig{
 			MaxSize:       1000000,
 			WriteStrategy: "max",
+			PriorityAging: &Duration{
+				Duration: 10 * time.Minute,
+			},
 		},
 		Udp:    udp.NewOptions(),
 		Tcp:    tcp.NewOptions(),
@@ -212,6 +358,33 @@ func NewConfig() *Config {
 			QueryCacheSizeMB:  0,
 			FindCacheEnabled:  true,
 			TrigramIndex:      true,
+			MergeMaxSize:      1073741824,
+			PeerScheme:        "http",
+			MaxBodySize:       134217728,
+			Cluster: carbonserverClusterConfig{
+				Enabled:           false,
+				Hashing:           hashing.CarbonCHType,
+				ReplicationFactor: 1,
+				Timeout: &Duration{
+					Duration: 5 * time.Second,
+				},
+			},
+			AntiEntropy: carbonserverAntiEntropyConfig{
+				Enabled: false,
+				Interval: &Duration{
+					Duration: time.Hour,
+				},
+				Window: &Duration{
+					Duration: 24 * time.Hour,
+				},
+				Delay: &Duration{
+					Duration: 10 * time.Minute,
+				},
+				MaxMetricsPerSecond: 100,
+				Timeout: &Duration{
+					Duration: 30 * time.Second,
+				},
+			},
 		},
 		Carbonlink: carbonlinkConfig{
 			Listen:  "127.0.0.1:7002",
@@ -241,6 +414,44 @@ func NewConfig() *Config {
 		Dump: dumpConfig{
 			Path: "/var/lib/graphite/dump/",
 		},
+		Wal: walConfig{
+			Enabled:     false,
+			Path:        "/var/lib/graphite/wal/",
+			SegmentSize: 67108864,
+			Fsync:       "interval",
+			FsyncInterval: &Duration{
+				Duration: time.Second,
+			},
+			Retention: &Duration{
+				Duration: 24 * time.Hour,
+			},
+		},
+		Rewrite: rewriteConfig{
+			Enabled:       false,
+			RulesFilename: "/etc/go-carbon/rewrite.conf",
+		},
+		Quota: quotaConfig{
+			Enabled:        false,
+			QuotasFilename: "/etc/go-carbon/quotas.conf",
+		},
+		Forwarder: forwarderConfig{
+			Enabled:           false,
+			Hashing:           "all",
+			ReplicationFactor: 1,
+			QueueSize:         100000,
+			SpoolDir:          "/var/lib/graphite/forwarder/",
+			MaxQueueSize:      1073741824,
+			ChunkSize:         32768,
+			ChunkInterval: &Duration{
+				Duration: time.Second,
+			},
+			Timeout: &Duration{
+				Duration: 5 * time.Second,
+			},
+			MaxBackoff: &Duration{
+				Duration: 30 * time.Second,
+			},
+		},
 		Prometheus: prometheusConfig{
 			Enabled:  false,
 			Endpoint: "/metrics",
@@ -293,6 +504,10 @@ func ReadConfig(filename string) (*Config, error) {
 		if _, err := toml.Decode(body, cfg); err != nil {
 			return nil, err
 		}
+
+		if _, err := toml.Decode(body, &cfg.builtinTenants); err != nil {
+			return nil, err
+		}
 	}
 
 	if cfg.Logging == nil {
@@ -3,6 +3,7 @@ package carbon
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -13,6 +14,7 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/lomik/go-carbon/cache"
 	"github.com/lomik/go-carbon/persister"
 	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/zapwriter"
@@ -34,33 +36,24 @@ func (s *SyncWriter) Flush() error {
 	return s.w.Flush()
 }
 
-// DumpStop implements gracefully stop:
-// * Start writing all new data to xlogs
-// * Stop cache worker
-// * Dump all cache to file
-// * Stop listeners
-// * Close xlogs
-// * Exit application
-func (app *App) DumpStop() error {
-	app.Lock()
-	defer app.Unlock()
-
-	if !app.Config.Dump.Enabled {
-		return nil
-	}
+// xlogFile receives points diverted from cache during dump
+type xlogFile struct {
+	file   *os.File
+	writer *SyncWriter
+}
 
-	if app.Persister != nil {
-		app.Persister.Stop()
-		app.Persister = nil
+// close flushes and closes xlog
+func (x *xlogFile) close() error {
+	if err := x.writer.Flush(); err != nil {
+		return err
 	}
+	return x.file.Close()
+}
 
-	logger := zapwriter.Logger("dump")
-
-	logger.Info("grace stop with dump inited")
-
-	filenamePostfix := fmt.Sprintf("%d.%d", os.Getpid(), time.Now().UnixNano())
-	dumpFilename := path.Join(app.Config.Dump.Path, fmt.Sprintf("cache.%s.bin", filenamePostfix))
-	xlogFilename := path.Join(app.Config.Dump.Path, fmt.Sprintf("input.%s", filenamePostfix))
+// dumpCache diverts new points of cache to xlog file and dumps cache content to file in dir
+func dumpCache(c *cache.Cache, dir string, filenamePostfix string, logger *zap.Logger) (*xlogFile, error) {
+	dumpFilename := path.Join(dir, fmt.Sprintf("cache.%s.bin", filenamePostfix))
+	xlogFilename := path.Join(dir, fmt.Sprintf("input.%s", filenamePostfix))
 
 	// start dumpers
 	logger.Info("start cache dump", zap.String("filename", dumpFilename))
@@ -69,28 +62,28 @@ func (app *App) DumpStop() error {
 	// open dump file
 	dump, err := os.Create(dumpFilename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	dumpWriter := bufio.NewWriterSize(dump, 1048576) // 1Mb
 
 	// start input dumper
 	xlog, err := os.Create(xlogFilename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	xlogWriter := &SyncWriter{w: bufio.NewWriterSize(xlog, 4096)} // 4kb
 
-	app.Cache.DivertToXlog(xlogWriter)
+	c.DivertToXlog(xlogWriter)
 
 	// stop cache
 	dumpStart := time.Now()
-	cacheSize := app.Cache.Size()
+	cacheSize := c.Size()
 
 	// dump cache
-	err = app.Cache.DumpBinary(dumpWriter)
+	err = c.DumpBinary(dumpWriter)
 	if err != nil {
 		logger.Info("dump failed", zap.Error(err))
-		return err
+		return nil, err
 	}
 
 	logger.Info("cache dump finished",
@@ -100,13 +93,70 @@ func (app *App) DumpStop() error {
 
 	if err = dumpWriter.Flush(); err != nil {
 		logger.Info("dump flush failed", zap.Error(err))
-		return err
+		return nil, err
 	}
 
 	if err = dump.Close(); err != nil {
 		logger.Info("dump close failed", zap.Error(err))
+		return nil, err
+	}
+
+	return &xlogFile{file: xlog, writer: xlogWriter}, nil
+}
+
+// DumpStop implements gracefully stop:
+// * Start writing all new data to xlogs
+// * Stop cache worker
+// * Dump all cache to file
+// * Stop listeners
+// * Close xlogs
+// * Exit application
+//
+// Caches of tenants are dumped to tenant/<name> subdirectories of dump path
+func (app *App) DumpStop() error {
+	app.Lock()
+	defer app.Unlock()
+
+	if !app.Config.Dump.Enabled {
+		return nil
+	}
+
+	if app.Persister != nil {
+		app.Persister.Stop()
+		app.Persister = nil
+	}
+
+	for _, t := range app.Tenants {
+		if t.Persister != nil {
+			t.Persister.Stop()
+			t.Persister = nil
+		}
+	}
+
+	logger := zapwriter.Logger("dump")
+
+	logger.Info("grace stop with dump inited")
+
+	filenamePostfix := fmt.Sprintf("%d.%d", os.Getpid(), time.Now().UnixNano())
+
+	xlog, err := dumpCache(app.Cache, app.Config.Dump.Path, filenamePostfix, logger)
+	if err != nil {
 		return err
 	}
+	xlogs := []*xlogFile{xlog}
+
+	for _, t := range app.Tenants {
+		dir := tenantPath(app.Config.Dump.Path, t.Name)
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		xlog, err = dumpCache(t.Cache, dir, filenamePostfix, logger.With(zap.String("tenant", t.Name)))
+		if err != nil {
+			return err
+		}
+		xlogs = append(xlogs, xlog)
+	}
 
 	// cache dump finished
 
@@ -119,14 +169,11 @@ func (app *App) DumpStop() error {
 	go func() {
 		app.stopListeners()
 
-		if err := xlogWriter.Flush(); err != nil {
-			logger.Info("xlog flush failed", zap.Error(err))
-			return
-		}
-
-		if err := xlog.Close(); err != nil {
-			logger.Info("xlog close failed", zap.Error(err))
-			return
+		for _, xlog := range xlogs {
+			if err := xlog.close(); err != nil {
+				logger.Info("xlog close failed", zap.Error(err))
+				return
+			}
 		}
 
 		close(stopped)
@@ -238,6 +285,43 @@ FilesLoop:
 	}
 }
 
+// RestoreWAL replays wal segments left from previous run. Points are written to the new wal
+// by storeFunc, so every segment is removed right after replay. Record cut by crash at the end of
+// segment is ignored. Segments corrupted in the middle are kept with .failed suffix for manual recovery
+func (app *App) RestoreWAL(storeFunc func(*points.Points), segments []string) {
+	startTime := time.Now()
+
+	logger := zapwriter.Logger("restore")
+	logger.Info("start wal restore", zap.Int("segments", len(segments)))
+
+	defer func() {
+		logger.Info("wal restore finished",
+			zap.Duration("runtime", time.Since(startTime)),
+		)
+	}()
+
+	for _, filename := range segments {
+		err := app.RestoreFromFile(filename, storeFunc)
+		if err == io.ErrUnexpectedEOF {
+			// torn tail of segment written before crash, all complete records are replayed
+			logger.Warn("wal segment is truncated, last record is ignored", zap.String("filename", filename))
+			err = nil
+		}
+		if err != nil {
+			logger.Error("wal segment restore failed", zap.String("filename", filename), zap.Error(err))
+
+			if err := os.Rename(filename, filename+".failed"); err != nil {
+				logger.Error("rename failed", zap.String("filename", filename), zap.Error(err))
+			}
+			continue
+		}
+
+		if err := os.Remove(filename); err != nil {
+			logger.Error("remove failed", zap.String("filename", filename), zap.Error(err))
+		}
+	}
+}
+
 // Restore from dump.path
 func (app *App) Restore(storeFunc func(*points.Points), path string, rps int) {
 	if rps > 0 {
@@ -0,0 +1,66 @@
+package carbon
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/lomik/go-carbon/persister"
+)
+
+// ReconcileAggregation updates aggregation method and xFilesFactor of existing whisper files of whisper section
+// and tenants to their storage aggregation. With dryRun files are not changed. Every change is written to out
+func (app *App) ReconcileAggregation(out io.Writer, dryRun bool) error {
+	conf := app.Config
+
+	if !conf.Whisper.Enabled {
+		return fmt.Errorf("whisper is disabled")
+	}
+
+	dirs := []struct {
+		dataDir     string
+		aggregation *persister.WhisperAggregation
+	}{
+		{conf.Whisper.DataDir, conf.Whisper.Aggregation},
+	}
+	for _, tc := range conf.Tenant {
+		dirs = append(dirs, struct {
+			dataDir     string
+			aggregation *persister.WhisperAggregation
+		}{tc.DataDir, tc.Aggregation})
+	}
+
+	var checked, changed, failed int
+
+	for _, d := range dirs {
+		err := persister.WalkMetrics(d.dataDir, nil, nil, func(metric string, path string) error {
+			checked++
+
+			change, err := persister.ReconcileAggregation(path, metric, d.aggregation, conf.Whisper.FLock, dryRun)
+			if err != nil {
+				failed++
+				fmt.Fprintf(out, "%s: %s\n", path, err.Error())
+				return nil
+			}
+
+			if change != nil {
+				changed++
+				fmt.Fprintln(out, change.String())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	action := "updated"
+	if dryRun {
+		action = "would be updated"
+	}
+	fmt.Fprintf(out, "%d files checked, %d %s, %d errors\n", checked, changed, action, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("failed to reconcile %d files", failed)
+	}
+	return nil
+}
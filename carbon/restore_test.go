@@ -1,7 +1,10 @@
 package carbon
 
 import (
+	"bytes"
+	"encoding/binary"
 	"io/ioutil"
+	"os"
 	"path"
 	"testing"
 
@@ -97,3 +100,68 @@ func TestRestore(t *testing.T) {
 		}
 	})
 }
+
+func TestRestoreWALKeepsFailedSegments(t *testing.T) {
+	qa.Root(t, func(root string) {
+		good := path.Join(root, "wal.1.bin")
+		bad := path.Join(root, "wal.2.bin")
+
+		var buf bytes.Buffer
+		points.OnePoint("m1", 1, 1470687039).WriteBinaryTo(&buf)
+		if err := ioutil.WriteFile(good, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// length of metric name over limit
+		lb := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutVarint(lb, 2*points.MB)
+		if err := ioutil.WriteFile(bad, lb[:n], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var restored []*points.Points
+		app := &App{}
+		app.RestoreWAL(func(p *points.Points) {
+			restored = append(restored, p)
+		}, []string{good, bad})
+
+		if len(restored) != 1 || restored[0].Metric != "m1" {
+			t.Fatalf("unexpected restored points: %#v", restored)
+		}
+		if _, err := os.Stat(good); !os.IsNotExist(err) {
+			t.Fatalf("restored segment is not removed: %v", err)
+		}
+		if _, err := os.Stat(bad + ".failed"); err != nil {
+			t.Fatalf("failed segment is not kept: %v", err)
+		}
+	})
+}
+
+func TestRestoreWALTornTail(t *testing.T) {
+	qa.Root(t, func(root string) {
+		torn := path.Join(root, "wal.1.bin")
+
+		var buf bytes.Buffer
+		points.OnePoint("m1", 1, 1470687039).WriteBinaryTo(&buf)
+		points.OnePoint("m2", 2, 1470687039).WriteBinaryTo(&buf)
+		// record of m2 is cut by crash
+		if err := ioutil.WriteFile(torn, buf.Bytes()[:buf.Len()-3], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var restored []*points.Points
+		app := &App{}
+		app.RestoreWAL(func(p *points.Points) {
+			restored = append(restored, p)
+		}, []string{torn})
+
+		if len(restored) != 1 || restored[0].Metric != "m1" {
+			t.Fatalf("unexpected restored points: %#v", restored)
+		}
+		if _, err := os.Stat(torn); !os.IsNotExist(err) {
+			t.Fatalf("truncated segment is not removed: %v", err)
+		}
+		if _, err := os.Stat(torn + ".failed"); !os.IsNotExist(err) {
+			t.Fatalf("truncated segment is kept as failed: %v", err)
+		}
+	})
+}
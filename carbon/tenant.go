@@ -0,0 +1,190 @@
+package carbon
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/cache"
+	"github.com/lomik/go-carbon/carbonserver"
+	"github.com/lomik/go-carbon/persister"
+	"github.com/lomik/go-carbon/tenant"
+	"github.com/lomik/go-carbon/wal"
+	"github.com/lomik/zapwriter"
+)
+
+// Tenant is cache, persister and carbonserver of one tenant with own data-dir
+type Tenant struct {
+	Name         string
+	Cache        *cache.Cache
+	WAL          *wal.WAL
+	Persister    *persister.Whisper
+	Carbonserver *carbonserver.CarbonserverListener
+	config       *tenantConfig // config tenant was started with, used on config reload
+}
+
+// tenantPath returns directory of tenant inside of wal, dump or cache overflow directory
+func tenantPath(dir string, name string) string {
+	return filepath.Join(dir, "tenant", name)
+}
+
+func dirExists(dir string) bool {
+	stat, err := os.Stat(dir)
+	return err == nil && stat.IsDir()
+}
+
+func (t *Tenant) stop() {
+	if t.Carbonserver != nil {
+		t.Carbonserver.Stop()
+		t.Carbonserver = nil
+	}
+
+	if t.Persister != nil {
+		t.Persister.Stop()
+		t.Persister = nil
+	}
+
+	if t.WAL != nil {
+		t.WAL.Stop()
+		t.WAL = nil
+	}
+
+	t.Cache.Stop()
+}
+
+// tenantPersisterChanged returns true if settings of tenant persister differ from settings it was started with
+func tenantPersisterChanged(oldConfig, newConfig *Config, prev, tc *tenantConfig) bool {
+	return prev == nil || oldConfig == nil ||
+		!reflect.DeepEqual(oldConfig.Whisper, newConfig.Whisper) ||
+		oldConfig.Tags.Enabled != newConfig.Tags.Enabled ||
+		prev.DataDir != tc.DataDir ||
+		!reflect.DeepEqual(prev.Schemas, tc.Schemas) ||
+		!reflect.DeepEqual(prev.Aggregation, tc.Aggregation)
+}
+
+// startTenants starts new tenants, stops removed ones and applies config to running tenants.
+// Persisters and carbonservers are restarted only if their settings were changed.
+// Points in cache of removed tenant are lost. Returns names of started, stopped and restarted modules
+func (app *App) startTenants(oldConfig *Config) ([]string, error) {
+	logger := zapwriter.Logger("app")
+	conf := app.Config
+
+	restarted := make([]string, 0)
+
+	for name, t := range app.Tenants {
+		if _, exists := conf.Tenant[name]; exists {
+			continue
+		}
+
+		if size := t.Cache.Size(); size > 0 {
+			logger.Warn("tenant removed, points in cache are lost",
+				zap.String("tenant", name),
+				zap.Int32("points", size),
+			)
+		}
+
+		t.stop()
+		delete(app.Tenants, name)
+		restarted = append(restarted, "tenant."+name)
+	}
+
+	names := make([]string, 0, len(conf.Tenant))
+	for name := range conf.Tenant {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	routes := make([]*tenant.Tenant, 0, len(names))
+
+	for _, name := range names {
+		tc := conf.Tenant[name]
+
+		t, exists := app.Tenants[name]
+		if !exists {
+			t = &Tenant{Name: name, Cache: cache.New()}
+
+			if o := app.Cache.Overflow(); o != nil {
+				if err := app.startOverflow(t.Cache, tenantPath(o.Dir(), name)); err != nil {
+					return restarted, err
+				}
+			}
+
+			// tenants added on config reload also get wal if it was enabled on start
+			if app.WAL != nil {
+				w, segments, err := app.startWAL(t.Cache, tenantPath(conf.Wal.Path, name))
+				if err != nil {
+					return restarted, err
+				}
+				t.WAL = w
+
+				if len(segments) > 0 {
+					go app.RestoreWAL(t.Cache.Add, segments)
+				}
+			}
+
+			app.Tenants[name] = t
+			restarted = append(restarted, "tenant."+name)
+		}
+
+		prev := t.config
+		t.config = tc
+
+		app.configureCache(t.Cache, tc.Quotas, tc.DataDir)
+
+		if tenantPersisterChanged(oldConfig, conf, prev, tc) {
+			running := t.Persister != nil
+			if running {
+				t.Persister.Stop()
+				t.Persister = nil
+			}
+
+			if conf.Whisper.Enabled {
+				// tagged metrics of tenants are not sent to tagdb
+				t.Persister = app.newPersister(t.Cache, tc.DataDir, tc.Schemas, tc.Aggregation)
+				t.Persister.SetTagsEnabled(conf.Tags.Enabled)
+				t.Persister.Start()
+			}
+
+			if prev != nil && (running || t.Persister != nil) {
+				restarted = append(restarted, "tenant."+name+".persister")
+			}
+		}
+
+		// prev is nil for new tenant and after failed carbonserver start
+		if prev == nil || carbonserverChanged(oldConfig, conf) ||
+			prev.DataDir != tc.DataDir || prev.CarbonserverListen != tc.CarbonserverListen {
+
+			running := t.Carbonserver != nil
+			if running {
+				t.Carbonserver.Stop()
+				t.Carbonserver = nil
+			}
+
+			if conf.Carbonserver.Enabled && tc.CarbonserverListen != "" {
+				var reg prometheus.Registerer
+				if conf.Prometheus.Enabled {
+					reg = prometheus.WrapRegistererWithPrefix("tenant_"+strings.Replace(name, "-", "_", -1)+"_", app.PromRegisterer)
+				}
+
+				var err error
+				if t.Carbonserver, err = app.newCarbonserver(t.Cache, tc.DataDir, tc.CarbonserverListen, false, reg); err != nil {
+					t.config = nil // start carbonserver again on next reload
+					return restarted, err
+				}
+			}
+
+			if prev != nil && (running || t.Carbonserver != nil) {
+				restarted = append(restarted, "tenant."+name+".carbonserver")
+			}
+		}
+
+		routes = append(routes, &tenant.Tenant{Name: name, Prefix: tc.Prefix, Store: t.Cache.Add})
+	}
+
+	return restarted, app.Router.SetTenants(routes)
+}
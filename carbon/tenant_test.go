@@ -0,0 +1,136 @@
+package carbon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+// writeTenantConfig writes test config with whisper data-dir in root/whisper, random ports and tenant sections
+func writeTenantConfig(t *testing.T, root string, tenants string) string {
+	configFile := TestConfig(root)
+
+	cfg, err := ReadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Whisper.DataDir = filepath.Join(root, "whisper")
+
+	// other tests can leave default ports in use
+	cfg.Udp.Listen = "127.0.0.1:0"
+	cfg.Tcp.Listen = "127.0.0.1:0"
+	cfg.Pickle.Listen = "127.0.0.1:0"
+	cfg.Carbonlink.Listen = "127.0.0.1:0"
+	cfg.Grpc.Listen = "127.0.0.1:0"
+
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(cfg); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString(tenants)
+
+	if err := ioutil.WriteFile(configFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+func TestTenants(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		tenantSection := func(name, prefix, dir string) string {
+			return fmt.Sprintf("\n[tenant.%s]\nprefix = %q\ndata-dir = %q\n", name, prefix, filepath.Join(root, dir))
+		}
+
+		waitFile := func(filename string) error {
+			for i := 0; i < 100; i++ {
+				if _, err := os.Stat(filename); err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			_, err := os.Stat(filename)
+			return err
+		}
+
+		configFile := writeTenantConfig(t, root, tenantSection("team-a", "team_a.", "team-a"))
+
+		app := New(configFile)
+		assert.NoError(app.ParseConfig())
+		assert.NoError(app.Start())
+		defer app.Stop()
+
+		teamA := app.Tenants["team-a"]
+		if !assert.NotNil(teamA) {
+			return
+		}
+
+		store := app.Router.Store(app.Cache.Add)
+		store(points.OnePoint("team_a.cpu", 1, time.Now().Unix()))
+		store(points.OnePoint("other.cpu", 1, time.Now().Unix()))
+
+		// points of tenant are persisted to tenant data-dir
+		assert.NoError(waitFile(filepath.Join(root, "team-a", "cpu.wsp")))
+		assert.NoError(waitFile(filepath.Join(root, "whisper", "other", "cpu.wsp")))
+
+		_, err := os.Stat(filepath.Join(root, "whisper", "team_a", "cpu.wsp"))
+		assert.True(os.IsNotExist(err))
+
+		// overlapping data-dir is rejected, running tenants are kept
+		writeTenantConfig(t, root, tenantSection("team-a", "team_a.", "team-a")+tenantSection("team-c", "", "team-a/sub"))
+		assert.Error(app.ReloadConfig())
+		assert.True(teamA == app.Tenants["team-a"])
+
+		// new tenant is started, running tenant keeps cache and persister
+		persisterA := teamA.Persister
+		writeTenantConfig(t, root, tenantSection("team-a", "team_a.", "team-a")+tenantSection("team-b", "", "team-b"))
+		assert.NoError(app.ReloadConfig())
+		assert.True(teamA == app.Tenants["team-a"])
+		assert.True(persisterA == teamA.Persister)
+		assert.NotNil(app.Tenants["team-b"])
+
+		store(&points.Points{Metric: "mem", Tenant: "team-b", Data: []points.Point{{Value: 1, Timestamp: time.Now().Unix()}}})
+		assert.NoError(waitFile(filepath.Join(root, "team-b", "mem.wsp")))
+
+		// removed tenant is stopped
+		writeTenantConfig(t, root, "")
+		assert.NoError(app.ReloadConfig())
+		assert.Equal(0, len(app.Tenants))
+	})
+}
+
+func TestBuiltinReceiverTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		configFile := filepath.Join(root, "go-carbon.conf")
+		body := "[tcp]\nlisten = \":2103\"\ntenant = \"team-a\"\n\n[udp]\nenabled = true\n"
+		if !assert.NoError(ioutil.WriteFile(configFile, []byte(body), 0644)) {
+			return
+		}
+
+		cfg, err := ReadConfig(configFile)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.Equal(":2103", cfg.Tcp.Listen)
+
+		options, err := receiverOptions(cfg)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.Equal("team-a", options["tcp"]["tenant"])
+		assert.Nil(options["udp"]["tenant"])
+	})
+}
@@ -0,0 +1,469 @@
+package carbon
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+
+	"github.com/lomik/go-carbon/helper/hashing"
+	"github.com/lomik/go-carbon/helper/tlsconfig"
+	"github.com/lomik/go-carbon/persister"
+	"github.com/lomik/go-carbon/rebalance"
+)
+
+// whisperTool runs maintenance commands on whisper files with data-dir, compressed, sparse and flock settings of whisper config.
+// TLS options of carbonserver config are used for https connections to carbonserver of other nodes
+type whisperTool struct {
+	out        io.Writer
+	usage      string
+	dataDir    string
+	flock      bool
+	sparse     bool
+	compressed bool
+	tls        tlsconfig.TLSOptions
+}
+
+type whisperCommand struct {
+	usage       string
+	description string
+	run         func(t *whisperTool, flags *flag.FlagSet, args []string) error
+}
+
+var whisperCommands = map[string]*whisperCommand{
+	"info": {
+		usage:       "FILE",
+		description: "Print header and archives of whisper file",
+		run:         (*whisperTool).info,
+	},
+	"dump": {
+		usage:       "FILE",
+		description: "Print header and all points of every archive",
+		run:         (*whisperTool).dump,
+	},
+	"fetch": {
+		usage:       "[-from TIMESTAMP] [-until TIMESTAMP] FILE",
+		description: "Print points of time range (default last 24 hours)",
+		run:         (*whisperTool).fetch,
+	},
+	"resize": {
+		usage:       "[-aggregation-method METHOD] [-xfiles-factor XFF] FILE RETENTIONS",
+		description: "Rewrite file with new retentions, e.g. 1m:30d,1h:5y. Points are kept. Points written by running go-carbon during rewrite are lost, stop it or use resize-enabled",
+		run:         (*whisperTool).resize,
+	},
+	"set-aggregation": {
+		usage:       "FILE METHOD [XFF]",
+		description: "Change aggregation method and xFilesFactor. Compressed file is rewritten, like with resize",
+		run:         (*whisperTool).setAggregation,
+	},
+	"fill": {
+		usage:       "SRC DST",
+		description: "Copy points of SRC into empty intervals of DST",
+		run:         (*whisperTool).fill,
+	},
+	"merge": {
+		usage:       "SRC DST",
+		description: "Copy all points of SRC into DST, overwriting points of DST",
+		run:         (*whisperTool).merge,
+	},
+	"diff": {
+		usage:       "[-summary] FILE1 FILE2",
+		description: "Print points which differ in two files with same archives",
+		run:         (*whisperTool).diff,
+	},
+	"rebalance": {
+		usage:       "[-hashing carbon_ch|jump_fnv1a] [-replication-factor N] [-dry-run] [-max-files-per-second N] [-token TOKEN] [-timeout DURATION] [-scheme http|https] SELF NODE...",
+		description: "Move files of data-dir owned by other cluster nodes to their carbonserver. Nodes are host:port[:instance] of carbonserver, SELF is local node. Https uses tls options of carbonserver config. Local go-carbon should be stopped, tagged files are skipped",
+		run:         (*whisperTool).rebalance,
+	},
+}
+
+// WhisperCommandUsage writes list of whisper maintenance commands to out
+func WhisperCommandUsage(out io.Writer) {
+	names := make([]string, 0, len(whisperCommands))
+	for name := range whisperCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(out, "Whisper maintenance commands:\n")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s %s\n    \t%s\n", name, whisperCommands[name].usage, whisperCommands[name].description)
+	}
+}
+
+// WhisperCommand runs whisper maintenance command args[0] with arguments args[1:]. Output is written to out
+func WhisperCommand(cfg *Config, out io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("command is not specified")
+	}
+
+	cmd, ok := whisperCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %#v", args[0])
+	}
+
+	t := &whisperTool{
+		out:        out,
+		usage:      fmt.Sprintf("%s %s", args[0], cmd.usage),
+		dataDir:    cfg.Whisper.DataDir,
+		flock:      cfg.Whisper.FLock,
+		sparse:     cfg.Whisper.Sparse,
+		compressed: cfg.Whisper.Compressed,
+		tls:        cfg.Carbonserver.TLSOptions,
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	return cmd.run(t, flags, args[1:])
+}
+
+// parseArgs parses flags of command and checks number of positional arguments. Negative max - no limit
+func (t *whisperTool) parseArgs(flags *flag.FlagSet, args []string, min int, max int) ([]string, error) {
+	if err := flags.Parse(args); err != nil || flags.NArg() < min || (max >= 0 && flags.NArg() > max) {
+		return nil, fmt.Errorf("usage: %s", t.usage)
+	}
+	return flags.Args(), nil
+}
+
+func (t *whisperTool) open(path string) (*whisper.Whisper, error) {
+	return whisper.OpenWithOptions(path, &whisper.Options{FLock: t.flock})
+}
+
+func formatValue(value float64) string {
+	if math.IsNaN(value) {
+		return "None"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (t *whisperTool) printInfo(path string, w *whisper.Whisper) error {
+	method, err := persister.AggregationMethod(w)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	if st, err := os.Stat(path); err == nil {
+		size = st.Size()
+	}
+
+	fmt.Fprintf(t.out, "aggregationMethod: %s\n", method)
+	fmt.Fprintf(t.out, "maxRetention: %d\n", w.MaxRetention())
+	fmt.Fprintf(t.out, "xFilesFactor: %g\n", w.XFilesFactor())
+	fmt.Fprintf(t.out, "compressed: %t\n", w.IsCompressed())
+	fmt.Fprintf(t.out, "fileSize: %d\n", size)
+
+	for i, r := range w.Retentions() {
+		fmt.Fprintf(t.out, "\nArchive %d\n", i)
+		fmt.Fprintf(t.out, "retention: %s\n", r.String())
+		fmt.Fprintf(t.out, "secondsPerPoint: %d\n", r.SecondsPerPoint())
+		fmt.Fprintf(t.out, "points: %d\n", r.NumberOfPoints())
+	}
+	return nil
+}
+
+func (t *whisperTool) info(flags *flag.FlagSet, args []string) error {
+	args, err := t.parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	w, err := t.open(args[0])
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	return t.printInfo(args[0], w)
+}
+
+func (t *whisperTool) dump(flags *flag.FlagSet, args []string) error {
+	args, err := t.parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	w, err := t.open(args[0])
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err = t.printInfo(args[0], w); err != nil {
+		return err
+	}
+
+	now := int(time.Now().Unix())
+	for i := range w.Retentions() {
+		series, err := persister.FetchArchive(w, i, now)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(t.out, "\nArchive %d data:\n", i)
+		if series == nil {
+			continue
+		}
+		for _, p := range series.Points() {
+			if !math.IsNaN(p.Value) {
+				fmt.Fprintf(t.out, "%d: %s\n", p.Time, formatValue(p.Value))
+			}
+		}
+	}
+	return nil
+}
+
+func (t *whisperTool) fetch(flags *flag.FlagSet, args []string) error {
+	now := int(time.Now().Unix())
+	from := flags.Int("from", now-86400, "Unix timestamp of beginning of range")
+	until := flags.Int("until", now, "Unix timestamp of end of range")
+
+	args, err := t.parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	w, err := t.open(args[0])
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	series, err := w.Fetch(*from, *until)
+	if err != nil || series == nil {
+		return err
+	}
+
+	for _, p := range series.Points() {
+		fmt.Fprintf(t.out, "%d\t%s\n", p.Time, formatValue(p.Value))
+	}
+	return nil
+}
+
+func (t *whisperTool) resize(flags *flag.FlagSet, args []string) error {
+	methodStr := flags.String("aggregation-method", "", "New aggregation method (default - not changed)")
+	xFilesFactorStr := flags.String("xfiles-factor", "", "New xFilesFactor (default - not changed)")
+
+	args, err := t.parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	retentions, err := persister.ParseRetentionDefs(args[1])
+	if err != nil {
+		return err
+	}
+
+	w, err := t.open(args[0])
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	method, err := persister.AggregationMethod(w)
+	if err != nil {
+		return err
+	}
+	if *methodStr != "" {
+		if method, err = persister.ParseAggregationMethod(*methodStr); err != nil {
+			return err
+		}
+	}
+
+	xFilesFactor := w.XFilesFactor()
+	if *xFilesFactorStr != "" {
+		v, err := strconv.ParseFloat(*xFilesFactorStr, 32)
+		if err != nil {
+			return err
+		}
+		xFilesFactor = float32(v)
+	}
+
+	// compressed file is never converted to plain one
+	return persister.RewriteFile(w, args[0], retentions, method, xFilesFactor, &whisper.Options{
+		Sparse:     t.sparse,
+		FLock:      t.flock,
+		Compressed: t.compressed || w.IsCompressed(),
+	})
+}
+
+func (t *whisperTool) setAggregation(flags *flag.FlagSet, args []string) error {
+	args, err := t.parseArgs(flags, args, 2, 3)
+	if err != nil {
+		return err
+	}
+
+	method, err := persister.ParseAggregationMethod(args[1])
+	if err != nil {
+		return err
+	}
+
+	w, err := t.open(args[0])
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	xFilesFactor := w.XFilesFactor()
+	if len(args) > 2 {
+		v, err := strconv.ParseFloat(args[2], 32)
+		if err != nil {
+			return err
+		}
+		xFilesFactor = float32(v)
+	}
+
+	return persister.SetAggregation(w, args[0], method, xFilesFactor, t.flock)
+}
+
+func (t *whisperTool) copyPoints(flags *flag.FlagSet, args []string, copy func(src, dst *whisper.Whisper) (int, error)) error {
+	args, err := t.parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	src, err := t.open(args[0])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := t.open(args[1])
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	written, err := copy(src, dst)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(t.out, "%d points written to %s\n", written, args[1])
+	return nil
+}
+
+func (t *whisperTool) fill(flags *flag.FlagSet, args []string) error {
+	return t.copyPoints(flags, args, persister.FillFile)
+}
+
+func (t *whisperTool) merge(flags *flag.FlagSet, args []string) error {
+	return t.copyPoints(flags, args, persister.MergeFile)
+}
+
+func (t *whisperTool) diff(flags *flag.FlagSet, args []string) error {
+	summary := flags.Bool("summary", false, "Print only number of different points of every archive")
+
+	args, err := t.parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	w1, err := t.open(args[0])
+	if err != nil {
+		return err
+	}
+	defer w1.Close()
+
+	w2, err := t.open(args[1])
+	if err != nil {
+		return err
+	}
+	defer w2.Close()
+
+	diffs, err := persister.DiffFiles(w1, w2)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range diffs {
+		if !*summary {
+			for _, p := range d.Points {
+				fmt.Fprintf(t.out, "%d %d %s %s\n", d.Archive, p.Timestamp, formatValue(p.Value1), formatValue(p.Value2))
+			}
+		}
+		fmt.Fprintf(t.out, "Archive %d: %d of %d points differ\n", d.Archive, len(d.Points), d.Total)
+	}
+	return nil
+}
+
+func (t *whisperTool) rebalance(flags *flag.FlagSet, args []string) error {
+	hashingType := flags.String("hashing", hashing.CarbonCHType, "Hashing of cluster: carbon_ch or jump_fnv1a")
+	replicationFactor := flags.Int("replication-factor", 1, "Number of owners of every metric")
+	dryRun := flags.Bool("dry-run", false, "Print files to move without moving them")
+	maxFilesPerSecond := flags.Int("max-files-per-second", 100, "Limit of moved files per second (0 - no limit)")
+	token := flags.String("token", "", "Bearer token for carbonserver with authentication")
+	timeout := flags.Duration("timeout", time.Minute, "Timeout of sending of one file")
+	scheme := flags.String("scheme", "http", "Scheme of carbonserver of nodes: http or https")
+
+	args, err := t.parseArgs(flags, args, 2, -1)
+	if err != nil {
+		return err
+	}
+
+	if *scheme != "http" && *scheme != "https" {
+		return fmt.Errorf("unknown scheme %#v", *scheme)
+	}
+
+	self, err := hashing.ParseNodeAddress(args[0])
+	if err != nil {
+		return err
+	}
+
+	nodes := make([]hashing.NodeAddress, 0, len(args)-1)
+	for _, s := range args[1:] {
+		n, err := hashing.ParseNodeAddress(s)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, n)
+	}
+
+	cluster, err := hashing.NewCluster(*hashingType, *replicationFactor, self, nodes)
+	if err != nil {
+		return err
+	}
+
+	r := rebalance.New(t.dataDir, cluster)
+	r.SetDryRun(*dryRun)
+	r.SetMaxFilesPerSecond(*maxFilesPerSecond)
+	r.SetFLock(t.flock)
+	r.SetToken(*token)
+	r.SetTimeout(*timeout)
+	r.SetScheme(*scheme)
+
+	if *scheme == "https" {
+		tlsConfig, err := tlsconfig.New(t.tls)
+		if err != nil {
+			return err
+		}
+		if tlsConfig != nil {
+			r.SetTLS(tlsConfig.ClientConfig())
+		}
+	}
+
+	result, err := r.Run(t.out)
+	if err != nil {
+		return err
+	}
+
+	action := "moved"
+	if *dryRun {
+		action = "would be moved"
+	}
+	fmt.Fprintf(t.out, "%d files checked, %d %s, %d errors, %d tagged skipped\n", result.Checked, result.Moved, action, result.Failed, result.Skipped)
+
+	if result.Failed > 0 {
+		return fmt.Errorf("failed to move %d files", result.Failed)
+	}
+	return nil
+}
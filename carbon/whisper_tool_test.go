@@ -0,0 +1,65 @@
+package carbon
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	whisper "github.com/go-graphite/go-whisper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/persister"
+)
+
+func TestWhisperCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		path := filepath.Join(root, "metric.wsp")
+		retentions, _ := persister.ParseRetentionDefs("1m:1h")
+		w, err := whisper.Create(path, retentions, whisper.Average, 0.5)
+		if !assert.NoError(err) {
+			return
+		}
+		w.Close()
+
+		cfg := NewConfig()
+		cfg.Whisper.Compressed = true
+
+		run := func(args ...string) (string, error) {
+			out := new(bytes.Buffer)
+			err := WhisperCommand(cfg, out, args)
+			return out.String(), err
+		}
+
+		out, err := run("info", path)
+		assert.NoError(err)
+		assert.True(strings.Contains(out, "aggregationMethod: average\n"), out)
+		assert.True(strings.Contains(out, "retention: 1m:1h\n"), out)
+
+		_, err = run("set-aggregation", path, "max", "0")
+		assert.NoError(err)
+
+		_, err = run("resize", path, "1m:2h,10m:1d")
+		assert.NoError(err)
+
+		out, err = run("info", path)
+		assert.NoError(err)
+		assert.True(strings.Contains(out, "aggregationMethod: max\n"), out)
+		assert.True(strings.Contains(out, "xFilesFactor: 0\n"), out)
+		// new file honours compressed option of config
+		assert.True(strings.Contains(out, "compressed: true\n"), out)
+		assert.True(strings.Contains(out, "retention: 10m:1d\n"), out)
+
+		_, err = run("info")
+		assert.EqualError(err, "usage: info FILE")
+
+		_, err = run("resize", "-unknown", path, "1m:1h")
+		assert.Error(err)
+
+		_, err = run("whisper-info", path)
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,455 @@
+package carbonserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonzipper/zipper/httpHeaders"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/lomik/go-carbon/persister"
+	"github.com/lomik/go-carbon/points"
+)
+
+// antiEntropyBatchSize is number of metrics compared with peer in one request
+const antiEntropyBatchSize = 100
+
+var errAntiEntropyStopped = errors.New("anti-entropy stopped")
+
+// AntiEntropyOptions is settings of background comparison of whisper files with replica peer
+type AntiEntropyOptions struct {
+	// Peer is carbonserver address (host:port) of replica
+	Peer string
+	// Interval between checks of all metrics
+	Interval time.Duration
+	// Window is compared time range, ending Delay before start of check
+	Window time.Duration
+	Delay  time.Duration
+	// MaxMetricsPerSecond limits compared metrics per second. 0 - no limit
+	MaxMetricsPerSecond int
+	// Timeout of request to peer
+	Timeout time.Duration
+	// Token is bearer token for peer with authentication
+	Token string
+}
+
+// ChecksumRequest is body of /metrics/checksum/ request
+type ChecksumRequest struct {
+	From    int64    `json:"from"`
+	Until   int64    `json:"until"`
+	Metrics []string `json:"metrics"`
+}
+
+// ChecksumResponse is reply of /metrics/checksum/. Metrics without whisper file are absent
+type ChecksumResponse struct {
+	Checksums map[string]string `json:"checksums"`
+}
+
+// RepairPoint is one point of RepairSeries
+type RepairPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// RepairSeries is points missing in whisper file of metric
+type RepairSeries struct {
+	Metric string        `json:"metric"`
+	Points []RepairPoint `json:"points"`
+}
+
+// RepairRequest is body of /metrics/repair/ request
+type RepairRequest struct {
+	Series []RepairSeries `json:"series"`
+}
+
+// SetAntiEntropy enables background repair of points missing locally or on replica peer. Nil disables it
+func (listener *CarbonserverListener) SetAntiEntropy(options *AntiEntropyOptions) {
+	listener.antiEntropy = options
+}
+
+// SetRepairWriter sets receiver of repaired points, which should pass them to persister like received ones
+func (listener *CarbonserverListener) SetRepairWriter(write func(p *points.Points)) {
+	listener.repairWrite = write
+}
+
+// checksum returns FNV-1a hash of points of metric stored on disk in time range.
+// Points in cache are not included, so checksums of nodes with same files match
+func (listener *CarbonserverListener) checksum(metric string, from, until int32) (string, error) {
+	m, err := listener.fetchFromDisk(metric, from, until)
+	if err != nil {
+		return "", err
+	}
+	if m.Timeseries == nil {
+		return "", fmt.Errorf("time range not found")
+	}
+
+	h := fnv.New64a()
+	var b [8]byte
+	put := func(v uint64) {
+		binary.BigEndian.PutUint64(b[:], v)
+		h.Write(b[:])
+	}
+
+	put(uint64(m.Timeseries.FromTime()))
+	put(uint64(m.Timeseries.Step()))
+	for _, v := range m.Timeseries.Values() {
+		if math.IsNaN(v) {
+			// NaN values may have different bits
+			put(0x7FF8000000000001)
+			continue
+		}
+		put(math.Float64bits(v))
+	}
+
+	return fmt.Sprintf("%016x", h.Sum64()), nil
+}
+
+func (listener *CarbonserverListener) checksumHandler(wr http.ResponseWriter, req *http.Request) {
+	// URL: /metrics/checksum/
+	// Body: ChecksumRequest in json
+	t0 := time.Now()
+	ctx := req.Context()
+
+	atomic.AddUint64(&listener.metrics.ChecksumRequests, 1)
+
+	accessLogger := TraceContextToZap(ctx, listener.accessLogger.With(
+		zap.String("handler", "checksum"),
+		zap.String("url", req.URL.RequestURI()),
+		zap.String("peer", req.RemoteAddr),
+	))
+
+	fail := func(reason string, err error, code int) {
+		atomic.AddUint64(&listener.metrics.ChecksumErrors, 1)
+		accessLogger.Error("checksum failed",
+			zap.Duration("runtime_seconds", time.Since(t0)),
+			zap.String("reason", reason),
+			zap.Error(err),
+			zap.Int("http_code", code),
+		)
+		http.Error(wr, fmt.Sprintf("%s (%v)", reason, err), code)
+	}
+
+	if req.Method != http.MethodPost {
+		fail("Bad request", fmt.Errorf("method %s is not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request ChecksumRequest
+	body, err := listener.readBody(wr, req)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		fail("Bad request", err, http.StatusBadRequest)
+		return
+	}
+
+	filter := principalFromContext(ctx).accessFilter()
+	resp := ChecksumResponse{Checksums: make(map[string]string, len(request.Metrics))}
+	for _, metric := range request.Metrics {
+		if !validMergeTarget(metric) || !filter.Allowed(metric) {
+			continue
+		}
+		if _, err := os.Stat(listener.metricPath(metric)); err != nil {
+			continue
+		}
+
+		sum, err := listener.checksum(metric, int32(request.From), int32(request.Until))
+		if err != nil {
+			continue
+		}
+		resp.Checksums[metric] = sum
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		fail("Internal error while processing request", err, http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Write(data)
+
+	accessLogger.Info("checksum success",
+		zap.Duration("runtime_seconds", time.Since(t0)),
+		zap.Int("metrics", len(request.Metrics)),
+		zap.Int("found", len(resp.Checksums)),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
+
+func (listener *CarbonserverListener) repairHandler(wr http.ResponseWriter, req *http.Request) {
+	// URL: /metrics/repair/
+	// Body: RepairRequest in json
+	t0 := time.Now()
+	ctx := req.Context()
+
+	atomic.AddUint64(&listener.metrics.RepairRequests, 1)
+
+	accessLogger := TraceContextToZap(ctx, listener.accessLogger.With(
+		zap.String("handler", "repair"),
+		zap.String("url", req.URL.RequestURI()),
+		zap.String("peer", req.RemoteAddr),
+	))
+
+	fail := func(reason string, err error, code int) {
+		atomic.AddUint64(&listener.metrics.RepairErrors, 1)
+		accessLogger.Error("repair failed",
+			zap.Duration("runtime_seconds", time.Since(t0)),
+			zap.String("reason", reason),
+			zap.Error(err),
+			zap.Int("http_code", code),
+		)
+		http.Error(wr, fmt.Sprintf("%s (%v)", reason, err), code)
+	}
+
+	if req.Method != http.MethodPost {
+		fail("Bad request", fmt.Errorf("method %s is not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if listener.repairWrite == nil {
+		fail("Not implemented", fmt.Errorf("repair is not enabled"), http.StatusNotImplemented)
+		return
+	}
+
+	var request RepairRequest
+	body, err := listener.readBody(wr, req)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		fail("Bad request", err, http.StatusBadRequest)
+		return
+	}
+
+	filter := principalFromContext(ctx).accessFilter()
+	for _, s := range request.Series {
+		if !validMergeTarget(s.Metric) {
+			fail("Bad request", fmt.Errorf("invalid metric %#v", s.Metric), http.StatusBadRequest)
+			return
+		}
+		if !filter.Allowed(s.Metric) {
+			fail("Forbidden", fmt.Errorf("no access to %s", s.Metric), http.StatusForbidden)
+			return
+		}
+	}
+
+	written := 0
+	for _, s := range request.Series {
+		p := points.New()
+		p.Metric = s.Metric
+		for _, rp := range s.Points {
+			p.Add(rp.Value, rp.Timestamp)
+		}
+		if len(p.Data) > 0 {
+			listener.repairWrite(p)
+			written += len(p.Data)
+		}
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Write([]byte("{}"))
+
+	accessLogger.Info("repair success",
+		zap.Duration("runtime_seconds", time.Since(t0)),
+		zap.Int("series", len(request.Series)),
+		zap.Int("points", written),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
+
+// antiEntropyWorker compares all local metrics with peer every interval
+func (listener *CarbonserverListener) antiEntropyWorker(exit <-chan struct{}) {
+	for {
+		listener.antiEntropyRun(exit)
+
+		select {
+		case <-time.After(listener.antiEntropy.Interval):
+		case <-exit:
+			return
+		}
+	}
+}
+
+// antiEntropyRun compares window of all local metrics with peer in batches
+func (listener *CarbonserverListener) antiEntropyRun(exit <-chan struct{}) {
+	options := listener.antiEntropy
+	client := listener.newPeerClient(options.Timeout)
+
+	until := time.Now().Add(-options.Delay).Unix()
+	from := until - int64(options.Window.Seconds())
+
+	throttle := persister.NewThrottleTicker(options.MaxMetricsPerSecond)
+	defer throttle.Stop()
+
+	batch := make([]string, 0, antiEntropyBatchSize)
+	err := persister.WalkMetrics(listener.whisperData, nil, nil, func(metric string, path string) error {
+		select {
+		case <-throttle.C:
+		case <-exit:
+			return errAntiEntropyStopped
+		}
+
+		batch = append(batch, metric)
+		if len(batch) == antiEntropyBatchSize {
+			listener.antiEntropyBatch(client, from, until, batch)
+			batch = batch[:0]
+		}
+		return nil
+	})
+	if err == errAntiEntropyStopped {
+		return
+	}
+	if len(batch) > 0 {
+		listener.antiEntropyBatch(client, from, until, batch)
+	}
+
+	atomic.AddUint64(&listener.metrics.AntiEntropyRuns, 1)
+}
+
+// antiEntropyBatch compares checksums of metrics with peer. Points of mismatched metrics missing on peer are
+// sent to it, points missing locally are written to cache
+func (listener *CarbonserverListener) antiEntropyBatch(client *http.Client, from, until int64, metrics []string) {
+	options := listener.antiEntropy
+	logger := listener.logger.With(zap.String("peer", options.Peer))
+
+	var authorization string
+	if options.Token != "" {
+		authorization = "Bearer " + options.Token
+	}
+
+	fail := func(msg string, err error) {
+		atomic.AddUint64(&listener.metrics.AntiEntropyErrors, 1)
+		logger.Error(msg, zap.Error(err))
+	}
+
+	atomic.AddUint64(&listener.metrics.AntiEntropyChecked, uint64(len(metrics)))
+
+	body, _ := json.Marshal(&ChecksumRequest{From: from, Until: until, Metrics: metrics})
+	data, err := peerPost(client, listener.peerURL(options.Peer, "/metrics/checksum/"), "application/json", authorization, body)
+	if err != nil {
+		fail("anti-entropy checksum request failed", err)
+		return
+	}
+	var remote ChecksumResponse
+	if err = json.Unmarshal(data, &remote); err != nil {
+		fail("bad anti-entropy checksum response", err)
+		return
+	}
+
+	var mismatched []string
+	for _, metric := range metrics {
+		local, err := listener.checksum(metric, int32(from), int32(until))
+		if err != nil {
+			fail("anti-entropy checksum failed", err)
+			continue
+		}
+		if remote.Checksums[metric] != local {
+			mismatched = append(mismatched, metric)
+		}
+	}
+	if len(mismatched) == 0 {
+		return
+	}
+	atomic.AddUint64(&listener.metrics.AntiEntropyMismatched, uint64(len(mismatched)))
+
+	// points of peer, including its cache
+	fetch := protov3.MultiFetchRequest{}
+	for _, metric := range mismatched {
+		fetch.Metrics = append(fetch.Metrics, protov3.FetchRequest{Name: metric, StartTime: from, StopTime: until})
+	}
+	body, _ = fetch.Marshal()
+	data, err = peerPost(client, listener.peerURL(options.Peer, "/render/?format=carbonapi_v3_pb"),
+		httpHeaders.ContentTypeCarbonAPIv3PB, authorization, body)
+	if err != nil {
+		fail("anti-entropy render request failed", err)
+		return
+	}
+	var fetched protov3.MultiFetchResponse
+	if err = fetched.Unmarshal(data); err != nil {
+		fail("bad anti-entropy render response", err)
+		return
+	}
+	peerSeries := make(map[string]*protov3.FetchResponse, len(fetched.Metrics))
+	for i := range fetched.Metrics {
+		peerSeries[fetched.Metrics[i].Name] = &fetched.Metrics[i]
+	}
+
+	var push RepairRequest
+	for _, metric := range mismatched {
+		local, err := listener.fetchSingleMetric(metric, "", int32(from), int32(until))
+		if err != nil {
+			fail("anti-entropy fetch failed", err)
+			continue
+		}
+
+		missingLocal, missingPeer, ok := diffSeries(local.proto3(), peerSeries[metric])
+		if !ok {
+			logger.Warn("anti-entropy skipped metric with different retentions on peer", zap.String("metric", metric))
+			continue
+		}
+
+		if len(missingLocal) > 0 && listener.repairWrite != nil {
+			p := points.New()
+			p.Metric = metric
+			for _, rp := range missingLocal {
+				p.Add(rp.Value, rp.Timestamp)
+			}
+			listener.repairWrite(p)
+			atomic.AddUint64(&listener.metrics.AntiEntropyRepairedPoints, uint64(len(missingLocal)))
+		}
+
+		if len(missingPeer) > 0 {
+			push.Series = append(push.Series, RepairSeries{Metric: metric, Points: missingPeer})
+		}
+	}
+
+	if len(push.Series) == 0 {
+		return
+	}
+
+	body, _ = json.Marshal(&push)
+	if _, err = peerPost(client, listener.peerURL(options.Peer, "/metrics/repair/"), "application/json", authorization, body); err != nil {
+		fail("anti-entropy repair request failed", err)
+		return
+	}
+	for _, s := range push.Series {
+		atomic.AddUint64(&listener.metrics.AntiEntropyPushedPoints, uint64(len(s.Points)))
+	}
+}
+
+// diffSeries returns points present only in local or only in peer series. Peer series is nil if peer has no
+// file of metric. Not ok if series have different time range or step
+func diffSeries(local *protov3.FetchResponse, peer *protov3.FetchResponse) (missingLocal []RepairPoint, missingPeer []RepairPoint, ok bool) {
+	if peer != nil && (peer.StartTime != local.StartTime || peer.StepTime != local.StepTime || len(peer.Values) != len(local.Values)) {
+		return nil, nil, false
+	}
+
+	for i, v := range local.Values {
+		ts := local.StartTime + int64(i)*local.StepTime
+		p := math.NaN()
+		if peer != nil {
+			p = peer.Values[i]
+		}
+
+		switch {
+		case math.IsNaN(v) && !math.IsNaN(p):
+			missingLocal = append(missingLocal, RepairPoint{Timestamp: ts, Value: p})
+		case !math.IsNaN(v) && math.IsNaN(p):
+			missingPeer = append(missingPeer, RepairPoint{Timestamp: ts, Value: v})
+		}
+	}
+
+	return missingLocal, missingPeer, true
+}
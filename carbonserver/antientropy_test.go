@@ -0,0 +1,108 @@
+package carbonserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestAntiEntropy(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		retentions, _ := whisper.ParseRetentionDefs("1m:1h")
+		now := int(time.Now().Unix())
+		now -= now % 60
+
+		create := func(dataDir string, metric string, values map[int]float64) {
+			path := filepath.Join(dataDir, strings.Replace(metric, ".", "/", -1)+".wsp")
+			assert.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+			w, err := whisper.Create(path, retentions, whisper.Average, 0)
+			if !assert.NoError(err) {
+				t.FailNow()
+			}
+			for ts, v := range values {
+				assert.NoError(w.Update(v, ts))
+			}
+			w.Close()
+		}
+
+		// written points by metric and timestamp
+		type written map[string]map[int64]float64
+		var mu sync.Mutex
+		newListener := func(dataDir string, w written) *CarbonserverListener {
+			listener := NewCarbonserverListener(func(string) []points.Point { return nil })
+			listener.SetWhisperData(dataDir)
+			listener.SetRepairWriter(func(p *points.Points) {
+				mu.Lock()
+				defer mu.Unlock()
+				if w[p.Metric] == nil {
+					w[p.Metric] = make(map[int64]float64)
+				}
+				for _, d := range p.Data {
+					w[p.Metric][d.Timestamp] = d.Value
+				}
+			})
+			return listener
+		}
+
+		selfDir := filepath.Join(root, "self")
+		peerDir := filepath.Join(root, "peer")
+		create(selfDir, "a.same", map[int]float64{now - 120: 1})
+		create(peerDir, "a.same", map[int]float64{now - 120: 1})
+		create(selfDir, "a.diverged", map[int]float64{now - 180: 1, now - 120: 2})
+		create(peerDir, "a.diverged", map[int]float64{now - 120: 2, now - 60: 3})
+		create(selfDir, "a.local", map[int]float64{now - 60: 4})
+
+		peerWritten := make(written)
+		peer := newListener(peerDir, peerWritten)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics/checksum/", peer.checksumHandler)
+		mux.HandleFunc("/metrics/repair/", peer.repairHandler)
+		mux.HandleFunc("/render/", peer.renderHandler)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		selfWritten := make(written)
+		listener := newListener(selfDir, selfWritten)
+		listener.SetAntiEntropy(&AntiEntropyOptions{
+			Peer:     strings.TrimPrefix(server.URL, "http://"),
+			Interval: time.Hour,
+			Window:   30 * time.Minute,
+			Timeout:  time.Second,
+		})
+
+		listener.antiEntropyRun(make(chan struct{}))
+
+		assert.Equal(written{"a.diverged": {int64(now - 60): 3}}, selfWritten)
+		assert.Equal(written{
+			"a.diverged": {int64(now - 180): 1},
+			"a.local":    {int64(now - 60): 4},
+		}, peerWritten)
+
+		assert.Equal(uint64(1), listener.metrics.AntiEntropyRuns)
+		assert.Equal(uint64(3), listener.metrics.AntiEntropyChecked)
+		assert.Equal(uint64(2), listener.metrics.AntiEntropyMismatched)
+		assert.Equal(uint64(1), listener.metrics.AntiEntropyRepairedPoints)
+		assert.Equal(uint64(2), listener.metrics.AntiEntropyPushedPoints)
+		assert.Equal(uint64(0), listener.metrics.AntiEntropyErrors)
+
+		// body over limit is rejected
+		peer.SetMaxBodySize(10)
+		rr := httptest.NewRecorder()
+		peer.repairHandler(rr, httptest.NewRequest("POST", "/metrics/repair/",
+			strings.NewReader(`{"series": [{"metric": "a.local", "points": [{"timestamp": 1, "value": 1}]}]}`)))
+		assert.Equal(http.StatusBadRequest, rr.Code)
+	})
+}
@@ -0,0 +1,352 @@
+package carbonserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+	tindex "github.com/lomik/go-carbon/tags/index"
+)
+
+// Principal is authenticated client of carbonserver. Principal has access to metrics with one of
+// Prefixes or to tagged metrics matched by all TagFilters
+type Principal struct {
+	Name       string
+	Tokens     []string // bearer tokens
+	Users      []string // users of htpasswd file
+	CertNames  []string // common names of verified TLS client certificates
+	Prefixes   []string
+	TagFilters []string
+}
+
+// splitList splits value by separator and skips empty items
+func splitList(value string, sep string) []string {
+	var result []string
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// ReadPrincipals reads auth file in storage-schemas.conf like format. Lists are comma separated,
+// tag-filters are separated by semicolon
+func ReadPrincipals(filename string) ([]*Principal, error) {
+	config, err := helper.ParseIniFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	principals := make([]*Principal, 0, len(config))
+
+	for _, section := range config {
+		p := &Principal{
+			Name:       section["name"],
+			Tokens:     splitList(section["tokens"], ","),
+			Users:      splitList(section["users"], ","),
+			CertNames:  splitList(section["cert-names"], ","),
+			Prefixes:   splitList(section["prefixes"], ","),
+			TagFilters: splitList(section["tag-filters"], ";"),
+		}
+
+		if len(p.Tokens) == 0 && len(p.Users) == 0 && len(p.CertNames) == 0 {
+			return nil, fmt.Errorf("one of tokens, users or cert-names should be set for [%s]", p.Name)
+		}
+
+		if len(p.Prefixes) == 0 && len(p.TagFilters) == 0 {
+			return nil, fmt.Errorf("one of prefixes or tag-filters should be set for [%s]", p.Name)
+		}
+
+		for i := range p.Prefixes {
+			if p.Prefixes[i] == "*" {
+				p.Prefixes[i] = ""
+			}
+		}
+
+		if _, err := tindex.NewFilter(p.Prefixes, p.TagFilters); err != nil {
+			return nil, fmt.Errorf("failed to parse tag-filters for [%s]: %s", p.Name, err.Error())
+		}
+
+		principals = append(principals, p)
+	}
+
+	return principals, nil
+}
+
+// ReadHtpasswd reads user:hash lines of htpasswd file. Only {SHA} and $apr1$ (MD5) hashes are supported
+func ReadHtpasswd(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("line %d: user:hash not found", n)
+		}
+
+		if !strings.HasPrefix(kv[1], "{SHA}") && !strings.HasPrefix(kv[1], "$apr1$") {
+			return nil, fmt.Errorf("line %d: unsupported hash of user %#v, only {SHA} and $apr1$ are supported", n, kv[0])
+		}
+
+		users[kv[0]] = kv[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// checkHtpasswd compares password with hash from htpasswd file
+func checkHtpasswd(hash string, password string) bool {
+	var expected string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		expected = apr1(password, salt)
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+}
+
+// apr1 is Apache variant of MD5 crypt
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 == 1 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 == 1 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(magic + salt + "$")
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			buf.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	to64(uint(final[11]), 2)
+
+	return buf.String()
+}
+
+// accessName converts metric path from file index to name checked by access filter.
+// Tagged metric is checked by file name without _tagged.xxx.yyy directories
+func accessName(path string) string {
+	i := strings.IndexByte(path, ';')
+	if i < 0 {
+		return path
+	}
+	return strings.Replace(path[strings.LastIndexByte(path[:i], '.')+1:], "_DOT_", ".", -1)
+}
+
+// principal is Principal prepared for request checks
+type principal struct {
+	name   string
+	filter *tindex.Filter
+}
+
+type tokenPrincipal struct {
+	token     []byte
+	principal *principal
+}
+
+// authenticator finds principal of request by client certificate, bearer token or basic auth
+type authenticator struct {
+	tokens    []tokenPrincipal
+	users     map[string]*principal
+	certNames map[string]*principal
+	htpasswd  map[string]string
+}
+
+func newAuthenticator(principals []*Principal, htpasswd map[string]string) (*authenticator, error) {
+	a := &authenticator{
+		users:     make(map[string]*principal),
+		certNames: make(map[string]*principal),
+		htpasswd:  htpasswd,
+	}
+
+	for _, p := range principals {
+		filter, err := tindex.NewFilter(p.Prefixes, p.TagFilters)
+		if err != nil {
+			return nil, err
+		}
+
+		pr := &principal{name: p.Name, filter: filter}
+		for _, token := range p.Tokens {
+			a.tokens = append(a.tokens, tokenPrincipal{token: []byte(token), principal: pr})
+		}
+		for _, user := range p.Users {
+			if _, exists := htpasswd[user]; !exists {
+				return nil, fmt.Errorf("user %#v of [%s] not found in htpasswd file", user, p.Name)
+			}
+			a.users[user] = pr
+		}
+		for _, name := range p.CertNames {
+			a.certNames[name] = pr
+		}
+	}
+
+	return a, nil
+}
+
+// authenticate returns nil if request has no valid credentials
+func (a *authenticator) authenticate(req *http.Request) *principal {
+	// verified chains are set only if client certificate was checked against tls-ca
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		if p, ok := a.certNames[req.TLS.VerifiedChains[0][0].Subject.CommonName]; ok {
+			return p
+		}
+	}
+
+	header := req.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := []byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		var found *principal
+		for _, tp := range a.tokens {
+			if subtle.ConstantTimeCompare(tp.token, token) == 1 {
+				found = tp.principal
+			}
+		}
+		return found
+	}
+
+	if user, password, ok := req.BasicAuth(); ok {
+		p, known := a.users[user]
+		if known && checkHtpasswd(a.htpasswd[user], password) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+type principalContextKey struct{}
+
+// principalFromContext returns nil if auth is disabled
+func principalFromContext(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalContextKey{}).(*principal)
+	return p
+}
+
+// accessFilter returns nil filter, which allows all metrics, if auth is disabled
+func (p *principal) accessFilter() *tindex.Filter {
+	if p == nil {
+		return nil
+	}
+	return p.filter
+}
+
+// cacheKey separates query cache items of different principals
+func (p *principal) cacheKey() string {
+	if p == nil {
+		return ""
+	}
+	return "&principal=" + p.name
+}
+
+// authHandler rejects requests without valid credentials. Principal of request is stored in context
+func (listener *CarbonserverListener) authHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		auth := listener.auth
+		if auth == nil {
+			h(wr, req)
+			return
+		}
+
+		p := auth.authenticate(req)
+		if p == nil {
+			atomic.AddUint64(&listener.metrics.AuthFailures, 1)
+			listener.accessLogger.Error("authentication failed",
+				zap.String("url", req.URL.RequestURI()),
+				zap.String("peer", req.RemoteAddr),
+				zap.Int("http_code", http.StatusUnauthorized),
+			)
+			wr.Header().Set("WWW-Authenticate", `Basic realm="carbonserver"`)
+			http.Error(wr, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h(wr, req.WithContext(context.WithValue(req.Context(), principalContextKey{}, p)))
+	}
+}
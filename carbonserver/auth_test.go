@@ -0,0 +1,174 @@
+package carbonserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-graphite/go-whisper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/tags"
+	tindex "github.com/lomik/go-carbon/tags/index"
+)
+
+func TestCheckHtpasswd(t *testing.T) {
+	assert := assert.New(t)
+
+	// hashes generated by openssl passwd -apr1 and htpasswd -s
+	assert.True(checkHtpasswd("$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "secret"))
+	assert.True(checkHtpasswd("$apr1$Z7$y0tMMOJDgDTJSxCkuEn7w1", "a-longer-password-over-16-bytes"))
+	assert.True(checkHtpasswd("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret"))
+
+	assert.False(checkHtpasswd("$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "wrong"))
+	assert.False(checkHtpasswd("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "wrong"))
+	assert.False(checkHtpasswd("secret", "secret"))
+}
+
+func TestReadPrincipals(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		filename := filepath.Join(root, "auth.conf")
+
+		assert.NoError(ioutil.WriteFile(filename, []byte(`
+[admin]
+users = admin
+prefixes = *
+
+[team-a]
+tokens = token1, token2
+cert-names = team-a.example.com
+prefixes = team_a., common.
+tag-filters = team=a; dc=~^ams
+`), 0644))
+
+		principals, err := ReadPrincipals(filename)
+		assert.NoError(err)
+		assert.Equal([]*Principal{
+			{Name: "admin", Users: []string{"admin"}, Prefixes: []string{""}},
+			{
+				Name:       "team-a",
+				Tokens:     []string{"token1", "token2"},
+				CertNames:  []string{"team-a.example.com"},
+				Prefixes:   []string{"team_a.", "common."},
+				TagFilters: []string{"team=a", "dc=~^ams"},
+			},
+		}, principals)
+
+		for _, body := range []string{
+			"[empty]\nprefixes = *\n",
+			"[no-access]\ntokens = token\n",
+			"[bad-filter]\ntokens = token\ntag-filters = team\n",
+		} {
+			assert.NoError(ioutil.WriteFile(filename, []byte(body), 0644))
+			_, err = ReadPrincipals(filename)
+			assert.Error(err, body)
+		}
+
+		htpasswd := filepath.Join(root, "htpasswd")
+		assert.NoError(ioutil.WriteFile(htpasswd, []byte("admin:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0644))
+		users, err := ReadHtpasswd(htpasswd)
+		assert.NoError(err)
+		assert.Equal(map[string]string{"admin": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}, users)
+
+		assert.NoError(ioutil.WriteFile(htpasswd, []byte("admin:$2y$05$bcrypthash\n"), 0644))
+		_, err = ReadHtpasswd(htpasswd)
+		assert.Error(err)
+	})
+}
+
+func TestAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		retentions, err := whisper.ParseRetentionDefs("1m:1h")
+		assert.NoError(err)
+
+		for _, metric := range []string{"team_a.cpu", "team_b.cpu", "cpu;team=a", "cpu;team=b"} {
+			filename := filepath.Join(root, strings.Replace(metric, ".", "/", -1)) + ".wsp"
+			if strings.IndexByte(metric, ';') >= 0 {
+				filename = tags.FilePath(root, metric, false) + ".wsp"
+			}
+			assert.NoError(os.MkdirAll(filepath.Dir(filename), 0755))
+
+			wsp, err := whisper.Create(filename, retentions, whisper.Last, 0.0)
+			assert.NoError(err)
+			wsp.Close()
+		}
+
+		listener := NewCarbonserverListener(nil)
+		listener.SetWhisperData(root)
+		listener.updateFileList(root)
+
+		assert.Error(listener.SetAuth([]*Principal{{Name: "unknown", Users: []string{"unknown"}, Prefixes: []string{""}}}, nil))
+
+		assert.NoError(listener.SetAuth([]*Principal{
+			{Name: "admin", Users: []string{"admin"}, Prefixes: []string{""}},
+			{Name: "team-a", Tokens: []string{"token-a"}, Prefixes: []string{"team_a."}, TagFilters: []string{"team=a"}},
+		}, map[string]string{"admin": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}))
+
+		list := func(setAuth func(*http.Request)) (int, []string) {
+			req := httptest.NewRequest("GET", "/metrics/list/?format=json", nil)
+			setAuth(req)
+			rr := httptest.NewRecorder()
+			listener.authHandler(listener.listHandler)(rr, req)
+			if rr.Code != http.StatusOK {
+				return rr.Code, nil
+			}
+
+			var resp struct{ Metrics []string }
+			assert.NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+			sort.Strings(resp.Metrics)
+			return rr.Code, resp.Metrics
+		}
+
+		code, _ := list(func(req *http.Request) {})
+		assert.Equal(http.StatusUnauthorized, code)
+
+		code, _ = list(func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") })
+		assert.Equal(http.StatusUnauthorized, code)
+
+		code, _ = list(func(req *http.Request) { req.SetBasicAuth("admin", "wrong") })
+		assert.Equal(http.StatusUnauthorized, code)
+
+		code, metrics := list(func(req *http.Request) { req.Header.Set("Authorization", "Bearer token-a") })
+		assert.Equal(http.StatusOK, code)
+		if assert.Equal(2, len(metrics), "%v", metrics) {
+			assert.Equal("team_a.cpu", metrics[1])
+			assert.Equal("cpu;team=a", accessName(metrics[0]))
+		}
+
+		code, metrics = list(func(req *http.Request) { req.SetBasicAuth("admin", "secret") })
+		assert.Equal(http.StatusOK, code)
+		assert.Equal(4, len(metrics), "%v", metrics)
+
+		assert.Equal(uint64(3), listener.metrics.AuthFailures)
+
+		// find shows directories on the way to allowed prefixes only
+		filter := listener.auth.tokens[0].principal.filter
+		files, leafs, err := listener.expandGlobs("*", filter)
+		assert.NoError(err)
+		assert.Equal([]string{"team_a"}, files)
+		assert.Equal([]bool{false}, leafs)
+
+		files, _, err = listener.expandGlobs("team_*.cpu", filter)
+		assert.NoError(err)
+		assert.Equal([]string{"team_a.cpu"}, files)
+
+		// tagged metrics in tag index
+		listener.tagsIdx.Insert("cpu;team=a", "team", "a", "cpu", "cpu;team=a")
+		listener.tagsIdx.Insert("cpu;team=b", "team", "b", "cpu", "cpu;team=b")
+		metricsList := listener.tagsIdx.ListMetrics(nil, []*tindex.TagValueExpr{{Tag: "team", Value: "", Op: tindex.OpNotEq}}, 0, filter)
+		if assert.Equal(1, len(metricsList)) {
+			assert.Equal("cpu;team=a", metricsList[0].Path)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package carbonserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/persister"
+	"github.com/lomik/go-carbon/points"
+)
+
+// BackfillRequest is body of /metrics/backfill/ request
+type BackfillRequest struct {
+	Series []RepairSeries `json:"series"`
+}
+
+// BackfillResponse is reply of /metrics/backfill/ with result of every series of request
+type BackfillResponse struct {
+	Results []*persister.BackfillResult `json:"results"`
+}
+
+// SetBackfill enables /metrics/backfill/ endpoint. Points of every series are written directly to whisper file with fn
+func (listener *CarbonserverListener) SetBackfill(fn func(*points.Points) *persister.BackfillResult) {
+	listener.backfill = fn
+}
+
+func (listener *CarbonserverListener) backfillHandler(wr http.ResponseWriter, req *http.Request) {
+	// URL: /metrics/backfill/
+	// Body: BackfillRequest in json
+	t0 := time.Now()
+	ctx := req.Context()
+
+	atomic.AddUint64(&listener.metrics.BackfillRequests, 1)
+
+	accessLogger := TraceContextToZap(ctx, listener.accessLogger.With(
+		zap.String("handler", "backfill"),
+		zap.String("url", req.URL.RequestURI()),
+		zap.String("peer", req.RemoteAddr),
+	))
+
+	fail := func(reason string, err error, code int) {
+		atomic.AddUint64(&listener.metrics.BackfillErrors, 1)
+		accessLogger.Error("backfill failed",
+			zap.Duration("runtime_seconds", time.Since(t0)),
+			zap.String("reason", reason),
+			zap.Error(err),
+			zap.Int("http_code", code),
+		)
+		http.Error(wr, fmt.Sprintf("%s (%v)", reason, err), code)
+	}
+
+	if req.Method != http.MethodPost {
+		fail("Bad request", fmt.Errorf("method %s is not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if listener.backfill == nil {
+		fail("Not implemented", fmt.Errorf("backfill is not enabled"), http.StatusNotImplemented)
+		return
+	}
+
+	var request BackfillRequest
+	body, err := listener.readBody(wr, req)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		fail("Bad request", err, http.StatusBadRequest)
+		return
+	}
+
+	filter := principalFromContext(ctx).accessFilter()
+	for _, s := range request.Series {
+		if !filter.Allowed(s.Metric) {
+			fail("Forbidden", fmt.Errorf("no access to %s", s.Metric), http.StatusForbidden)
+			return
+		}
+	}
+
+	response := BackfillResponse{Results: make([]*persister.BackfillResult, 0, len(request.Series))}
+	written, rejected := 0, 0
+	for _, s := range request.Series {
+		p := points.New()
+		p.Metric = s.Metric
+		for _, rp := range s.Points {
+			p.Add(rp.Value, rp.Timestamp)
+		}
+
+		r := listener.backfill(p)
+		written += r.Written
+		rejected += r.Rejected
+		response.Results = append(response.Results, r)
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		fail("Internal error", err, http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Write(data)
+
+	accessLogger.Info("backfill success",
+		zap.Duration("runtime_seconds", time.Since(t0)),
+		zap.Int("series", len(request.Series)),
+		zap.Int("points", written),
+		zap.Int("rejected", rejected),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
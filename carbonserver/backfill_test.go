@@ -0,0 +1,72 @@
+package carbonserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/persister"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestBackfillHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	listener := NewCarbonserverListener(func(string) []points.Point { return nil })
+
+	backfill := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		listener.backfillHandler(rr, httptest.NewRequest("POST", "/metrics/backfill/", strings.NewReader(body)))
+		return rr
+	}
+
+	body := `{"series": [
+		{"metric": "a.b", "points": [{"timestamp": 1500000000, "value": 1}, {"timestamp": 60, "value": 2}]},
+		{"metric": "a..c", "points": [{"timestamp": 1500000000, "value": 3}]}
+	]}`
+
+	assert.Equal(http.StatusNotImplemented, backfill(body).Code)
+
+	var received []*points.Points
+	listener.SetBackfill(func(p *points.Points) *persister.BackfillResult {
+		received = append(received, p)
+		if p.Metric == "a..c" {
+			return &persister.BackfillResult{Metric: p.Metric, Error: "invalid metric name"}
+		}
+		return &persister.BackfillResult{Metric: p.Metric, Written: 1, Rejected: 1}
+	})
+
+	rr := backfill(body)
+	if !assert.Equal(http.StatusOK, rr.Code) {
+		return
+	}
+
+	var resp BackfillResponse
+	assert.NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(BackfillResponse{Results: []*persister.BackfillResult{
+		{Metric: "a.b", Written: 1, Rejected: 1},
+		{Metric: "a..c", Error: "invalid metric name"},
+	}}, resp)
+
+	if assert.Equal(2, len(received)) {
+		assert.Equal(points.OnePoint("a.b", 1, 1500000000).Add(2, 60), received[0])
+	}
+
+	assert.Equal(http.StatusBadRequest, backfill("{").Code)
+
+	// body over max-body-size
+	listener.SetMaxBodySize(10)
+	assert.Equal(http.StatusBadRequest, backfill(body).Code)
+	assert.Equal(2, len(received))
+
+	rr = httptest.NewRecorder()
+	listener.backfillHandler(rr, httptest.NewRequest("GET", "/metrics/backfill/", nil))
+	assert.Equal(http.StatusMethodNotAllowed, rr.Code)
+
+	assert.Equal(uint64(5), listener.metrics.BackfillRequests)
+	assert.Equal(uint64(4), listener.metrics.BackfillErrors)
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
@@ -43,8 +44,12 @@ import (
 	"github.com/dgryski/go-trigram"
 	"github.com/dgryski/httputil"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/lomik/go-carbon/cache"
 	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/helper/hashing"
 	"github.com/lomik/go-carbon/helper/stat"
+	"github.com/lomik/go-carbon/helper/tlsconfig"
+	"github.com/lomik/go-carbon/persister"
 	"github.com/lomik/go-carbon/points"
 	tindex "github.com/lomik/go-carbon/tags/index"
 	"github.com/lomik/zapwriter"
@@ -97,6 +102,37 @@ type metricStruct struct {
 	// Tag update/add requests
 	TagMultiSeries       uint64
 	TagMultiSeriesErrors uint64
+
+	// Prometheus remote read requests
+	RemoteReadRequests uint64
+	RemoteReadErrors   uint64
+
+	// Whisper files merged by /metrics/merge/
+	MergeRequests uint64
+	MergeErrors   uint64
+
+	// Requests to other nodes of cluster
+	ClusterRequests uint64
+	ClusterErrors   uint64
+
+	// Anti-entropy endpoints and comparison with replica peer
+	ChecksumRequests          uint64
+	ChecksumErrors            uint64
+	RepairRequests            uint64
+	RepairErrors              uint64
+	AntiEntropyRuns           uint64
+	AntiEntropyChecked        uint64
+	AntiEntropyMismatched     uint64
+	AntiEntropyRepairedPoints uint64
+	AntiEntropyPushedPoints   uint64
+	AntiEntropyErrors         uint64
+
+	// Writes of historic points directly to whisper files
+	BackfillRequests uint64
+	BackfillErrors   uint64
+
+	// Requests without valid credentials
+	AuthFailures uint64
 }
 
 type requestsTimes struct {
@@ -133,6 +169,12 @@ var statusCodes = map[string][]uint64{
 	"tagsList": make([]uint64, 5),
 	"tagsStat": make([]uint64, 5),
 	"seriesByTag": make([]uint64, 5),
+	"quotas": make([]uint64, 5),
+	"remoteRead": make([]uint64, 5),
+	"merge": make([]uint64, 5),
+	"checksum": make([]uint64, 5),
+	"repair": make([]uint64, 5),
+	"backfill": make([]uint64, 5),
 }
 
 type responseWriterWithStatus struct {
@@ -253,6 +295,17 @@ type CarbonserverListener struct {
 	forceScanChan     chan struct{}
 	metricsAsCounters bool
 	tcpListener       *net.TCPListener
+	tls               *tlsconfig.Config
+	auth              *authenticator
+	cluster           *hashing.Cluster
+	clusterClient     *http.Client
+	peerScheme        string
+	maxBodySize       int64
+	antiEntropy       *AntiEntropyOptions
+	repairWrite       func(p *points.Points)
+	backfill          func(p *points.Points) *persister.BackfillResult
+	mergeLock         func(metric string) func()
+	mergeMaxSize      int64
 	logger            *zap.Logger
 	accessLogger      *zap.Logger
 	internalStatsDir  string
@@ -277,13 +330,16 @@ type CarbonserverListener struct {
 
 	tagsIdx *tindex.TagIndex
 
+	quotaState func() []cache.QuotaState
+
 	prometheus prometheus
 
 	db *leveldb.DB
 }
 
 type prometheus struct {
-	enabled bool
+	enabled    bool
+	registerer prom.Registerer
 
 	requests *prom.CounterVec
 	request  func(string, int)
@@ -310,7 +366,8 @@ type prometheus struct {
 
 func (c *CarbonserverListener) InitPrometheus(reg prom.Registerer) {
 	c.prometheus = prometheus{
-		enabled: true,
+		enabled:    true,
+		registerer: reg,
 
 		requests: prom.NewCounterVec(
 			prom.CounterOpts{
@@ -440,6 +497,7 @@ func NewCarbonserverListener(cacheGetFunc func(key string) []points.Point) *Carb
 		findCache:         queryCache{ec: expirecache.New(0)},
 		trigramIndex:      true,
 		percentiles:       []int{100, 99, 98, 95, 75, 50},
+		maxBodySize:       128 * 1024 * 1024,
 		prometheus: prometheus{
 			request:          func(string, int) {},
 			duration:         func(time.Duration) {},
@@ -470,6 +528,16 @@ func (listener *CarbonserverListener) SetFLock(flock bool) {
 func (listener *CarbonserverListener) SetHashOnly(hashOnly bool) {
 	listener.hashOnly = hashOnly
 }
+
+// SetMaxBodySize limits size of json body of POST requests in bytes
+func (listener *CarbonserverListener) SetMaxBodySize(size int64) {
+	listener.maxBodySize = size
+}
+
+// readBody reads body of request limited by max body size
+func (listener *CarbonserverListener) readBody(wr http.ResponseWriter, req *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(http.MaxBytesReader(wr, req.Body, listener.maxBodySize))
+}
 func (listener *CarbonserverListener) SetBuckets(buckets int) {
 	listener.buckets = buckets
 }
@@ -509,6 +577,33 @@ func (listener *CarbonserverListener) SetInternalStatsDir(dbPath string) {
 func (listener *CarbonserverListener) SetPercentiles(percentiles []int) {
 	listener.percentiles = percentiles
 }
+func (listener *CarbonserverListener) SetTLS(config *tlsconfig.Config) {
+	listener.tls = config
+}
+
+// SetAuth enables authentication of requests. Every principal has access only to own metrics.
+// Empty principals list disables authentication
+func (listener *CarbonserverListener) SetAuth(principals []*Principal, htpasswd map[string]string) error {
+	if len(principals) == 0 {
+		listener.auth = nil
+		return nil
+	}
+
+	auth, err := newAuthenticator(principals, htpasswd)
+	if err != nil {
+		return err
+	}
+	listener.auth = auth
+	return nil
+}
+
+// ReloadTLS reads certificate files again. Used on SIGHUP
+func (listener *CarbonserverListener) ReloadTLS() error {
+	if listener.tls == nil {
+		return nil
+	}
+	return listener.tls.Reload()
+}
 func (listener *CarbonserverListener) CurrentFileIndex() *fileIndex {
 	p := listener.fileIdx.Load()
 	if p == nil {
@@ -627,7 +722,7 @@ func (listener *CarbonserverListener) updateFileList(dir string) {
 							// logger.Error()
 							continue
 						}
-						listener.tagsIdx.Insert(pair[0], pair[1], metric, taggedName)
+						listener.tagsIdx.Insert(taggedName, pair[0], pair[1], metric, taggedName)
 					}
 				}
 			}
@@ -711,7 +806,8 @@ func (listener *CarbonserverListener) updateFileList(dir string) {
 	)
 }
 
-func (listener *CarbonserverListener) expandGlobs(query string) ([]string, []bool, error) {
+// expandGlobs returns files and directories matched by query. Results not visible with filter are skipped
+func (listener *CarbonserverListener) expandGlobs(query string, filter *tindex.Filter) ([]string, []bool, error) {
 	var useGlob bool
 	logger := zapwriter.Logger("carbonserver")
 
@@ -854,7 +950,20 @@ func (listener *CarbonserverListener) expandGlobs(query string) ([]string, []boo
 		files[i] = strings.Replace(p, "/", ".", -1)
 	}
 
-	return files, leafs, nil
+	if filter == nil {
+		return files, leafs, nil
+	}
+
+	visibleFiles := files[:0]
+	visibleLeafs := leafs[:0]
+	for i, name := range files {
+		if filter.Visible(accessName(name), !leafs[i]) {
+			visibleFiles = append(visibleFiles, files[i])
+			visibleLeafs = append(visibleLeafs, leafs[i])
+		}
+	}
+
+	return visibleFiles, visibleLeafs, nil
 }
 
 func (listener *CarbonserverListener) Stat(send helper.StatCallback) {
@@ -891,6 +1000,25 @@ func (listener *CarbonserverListener) Stat(send helper.StatCallback) {
 	sender("metrics_returned", &listener.metrics.MetricsReturned, send)
 	sender("metrics_found", &listener.metrics.MetricsFound, send)
 	sender("fetch_size_bytes", &listener.metrics.FetchSize, send)
+	sender("remote_read_requests", &listener.metrics.RemoteReadRequests, send)
+	sender("remote_read_errors", &listener.metrics.RemoteReadErrors, send)
+	sender("merge_requests", &listener.metrics.MergeRequests, send)
+	sender("merge_errors", &listener.metrics.MergeErrors, send)
+	sender("cluster_requests", &listener.metrics.ClusterRequests, send)
+	sender("cluster_errors", &listener.metrics.ClusterErrors, send)
+	sender("checksum_requests", &listener.metrics.ChecksumRequests, send)
+	sender("checksum_errors", &listener.metrics.ChecksumErrors, send)
+	sender("repair_requests", &listener.metrics.RepairRequests, send)
+	sender("repair_errors", &listener.metrics.RepairErrors, send)
+	sender("anti_entropy_runs", &listener.metrics.AntiEntropyRuns, send)
+	sender("anti_entropy_checked", &listener.metrics.AntiEntropyChecked, send)
+	sender("anti_entropy_mismatched", &listener.metrics.AntiEntropyMismatched, send)
+	sender("anti_entropy_repaired_points", &listener.metrics.AntiEntropyRepairedPoints, send)
+	sender("anti_entropy_pushed_points", &listener.metrics.AntiEntropyPushedPoints, send)
+	sender("anti_entropy_errors", &listener.metrics.AntiEntropyErrors, send)
+	sender("backfill_requests", &listener.metrics.BackfillRequests, send)
+	sender("backfill_errors", &listener.metrics.BackfillErrors, send)
+	sender("auth_failures", &listener.metrics.AuthFailures, send)
 
 	senderRaw("metrics_known", &listener.metrics.MetricsKnown, send)
 	sender("index_build_time_ns", &listener.metrics.IndexBuildTimeNS, send)
@@ -902,6 +1030,10 @@ func (listener *CarbonserverListener) Stat(send helper.StatCallback) {
 	sender("find_cache_hit", &listener.metrics.FindCacheHit, send)
 	sender("find_cache_miss", &listener.metrics.FindCacheMiss, send)
 
+	if listener.tls != nil {
+		send("tls_handshake_errors", float64(listener.tls.HandshakeErrors()))
+	}
+
 	sender("alloc", &alloc, send)
 	sender("total_alloc", &totalAlloc, send)
 	sender("num_gc", &numGC, send)
@@ -941,8 +1073,21 @@ func (listener *CarbonserverListener) Stat(send helper.StatCallback) {
 }
 
 func (listener *CarbonserverListener) Stop() error {
-	close(listener.forceScanChan)
+	if listener.forceScanChan != nil {
+		close(listener.forceScanChan)
+	}
 	close(listener.exitChan)
+	if listener.prometheus.enabled {
+		// allows to register metrics of new listener after config reload
+		reg := listener.prometheus.registerer
+		reg.Unregister(listener.prometheus.requests)
+		reg.Unregister(listener.prometheus.cacheRequests)
+		reg.Unregister(listener.prometheus.durations)
+		reg.Unregister(listener.prometheus.diskRequests)
+		reg.Unregister(listener.prometheus.diskWaitDurations)
+		reg.Unregister(listener.prometheus.returnedMetrics)
+		reg.Unregister(listener.prometheus.returnedPoints)
+	}
 	if listener.db != nil {
 		listener.db.Close()
 	}
@@ -1027,6 +1172,10 @@ func (listener *CarbonserverListener) Listen(listen string) error {
 		listener.forceScanChan <- struct{}{}
 	}
 
+	if listener.antiEntropy != nil {
+		go listener.antiEntropyWorker(listener.exitChan)
+	}
+
 	listener.queryCache = queryCache{ec: expirecache.New(uint64(listener.queryCacheSizeMB))}
 
 	// +1 to track every over the number of buckets we track
@@ -1038,7 +1187,7 @@ func (listener *CarbonserverListener) Listen(listen string) error {
 		return httputil.TrackConnections(
 			httputil.TimeHandler(
 				TraceHandler(
-					h,
+					listener.authHandler(h),
 					statusCodes["combined"],
 					handlerStatusCodes,
 					listener.prometheus.request,
@@ -1060,6 +1209,13 @@ func (listener *CarbonserverListener) Listen(listen string) error {
 	// carbonserverMux.HandleFunc("/tags/findSeries", wrapHandler(listener.tagsHandler, statusCodes["find"]))
 	carbonserverMux.HandleFunc("/seriesByTag", wrapHandler(listener.seriesByTagHandler, statusCodes["seriesByTag"]))
 
+	carbonserverMux.HandleFunc("/quotas", wrapHandler(listener.quotaHandler, statusCodes["quotas"]))
+	carbonserverMux.HandleFunc("/api/v1/read", wrapHandler(listener.remoteReadHandler, statusCodes["remoteRead"]))
+	carbonserverMux.HandleFunc("/metrics/merge/", wrapHandler(listener.mergeHandler, statusCodes["merge"]))
+	carbonserverMux.HandleFunc("/metrics/checksum/", wrapHandler(listener.checksumHandler, statusCodes["checksum"]))
+	carbonserverMux.HandleFunc("/metrics/repair/", wrapHandler(listener.repairHandler, statusCodes["repair"]))
+	carbonserverMux.HandleFunc("/metrics/backfill/", wrapHandler(listener.backfillHandler, statusCodes["backfill"]))
+
 	carbonserverMux.HandleFunc("/forcescan", func(w http.ResponseWriter, r *http.Request) {
 		select {
 		case listener.forceScanChan <- struct{}{}:
@@ -1139,7 +1295,12 @@ func (listener *CarbonserverListener) Listen(listen string) error {
 		WriteTimeout: listener.writeTimeout,
 	}
 
-	go srv.Serve(listener.tcpListener)
+	var netListener net.Listener = listener.tcpListener
+	if listener.tls != nil {
+		netListener = tlsconfig.NewListener(listener.tcpListener, listener.tls)
+	}
+
+	go srv.Serve(netListener)
 
 	return nil
 }
@@ -360,7 +360,7 @@ func TestGetMetricsListEmpty(t *testing.T) {
 		metrics:     &metricStruct{},
 	}
 
-	metrics, err := carbonserver.getMetricsList()
+	metrics, err := carbonserver.getMetricsList(nil)
 	if err != errMetricsListEmpty {
 		t.Errorf("err: '%v', expected: '%v'", err, errMetricsListEmpty)
 	}
@@ -388,7 +388,7 @@ func TestGetMetricsListWithData(t *testing.T) {
 	fidx.files = append(fidx.files, "/foo/baz.wsp")
 	carbonserver.UpdateFileIndex(&fidx)
 
-	metrics, err := carbonserver.getMetricsList()
+	metrics, err := carbonserver.getMetricsList(nil)
 	if err != nil {
 		t.Errorf("err: '%v', expected: 'nil'", err)
 		return
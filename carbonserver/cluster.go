@@ -0,0 +1,407 @@
+package carbonserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonzipper/zipper/httpHeaders"
+	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/lomik/go-carbon/helper/hashing"
+	tindex "github.com/lomik/go-carbon/tags/index"
+)
+
+// clusterLocalHeader marks requests of cluster peers. Such requests are answered with local data only
+const clusterLocalHeader = "X-Carbonserver-Local"
+
+// clusterFailedHeader of response is number of nodes which failed to answer, so result is partial
+const clusterFailedHeader = "X-Carbonserver-Failed-Nodes"
+
+// SetCluster enables fan out of find and render requests to other nodes of cluster.
+// Timeout limits request to every node, results of failed nodes are skipped. Should be called after SetTLS
+func (listener *CarbonserverListener) SetCluster(cluster *hashing.Cluster, timeout time.Duration) {
+	listener.cluster = cluster
+	listener.clusterClient = listener.newPeerClient(timeout)
+}
+
+// SetPeerScheme sets scheme of requests to cluster and anti-entropy peers: http (default) or https
+func (listener *CarbonserverListener) SetPeerScheme(scheme string) {
+	listener.peerScheme = scheme
+}
+
+// peerURL returns url of path on carbonserver of peer
+func (listener *CarbonserverListener) peerURL(address string, path string) string {
+	scheme := listener.peerScheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + address + path
+}
+
+// newPeerClient returns client of peers. Certificate and CA of listener are used for https
+func (listener *CarbonserverListener) newPeerClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if listener.tls != nil {
+		client.Transport = &http.Transport{TLSClientConfig: listener.tls.ClientConfig()}
+	}
+	return client
+}
+
+// clusterRequest is fan out of one find or render request to peers
+type clusterRequest struct {
+	listener      *CarbonserverListener
+	logger        *zap.Logger
+	authorization string
+	failed        int32 // nodes failed to answer, changing via atomic
+}
+
+// newClusterRequest returns nil if cluster is not configured or req is sent by peer
+func (listener *CarbonserverListener) newClusterRequest(req *http.Request, logger *zap.Logger) *clusterRequest {
+	if listener.cluster == nil || req.Header.Get(clusterLocalHeader) != "" {
+		return nil
+	}
+	return &clusterRequest{
+		listener:      listener,
+		logger:        logger,
+		authorization: req.Header.Get("Authorization"),
+	}
+}
+
+// cacheKey separates cached results of cluster and local requests
+func (r *clusterRequest) cacheKey() string {
+	if r == nil {
+		return ""
+	}
+	return "&cluster"
+}
+
+// failedNodes returns number of nodes which failed to answer. Result with failed nodes is partial and not cached
+func (r *clusterRequest) failedNodes() int {
+	if r == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&r.failed))
+}
+
+// setFailedHeader marks partial response with number of failed nodes
+func (r *clusterRequest) setFailedHeader(wr http.ResponseWriter) {
+	if n := r.failedNodes(); n > 0 {
+		wr.Header().Set(clusterFailedHeader, strconv.Itoa(n))
+	}
+}
+
+// peerPost sends request of peer node to url. Not found is empty response
+func peerPost(client *http.Client, url string, contentType string, authorization string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(clusterLocalHeader, "1")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return data, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+}
+
+// post sends carbonapi_v3_pb request to path of node
+func (r *clusterRequest) post(n hashing.NodeAddress, path string, body []byte) ([]byte, error) {
+	return peerPost(r.listener.clusterClient, r.listener.peerURL(n.Address, path+"?format=carbonapi_v3_pb"),
+		httpHeaders.ContentTypeCarbonAPIv3PB, r.authorization, body)
+}
+
+// query posts requests to nodes concurrently and waits for all of them. Failed nodes are absent in result
+func (r *clusterRequest) query(path string, requests map[hashing.NodeAddress][]byte) map[hashing.NodeAddress][]byte {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	responses := make(map[hashing.NodeAddress][]byte, len(requests))
+
+	for n, body := range requests {
+		wg.Add(1)
+		go func(n hashing.NodeAddress, body []byte) {
+			defer wg.Done()
+
+			atomic.AddUint64(&r.listener.metrics.ClusterRequests, 1)
+			data, err := r.post(n, path, body)
+			if err != nil {
+				atomic.AddInt32(&r.failed, 1)
+				atomic.AddUint64(&r.listener.metrics.ClusterErrors, 1)
+				r.logger.Warn("cluster node request failed",
+					zap.String("node", n.String()),
+					zap.String("path", path),
+					zap.Error(err),
+				)
+				return
+			}
+
+			mu.Lock()
+			responses[n] = data
+			mu.Unlock()
+		}(n, body)
+	}
+	wg.Wait()
+
+	return responses
+}
+
+// find returns matches of globs on all peers
+func (r *clusterRequest) find(names []string) []protov3.GlobResponse {
+	body, err := (&protov3.MultiGlobRequest{Metrics: names}).Marshal()
+	if err != nil {
+		return nil
+	}
+
+	requests := make(map[hashing.NodeAddress][]byte)
+	for _, n := range r.listener.cluster.Peers() {
+		requests[n] = body
+	}
+
+	var result []protov3.GlobResponse
+	for n, data := range r.query("/metrics/find/", requests) {
+		var resp protov3.MultiGlobResponse
+		if err := resp.Unmarshal(data); err != nil {
+			atomic.AddInt32(&r.failed, 1)
+			atomic.AddUint64(&r.listener.metrics.ClusterErrors, 1)
+			r.logger.Warn("bad find response of cluster node", zap.String("node", n.String()), zap.Error(err))
+			continue
+		}
+		result = append(result, resp.Metrics...)
+	}
+	return result
+}
+
+// isGlob returns true if metric name should be expanded on every node
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[{")
+}
+
+// render fetches targets from peers. Globs are sent to all peers, plain and tagged metrics to their owners only
+func (r *clusterRequest) render(targets map[timeRange][]target) []protov3.FetchResponse {
+	multi := make(map[hashing.NodeAddress]*protov3.MultiFetchRequest)
+	add := func(n hashing.NodeAddress, fr protov3.FetchRequest) {
+		if multi[n] == nil {
+			multi[n] = &protov3.MultiFetchRequest{}
+		}
+		multi[n].Metrics = append(multi[n].Metrics, fr)
+	}
+
+	for tr, ts := range targets {
+		for _, t := range ts {
+			fr := protov3.FetchRequest{
+				Name:           t.Name,
+				StartTime:      int64(tr.from),
+				StopTime:       int64(tr.until),
+				PathExpression: t.PathExpression,
+			}
+
+			nodes := r.listener.cluster.Peers()
+			if !isGlob(t.Name) {
+				nodes, _ = r.listener.cluster.Owners(strings.Replace(t.Name, "_DOT_", ".", -1))
+			}
+			for _, n := range nodes {
+				add(n, fr)
+			}
+		}
+	}
+
+	requests := make(map[hashing.NodeAddress][]byte, len(multi))
+	for n, m := range multi {
+		body, err := m.Marshal()
+		if err != nil {
+			continue
+		}
+		requests[n] = body
+	}
+
+	var result []protov3.FetchResponse
+	for n, data := range r.query("/render/", requests) {
+		if data == nil {
+			continue
+		}
+		var resp protov3.MultiFetchResponse
+		if err := resp.Unmarshal(data); err != nil {
+			atomic.AddInt32(&r.failed, 1)
+			atomic.AddUint64(&r.listener.metrics.ClusterErrors, 1)
+			r.logger.Warn("bad render response of cluster node", zap.String("node", n.String()), zap.Error(err))
+			continue
+		}
+		result = append(result, resp.Metrics...)
+	}
+	return result
+}
+
+// mergeGlobs adds matches of peers to local globs. Match is leaf if it is leaf on any node
+func mergeGlobs(local []globs, remote []protov3.GlobResponse, filter *tindex.Filter) []globs {
+	index := make(map[string]int, len(local))
+	for i, g := range local {
+		index[g.Name] = i
+	}
+
+	for _, resp := range remote {
+		i, ok := index[resp.Name]
+		if !ok {
+			i = len(local)
+			index[resp.Name] = i
+			local = append(local, globs{Name: resp.Name})
+		}
+
+		g := &local[i]
+		files := make(map[string]int, len(g.Files))
+		for j, f := range g.Files {
+			files[f] = j
+		}
+
+		for _, m := range resp.Matches {
+			if m.IsLeaf && !filter.Allowed(m.Path) {
+				continue
+			}
+			if j, exists := files[m.Path]; exists {
+				g.Leafs[j] = g.Leafs[j] || m.IsLeaf
+				continue
+			}
+			files[m.Path] = len(g.Files)
+			g.Files = append(g.Files, m.Path)
+			g.Leafs = append(g.Leafs, m.IsLeaf)
+		}
+	}
+
+	return local
+}
+
+// presentPoints counts not NaN values of series
+func presentPoints(values []float64) int {
+	n := 0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			n++
+		}
+	}
+	return n
+}
+
+// mergeFetchV3 merges series of peers into local series of same name and request time range.
+// Gaps are filled if series have same time range and step, otherwise series with more points is kept
+func mergeFetchV3(local []protov3.FetchResponse, remote []protov3.FetchResponse) []protov3.FetchResponse {
+	key := func(m *protov3.FetchResponse) string {
+		return fmt.Sprintf("%s&%d&%d", m.Name, m.RequestStartTime, m.RequestStopTime)
+	}
+
+	index := make(map[string]int, len(local))
+	for i := range local {
+		index[key(&local[i])] = i
+	}
+
+	for _, m := range remote {
+		i, ok := index[key(&m)]
+		if !ok {
+			index[key(&m)] = len(local)
+			local = append(local, m)
+			continue
+		}
+
+		dst := &local[i]
+		if dst.StartTime == m.StartTime && dst.StepTime == m.StepTime && len(dst.Values) == len(m.Values) {
+			for j, v := range dst.Values {
+				if math.IsNaN(v) {
+					dst.Values[j] = m.Values[j]
+				}
+			}
+		} else if presentPoints(m.Values) > presentPoints(dst.Values) {
+			*dst = m
+		}
+	}
+
+	return local
+}
+
+// fetchV3ToV2 converts series of peer to carbonapi_v2_pb
+func fetchV3ToV2(m protov3.FetchResponse) protov2.FetchResponse {
+	resp := protov2.FetchResponse{
+		Name:      m.Name,
+		StartTime: int32(m.StartTime),
+		StopTime:  int32(m.StopTime),
+		StepTime:  int32(m.StepTime),
+		Values:    make([]float64, len(m.Values)),
+		IsAbsent:  make([]bool, len(m.Values)),
+	}
+	for i, v := range m.Values {
+		if math.IsNaN(v) {
+			resp.IsAbsent[i] = true
+		} else {
+			resp.Values[i] = v
+		}
+	}
+	return resp
+}
+
+// mergeFetchV2 is mergeFetchV3 for carbonapi_v2_pb series, which have no request time range
+func mergeFetchV2(local []protov2.FetchResponse, remote []protov3.FetchResponse) []protov2.FetchResponse {
+	index := make(map[string]int, len(local))
+	for i := range local {
+		index[local[i].Name] = i
+	}
+
+	present := func(m *protov2.FetchResponse) int {
+		n := 0
+		for _, absent := range m.IsAbsent {
+			if !absent {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, r := range remote {
+		m := fetchV3ToV2(r)
+		i, ok := index[m.Name]
+		if !ok {
+			index[m.Name] = len(local)
+			local = append(local, m)
+			continue
+		}
+
+		dst := &local[i]
+		if dst.StartTime == m.StartTime && dst.StepTime == m.StepTime && len(dst.Values) == len(m.Values) {
+			for j, absent := range dst.IsAbsent {
+				if absent && !m.IsAbsent[j] {
+					dst.Values[j] = m.Values[j]
+					dst.IsAbsent[j] = false
+				}
+			}
+		} else if present(&m) > present(dst) {
+			*dst = m
+		}
+	}
+
+	return local
+}
@@ -0,0 +1,172 @@
+package carbonserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/hashing"
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestClusterFindRender(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		retentions, _ := whisper.ParseRetentionDefs("1m:1h")
+		now := int(time.Now().Unix())
+		now -= now % 60
+
+		create := func(dataDir string, metric string, values map[int]float64) {
+			path := filepath.Join(dataDir, strings.Replace(metric, ".", "/", -1)+".wsp")
+			assert.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+			w, err := whisper.Create(path, retentions, whisper.Average, 0)
+			if !assert.NoError(err) {
+				t.FailNow()
+			}
+			for ts, v := range values {
+				assert.NoError(w.Update(v, ts))
+			}
+			w.Close()
+		}
+
+		newListener := func(dataDir string) *CarbonserverListener {
+			listener := NewCarbonserverListener(func(string) []points.Point { return nil })
+			listener.SetWhisperData(dataDir)
+			listener.SetMaxGlobs(100)
+			return listener
+		}
+
+		create(filepath.Join(root, "self"), "a.local", map[int]float64{now - 120: 1})
+		create(filepath.Join(root, "self"), "a.shared", map[int]float64{now - 120: 1})
+		create(filepath.Join(root, "peer"), "a.remote", map[int]float64{now - 120: 3})
+		create(filepath.Join(root, "peer"), "a.shared", map[int]float64{now - 60: 2})
+
+		peer := newListener(filepath.Join(root, "peer"))
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics/find/", peer.findHandler)
+		mux.HandleFunc("/render/", peer.renderHandler)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		self, _ := hashing.ParseNodeAddress("127.0.0.1:1:self")
+		peerNode, _ := hashing.ParseNodeAddress(strings.TrimPrefix(server.URL, "http://"))
+		// nobody listens on port 2 of 127.0.0.2, its results are skipped
+		deadNode, _ := hashing.ParseNodeAddress("127.0.0.2:2")
+		cluster, err := hashing.NewCluster(hashing.CarbonCHType, 3, self, []hashing.NodeAddress{self, peerNode, deadNode})
+		if !assert.NoError(err) {
+			return
+		}
+
+		listener := newListener(filepath.Join(root, "self"))
+		listener.SetCluster(cluster, time.Second)
+
+		find := func(local bool) []string {
+			req := httptest.NewRequest("GET", "/metrics/find/?format=json&query=a.*", nil)
+			if local {
+				req.Header.Set(clusterLocalHeader, "1")
+			}
+			rr := httptest.NewRecorder()
+			listener.findHandler(rr, req)
+			assert.Equal(http.StatusOK, rr.Code)
+
+			// dead node makes response of cluster partial
+			failed := "1"
+			if local {
+				failed = ""
+			}
+			assert.Equal(failed, rr.Header().Get(clusterFailedHeader))
+
+			var resp protov3.MultiGlobResponse
+			assert.NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+			var paths []string
+			for _, g := range resp.Metrics {
+				for _, m := range g.Matches {
+					assert.True(m.IsLeaf, m.Path)
+					paths = append(paths, m.Path)
+				}
+			}
+			sort.Strings(paths)
+			return paths
+		}
+
+		assert.Equal([]string{"a.local", "a.remote", "a.shared"}, find(false))
+		assert.Equal([]string{"a.local", "a.shared"}, find(true))
+		assert.Equal(uint64(2), listener.metrics.ClusterRequests)
+		assert.Equal(uint64(1), listener.metrics.ClusterErrors)
+
+		render := func(target string) map[int]float64 {
+			rr := httptest.NewRecorder()
+			listener.renderHandler(rr, httptest.NewRequest("GET",
+				fmt.Sprintf("/render/?format=json&target=%s&from=%d&until=%d", target, now-300, now), nil))
+			if !assert.Equal(http.StatusOK, rr.Code, "render of %s", target) {
+				return nil
+			}
+			assert.Equal("1", rr.Header().Get(clusterFailedHeader))
+
+			var resp protov2.MultiFetchResponse
+			assert.NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+			if !assert.Equal(1, len(resp.Metrics)) {
+				return nil
+			}
+
+			m := resp.Metrics[0]
+			assert.Equal(target, m.Name)
+			values := make(map[int]float64)
+			for i, v := range m.Values {
+				if !m.IsAbsent[i] && !math.IsNaN(v) {
+					values[int(m.StartTime)+i*int(m.StepTime)] = v
+				}
+			}
+			return values
+		}
+
+		// gaps of local series are filled with points of peer
+		assert.Equal(map[int]float64{now - 120: 1, now - 60: 2}, render("a.shared"))
+		// metric exists only on peer
+		assert.Equal(map[int]float64{now - 120: 3}, render("a.remote"))
+
+		assert.Equal("http://127.0.0.2:2/render/", listener.peerURL("127.0.0.2:2", "/render/"))
+		listener.SetPeerScheme("https")
+		assert.Equal("https://127.0.0.2:2/render/", listener.peerURL("127.0.0.2:2", "/render/"))
+	})
+}
+
+func TestMergeFetchV3(t *testing.T) {
+	assert := assert.New(t)
+	nan := math.NaN()
+
+	local := []protov3.FetchResponse{
+		{Name: "a", StartTime: 60, StepTime: 60, Values: []float64{1, nan, nan}},
+		{Name: "b", StartTime: 60, StepTime: 60, Values: []float64{1, nan}},
+	}
+	remote := []protov3.FetchResponse{
+		{Name: "a", StartTime: 60, StepTime: 60, Values: []float64{5, 2, nan}},
+		// different step: series with more points wins
+		{Name: "b", StartTime: 0, StepTime: 10, Values: []float64{1, 2, 3}},
+		{Name: "c", StartTime: 60, StepTime: 60, Values: []float64{7}},
+	}
+
+	merged := mergeFetchV3(local, remote)
+	if !assert.Equal(3, len(merged)) {
+		return
+	}
+	assert.Equal([]float64{1, 2}, merged[0].Values[:2])
+	assert.True(math.IsNaN(merged[0].Values[2]))
+	assert.Equal(int64(10), merged[1].StepTime)
+	assert.Equal("c", merged[2].Name)
+}
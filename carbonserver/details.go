@@ -76,6 +76,8 @@ func (listener *CarbonserverListener) detailsHandler(wr http.ResponseWriter, req
 
 	var b []byte
 
+	filter := principalFromContext(ctx).accessFilter()
+
 	contentType := ""
 	switch formatCode {
 	case jsonFormat:
@@ -86,6 +88,9 @@ func (listener *CarbonserverListener) detailsHandler(wr http.ResponseWriter, req
 		}
 		listener.fileIdxMutex.Lock()
 		for m, v := range fidx.details {
+			if filter != nil && !filter.Allowed(accessName(m)) {
+				continue
+			}
 			response.Metrics = append(response.Metrics, metricDetailsFlat{
 				Name:          m,
 				MetricDetails: v,
@@ -105,6 +110,14 @@ func (listener *CarbonserverListener) detailsHandler(wr http.ResponseWriter, req
 			FreeSpace:  fidx.freeSpace,
 			TotalSpace: fidx.totalSpace,
 		}
+		if filter != nil {
+			response.Metrics = make(map[string]*protov3.MetricDetails)
+			for m, v := range fidx.details {
+				if filter.Allowed(accessName(m)) {
+					response.Metrics[m] = v
+				}
+			}
+		}
 		b, err = response.Marshal()
 		listener.fileIdxMutex.Unlock()
 	}
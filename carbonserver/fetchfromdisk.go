@@ -11,6 +11,7 @@ import (
 
 	"github.com/go-graphite/go-whisper"
 	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/tags"
 )
 
 type Metadata struct {
@@ -25,11 +26,20 @@ type metricFromDisk struct {
 	Metadata      Metadata
 }
 
+// metricPath returns whisper file path of metric. Metric can be tagged name (name;tag=value)
+// or partial file path of tagged metric (_tagged/55e/e99/name;tag=value)
+func (listener *CarbonserverListener) metricPath(metric string) string {
+	if strings.IndexByte(metric, ';') >= 0 && !strings.HasPrefix(metric, "_tagged/") {
+		return tags.FilePath(listener.whisperData, metric, listener.hashOnly) + ".wsp"
+	}
+	return listener.whisperData + "/" + strings.Replace(metric, ".", "/", -1) + ".wsp"
+}
+
 func (listener *CarbonserverListener) fetchFromDisk(metric string, fromTime, untilTime int32) (*metricFromDisk, error) {
 	var step int32
 
 	// We need to obtain the metadata from whisper file anyway.
-	path := listener.whisperData + "/" + strings.Replace(metric, ".", "/", -1) + ".wsp"
+	path := listener.metricPath(metric)
 	w, err := whisper.OpenWithOptions(path, &whisper.Options{
 		FLock: listener.flock,
 	})
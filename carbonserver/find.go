@@ -17,6 +17,8 @@ import (
 	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	pickle "github.com/lomik/og-rek"
+
+	tindex "github.com/lomik/go-carbon/tags/index"
 )
 
 type findResponse struct {
@@ -116,10 +118,12 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 		return
 	}
 
+	cluster := listener.newClusterRequest(req, logger)
+
 	var err error
 	fromCache := false
 	if listener.findCacheEnabled {
-		key := strings.Join(query, ",") + "&" + format
+		key := strings.Join(query, ",") + "&" + format + principalFromContext(ctx).cacheKey() + cluster.cacheKey()
 		size := uint64(100 * 1024 * 1024)
 		item := listener.findCache.getQueryItem(key, size, 300)
 		res, ok := item.FetchOrLock()
@@ -127,8 +131,8 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 		if !ok {
 			logger.Debug("find cache miss")
 			atomic.AddUint64(&listener.metrics.FindCacheMiss, 1)
-			response, err = listener.findMetrics(logger, t0, formatCode, query)
-			if err != nil {
+			response, err = listener.findMetrics(logger, t0, formatCode, query, principalFromContext(ctx).accessFilter(), cluster)
+			if err != nil || cluster.failedNodes() > 0 {
 				item.StoreAbort()
 			} else {
 				item.StoreAndUnlock(response)
@@ -140,7 +144,7 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 			fromCache = true
 		}
 	} else {
-		response, err = listener.findMetrics(logger, t0, formatCode, query)
+		response, err = listener.findMetrics(logger, t0, formatCode, query, principalFromContext(ctx).accessFilter(), cluster)
 	}
 
 	if err != nil || response == nil {
@@ -166,6 +170,7 @@ func (listener *CarbonserverListener) findHandler(wr http.ResponseWriter, req *h
 	}
 
 	wr.Header().Set("Content-Type", response.contentType)
+	cluster.setFailedHeader(wr)
 	wr.Write(response.data)
 
 	if response.files == 0 {
@@ -200,7 +205,8 @@ type globs struct {
 	Leafs []bool
 }
 
-func (listener *CarbonserverListener) findMetrics(logger *zap.Logger, t0 time.Time, format responseFormat, names []string) (*findResponse, error) {
+// findMetrics expands globs of names. Matches of cluster peers are added if cluster is not nil
+func (listener *CarbonserverListener) findMetrics(logger *zap.Logger, t0 time.Time, format responseFormat, names []string, filter *tindex.Filter, cluster *clusterRequest) (*findResponse, error) {
 	var result findResponse
 	var expandedGlobs []globs
 	var errors []findError
@@ -211,7 +217,7 @@ func (listener *CarbonserverListener) findMetrics(logger *zap.Logger, t0 time.Ti
 		glob := globs{
 			Name: name,
 		}
-		glob.Files, glob.Leafs, err = listener.expandGlobs(name)
+		glob.Files, glob.Leafs, err = listener.expandGlobs(name, filter)
 		if err != nil {
 			errors = append(errors, findError{name: name, err: err})
 			continue
@@ -220,10 +226,14 @@ func (listener *CarbonserverListener) findMetrics(logger *zap.Logger, t0 time.Ti
 		expandedGlobs = append(expandedGlobs, glob)
 	}
 
+	if cluster != nil {
+		expandedGlobs = mergeGlobs(expandedGlobs, cluster.find(names), filter)
+	}
+
 	if len(errors) > 0 {
 		atomic.AddUint64(&listener.metrics.FindErrors, uint64(len(errors)))
 
-		if len(errors) == len(names) {
+		if len(expandedGlobs) == 0 {
 			logger.Error("find failed",
 				zap.Duration("runtime_seconds", time.Since(t0)),
 				zap.String("reason", "can't expand globs"),
@@ -84,10 +84,17 @@ func (listener *CarbonserverListener) infoHandler(wr http.ResponseWriter, req *h
 
 	response := protov3.MultiMetricsInfoResponse{}
 	var retentionsV2 []protov2.Retention
+	filter := principalFromContext(ctx).accessFilter()
 	for i, metric := range metrics {
 		path := listener.whisperData + "/" + strings.Replace(metric, ".", "/", -1) + ".wsp"
 		w, err := whisper.Open(path)
 
+		if err == nil && !filter.Allowed(metric) {
+			// metric without access is reported as not existing
+			w.Close()
+			err = errorNotFound{}
+		}
+
 		if err != nil {
 			atomic.AddUint64(&listener.metrics.NotFound, 1)
 			accessLogger.Error("info served",
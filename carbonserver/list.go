@@ -13,12 +13,14 @@ import (
 
 	"github.com/go-graphite/carbonzipper/zipper/httpHeaders"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	tindex "github.com/lomik/go-carbon/tags/index"
 )
 
 var errMaxGlobsExhausted = fmt.Errorf("maxGlobs in request exhausted, kindly refusing to perform the request")
 var errMetricsListEmpty = fmt.Errorf("File index is empty or disabled")
 
-func (listener *CarbonserverListener) getMetricsList() ([]string, error) {
+func (listener *CarbonserverListener) getMetricsList(filter *tindex.Filter) ([]string, error) {
 	fidx := listener.CurrentFileIndex()
 	var metrics []string
 
@@ -31,7 +33,11 @@ func (listener *CarbonserverListener) getMetricsList() ([]string, error) {
 			continue
 		}
 		p = p[1 : len(p)-4]
-		metrics = append(metrics, strings.Replace(p, "/", ".", -1))
+		metric := strings.Replace(p, "/", ".", -1)
+		if filter != nil && !filter.Allowed(accessName(metric)) {
+			continue
+		}
+		metrics = append(metrics, metric)
 	}
 	return metrics, nil
 }
@@ -78,7 +84,7 @@ func (listener *CarbonserverListener) listHandler(wr http.ResponseWriter, req *h
 
 	var err error
 
-	metrics, err := listener.getMetricsList()
+	metrics, err := listener.getMetricsList(principalFromContext(ctx).accessFilter())
 	if err != nil {
 		atomic.AddUint64(&listener.metrics.ListErrors, 1)
 		accessLogger.Error("list failed",
@@ -0,0 +1,169 @@
+package carbonserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/persister"
+)
+
+// MergeResponse is reply of /metrics/merge/ handler. Sender may remove its copy of metric after it
+type MergeResponse struct {
+	Metric  string `json:"metric"`
+	Created bool   `json:"created"`
+	Points  int    `json:"points"`
+}
+
+// validMergeTarget checks that plain metric name can't point outside of whisper data dir
+func validMergeTarget(metric string) bool {
+	if metric == "" || strings.ContainsAny(metric, "/;\x00") {
+		return false
+	}
+	for _, node := range strings.Split(metric, ".") {
+		if node == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// SetMerge enables /metrics/merge/ endpoint. Body is limited by maxSize bytes. File of metric is created or filled
+// under lock returned by lock, so persister doesn't write it concurrently
+func (listener *CarbonserverListener) SetMerge(maxSize int64, lock func(metric string) (unlock func())) {
+	listener.mergeMaxSize = maxSize
+	listener.mergeLock = lock
+}
+
+// mergeFile stores whisper file from body as file of metric. Existing file of metric is filled with points of body
+func (listener *CarbonserverListener) mergeFile(metric string, body io.Reader) (*MergeResponse, error) {
+	path := listener.metricPath(metric)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	tmpPath := path + ".merge"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := whisper.OpenWithOptions(tmpPath, &whisper.Options{FLock: listener.flock})
+	if err != nil {
+		return nil, fmt.Errorf("bad whisper file: %s", err.Error())
+	}
+	defer src.Close()
+
+	unlock := listener.mergeLock(metric)
+	defer unlock()
+
+	// link fails if file of metric exists, so file created by persister in the meantime is not replaced
+	if err = os.Link(tmpPath, path); err == nil {
+		return &MergeResponse{Metric: metric, Created: true}, nil
+	}
+	if !os.IsExist(err) {
+		return nil, err
+	}
+
+	dst, err := whisper.OpenWithOptions(path, &whisper.Options{FLock: listener.flock})
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+
+	written, err := persister.FillFile(src, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MergeResponse{Metric: metric, Points: written}, nil
+}
+
+func (listener *CarbonserverListener) mergeHandler(wr http.ResponseWriter, req *http.Request) {
+	// URL: /metrics/merge/?target=the.metric.name
+	// Body: whisper file
+	t0 := time.Now()
+	ctx := req.Context()
+
+	atomic.AddUint64(&listener.metrics.MergeRequests, 1)
+
+	metric := req.URL.Query().Get("target")
+
+	accessLogger := TraceContextToZap(ctx, listener.accessLogger.With(
+		zap.String("handler", "merge"),
+		zap.String("url", req.URL.RequestURI()),
+		zap.String("peer", req.RemoteAddr),
+		zap.String("target", metric),
+	))
+
+	fail := func(reason string, err error, code int) {
+		atomic.AddUint64(&listener.metrics.MergeErrors, 1)
+		accessLogger.Error("merge failed",
+			zap.Duration("runtime_seconds", time.Since(t0)),
+			zap.String("reason", reason),
+			zap.Error(err),
+			zap.Int("http_code", code),
+		)
+		http.Error(wr, fmt.Sprintf("%s (%v)", reason, err), code)
+	}
+
+	if req.Method != http.MethodPost {
+		fail("Bad request", fmt.Errorf("method %s is not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if listener.mergeLock == nil {
+		fail("Not implemented", fmt.Errorf("merge is not enabled"), http.StatusNotImplemented)
+		return
+	}
+
+	if !validMergeTarget(metric) {
+		fail("Bad request", fmt.Errorf("invalid target %#v", metric), http.StatusBadRequest)
+		return
+	}
+
+	if !principalFromContext(ctx).accessFilter().Allowed(metric) {
+		fail("Forbidden", fmt.Errorf("no access to %s", metric), http.StatusForbidden)
+		return
+	}
+
+	resp, err := listener.mergeFile(metric, http.MaxBytesReader(wr, req.Body, listener.mergeMaxSize))
+	if err != nil {
+		fail("Merge failed", err, http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		fail("Internal error while processing request", err, http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Write(data)
+
+	accessLogger.Info("merge success",
+		zap.Duration("runtime_seconds", time.Since(t0)),
+		zap.Bool("created", resp.Created),
+		zap.Int("points", resp.Points),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
@@ -0,0 +1,116 @@
+package carbonserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+)
+
+func TestMergeHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		retentions, _ := whisper.ParseRetentionDefs("1m:1h")
+		now := int(time.Now().Unix())
+		now -= now % 60
+
+		create := func(path string, values map[int]float64) []byte {
+			assert.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+			w, err := whisper.Create(path, retentions, whisper.Average, 0)
+			if !assert.NoError(err) {
+				t.FailNow()
+			}
+			for ts, v := range values {
+				assert.NoError(w.Update(v, ts))
+			}
+			w.Close()
+
+			data, err := ioutil.ReadFile(path)
+			assert.NoError(err)
+			return data
+		}
+
+		incoming := create(filepath.Join(root, "src", "a.wsp"), map[int]float64{now - 120: 1, now - 60: 2})
+
+		listener := NewCarbonserverListener(nil)
+		listener.SetWhisperData(filepath.Join(root, "data"))
+
+		merge := func(target string, body []byte) (int, *MergeResponse) {
+			rr := httptest.NewRecorder()
+			listener.mergeHandler(rr, httptest.NewRequest("POST", "/metrics/merge/?target="+target, bytes.NewReader(body)))
+			if rr.Code != http.StatusOK {
+				return rr.Code, nil
+			}
+			resp := &MergeResponse{}
+			assert.NoError(json.Unmarshal(rr.Body.Bytes(), resp))
+			return rr.Code, resp
+		}
+
+		code, _ := merge("new.metric", incoming)
+		assert.Equal(http.StatusNotImplemented, code)
+
+		var locked []string
+		listener.SetMerge(int64(len(incoming)), func(metric string) func() {
+			locked = append(locked, metric)
+			return func() {}
+		})
+
+		// new file
+		code, resp := merge("new.metric", incoming)
+		assert.Equal(http.StatusOK, code)
+		assert.Equal(&MergeResponse{Metric: "new.metric", Created: true}, resp)
+		_, err := os.Stat(filepath.Join(root, "data", "new", "metric.wsp.merge"))
+		assert.True(os.IsNotExist(err))
+
+		// existing file is filled, own points are kept
+		create(filepath.Join(root, "data", "old", "metric.wsp"), map[int]float64{now - 60: 20, now - 180: 30})
+		code, resp = merge("old.metric", incoming)
+		assert.Equal(http.StatusOK, code)
+		assert.Equal(&MergeResponse{Metric: "old.metric", Points: 1}, resp)
+
+		w, err := whisper.Open(filepath.Join(root, "data", "old", "metric.wsp"))
+		if assert.NoError(err) {
+			series, err := w.Fetch(now-240, now)
+			assert.NoError(err)
+			values := make(map[int]float64)
+			for _, p := range series.Points() {
+				if !math.IsNaN(p.Value) {
+					values[p.Time] = p.Value
+				}
+			}
+			assert.Equal(map[int]float64{now - 180: 30, now - 120: 1, now - 60: 20}, values)
+			w.Close()
+		}
+
+		assert.Equal([]string{"new.metric", "old.metric"}, locked)
+
+		// body is limited by max size
+		code, _ = merge("big.metric", append(incoming, 0))
+		assert.Equal(http.StatusInternalServerError, code)
+		_, err = os.Stat(filepath.Join(root, "data", "big", "metric.wsp"))
+		assert.True(os.IsNotExist(err))
+
+		code, _ = merge("../etc/passwd", incoming)
+		assert.Equal(http.StatusBadRequest, code)
+		code, _ = merge("a..b", incoming)
+		assert.Equal(http.StatusBadRequest, code)
+		code, _ = merge("bad.file", []byte("not whisper"))
+		assert.Equal(http.StatusInternalServerError, code)
+
+		rr := httptest.NewRecorder()
+		listener.mergeHandler(rr, httptest.NewRequest("GET", "/metrics/merge/?target=new.metric", nil))
+		assert.Equal(http.StatusMethodNotAllowed, rr.Code)
+	})
+}
@@ -0,0 +1,30 @@
+package carbonserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/lomik/go-carbon/cache"
+)
+
+// SetQuotaState sets source of ingestion quotas state for /quotas handler
+func (listener *CarbonserverListener) SetQuotaState(quotaState func() []cache.QuotaState) {
+	listener.quotaState = quotaState
+}
+
+func (listener *CarbonserverListener) quotaHandler(wr http.ResponseWriter, req *http.Request) {
+	// URL: /quotas
+	state := make([]cache.QuotaState, 0)
+	if listener.quotaState != nil {
+		state = listener.quotaState()
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Write(data)
+}
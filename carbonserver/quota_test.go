@@ -0,0 +1,33 @@
+package carbonserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lomik/go-carbon/cache"
+)
+
+func TestQuotaHandler(t *testing.T) {
+	listener := NewCarbonserverListener(nil)
+	listener.SetQuotaState(func() []cache.QuotaState {
+		return []cache.QuotaState{{Name: "servers", Prefix: "servers.", Series: 3, MaxSeries: 10}}
+	})
+
+	rr := httptest.NewRecorder()
+	listener.quotaHandler(rr, httptest.NewRequest("GET", "/quotas", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected code %d", rr.Code)
+	}
+
+	var state []cache.QuotaState
+	if err := json.Unmarshal(rr.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(state) != 1 || state[0].Name != "servers" || state[0].Series != 3 || state[0].MaxSeries != 10 {
+		t.Fatalf("unexpected state %#v", state)
+	}
+}
@@ -0,0 +1,272 @@
+package carbonserver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/klauspost/compress/snappy"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper/prompb"
+	tindex "github.com/lomik/go-carbon/tags/index"
+)
+
+var errNoMatchers = errors.New("no matchers")
+
+// remoteReadMatcher is label matcher checked against labels of found series. Missing label has empty value as in prometheus
+type remoteReadMatcher struct {
+	name  string
+	typ   prompb.LabelMatcher_Type
+	value string
+	re    *regexp.Regexp
+}
+
+func (m *remoteReadMatcher) matches(labels []prompb.Label) bool {
+	value := ""
+	for _, l := range labels {
+		if l.Name == m.name {
+			value = l.Value
+			break
+		}
+	}
+	return m.matchValue(value)
+}
+
+func (m *remoteReadMatcher) matchValue(value string) bool {
+	switch m.typ {
+	case prompb.LabelMatcher_EQ:
+		return value == m.value
+	case prompb.LabelMatcher_NEQ:
+		return value != m.value
+	case prompb.LabelMatcher_RE:
+		return m.re.MatchString(value)
+	case prompb.LabelMatcher_NRE:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// remoteReadExprs converts prometheus label matchers to tag index expressions.
+// Matchers of empty value also match series without label, they can't be searched in index
+// and are returned to be checked against labels of found series. Prometheus regexps are fully anchored
+func remoteReadExprs(matchers []*prompb.LabelMatcher) (*tindex.TagValueExpr, []*tindex.TagValueExpr, []*remoteReadMatcher, error) {
+	var metricExpr *tindex.TagValueExpr
+	var tves []*tindex.TagValueExpr
+	var post []*remoteReadMatcher
+
+	for _, m := range matchers {
+		tve := &tindex.TagValueExpr{Tag: m.Name, Value: m.Value}
+		rm := &remoteReadMatcher{name: m.Name, typ: m.Type, value: m.Value}
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			tve.Op = tindex.OpEq
+		case prompb.LabelMatcher_NEQ:
+			tve.Op = tindex.OpNotEq
+		case prompb.LabelMatcher_RE:
+			tve.Op = tindex.OpMatch
+			tve.Value = "^(?:" + m.Value + ")$"
+		case prompb.LabelMatcher_NRE:
+			tve.Op = tindex.OpNotMatch
+			tve.Value = "^(?:" + m.Value + ")$"
+		default:
+			return nil, nil, nil, fmt.Errorf("unknown matcher type %d", m.Type)
+		}
+
+		if tve.Op == tindex.OpMatch || tve.Op == tindex.OpNotMatch {
+			var err error
+			if rm.re, err = regexp.Compile(tve.Value); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+
+		if m.Name == "__name__" {
+			// metric name is never empty
+			tve.Tag = "name"
+			metricExpr = tve
+			continue
+		}
+
+		if rm.matchValue("") {
+			post = append(post, rm)
+			continue
+		}
+		tves = append(tves, tve)
+	}
+
+	if metricExpr == nil && len(tves) == 0 {
+		if len(post) == 0 {
+			return nil, nil, nil, errNoMatchers
+		}
+		// all series are checked by post matchers
+		metricExpr = &tindex.TagValueExpr{Tag: "name", Op: tindex.OpNotEq}
+	}
+
+	return metricExpr, tves, post, nil
+}
+
+// remoteReadLabels converts tagged name name;k1=v1;k2=v2 to sorted prometheus labels
+func remoteReadLabels(taggedName string) []prompb.Label {
+	arr := strings.Split(taggedName, ";")
+	labels := make([]prompb.Label, 0, len(arr))
+	labels = append(labels, prompb.Label{Name: "__name__", Value: arr[0]})
+	for _, tv := range arr[1:] {
+		kv := strings.SplitN(tv, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		labels = append(labels, prompb.Label{Name: kv[0], Value: kv[1]})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// remoteReadQuery returns series matched by query
+func (listener *CarbonserverListener) remoteReadQuery(q *prompb.Query, filter *tindex.Filter) (*prompb.QueryResult, error) {
+	metricExpr, tves, post, err := remoteReadExprs(q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	fromTime := int32(q.StartTimestampMs / 1000)
+	untilTime := int32(q.EndTimestampMs / 1000)
+
+	result := &prompb.QueryResult{Timeseries: make([]*prompb.TimeSeries, 0)}
+
+	metrics := listener.tagsIdx.ListMetrics(metricExpr, tves, listener.maxGlobs, filter)
+	atomic.AddUint64(&listener.metrics.MetricsFound, uint64(len(metrics)))
+
+	for _, m := range metrics {
+		// index path is file name with escaped dots: my_DOT_metric;tag=value
+		taggedName := strings.Replace(strings.TrimSuffix(filepath.Base(m.Path), ".wsp"), "_DOT_", ".", -1)
+		if strings.IndexByte(taggedName, ';') < 0 {
+			// file name is hash, tagged name can't be restored
+			continue
+		}
+
+		labels := remoteReadLabels(taggedName)
+		matched := true
+		for _, m := range post {
+			if !m.matches(labels) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		resp, err := listener.fetchSingleMetric(taggedName, "", fromTime, untilTime)
+		if err != nil {
+			continue
+		}
+
+		ts := &prompb.TimeSeries{
+			Labels:  labels,
+			Samples: make([]prompb.Sample, 0, len(resp.Values)),
+		}
+		for i, v := range resp.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			ts.Samples = append(ts.Samples, prompb.Sample{
+				Value:     v,
+				Timestamp: (resp.StartTime + int64(i)*resp.StepTime) * 1000,
+			})
+		}
+		result.Timeseries = append(result.Timeseries, ts)
+	}
+
+	return result, nil
+}
+
+func (listener *CarbonserverListener) remoteReadHandler(wr http.ResponseWriter, req *http.Request) {
+	// URL: /api/v1/read
+	t0 := time.Now()
+	ctx := req.Context()
+
+	atomic.AddUint64(&listener.metrics.RemoteReadRequests, 1)
+
+	accessLogger := TraceContextToZap(ctx, listener.accessLogger.With(
+		zap.String("handler", "remoteRead"),
+		zap.String("url", req.URL.RequestURI()),
+		zap.String("peer", req.RemoteAddr),
+	))
+
+	fail := func(reason string, err error, code int) {
+		atomic.AddUint64(&listener.metrics.RemoteReadErrors, 1)
+		accessLogger.Error("remoteRead failed",
+			zap.Duration("runtime_seconds", time.Since(t0)),
+			zap.String("reason", reason),
+			zap.Error(err),
+			zap.Int("http_code", code),
+		)
+		http.Error(wr, fmt.Sprintf("%s (%v)", reason, err), code)
+	}
+
+	// tagged names are restored from file names of index, hashed file names can't be converted back
+	if listener.hashOnly {
+		fail("Not implemented", fmt.Errorf("remote read is not supported with hash-filenames"), http.StatusNotImplemented)
+		return
+	}
+
+	compressed, err := listener.readBody(wr, req)
+	if err != nil {
+		fail("Bad request", err, http.StatusBadRequest)
+		return
+	}
+
+	if n, err := snappy.DecodedLen(compressed); err != nil || int64(n) > listener.maxBodySize {
+		fail("Bad request", fmt.Errorf("decoded body is over max-body-size or corrupted"), http.StatusBadRequest)
+		return
+	}
+
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		fail("Bad request", err, http.StatusBadRequest)
+		return
+	}
+
+	var readReq prompb.ReadRequest
+	if err = proto.Unmarshal(body, &readReq); err != nil {
+		fail("Bad request", err, http.StatusBadRequest)
+		return
+	}
+
+	readResp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, 0, len(readReq.Queries))}
+	series := 0
+	for _, q := range readReq.Queries {
+		result, err := listener.remoteReadQuery(q, principalFromContext(ctx).accessFilter())
+		if err != nil {
+			fail("Bad request", err, http.StatusBadRequest)
+			return
+		}
+		series += len(result.Timeseries)
+		readResp.Results = append(readResp.Results, result)
+	}
+
+	data, err := proto.Marshal(readResp)
+	if err != nil {
+		fail("Internal error while processing request", err, http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/x-protobuf")
+	wr.Header().Set("Content-Encoding", "snappy")
+	wr.Write(snappy.Encode(nil, data))
+
+	accessLogger.Info("remoteRead success",
+		zap.Duration("runtime_seconds", time.Since(t0)),
+		zap.Int("queries", len(readReq.Queries)),
+		zap.Int("series", series),
+		zap.Int("http_code", http.StatusOK),
+	)
+}
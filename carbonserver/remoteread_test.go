@@ -0,0 +1,177 @@
+package carbonserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+	"github.com/gogo/protobuf/proto"
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/cache"
+	"github.com/lomik/go-carbon/helper/prompb"
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/tags"
+)
+
+func remoteRead(t *testing.T, listener *CarbonserverListener, req *prompb.ReadRequest) (int, *prompb.ReadResponse) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	listener.remoteReadHandler(rr, httptest.NewRequest("POST", "/api/v1/read", bytes.NewReader(snappy.Encode(nil, body))))
+	if rr.Code != http.StatusOK {
+		return rr.Code, nil
+	}
+
+	data, err := snappy.Decode(nil, rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp prompb.ReadResponse
+	if err = proto.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, &resp
+}
+
+func TestRemoteRead(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		now := int(time.Now().Unix())
+		now = now - now%60
+
+		retentions, err := whisper.ParseRetentionDefs("1m:1h")
+		assert.NoError(err)
+
+		for _, metric := range []string{"up;job=node", "up;job=db", "cpu.load;host=a"} {
+			filename := tags.FilePath(root, metric, false) + ".wsp"
+			assert.NoError(os.MkdirAll(filepath.Dir(filename), 0755))
+
+			wsp, err := whisper.Create(filename, retentions, whisper.Last, 0.0)
+			assert.NoError(err)
+			assert.NoError(wsp.UpdateMany([]*whisper.TimeSeriesPoint{
+				{Time: now - 180, Value: 1},
+				{Time: now - 120, Value: 2},
+			}))
+			wsp.Close()
+		}
+
+		c := cache.New()
+		c.Add(points.OnePoint("up;job=node", 3, int64(now-60)))
+
+		listener := NewCarbonserverListener(c.Get)
+		listener.SetWhisperData(root)
+		listener.updateFileList(root)
+
+		query := func(matchers ...*prompb.LabelMatcher) *prompb.Query {
+			return &prompb.Query{
+				StartTimestampMs: int64(now-300) * 1000,
+				EndTimestampMs:   int64(now) * 1000,
+				Matchers:         matchers,
+			}
+		}
+
+		code, resp := remoteRead(t, listener, &prompb.ReadRequest{Queries: []*prompb.Query{
+			query(
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "no.*"},
+			),
+			query(&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}),
+			query(&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "cpu\\..*"}),
+			query(&prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "node|db"}),
+			// missing label has empty value
+			query(
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: ".+"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "node"},
+			),
+			query(
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: ".+"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: ".+"},
+			),
+			query(
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: ""},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "db"},
+			),
+		}})
+
+		assert.Equal(http.StatusOK, code)
+		if !assert.Equal(7, len(resp.Results)) {
+			return
+		}
+
+		if assert.Equal(1, len(resp.Results[0].Timeseries)) {
+			ts := resp.Results[0].Timeseries[0]
+			assert.Equal([]prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}}, ts.Labels)
+			assert.Equal([]prompb.Sample{
+				{Value: 1, Timestamp: int64(now-180) * 1000},
+				{Value: 2, Timestamp: int64(now-120) * 1000},
+				{Value: 3, Timestamp: int64(now-60) * 1000},
+			}, ts.Samples)
+		}
+
+		assert.Equal(2, len(resp.Results[1].Timeseries))
+
+		if assert.Equal(1, len(resp.Results[2].Timeseries)) {
+			assert.Equal([]prompb.Label{{Name: "__name__", Value: "cpu.load"}, {Name: "host", Value: "a"}}, resp.Results[2].Timeseries[0].Labels)
+		}
+
+		names := func(result *prompb.QueryResult) []string {
+			var res []string
+			for _, ts := range result.Timeseries {
+				var name string
+				for _, l := range ts.Labels {
+					if l.Name == "__name__" {
+						name += l.Value
+					} else {
+						name += ";" + l.Name + "=" + l.Value
+					}
+				}
+				res = append(res, name)
+			}
+			return res
+		}
+
+		assert.Equal([]string{"cpu.load;host=a"}, names(resp.Results[3]))
+		assert.ElementsMatch([]string{"cpu.load;host=a", "up;job=db"}, names(resp.Results[4]))
+		assert.Equal([]string{"cpu.load;host=a"}, names(resp.Results[5]))
+		assert.Equal([]string{"up;job=node"}, names(resp.Results[6]))
+
+		// invalid regexp
+		code, _ = remoteRead(t, listener, &prompb.ReadRequest{Queries: []*prompb.Query{
+			query(&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "("}),
+		}})
+		assert.Equal(http.StatusBadRequest, code)
+
+		// body over max-body-size
+		listener.SetMaxBodySize(10)
+		code, _ = remoteRead(t, listener, &prompb.ReadRequest{Queries: []*prompb.Query{
+			query(&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}),
+		}})
+		assert.Equal(http.StatusBadRequest, code)
+		listener.SetMaxBodySize(1024)
+
+		// query without matchers
+		code, _ = remoteRead(t, listener, &prompb.ReadRequest{Queries: []*prompb.Query{query()}})
+		assert.Equal(http.StatusBadRequest, code)
+
+		// tagged names can't be restored from hashed file names
+		listener.SetHashOnly(true)
+		code, _ = remoteRead(t, listener, &prompb.ReadRequest{Queries: []*prompb.Query{
+			query(&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}),
+		}})
+		assert.Equal(http.StatusNotImplemented, code)
+	})
+}
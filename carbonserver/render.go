@@ -20,6 +20,8 @@ import (
 	protov2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	pickle "github.com/lomik/og-rek"
+
+	tindex "github.com/lomik/go-carbon/tags/index"
 )
 
 type fetchResponse struct {
@@ -204,9 +206,11 @@ func (listener *CarbonserverListener) renderHandler(wr http.ResponseWriter, req
 		}
 	}()
 
-	response, fromCache, err := listener.fetchWithCache(logger, format, targets)
+	cluster := listener.newClusterRequest(req, logger)
+	response, fromCache, err := listener.fetchWithCache(logger, format, targets, principalFromContext(ctx), cluster)
 
 	wr.Header().Set("Content-Type", response.contentType)
+	cluster.setFailedHeader(wr)
 	if err != nil {
 		atomic.AddUint64(&listener.metrics.RenderErrors, 1)
 		accessLogger.Error("fetch failed",
@@ -248,7 +252,7 @@ func (listener *CarbonserverListener) renderHandler(wr http.ResponseWriter, req
 
 }
 
-func (listener *CarbonserverListener) fetchWithCache(logger *zap.Logger, format responseFormat, targets map[timeRange][]target) (fetchResponse, bool, error) {
+func (listener *CarbonserverListener) fetchWithCache(logger *zap.Logger, format responseFormat, targets map[timeRange][]target, p *principal, cluster *clusterRequest) (fetchResponse, bool, error) {
 	logger = logger.With(
 		zap.String("function", "fetchWithCache"),
 	)
@@ -265,7 +269,7 @@ func (listener *CarbonserverListener) fetchWithCache(logger *zap.Logger, format
 			}
 			targetKeys = append(targetKeys, fmt.Sprintf("%s&%d&%d", strings.Join(names, "&"), tr.from, tr.until))
 		}
-		key := fmt.Sprintf("%s&%s", strings.Join(targetKeys, "&"), format)
+		key := fmt.Sprintf("%s&%s%s%s", strings.Join(targetKeys, "&"), format, p.cacheKey(), cluster.cacheKey())
 
 		size := uint64(100 * 1024 * 1024)
 		renderRequests := atomic.LoadUint64(&listener.metrics.RenderRequests)
@@ -296,8 +300,8 @@ func (listener *CarbonserverListener) fetchWithCache(logger *zap.Logger, format
 			logger.Debug("query cache miss")
 			atomic.AddUint64(&listener.metrics.QueryCacheMiss, 1)
 
-			response, err = listener.prepareDataProto(format, targets)
-			if err != nil {
+			response, err = listener.prepareDataProto(format, targets, p.accessFilter(), cluster)
+			if err != nil || cluster.failedNodes() > 0 {
 				item.StoreAbort()
 			} else {
 				item.StoreAndUnlock(response)
@@ -310,12 +314,13 @@ func (listener *CarbonserverListener) fetchWithCache(logger *zap.Logger, format
 			fromCache = true
 		}
 	} else {
-		response, err = listener.prepareDataProto(format, targets)
+		response, err = listener.prepareDataProto(format, targets, p.accessFilter(), cluster)
 	}
 	return response, fromCache, err
 }
 
-func (listener *CarbonserverListener) prepareDataProto(format responseFormat, targets map[timeRange][]target) (fetchResponse, error) {
+// prepareDataProto fetches targets and encodes them in format. Series of cluster peers are merged if cluster is not nil
+func (listener *CarbonserverListener) prepareDataProto(format responseFormat, targets map[timeRange][]target, filter *tindex.Filter, cluster *clusterRequest) (fetchResponse, error) {
 	contentType := "application/text"
 	var b []byte
 	var err error
@@ -326,6 +331,15 @@ func (listener *CarbonserverListener) prepareDataProto(format responseFormat, ta
 	var multiv3 protov3.MultiFetchResponse
 	var multiv2 protov2.MultiFetchResponse
 
+	// peers are queried while local files are read
+	var remote chan []protov3.FetchResponse
+	if cluster != nil {
+		remote = make(chan []protov3.FetchResponse, 1)
+		go func() {
+			remote <- cluster.render(targets)
+		}()
+	}
+
 	var metrics []string
 	for tr, ts := range targets {
 		for _, metric := range ts {
@@ -335,6 +349,9 @@ func (listener *CarbonserverListener) prepareDataProto(format responseFormat, ta
 			listener.logger.Debug("fetching data...")
 			if strings.Contains(metric.Name, ";") {
 				metric.Name = strings.Replace(metric.Name, "_DOT_", ".", -1)
+				if !filter.Allowed(metric.Name) {
+					continue
+				}
 				listener.logger.Debug("fetching",
 					zap.Strings("prepareData.path", []string{tags.FilePath("", metric.Name, false)}),
 				)
@@ -357,7 +374,7 @@ func (listener *CarbonserverListener) prepareDataProto(format responseFormat, ta
 				continue
 			}
 
-			files, leafs, err := listener.expandGlobs(metric.Name)
+			files, leafs, err := listener.expandGlobs(metric.Name, filter)
 			if err != nil {
 				listener.logger.Debug("expand globs returned an error",
 					zap.Error(err),
@@ -407,6 +424,14 @@ func (listener *CarbonserverListener) prepareDataProto(format responseFormat, ta
 		}
 	}
 
+	if remote != nil {
+		if format == protoV2Format || format == jsonFormat {
+			multiv2.Metrics = mergeFetchV2(multiv2.Metrics, <-remote)
+		} else {
+			multiv3.Metrics = mergeFetchV3(multiv3.Metrics, <-remote)
+		}
+	}
+
 	if format == protoV2Format || format == jsonFormat {
 		if len(multiv2.Metrics) == 0 && format == protoV2Format {
 			return fetchResponse{nil, contentType, 0, 0, 0, nil}, err
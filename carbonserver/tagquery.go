@@ -92,7 +92,7 @@ func (listener *CarbonserverListener) statTagHandler(wr http.ResponseWriter, req
 	var err error
 	var contentType string
 	var data = []byte("{}")
-	stat := listener.tagsIdx.StatTag(tag, filter, limit)
+	stat := listener.tagsIdx.StatTag(tag, filter, limit, principalFromContext(ctx).accessFilter())
 	if stat != nil {
 		var resp statTagResponse
 		resp.Tag = stat.Tag
@@ -175,7 +175,7 @@ func (listener *CarbonserverListener) listTagsHandler(wr http.ResponseWriter, re
 	var err error
 	var data = []byte(`{}`)
 	var contentType string
-	tags := listener.tagsIdx.ListTags(filter, limit)
+	tags := listener.tagsIdx.ListTags(filter, limit, principalFromContext(ctx).accessFilter())
 	var resp listTagsResponse
 	for _, tag := range tags {
 		resp.Tags = append(resp.Tags, tagType{Tag: tag})
@@ -296,13 +296,13 @@ func (listener *CarbonserverListener) seriesByTagHandler(wr http.ResponseWriter,
 		return
 	}
 
-	metrics := listener.tagsIdx.ListMetrics(metricExpr, tagValues, limit)
+	metrics := listener.tagsIdx.ListMetrics(metricExpr, tagValues, limit, principalFromContext(ctx).accessFilter())
 	paths := make([]string, 0, len(metrics))
 	for _, m := range metrics {
 		paths = append(paths, m.Path)
 	}
 
-	response, _, err := listener.fetchWithCache(logger, format, targets)
+	response, _, err := listener.fetchWithCache(logger, format, targets, principalFromContext(ctx), nil)
 
 	if err != nil {
 		accessLogger.Error("seriesByTag failed",
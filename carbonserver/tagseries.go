@@ -82,7 +82,11 @@ func (listener *CarbonserverListener) tagMultiSeriesHandler(wr http.ResponseWrit
 
 	addedSeries := make([]string, 0)
 
+	filter := principalFromContext(ctx).accessFilter()
 	for _, path := range req.PostForm["path"] {
+		if !filter.Allowed(path) {
+			continue
+		}
 		fileName := tags.FilePath(listener.whisperData, path, listener.hashOnly)
 		metric, tagValues := listener.splitMetricTags(path)
 		if len(tagValues) == 0 {
@@ -9,3 +9,7 @@ chmod 755 /etc/init.d/go-carbon || true
 chmod 644 /etc/go-carbon/go-carbon.conf || true
 chmod 644 /etc/go-carbon/storage-schemas.conf || true
 chmod 644 /etc/go-carbon/storage-aggregation.conf || true
+chmod 644 /etc/go-carbon/rewrite.conf || true
+chmod 644 /etc/go-carbon/quotas.conf || true
+chmod 644 /etc/go-carbon/carbonserver-auth.conf || true
+chmod 644 /etc/go-carbon/cache-priority.conf || true
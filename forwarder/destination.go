@@ -0,0 +1,320 @@
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/zapwriter"
+)
+
+var errExit = errors.New("exit")
+
+const minBackoff = 100 * time.Millisecond
+
+// Destination sends points to one downstream carbon. Points which do not fit into memory queue
+// and chunks which were not sent before stop are stored in disk queue and sent later
+type Destination struct {
+	helper.Stoppable
+	address       string
+	instance      string
+	protocol      string
+	name          string
+	encode        encodeFunc
+	in            chan *points.Points
+	queue         *diskQueue
+	chunkSize     int
+	chunkInterval time.Duration
+	timeout       time.Duration
+	maxBackoff    time.Duration
+	logger        *zap.Logger
+
+	connMutex sync.Mutex
+	conn      net.Conn
+
+	stat struct {
+		queuedPoints  uint32 // counter
+		spooledPoints uint32 // counter
+		droppedPoints uint32 // counter
+		sentBytes     uint32 // counter
+		sendErrors    uint32 // counter
+		connectErrors uint32 // counter
+	}
+}
+
+// NewDestination creates destination. Disk queue is stored in subdirectory of spoolDir
+func NewDestination(address string, protocol string, spoolDir string) (*Destination, error) {
+	encode, err := encoder(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		return nil, err
+	}
+
+	name := strings.NewReplacer(".", "_", ":", "_").Replace(address)
+
+	return &Destination{
+		address:       address,
+		protocol:      protocol,
+		name:          name,
+		encode:        encode,
+		in:            make(chan *points.Points, 100000),
+		queue:         newDiskQueue(filepath.Join(spoolDir, name+"_"+protocol), 64*1024*1024),
+		chunkSize:     32768,
+		chunkInterval: time.Second,
+		timeout:       5 * time.Second,
+		maxBackoff:    30 * time.Second,
+		logger:        zapwriter.Logger("forwarder").With(zap.String("destination", address)),
+	}, nil
+}
+
+// SetInstance sets instance name used by consistent hashing
+func (d *Destination) SetInstance(instance string) {
+	d.instance = instance
+}
+
+// SetQueueSize sets size of memory queue in points. Should be called before start
+func (d *Destination) SetQueueSize(size int) {
+	d.in = make(chan *points.Points, size)
+}
+
+// SetMaxDiskQueueSize sets max size of disk queue in bytes. Oldest files of queue are dropped when it is exceeded. 0 - no limit
+func (d *Destination) SetMaxDiskQueueSize(size int64) {
+	d.queue.setMaxSize(size)
+}
+
+// SetChunkSize sets max size of one write in bytes
+func (d *Destination) SetChunkSize(size int) {
+	d.chunkSize = size
+}
+
+// SetChunkInterval sets max delay of points in memory queue
+func (d *Destination) SetChunkInterval(interval time.Duration) {
+	d.chunkInterval = interval
+}
+
+// SetTimeout sets connect and write timeout
+func (d *Destination) SetTimeout(timeout time.Duration) {
+	d.timeout = timeout
+}
+
+// SetMaxBackoff sets max delay between reconnects
+func (d *Destination) SetMaxBackoff(backoff time.Duration) {
+	d.maxBackoff = backoff
+}
+
+// Send puts points to queue. Caller should not modify points after call
+func (d *Destination) Send(p *points.Points) {
+	select {
+	case d.in <- p:
+		atomic.AddUint32(&d.stat.queuedPoints, uint32(len(p.Data)))
+	default:
+		d.spool(p)
+	}
+}
+
+func (d *Destination) spool(p *points.Points) {
+	buf := bytes.NewBuffer(nil)
+	d.encode(buf, p)
+
+	if err := d.queue.push(buf.Bytes()); err != nil {
+		atomic.AddUint32(&d.stat.droppedPoints, uint32(len(p.Data)))
+		d.logger.Error("disk queue write failed", zap.Error(err))
+		return
+	}
+	atomic.AddUint32(&d.stat.spooledPoints, uint32(len(p.Data)))
+}
+
+func sleep(exit chan bool, d time.Duration) bool {
+	select {
+	case <-exit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// send writes chunk to connection, reconnects with backoff on errors. Returns false on exit
+func (d *Destination) send(exit chan bool, chunk []byte) bool {
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+
+	backoff := minBackoff
+	wait := func() bool {
+		if !sleep(exit, backoff) {
+			return false
+		}
+		backoff *= 2
+		if backoff > d.maxBackoff {
+			backoff = d.maxBackoff
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-exit:
+			return false
+		default:
+		}
+
+		if d.conn == nil {
+			conn, err := net.DialTimeout("tcp", d.address, d.timeout)
+			if err != nil {
+				atomic.AddUint32(&d.stat.connectErrors, 1)
+				d.logger.Error("dial failed", zap.Error(err), zap.Duration("backoff", backoff))
+				if !wait() {
+					return false
+				}
+				continue
+			}
+			d.conn = conn
+		}
+
+		d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+		if _, err := d.conn.Write(chunk); err != nil {
+			atomic.AddUint32(&d.stat.sendErrors, 1)
+			d.logger.Error("write failed", zap.Error(err), zap.Duration("backoff", backoff))
+			d.conn.Close()
+			d.conn = nil
+			if !wait() {
+				return false
+			}
+			continue
+		}
+
+		atomic.AddUint32(&d.stat.sentBytes, uint32(len(chunk)))
+		return true
+	}
+}
+
+// replay sends chunks from disk queue
+func (d *Destination) replay(exit chan bool) {
+	ticker := time.NewTicker(d.chunkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exit:
+			return
+		case <-ticker.C:
+		}
+
+		files, err := d.queue.list()
+		if err != nil {
+			d.logger.Error("disk queue list failed", zap.Error(err))
+			continue
+		}
+
+		if len(files) == 0 {
+			// make current file available on next tick
+			if err = d.queue.flush(); err != nil {
+				d.logger.Error("disk queue flush failed", zap.Error(err))
+			}
+			continue
+		}
+
+		for _, filename := range files {
+			err = readRecords(filename, func(record []byte) error {
+				if !d.send(exit, record) {
+					return errExit
+				}
+				return nil
+			})
+
+			if err == errExit {
+				return
+			}
+
+			if err != nil && err != io.ErrUnexpectedEOF {
+				d.logger.Error("disk queue read failed", zap.String("filename", filename), zap.Error(err))
+			}
+
+			// file can be dropped by max size of queue meanwhile
+			if err = os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				d.logger.Error("disk queue remove failed", zap.String("filename", filename), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Start recovers disk queue and runs send workers
+func (d *Destination) Start() error {
+	return d.StartFunc(func() error {
+		if err := d.queue.recover(); err != nil {
+			return err
+		}
+
+		d.Go(func(exit chan bool) {
+			glue(exit, d.in, d.chunkSize, d.chunkInterval, d.encode, func(chunk []byte) {
+				if d.send(exit, chunk) {
+					return
+				}
+				// stopped before chunk was sent
+				if err := d.queue.push(chunk); err != nil {
+					d.logger.Error("disk queue write failed", zap.Error(err))
+				}
+			})
+		})
+
+		d.Go(d.replay)
+
+		return nil
+	})
+}
+
+// Stop stops workers and moves all unsent points to disk queue
+func (d *Destination) Stop() {
+	d.StopFunc(func() {})
+
+DrainLoop:
+	for {
+		select {
+		case p := <-d.in:
+			d.spool(p)
+		default:
+			break DrainLoop
+		}
+	}
+
+	if err := d.queue.flush(); err != nil {
+		d.logger.Error("disk queue flush failed", zap.Error(err))
+	}
+
+	d.connMutex.Lock()
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+	d.connMutex.Unlock()
+}
+
+// Stat callback
+func (d *Destination) Stat(send helper.StatCallback) {
+	send("queueSize", float64(len(d.in)))
+
+	if files, err := d.queue.list(); err == nil {
+		send("diskQueueFiles", float64(len(files)))
+	}
+
+	helper.SendAndSubstractUint32("queuedPoints", &d.stat.queuedPoints, send)
+	helper.SendAndSubstractUint32("spooledPoints", &d.stat.spooledPoints, send)
+	helper.SendAndSubstractUint32("droppedPoints", &d.stat.droppedPoints, send)
+	helper.SendAndSubstractUint32("diskQueueDroppedFiles", &d.queue.dropped, send)
+	helper.SendAndSubstractUint32("sentBytes", &d.stat.sentBytes, send)
+	helper.SendAndSubstractUint32("sendErrors", &d.stat.sendErrors, send)
+	helper.SendAndSubstractUint32("connectErrors", &d.stat.connectErrors, send)
+}
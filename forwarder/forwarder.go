@@ -0,0 +1,149 @@
+// Package forwarder sends copy of all received points to downstream carbon nodes
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/helper/hashing"
+	"github.com/lomik/go-carbon/points"
+)
+
+// Hashing types
+const (
+	HashingAll      = "all"
+	HashingCarbonCH = "carbon_ch"
+)
+
+// Forwarder distributes points between destinations. Destinations can be replaced on the fly
+type Forwarder struct {
+	mu     sync.RWMutex
+	routes *routes
+}
+
+// routes is one set of destinations. Sending holds read lock of set, so replaced set
+// is returned to caller only after all sends to it are finished
+type routes struct {
+	sending           sync.RWMutex
+	hashingType       string
+	replicationFactor int
+	ring              *hashing.CarbonCH
+	destinations      []*Destination
+	byNode            map[hashing.Node]*Destination
+}
+
+// New creates Forwarder without destinations
+func New() *Forwarder {
+	return &Forwarder{routes: &routes{}}
+}
+
+// SetDestinations replaces destinations and returns previous ones. Caller should start new and stop previous destinations
+func (f *Forwarder) SetDestinations(hashingType string, replicationFactor int, destinations []*Destination) ([]*Destination, error) {
+	var ring *hashing.CarbonCH
+	byNode := make(map[hashing.Node]*Destination)
+
+	switch hashingType {
+	case HashingAll:
+		// pass
+	case HashingCarbonCH:
+		nodes := make([]hashing.Node, 0, len(destinations))
+		for _, d := range destinations {
+			host, _, err := net.SplitHostPort(d.address)
+			if err != nil {
+				return nil, err
+			}
+			node := hashing.Node{Server: host, Instance: d.instance}
+			if _, exists := byNode[node]; exists {
+				return nil, fmt.Errorf("duplicate destination %s with instance %#v", host, d.instance)
+			}
+			byNode[node] = d
+			nodes = append(nodes, node)
+		}
+		ring = hashing.NewCarbonCH(nodes)
+	default:
+		return nil, fmt.Errorf("unknown hashing %#v, should be one of: all, carbon_ch", hashingType)
+	}
+
+	if replicationFactor < 1 {
+		replicationFactor = 1
+	}
+
+	f.mu.Lock()
+	prev := f.routes
+	f.routes = &routes{
+		hashingType:       hashingType,
+		replicationFactor: replicationFactor,
+		ring:              ring,
+		destinations:      destinations,
+		byNode:            byNode,
+	}
+	f.mu.Unlock()
+
+	// wait for sends to previous destinations
+	prev.sending.Lock()
+	defer prev.sending.Unlock()
+
+	return prev.destinations, nil
+}
+
+// Send copy of points to destinations. Destinations may spool points to disk synchronously,
+// forwarder lock is not held meanwhile
+func (f *Forwarder) Send(p *points.Points) {
+	f.mu.RLock()
+	r := f.routes
+	r.sending.RLock()
+	f.mu.RUnlock()
+	defer r.sending.RUnlock()
+
+	if len(r.destinations) == 0 {
+		return
+	}
+
+	// receivers and cache can modify original points
+	c := &points.Points{
+		Metric: p.Metric,
+		Data:   append([]points.Point(nil), p.Data...),
+	}
+
+	if r.ring == nil {
+		for _, d := range r.destinations {
+			d.Send(c)
+		}
+		return
+	}
+
+	for _, node := range r.ring.GetN(c.Metric, r.replicationFactor) {
+		r.byNode[node].Send(c)
+	}
+}
+
+// Store wraps store func with forwarding
+func (f *Forwarder) Store(store func(*points.Points)) func(*points.Points) {
+	return func(p *points.Points) {
+		f.Send(p)
+		store(p)
+	}
+}
+
+// Stop stops all destinations
+func (f *Forwarder) Stop() {
+	prev, _ := f.SetDestinations(HashingAll, 1, nil)
+	for _, d := range prev {
+		d.Stop()
+	}
+}
+
+// Stat callback
+func (f *Forwarder) Stat(send helper.StatCallback) {
+	f.mu.RLock()
+	destinations := f.routes.destinations
+	f.mu.RUnlock()
+
+	for _, d := range destinations {
+		d.Stat(func(metric string, value float64) {
+			send(fmt.Sprintf("%s.%s", d.name, metric), value)
+		})
+	}
+}
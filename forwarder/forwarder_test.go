@@ -0,0 +1,251 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver/parse"
+)
+
+func TestEncode(t *testing.T) {
+	assert := assert.New(t)
+
+	p := points.OnePoint("hello.world", 42, 1470687039).Add(43, 1470687040)
+
+	buf := bytes.NewBuffer(nil)
+	encodePlain(buf, p)
+	assert.Equal("hello.world 42 1470687039\nhello.world 43 1470687040\n", buf.String())
+
+	table := []struct {
+		encode encodeFunc
+		parse  func([]byte) ([]*points.Points, error)
+	}{
+		{encodePickle, parse.Pickle},
+		{encodeProtobuf, parse.Protobuf},
+	}
+
+	for _, tt := range table {
+		buf.Reset()
+		tt.encode(buf, p)
+
+		frame := buf.Bytes()
+		assert.Equal(uint32(len(frame)-4), binary.BigEndian.Uint32(frame[:4]))
+
+		parsed, err := tt.parse(frame[4:])
+		assert.NoError(err)
+		if assert.Equal(1, len(parsed)) {
+			assert.True(p.Eq(parsed[0]))
+		}
+	}
+}
+
+// readLines accepts one connection and sends received lines to channel
+func readLines(t *testing.T, listener net.Listener) chan string {
+	lines := make(chan string, 1024)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+func expectLines(t *testing.T, lines chan string, expected ...string) {
+	received := make([]string, 0)
+	timeout := time.After(5 * time.Second)
+	for len(received) < len(expected) {
+		select {
+		case line := <-lines:
+			received = append(received, line)
+		case <-timeout:
+			t.Fatalf("received %#v, expected %#v", received, expected)
+		}
+	}
+	assert.Equal(t, expected, received)
+}
+
+func TestForwardAll(t *testing.T) {
+	qa.Root(t, func(root string) {
+		listener1, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer listener1.Close()
+
+		listener2, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer listener2.Close()
+
+		lines1 := readLines(t, listener1)
+		lines2 := readLines(t, listener2)
+
+		destinations := make([]*Destination, 0)
+		for _, addr := range []string{listener1.Addr().String(), listener2.Addr().String()} {
+			d, err := NewDestination(addr, ProtocolPlain, root)
+			assert.NoError(t, err)
+			d.SetChunkInterval(10 * time.Millisecond)
+			assert.NoError(t, d.Start())
+			destinations = append(destinations, d)
+		}
+
+		f := New()
+		_, err = f.SetDestinations(HashingAll, 1, destinations)
+		assert.NoError(t, err)
+		defer f.Stop()
+
+		stored := 0
+		store := f.Store(func(p *points.Points) { stored++ })
+		store(points.OnePoint("hello.world", 42, 1470687039))
+
+		assert.Equal(t, 1, stored)
+		expectLines(t, lines1, "hello.world 42 1470687039")
+		expectLines(t, lines2, "hello.world 42 1470687039")
+	})
+}
+
+func TestForwardCarbonCH(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		d1, err := NewDestination("127.0.0.1:2003", ProtocolPlain, root)
+		assert.NoError(err)
+		d2, err := NewDestination("127.0.0.2:2003", ProtocolPlain, root)
+		assert.NoError(err)
+
+		// not started, points stay in memory queue
+		f := New()
+		_, err = f.SetDestinations(HashingCarbonCH, 1, []*Destination{d1, d2})
+		assert.NoError(err)
+
+		for _, m := range []string{"a.b.c", "servers.web1.cpu.user", "x", "carbon.agents.host1.cache.size"} {
+			f.Send(points.OnePoint(m, 1, 10))
+		}
+		assert.Equal(4, len(d1.in)+len(d2.in))
+		assert.True(len(d1.in) > 0 && len(d2.in) > 0)
+
+		_, err = f.SetDestinations(HashingCarbonCH, 2, []*Destination{d1, d2})
+		assert.NoError(err)
+		f.Send(points.OnePoint("x", 1, 10))
+		assert.Equal(6, len(d1.in)+len(d2.in))
+
+		_, err = f.SetDestinations(HashingCarbonCH, 1, []*Destination{d1, d1})
+		assert.Error(err)
+
+		_, err = f.SetDestinations("unknown", 1, []*Destination{d1})
+		assert.Error(err)
+	})
+}
+
+func TestDiskQueue(t *testing.T) {
+	qa.Root(t, func(root string) {
+		// reserve address, nobody listens
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		addr := listener.Addr().String()
+		listener.Close()
+
+		d, err := NewDestination(addr, ProtocolPlain, root)
+		assert.NoError(t, err)
+		d.SetQueueSize(1)
+		d.SetChunkInterval(10 * time.Millisecond)
+		d.SetMaxBackoff(10 * time.Millisecond)
+		assert.NoError(t, d.Start())
+
+		expected := make([]string, 0)
+		for i := 0; i < 10; i++ {
+			expected = append(expected, fmt.Sprintf("hello.world %d 1470687039", i))
+			d.Send(points.OnePoint("hello.world", float64(i), 1470687039))
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		d.Stop()
+
+		files, err := d.queue.list()
+		assert.NoError(t, err)
+		assert.NotEqual(t, 0, len(files))
+
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			t.Skip("address reused: ", err)
+		}
+		defer listener.Close()
+		lines := readLines(t, listener)
+
+		d, err = NewDestination(addr, ProtocolPlain, root)
+		assert.NoError(t, err)
+		d.SetChunkInterval(10 * time.Millisecond)
+		assert.NoError(t, d.Start())
+		defer d.Stop()
+
+		received := make(map[string]bool)
+		timeout := time.After(5 * time.Second)
+		for len(received) < len(expected) {
+			select {
+			case line := <-lines:
+				received[line] = true
+			case <-timeout:
+				t.Fatalf("received %#v, expected %#v", received, expected)
+			}
+		}
+		for _, line := range expected {
+			assert.True(t, received[line], line)
+		}
+	})
+}
+
+func TestDiskQueueMaxSize(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		q := newDiskQueue(root, 64*1024*1024)
+		q.setMaxSize(1000)
+		assert.Equal(int64(250), q.segmentSize)
+
+		record := bytes.Repeat([]byte{'a'}, 96)
+		for i := 0; i < 50; i++ {
+			record[0] = byte(i)
+			assert.NoError(q.push(record))
+		}
+		assert.NoError(q.flush())
+
+		files, err := q.list()
+		assert.NoError(err)
+
+		var size int64
+		var first []byte
+		for _, filename := range files {
+			info, err := os.Stat(filename)
+			if assert.NoError(err) {
+				size += info.Size()
+			}
+			if first == nil {
+				readRecords(filename, func(r []byte) error {
+					first = r
+					return errExit
+				})
+			}
+		}
+		assert.True(size <= 1000+q.segmentSize, "size: %d", size)
+		assert.True(q.dropped > 0)
+
+		// oldest records are dropped
+		if assert.NotNil(first) {
+			assert.True(first[0] > 0)
+		}
+	})
+}
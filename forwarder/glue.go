@@ -0,0 +1,58 @@
+package forwarder
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+// glue joins points from channel into chunks encoded with encode. Chunk is flushed before encoded points
+// if they do not fit into chunkSize. Buffered chunk is flushed on exit, so it can be moved to disk queue
+func glue(exit chan bool, in chan *points.Points, chunkSize int, chunkTimeout time.Duration, encode encodeFunc, callback func([]byte)) {
+	var p *points.Points
+	var ok bool
+
+	buf := bytes.NewBuffer(nil)
+	tmp := bytes.NewBuffer(nil)
+
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		callback(buf.Bytes())
+		buf = bytes.NewBuffer(nil)
+	}
+
+	ticker := time.NewTicker(chunkTimeout)
+	defer ticker.Stop()
+
+	for {
+		p = nil
+		select {
+		case p, ok = <-in:
+			if !ok { // in chan closed
+				flush()
+				return
+			}
+			// pass
+		case <-ticker.C:
+			flush()
+		case <-exit:
+			flush()
+			return
+		}
+
+		if p == nil {
+			continue
+		}
+
+		tmp.Reset()
+		encode(tmp, p)
+
+		if buf.Len()+tmp.Len() > chunkSize {
+			flush()
+		}
+		buf.Write(tmp.Bytes())
+	}
+}
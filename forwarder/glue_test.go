@@ -0,0 +1,39 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestGlue(t *testing.T) {
+	assert := assert.New(t)
+
+	in := make(chan *points.Points, 10)
+	exit := make(chan bool)
+
+	in <- points.OnePoint("hello.world", 42, 1470687039).Add(43, 1470687040)
+	in <- points.OnePoint("hello.world", 44, 1470687041)
+
+	var chunks []string
+	done := make(chan bool)
+	go func() {
+		glue(exit, in, 60, time.Hour, encodePlain, func(chunk []byte) {
+			chunks = append(chunks, string(chunk))
+		})
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(exit)
+	<-done
+
+	// points are not split between chunks, last chunk is flushed on exit
+	assert.Equal([]string{
+		"hello.world 42 1470687039\nhello.world 43 1470687040\n",
+		"hello.world 44 1470687041\n",
+	}, chunks)
+}
@@ -0,0 +1,79 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+	pickle "github.com/lomik/graphite-pickle"
+
+	"github.com/lomik/go-carbon/helper/carbonpb"
+	"github.com/lomik/go-carbon/points"
+)
+
+// Destination protocols
+const (
+	ProtocolPlain    = "plain"
+	ProtocolPickle   = "pickle"
+	ProtocolProtobuf = "protobuf"
+)
+
+type encodeFunc func(buf *bytes.Buffer, p *points.Points)
+
+func encoder(protocol string) (encodeFunc, error) {
+	switch protocol {
+	case ProtocolPlain:
+		return encodePlain, nil
+	case ProtocolPickle:
+		return encodePickle, nil
+	case ProtocolProtobuf:
+		return encodeProtobuf, nil
+	}
+	return nil, fmt.Errorf("unknown protocol %#v, should be one of: plain, pickle, protobuf", protocol)
+}
+
+func encodePlain(buf *bytes.Buffer, p *points.Points) {
+	p.WriteTo(buf)
+}
+
+// writeFrame writes message with 4 bytes big endian size prefix, as receiver/tcp framing expects
+func writeFrame(buf *bytes.Buffer, msg []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(msg)))
+	buf.Write(size[:])
+	buf.Write(msg)
+}
+
+func encodePickle(buf *bytes.Buffer, p *points.Points) {
+	// one point per message: graphite carbon expects (name, (timestamp, value)) items
+	msgs := make([]pickle.Message, len(p.Data))
+	for i, d := range p.Data {
+		msgs[i] = pickle.Message{
+			Name:   p.Metric,
+			Points: []pickle.DataPoint{{Timestamp: d.Timestamp, Value: d.Value}},
+		}
+	}
+
+	msg, err := pickle.MarshalMessages(msgs)
+	if err != nil {
+		return
+	}
+	writeFrame(buf, msg)
+}
+
+func encodeProtobuf(buf *bytes.Buffer, p *points.Points) {
+	m := &carbonpb.Metric{
+		Metric: p.Metric,
+		Points: make([]carbonpb.Point, len(p.Data)),
+	}
+	for i, d := range p.Data {
+		m.Points[i] = carbonpb.Point{Timestamp: uint32(d.Timestamp), Value: d.Value}
+	}
+
+	msg, err := proto.Marshal(&carbonpb.Payload{Metrics: []*carbonpb.Metric{m}})
+	if err != nil {
+		return
+	}
+	writeFrame(buf, msg)
+}
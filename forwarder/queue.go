@@ -0,0 +1,249 @@
+package forwarder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const queueSuffix = ".queue"
+const queueTmpSuffix = ".tmp"
+
+// diskQueue stores encoded chunks in files. File is written with .tmp suffix and renamed
+// on close, so only complete files are read. Every record is prefixed with 4 bytes size.
+// Oldest complete files are removed when size of queue is over maxSize
+type diskQueue struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64 // 0 - no limit
+
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	tmpPath string
+	written int64
+	lastID  int64
+	dropped uint32 // counter of files removed by maxSize
+}
+
+func newDiskQueue(dir string, segmentSize int64) *diskQueue {
+	return &diskQueue{
+		dir:         dir,
+		segmentSize: segmentSize,
+	}
+}
+
+// push appends record to current file
+func (q *diskQueue) push(record []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file == nil {
+		if err := q.open(); err != nil {
+			return err
+		}
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(record)))
+
+	if _, err := q.writer.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := q.writer.Write(record); err != nil {
+		return err
+	}
+	q.written += int64(len(record) + 4)
+
+	if q.written >= q.segmentSize {
+		if err := q.close(); err != nil {
+			return err
+		}
+		return q.trim()
+	}
+	return nil
+}
+
+// setMaxSize sets max size of all files in bytes. Files are not bigger than quarter of it
+func (q *diskQueue) setMaxSize(maxSize int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.maxSize = maxSize
+	if maxSize > 0 && q.segmentSize > maxSize/4 {
+		q.segmentSize = maxSize / 4
+	}
+}
+
+// trim removes oldest complete files while size of queue is over maxSize. Called with locked mutex
+func (q *diskQueue) trim() error {
+	if q.maxSize <= 0 {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var complete []os.FileInfo
+	size := q.written
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), queueSuffix) {
+			complete = append(complete, file)
+			size += file.Size()
+		}
+	}
+
+	// names are nanosecond timestamps with same length
+	sort.Slice(complete, func(i, j int) bool { return complete[i].Name() < complete[j].Name() })
+
+	for _, file := range complete {
+		if size <= q.maxSize {
+			break
+		}
+		if err = os.Remove(filepath.Join(q.dir, file.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= file.Size()
+		atomic.AddUint32(&q.dropped, 1)
+	}
+	return nil
+}
+
+// open creates new file. Called with locked mutex
+func (q *diskQueue) open() error {
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return err
+	}
+
+	id := time.Now().UnixNano()
+	if id <= q.lastID {
+		id = q.lastID + 1
+	}
+
+	tmpPath := filepath.Join(q.dir, fmt.Sprintf("%d%s%s", id, queueSuffix, queueTmpSuffix))
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	q.lastID = id
+	q.file = file
+	q.writer = bufio.NewWriterSize(file, 65536)
+	q.tmpPath = tmpPath
+	q.written = 0
+	return nil
+}
+
+// close flushes and renames current file. Called with locked mutex
+func (q *diskQueue) close() error {
+	if q.file == nil {
+		return nil
+	}
+
+	err := q.writer.Flush()
+	if closeErr := q.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(q.tmpPath, strings.TrimSuffix(q.tmpPath, queueTmpSuffix))
+	}
+
+	q.file = nil
+	q.writer = nil
+	q.written = 0
+	return err
+}
+
+// flush closes current file, so it becomes available for read
+func (q *diskQueue) flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.close()
+}
+
+// recover makes files left unfinished by previous run available for read
+func (q *diskQueue) recover() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(q.dir, "*"+queueSuffix+queueTmpSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, tmpPath := range files {
+		if tmpPath == q.tmpPath && q.file != nil {
+			continue
+		}
+		if err = os.Rename(tmpPath, strings.TrimSuffix(tmpPath, queueTmpSuffix)); err != nil {
+			return err
+		}
+	}
+	return q.trim()
+}
+
+// list returns complete files sorted from oldest
+func (q *diskQueue) list() ([]string, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	res := make([]string, 0)
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), queueSuffix) {
+			res = append(res, filepath.Join(q.dir, file.Name()))
+		}
+	}
+
+	// names are nanosecond timestamps with same length
+	sort.Strings(res)
+	return res, nil
+}
+
+// readRecords calls callback for every record in file. Stops on callback error
+func readRecords(filename string, callback func([]byte) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 65536)
+	var size [4]byte
+
+	for {
+		if _, err := io.ReadFull(reader, size[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		record := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(reader, record); err != nil {
+			return err
+		}
+
+		if err := callback(record); err != nil {
+			return err
+		}
+	}
+}
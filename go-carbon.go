@@ -62,6 +62,16 @@ func main() {
 
 	cat := flag.String("cat", "", "Print cache dump file")
 
+	reconcileAggregation := flag.Bool("reconcile-aggregation", false, "Update aggregation method and xFilesFactor of existing whisper files to storage-aggregation.conf and exit")
+	dryRun := flag.Bool("dry-run", false, "Print changes of -reconcile-aggregation without applying them")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [command [arguments]]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr)
+		carbon.WhisperCommandUsage(os.Stderr)
+	}
+
 	flag.Parse()
 
 	if *printVersion {
@@ -81,6 +91,18 @@ func main() {
 		return
 	}
 
+	// whisper maintenance command. Only [whisper] options of config are used
+	if flag.NArg() > 0 {
+		cfg, err := carbon.ReadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = carbon.WhisperCommand(cfg, os.Stdout, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *printDefaultConfig {
 		if err = carbon.PrintDefaultConfig(); err != nil {
 			log.Fatal(err)
@@ -109,6 +131,13 @@ func main() {
 		return
 	}
 
+	if *reconcileAggregation {
+		if err = app.ReconcileAggregation(os.Stdout, *dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	for i := 0; i < len(cfg.Logging); i++ {
 		if err := zapwriter.PrepareFileForUser(cfg.Logging[i].File, runAsUser); err != nil {
 			log.Fatal(err)
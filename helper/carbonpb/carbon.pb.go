@@ -13,6 +13,8 @@
 		Metric
 		Payload
 		CacheRequest
+		BackfillResult
+		BackfillResponse
 */
 package carbonpb
 
@@ -91,11 +93,41 @@ func (m *CacheRequest) String() string            { return proto.CompactTextStri
 func (*CacheRequest) ProtoMessage()               {}
 func (*CacheRequest) Descriptor() ([]byte, []int) { return fileDescriptorCarbon, []int{3} }
 
+type BackfillResult struct {
+	Metric   string `protobuf:"bytes,1,opt,name=metric,proto3" json:"metric,omitempty"`
+	Written  uint32 `protobuf:"varint,2,opt,name=written,proto3" json:"written,omitempty"`
+	Rejected uint32 `protobuf:"varint,3,opt,name=rejected,proto3" json:"rejected,omitempty"`
+	Error    string `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (m *BackfillResult) Reset()                    { *m = BackfillResult{} }
+func (m *BackfillResult) String() string            { return proto.CompactTextString(m) }
+func (*BackfillResult) ProtoMessage()               {}
+func (*BackfillResult) Descriptor() ([]byte, []int) { return fileDescriptorCarbon, []int{4} }
+
+type BackfillResponse struct {
+	Results []*BackfillResult `protobuf:"bytes,1,rep,name=results" json:"results,omitempty"`
+}
+
+func (m *BackfillResponse) Reset()                    { *m = BackfillResponse{} }
+func (m *BackfillResponse) String() string            { return proto.CompactTextString(m) }
+func (*BackfillResponse) ProtoMessage()               {}
+func (*BackfillResponse) Descriptor() ([]byte, []int) { return fileDescriptorCarbon, []int{5} }
+
+func (m *BackfillResponse) GetResults() []*BackfillResult {
+	if m != nil {
+		return m.Results
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Point)(nil), "carbonpb.Point")
 	proto.RegisterType((*Metric)(nil), "carbonpb.Metric")
 	proto.RegisterType((*Payload)(nil), "carbonpb.Payload")
 	proto.RegisterType((*CacheRequest)(nil), "carbonpb.CacheRequest")
+	proto.RegisterType((*BackfillResult)(nil), "carbonpb.BackfillResult")
+	proto.RegisterType((*BackfillResponse)(nil), "carbonpb.BackfillResponse")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -111,6 +143,8 @@ const _ = grpc.SupportPackageIsVersion3
 type CarbonClient interface {
 	// Same as carbonlink
 	CacheQuery(ctx context.Context, in *CacheRequest, opts ...grpc.CallOption) (*Payload, error)
+	// Writes points directly to whisper files, bypassing cache
+	Backfill(ctx context.Context, in *Payload, opts ...grpc.CallOption) (*BackfillResponse, error)
 }
 
 type carbonClient struct {
@@ -130,11 +164,22 @@ func (c *carbonClient) CacheQuery(ctx context.Context, in *CacheRequest, opts ..
 	return out, nil
 }
 
+func (c *carbonClient) Backfill(ctx context.Context, in *Payload, opts ...grpc.CallOption) (*BackfillResponse, error) {
+	out := new(BackfillResponse)
+	err := grpc.Invoke(ctx, "/carbonpb.Carbon/Backfill", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Carbon service
 
 type CarbonServer interface {
 	// Same as carbonlink
 	CacheQuery(context.Context, *CacheRequest) (*Payload, error)
+	// Writes points directly to whisper files, bypassing cache
+	Backfill(context.Context, *Payload) (*BackfillResponse, error)
 }
 
 func RegisterCarbonServer(s *grpc.Server, srv CarbonServer) {
@@ -159,6 +204,24 @@ func _Carbon_CacheQuery_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Carbon_Backfill_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Payload)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CarbonServer).Backfill(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/carbonpb.Carbon/Backfill",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CarbonServer).Backfill(ctx, req.(*Payload))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Carbon_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "carbonpb.Carbon",
 	HandlerType: (*CarbonServer)(nil),
@@ -167,6 +230,10 @@ var _Carbon_serviceDesc = grpc.ServiceDesc{
 			MethodName: "CacheQuery",
 			Handler:    _Carbon_CacheQuery_Handler,
 		},
+		{
+			MethodName: "Backfill",
+			Handler:    _Carbon_Backfill_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: fileDescriptorCarbon,
@@ -299,6 +366,76 @@ func (m *CacheRequest) MarshalTo(dAtA []byte) (int, error) {
 	return i, nil
 }
 
+func (m *BackfillResult) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *BackfillResult) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Metric) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintCarbon(dAtA, i, uint64(len(m.Metric)))
+		i += copy(dAtA[i:], m.Metric)
+	}
+	if m.Written != 0 {
+		dAtA[i] = 0x10
+		i++
+		i = encodeVarintCarbon(dAtA, i, uint64(m.Written))
+	}
+	if m.Rejected != 0 {
+		dAtA[i] = 0x18
+		i++
+		i = encodeVarintCarbon(dAtA, i, uint64(m.Rejected))
+	}
+	if len(m.Error) > 0 {
+		dAtA[i] = 0x22
+		i++
+		i = encodeVarintCarbon(dAtA, i, uint64(len(m.Error)))
+		i += copy(dAtA[i:], m.Error)
+	}
+	return i, nil
+}
+
+func (m *BackfillResponse) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *BackfillResponse) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Results) > 0 {
+		for _, msg := range m.Results {
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintCarbon(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	return i, nil
+}
+
 func encodeFixed64Carbon(dAtA []byte, offset int, v uint64) int {
 	dAtA[offset] = uint8(v)
 	dAtA[offset+1] = uint8(v >> 8)
@@ -378,6 +515,38 @@ func (m *CacheRequest) Size() (n int) {
 	return n
 }
 
+func (m *BackfillResult) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Metric)
+	if l > 0 {
+		n += 1 + l + sovCarbon(uint64(l))
+	}
+	if m.Written != 0 {
+		n += 1 + sovCarbon(uint64(m.Written))
+	}
+	if m.Rejected != 0 {
+		n += 1 + sovCarbon(uint64(m.Rejected))
+	}
+	l = len(m.Error)
+	if l > 0 {
+		n += 1 + l + sovCarbon(uint64(l))
+	}
+	return n
+}
+
+func (m *BackfillResponse) Size() (n int) {
+	var l int
+	_ = l
+	if len(m.Results) > 0 {
+		for _, e := range m.Results {
+			l = e.Size()
+			n += 1 + l + sovCarbon(uint64(l))
+		}
+	}
+	return n
+}
+
 func sovCarbon(x uint64) (n int) {
 	for {
 		n++
@@ -748,6 +917,233 @@ func (m *CacheRequest) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *BackfillResult) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowCarbon
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: BackfillResult: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: BackfillResult: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metric", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowCarbon
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthCarbon
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Metric = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Written", wireType)
+			}
+			m.Written = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowCarbon
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Written |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Rejected", wireType)
+			}
+			m.Rejected = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowCarbon
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Rejected |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Error", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowCarbon
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthCarbon
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Error = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipCarbon(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthCarbon
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *BackfillResponse) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowCarbon
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: BackfillResponse: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: BackfillResponse: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Results", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowCarbon
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthCarbon
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Results = append(m.Results, &BackfillResult{})
+			if err := m.Results[len(m.Results)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipCarbon(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthCarbon
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipCarbon(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -856,23 +1252,29 @@ var (
 func init() { proto.RegisterFile("carbon.proto", fileDescriptorCarbon) }
 
 var fileDescriptorCarbon = []byte{
-	// 278 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x54, 0x90, 0xd1, 0x4a, 0xc3, 0x30,
-	0x14, 0x86, 0x97, 0xe9, 0x3a, 0x7b, 0xac, 0xa8, 0x41, 0x46, 0x19, 0x52, 0x4b, 0xaf, 0x8a, 0xb0,
-	0x0e, 0x26, 0x5e, 0x88, 0x77, 0xeb, 0xb5, 0x38, 0xf3, 0x06, 0x49, 0x8d, 0x5d, 0x61, 0x5d, 0x6a,
-	0x9b, 0x08, 0x7b, 0xc3, 0x5d, 0xfa, 0x04, 0x22, 0x7d, 0x12, 0xf1, 0x64, 0xb3, 0xf3, 0xee, 0xfc,
-	0xe1, 0xff, 0xbe, 0x73, 0x08, 0x78, 0x19, 0xaf, 0x85, 0x5a, 0x27, 0x55, 0xad, 0xb4, 0xa2, 0x27,
-	0x36, 0x55, 0x62, 0x3c, 0xc9, 0x0b, 0xbd, 0x34, 0x22, 0xc9, 0x54, 0x39, 0xcd, 0x55, 0xae, 0xa6,
-	0x58, 0x10, 0xe6, 0x0d, 0x13, 0x06, 0x9c, 0x2c, 0x18, 0x3d, 0xc2, 0x60, 0xa1, 0x8a, 0xb5, 0xa6,
-	0xd7, 0xe0, 0xea, 0xa2, 0x94, 0x8d, 0xe6, 0x65, 0xe5, 0x93, 0x90, 0xc4, 0x67, 0xac, 0x7b, 0xa0,
-	0x57, 0x30, 0xf8, 0xe0, 0x2b, 0x23, 0xfd, 0x7e, 0x48, 0x62, 0xc2, 0x6c, 0x88, 0x9e, 0xc1, 0x79,
-	0x92, 0xba, 0x2e, 0x32, 0x3a, 0x02, 0xa7, 0xc4, 0x09, 0x51, 0x97, 0xed, 0x12, 0x9d, 0x80, 0x53,
-	0xfd, 0xea, 0x1b, 0xbf, 0x1f, 0x1e, 0xc5, 0xa7, 0xb3, 0xf3, 0x64, 0x7f, 0x68, 0x82, 0x6b, 0xe7,
-	0xc7, 0xdb, 0xaf, 0x9b, 0x1e, 0xdb, 0x95, 0xa2, 0x7b, 0x18, 0x2e, 0xf8, 0x66, 0xa5, 0xf8, 0x2b,
-	0xbd, 0x85, 0xa1, 0x75, 0x34, 0x3e, 0x41, 0xf4, 0xa2, 0x43, 0xed, 0x52, 0xb6, 0x2f, 0x44, 0x31,
-	0x78, 0x29, 0xcf, 0x96, 0x92, 0xc9, 0x77, 0x23, 0x1b, 0x4d, 0xfd, 0xff, 0xac, 0xfb, 0xd7, 0x9c,
-	0xa5, 0xe0, 0xa4, 0x68, 0xa1, 0x0f, 0x00, 0xc8, 0xbc, 0x18, 0x59, 0x6f, 0xe8, 0xa8, 0x93, 0x1f,
-	0x9a, 0xc6, 0x97, 0x07, 0xf7, 0xda, 0xc3, 0xa2, 0xde, 0xdc, 0xdb, 0xb6, 0x01, 0xf9, 0x6c, 0x03,
-	0xf2, 0xdd, 0x06, 0x44, 0x38, 0xf8, 0x91, 0x77, 0x3f, 0x01, 0x00, 0x00, 0xff, 0xff, 0x96, 0x97,
-	0x56, 0x0a, 0x91, 0x01, 0x00, 0x00,
+	// 375 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x92, 0xcf, 0x6e, 0xda, 0x40,
+	0x10, 0xc6, 0x59, 0xfe, 0xd8, 0x30, 0x85, 0x96, 0xae, 0x2a, 0xb4, 0xb2, 0x2a, 0x8a, 0x7c, 0xb2,
+	0x2a, 0x61, 0x24, 0xaa, 0x1e, 0x2a, 0x6e, 0x20, 0xf5, 0x56, 0x95, 0xec, 0x1b, 0xd8, 0x66, 0x01,
+	0x27, 0xb6, 0xd7, 0x59, 0xaf, 0x13, 0x71, 0xcb, 0xe3, 0x71, 0xcc, 0x13, 0x44, 0x11, 0x4f, 0x12,
+	0x31, 0xc6, 0x31, 0x28, 0xc9, 0x6d, 0x7e, 0xf6, 0xf7, 0xcd, 0x7c, 0x33, 0x5a, 0xe8, 0x06, 0x9e,
+	0xf2, 0x65, 0xe2, 0xa6, 0x4a, 0x6a, 0x49, 0xdb, 0x05, 0xa5, 0xbe, 0x35, 0xde, 0x84, 0x7a, 0x9b,
+	0xfb, 0x6e, 0x20, 0xe3, 0xc9, 0x46, 0x6e, 0xe4, 0x04, 0x05, 0x7e, 0xbe, 0x46, 0x42, 0xc0, 0xaa,
+	0x30, 0xda, 0x33, 0x68, 0x2d, 0x65, 0x98, 0x68, 0xfa, 0x1d, 0x3a, 0x3a, 0x8c, 0x45, 0xa6, 0xbd,
+	0x38, 0x65, 0x64, 0x44, 0x9c, 0x1e, 0xaf, 0x3e, 0xd0, 0x6f, 0xd0, 0xba, 0xf3, 0xa2, 0x5c, 0xb0,
+	0xfa, 0x88, 0x38, 0x84, 0x17, 0x60, 0xff, 0x07, 0xe3, 0x9f, 0xd0, 0x2a, 0x0c, 0xe8, 0x00, 0x8c,
+	0x18, 0x2b, 0xb4, 0x76, 0xf8, 0x89, 0xe8, 0x18, 0x8c, 0xf4, 0xd8, 0x3e, 0x63, 0xf5, 0x51, 0xc3,
+	0xf9, 0x34, 0xfd, 0xe2, 0x96, 0x41, 0x5d, 0x1c, 0x3b, 0x6f, 0xee, 0x9f, 0x7e, 0xd4, 0xf8, 0x49,
+	0x64, 0xff, 0x06, 0x73, 0xe9, 0xed, 0x22, 0xe9, 0xad, 0xe8, 0x4f, 0x30, 0x8b, 0x1e, 0x19, 0x23,
+	0x68, 0xed, 0x57, 0xd6, 0x62, 0x28, 0x2f, 0x05, 0xb6, 0x03, 0xdd, 0x85, 0x17, 0x6c, 0x05, 0x17,
+	0xb7, 0xb9, 0xc8, 0x34, 0x65, 0x97, 0xde, 0x4e, 0xa5, 0xd4, 0xf0, 0x79, 0xee, 0x05, 0x37, 0xeb,
+	0x30, 0x8a, 0xb8, 0xc8, 0xf2, 0x48, 0x7f, 0x98, 0x9c, 0x81, 0x79, 0xaf, 0x42, 0xad, 0x45, 0x82,
+	0x3b, 0xf7, 0x78, 0x89, 0xd4, 0x82, 0xb6, 0x12, 0xd7, 0x22, 0xd0, 0x62, 0xc5, 0x1a, 0xf8, 0xeb,
+	0x95, 0x8f, 0x77, 0x12, 0x4a, 0x49, 0xc5, 0x9a, 0xd8, 0xac, 0x00, 0xfb, 0x2f, 0xf4, 0xcf, 0xa6,
+	0xa6, 0x32, 0xc9, 0x04, 0x9d, 0x82, 0xa9, 0x30, 0x41, 0xb9, 0x1f, 0xab, 0xf6, 0xbb, 0x8c, 0xc8,
+	0x4b, 0xe1, 0xf4, 0x81, 0x80, 0xb1, 0x40, 0x11, 0xfd, 0x03, 0x80, 0x2b, 0x5f, 0xe5, 0x42, 0xed,
+	0xe8, 0xa0, 0xf2, 0x9e, 0x1f, 0xc2, 0xfa, 0x7a, 0x76, 0xee, 0xe2, 0xae, 0x76, 0x8d, 0xce, 0xa0,
+	0x5d, 0x0e, 0xa0, 0x6f, 0x05, 0x96, 0xf5, 0x6e, 0x0e, 0x0c, 0x6d, 0xd7, 0xe6, 0xdd, 0xfd, 0x61,
+	0x48, 0x1e, 0x0f, 0x43, 0xf2, 0x7c, 0x18, 0x12, 0xdf, 0xc0, 0x47, 0xf4, 0xeb, 0x65, 0x00, 0x2a,
+	0xa5, 0x0b, 0x84, 0x8d, 0x02, 0x00, 0x00,
 }
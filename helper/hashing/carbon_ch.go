@@ -0,0 +1,114 @@
+// Package hashing implements metric to node distribution compatible with graphite carbon-relay
+package hashing
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Node is destination in form of carbon-relay DESTINATIONS: server and optional instance
+type Node struct {
+	Server   string
+	Instance string
+}
+
+func (n Node) ringKey() string {
+	// python str() of (server, instance) tuple
+	if n.Instance == "" {
+		return fmt.Sprintf("('%s', None)", n.Server)
+	}
+	return fmt.Sprintf("('%s', '%s')", n.Server, n.Instance)
+}
+
+type ringEntry struct {
+	position int
+	node     int // index in nodes
+}
+
+// CarbonCH is consistent hash ring of carbon_ch type
+type CarbonCH struct {
+	nodes        []Node
+	ring         []ringEntry
+	replicaCount int
+}
+
+// NewCarbonCH creates ring with default replica count (100)
+func NewCarbonCH(nodes []Node) *CarbonCH {
+	return NewCarbonCHWithReplicas(nodes, 100)
+}
+
+// NewCarbonCHWithReplicas creates ring
+func NewCarbonCHWithReplicas(nodes []Node, replicaCount int) *CarbonCH {
+	r := &CarbonCH{
+		replicaCount: replicaCount,
+	}
+	for _, node := range nodes {
+		r.add(node)
+	}
+	return r
+}
+
+func carbonCHPosition(key string) int {
+	sum := md5.Sum([]byte(key))
+	position, _ := strconv.ParseInt(hex.EncodeToString(sum[:2]), 16, 32)
+	return int(position)
+}
+
+func (r *CarbonCH) add(node Node) {
+	index := len(r.nodes)
+	r.nodes = append(r.nodes, node)
+
+	used := make(map[int]bool, len(r.ring))
+	for _, e := range r.ring {
+		used[e.position] = true
+	}
+
+	for i := 0; i < r.replicaCount; i++ {
+		position := carbonCHPosition(fmt.Sprintf("%s:%d", node.ringKey(), i))
+		for used[position] {
+			position++
+		}
+		used[position] = true
+		r.ring = append(r.ring, ringEntry{position: position, node: index})
+	}
+
+	sort.Slice(r.ring, func(i, j int) bool { return r.ring[i].position < r.ring[j].position })
+}
+
+// Nodes returns all nodes of ring
+func (r *CarbonCH) Nodes() []Node {
+	return r.nodes
+}
+
+// Get returns node for metric
+func (r *CarbonCH) Get(metric string) Node {
+	return r.GetN(metric, 1)[0]
+}
+
+// GetN returns up to n distinct nodes for metric in carbon-relay replication order
+func (r *CarbonCH) GetN(metric string, n int) []Node {
+	if len(r.ring) == 0 {
+		return nil
+	}
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+
+	position := carbonCHPosition(metric)
+	index := sort.Search(len(r.ring), func(i int) bool { return r.ring[i].position >= position }) % len(r.ring)
+
+	res := make([]Node, 0, n)
+	seen := make(map[int]bool, n)
+	for i := 0; i < len(r.ring) && len(res) < n; i++ {
+		e := r.ring[(index+i)%len(r.ring)]
+		if seen[e.node] {
+			continue
+		}
+		seen[e.node] = true
+		res = append(res, r.nodes[e.node])
+	}
+	return res
+}
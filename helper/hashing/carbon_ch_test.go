@@ -0,0 +1,37 @@
+package hashing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCarbonCH(t *testing.T) {
+	assert := assert.New(t)
+
+	n1 := Node{Server: "127.0.0.1"}
+	n2 := Node{Server: "127.0.0.2", Instance: "a"}
+	n3 := Node{Server: "10.0.0.3"}
+
+	r := NewCarbonCH([]Node{n1, n2, n3})
+
+	// expected values are from graphite carbon ConsistentHashRing
+	table := []struct {
+		metric   string
+		expected []Node
+	}{
+		{"carbon.agents.host1.cache.size", []Node{n3, n2, n1}},
+		{"a.b.c", []Node{n2, n3, n1}},
+		{"servers.web1.cpu.user", []Node{n1, n3, n2}},
+		{"x", []Node{n2, n1, n3}},
+	}
+
+	for _, tt := range table {
+		assert.Equal(tt.expected, r.GetN(tt.metric, 3), tt.metric)
+		assert.Equal(tt.expected[:2], r.GetN(tt.metric, 2), tt.metric)
+		assert.Equal(tt.expected[0], r.Get(tt.metric), tt.metric)
+	}
+
+	assert.Equal(3, len(r.GetN("x", 10)))
+	assert.Nil(NewCarbonCH(nil).GetN("x", 1))
+}
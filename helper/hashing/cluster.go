@@ -0,0 +1,110 @@
+package hashing
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NodeAddress is node of ring with address of its carbonserver
+type NodeAddress struct {
+	Node
+	Address string
+}
+
+// ParseNodeAddress parses node in form host:port[:instance], where host:port is address of carbonserver.
+// Host and instance are key of node in ring, like in carbon-relay destinations
+func ParseNodeAddress(s string) (NodeAddress, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return NodeAddress{}, fmt.Errorf("bad node %#v, should be host:port[:instance]", s)
+	}
+
+	n := NodeAddress{
+		Node:    Node{Server: parts[0]},
+		Address: parts[0] + ":" + parts[1],
+	}
+	if len(parts) == 3 {
+		n.Instance = parts[2]
+	}
+	return n, nil
+}
+
+func (n NodeAddress) String() string {
+	if n.Instance == "" {
+		return n.Address
+	}
+	return n.Address + ":" + n.Instance
+}
+
+// Cluster is ring of nodes with addresses as seen from local node self
+type Cluster struct {
+	ring              Ring
+	self              Node
+	nodes             []NodeAddress
+	byNode            map[Node]NodeAddress
+	replicationFactor int
+}
+
+// NewCluster creates cluster of carbon_ch or jump_fnv1a type. Self should be one of nodes
+func NewCluster(hashingType string, replicationFactor int, self NodeAddress, nodes []NodeAddress) (*Cluster, error) {
+	byNode := make(map[Node]NodeAddress, len(nodes))
+	keys := make([]Node, 0, len(nodes))
+	for _, n := range nodes {
+		if _, exists := byNode[n.Node]; exists {
+			return nil, fmt.Errorf("duplicate node %s with instance %#v", n.Server, n.Instance)
+		}
+		byNode[n.Node] = n
+		keys = append(keys, n.Node)
+	}
+
+	if _, exists := byNode[self.Node]; !exists {
+		return nil, fmt.Errorf("node %s is not in cluster nodes", self.String())
+	}
+
+	ring, err := NewRing(hashingType, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	if replicationFactor < 1 {
+		replicationFactor = 1
+	}
+
+	return &Cluster{
+		ring:              ring,
+		self:              self.Node,
+		nodes:             nodes,
+		byNode:            byNode,
+		replicationFactor: replicationFactor,
+	}, nil
+}
+
+// Owners returns nodes of metric. Local is true if self is one of them, self is not included in owners
+func (c *Cluster) Owners(metric string) (owners []NodeAddress, local bool) {
+	keys := c.ring.GetN(metric, c.replicationFactor)
+	owners = make([]NodeAddress, 0, len(keys))
+	for _, key := range keys {
+		if key == c.self {
+			local = true
+			continue
+		}
+		owners = append(owners, c.byNode[key])
+	}
+	return owners, local
+}
+
+// Peers returns all nodes except self
+func (c *Cluster) Peers() []NodeAddress {
+	peers := make([]NodeAddress, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if n.Node != c.self {
+			peers = append(peers, n)
+		}
+	}
+	return peers
+}
+
+// Self returns local node
+func (c *Cluster) Self() NodeAddress {
+	return c.byNode[c.self]
+}
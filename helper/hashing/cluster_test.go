@@ -0,0 +1,51 @@
+package hashing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(s string) NodeAddress {
+		n, err := ParseNodeAddress(s)
+		assert.NoError(err)
+		return n
+	}
+
+	// same nodes as in TestCarbonCH
+	n1 := parse("127.0.0.1:8080")
+	n2 := parse("127.0.0.2:8080:a")
+	n3 := parse("10.0.0.3:8080")
+
+	assert.Equal(NodeAddress{Node: Node{Server: "127.0.0.2", Instance: "a"}, Address: "127.0.0.2:8080"}, n2)
+	assert.Equal("127.0.0.2:8080:a", n2.String())
+
+	for _, bad := range []string{"10.0.0.1", ":8080", "10.0.0.1:", "a:1:b:c"} {
+		_, err := ParseNodeAddress(bad)
+		assert.Error(err, "%s", bad)
+	}
+
+	_, err := NewCluster(CarbonCHType, 1, n1, []NodeAddress{n2, n3})
+	assert.Error(err)
+	_, err = NewCluster(CarbonCHType, 1, n1, []NodeAddress{n1, n1})
+	assert.Error(err)
+
+	c, err := NewCluster(CarbonCHType, 2, n1, []NodeAddress{n1, n2, n3})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]NodeAddress{n2, n3}, c.Peers())
+
+	// ring order n3, n2, n1
+	owners, local := c.Owners("carbon.agents.host1.cache.size")
+	assert.Equal([]NodeAddress{n3, n2}, owners)
+	assert.False(local)
+
+	// ring order n1, n3, n2
+	owners, local = c.Owners("servers.web1.cpu.user")
+	assert.Equal([]NodeAddress{n3}, owners)
+	assert.True(local)
+}
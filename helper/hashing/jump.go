@@ -0,0 +1,55 @@
+package hashing
+
+import "hash/fnv"
+
+// JumpFNV1a is jump consistent hash of FNV-1a 64 of metric, compatible with jump_fnv1a_ch of carbon-c-relay.
+// Position of node in list is significant: nodes should be only appended to grow cluster
+type JumpFNV1a struct {
+	nodes []Node
+}
+
+// NewJumpFNV1a creates hash for nodes in given order
+func NewJumpFNV1a(nodes []Node) *JumpFNV1a {
+	return &JumpFNV1a{nodes: nodes}
+}
+
+// jumpHash is "A Fast, Minimal Memory, Consistent Hash Algorithm" by Lamping and Veach
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Nodes returns all nodes
+func (r *JumpFNV1a) Nodes() []Node {
+	return r.nodes
+}
+
+// Get returns node for metric
+func (r *JumpFNV1a) Get(metric string) Node {
+	return r.GetN(metric, 1)[0]
+}
+
+// GetN returns up to n distinct nodes for metric. Replicas are next nodes of list after owner
+func (r *JumpFNV1a) GetN(metric string, n int) []Node {
+	if len(r.nodes) == 0 {
+		return nil
+	}
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(metric))
+	index := jumpHash(h.Sum64(), len(r.nodes))
+
+	res := make([]Node, 0, n)
+	for i := 0; i < n; i++ {
+		res = append(res, r.nodes[(index+i)%len(r.nodes)])
+	}
+	return res
+}
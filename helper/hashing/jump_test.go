@@ -0,0 +1,49 @@
+package hashing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJumpFNV1a(t *testing.T) {
+	assert := assert.New(t)
+
+	nodes := []Node{{Server: "10.0.0.1"}, {Server: "10.0.0.2"}, {Server: "10.0.0.3"}}
+	grown := append(append([]Node{}, nodes...), Node{Server: "10.0.0.4"})
+
+	r1 := NewJumpFNV1a(nodes)
+	r2 := NewJumpFNV1a(grown)
+
+	count := make(map[Node]int)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		metric := fmt.Sprintf("servers.host%d.cpu", i)
+		n1 := r1.Get(metric)
+		n2 := r2.Get(metric)
+		count[n2]++
+
+		// metrics are moved only to new node
+		if n1 != n2 {
+			moved++
+			assert.Equal(grown[3], n2, metric)
+		}
+	}
+
+	for _, n := range grown {
+		assert.True(count[n] > 2000, "node %s: %d metrics", n.Server, count[n])
+	}
+	assert.True(moved > 2000 && moved < 3000, "moved: %d", moved)
+
+	owners := r2.GetN("a.b.c", 3)
+	assert.Equal(3, len(owners))
+	assert.Equal(r2.Get("a.b.c"), owners[0])
+	assert.NotEqual(owners[0], owners[1])
+	assert.Nil(NewJumpFNV1a(nil).GetN("x", 1))
+
+	_, err := NewRing("jump_fnv1a", nodes)
+	assert.NoError(err)
+	_, err = NewRing("fnv1a_ch", nodes)
+	assert.Error(err)
+}
@@ -0,0 +1,27 @@
+package hashing
+
+import "fmt"
+
+// Hashing types of Ring
+const (
+	CarbonCHType  = "carbon_ch"
+	JumpFNV1aType = "jump_fnv1a"
+)
+
+// Ring distributes metrics between nodes
+type Ring interface {
+	Nodes() []Node
+	Get(metric string) Node
+	GetN(metric string, n int) []Node
+}
+
+// NewRing creates ring of carbon_ch or jump_fnv1a type
+func NewRing(hashingType string, nodes []Node) (Ring, error) {
+	switch hashingType {
+	case CarbonCHType:
+		return NewCarbonCH(nodes), nil
+	case JumpFNV1aType:
+		return NewJumpFNV1a(nodes), nil
+	}
+	return nil, fmt.Errorf("unknown hashing %#v, should be one of: %s, %s", hashingType, CarbonCHType, JumpFNV1aType)
+}
@@ -1,4 +1,4 @@
-package persister
+package helper
 
 import (
 	"bytes"
@@ -7,7 +7,8 @@ import (
 	"strings"
 )
 
-func parseIniFile(filename string) ([]map[string]string, error) {
+// ParseIniFile reads storage-schemas.conf like file. Every section is returned as map with section name in "name" key
+func ParseIniFile(filename string) ([]map[string]string, error) {
 	body, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,61 @@
+package qa
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+// Collector stores points sent by receiver under test
+type Collector struct {
+	sync.Mutex
+	received []*points.Points
+}
+
+// Store is receiver store callback
+func (c *Collector) Store(p *points.Points) {
+	c.Lock()
+	c.received = append(c.received, p)
+	c.Unlock()
+}
+
+// Received returns copy of stored points
+func (c *Collector) Received() []*points.Points {
+	c.Lock()
+	defer c.Unlock()
+	return append([]*points.Points(nil), c.received...)
+}
+
+// Last returns last stored value of every metric
+func (c *Collector) Last() map[string]float64 {
+	res := make(map[string]float64)
+	for _, p := range c.Received() {
+		res[p.Metric] = p.Data[len(p.Data)-1].Value
+	}
+	return res
+}
+
+// Reset removes stored points
+func (c *Collector) Reset() {
+	c.Lock()
+	c.received = nil
+	c.Unlock()
+}
+
+// Wait waits for at least n stored points. Test fails after 5 seconds
+func (c *Collector) Wait(t *testing.T, n int) []*points.Points {
+	timeout := time.After(5 * time.Second)
+	for {
+		received := c.Received()
+		if len(received) >= n {
+			return received
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("received %d points, expected %d", len(received), n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
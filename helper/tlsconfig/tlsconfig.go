@@ -0,0 +1,191 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeTimeout limits time of TLS handshake of accepted connection
+const handshakeTimeout = 10 * time.Second
+
+// TLSOptions of TLS listener. TLS is enabled if Cert is set. If CA is set, clients should present
+// certificate signed by CA (mutual TLS)
+type TLSOptions struct {
+	Cert string `toml:"tls-cert"`
+	Key  string `toml:"tls-key"`
+	CA   string `toml:"tls-ca"`
+}
+
+// Enabled returns true if listener should use TLS
+func (o *TLSOptions) Enabled() bool {
+	return o.Cert != "" || o.Key != "" || o.CA != ""
+}
+
+// Config holds certificates loaded from files of TLSOptions. Files are read again on Reload
+type Config struct {
+	options         TLSOptions
+	nextProtos      []string
+	cert            atomic.Value // *tls.Certificate
+	clientCAs       atomic.Value // *x509.CertPool, nil pool if client certificates are not verified
+	handshakeErrors uint32       // atomic
+}
+
+// New loads certificates. Returns nil config if TLS is not enabled in options
+func New(options TLSOptions) (*Config, error) {
+	if !options.Enabled() {
+		return nil, nil
+	}
+
+	if options.Cert == "" || options.Key == "" {
+		return nil, fmt.Errorf("both tls-cert and tls-key should be set")
+	}
+
+	c := &Config{options: options}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// SetNextProtos sets application protocols for ALPN negotiation. "h2" is required by gRPC clients
+func (c *Config) SetNextProtos(nextProtos []string) {
+	c.nextProtos = nextProtos
+}
+
+// Reload reads certificate, key and CA files. Previous certificates are kept on error
+func (c *Config) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.options.Cert, c.options.Key)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if c.options.CA != "" {
+		pem, err := ioutil.ReadFile(c.options.CA)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.options.CA)
+		}
+	}
+
+	c.cert.Store(&cert)
+	c.clientCAs.Store(pool)
+	return nil
+}
+
+// TLSConfig returns server config. Every handshake uses last loaded certificates
+func (c *Config) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				Certificates: []tls.Certificate{*c.cert.Load().(*tls.Certificate)},
+				NextProtos:   c.nextProtos,
+			}
+
+			if pool := c.clientCAs.Load().(*x509.CertPool); pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig returns config of client of peer with same options. Last loaded certificate is presented to server.
+// Certificate of server is verified with CA loaded before call or with system roots if CA is not set
+func (c *Config) ClientConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.cert.Load().(*tls.Certificate), nil
+		},
+		RootCAs: c.clientCAs.Load().(*x509.CertPool),
+	}
+}
+
+// HandshakeErrors returns number of failed handshakes and resets counter
+func (c *Config) HandshakeErrors() uint32 {
+	v := atomic.LoadUint32(&c.handshakeErrors)
+	atomic.AddUint32(&c.handshakeErrors, -v)
+	return v
+}
+
+// listener completes TLS handshake before connection is returned from Accept
+type listener struct {
+	net.Listener
+	config *Config
+	conns  chan net.Conn
+	failed chan struct{} // closed when inner Accept failed
+	err    error
+}
+
+// NewListener wraps listener. Accept returns *tls.Conn with completed handshake. Failed handshakes
+// are counted and connections are closed. Accept returns error of wrapped listener after it is closed
+func NewListener(inner net.Listener, c *Config) net.Listener {
+	l := &listener{
+		Listener: inner,
+		config:   c,
+		conns:    make(chan net.Conn),
+		failed:   make(chan struct{}),
+	}
+
+	go l.acceptLoop()
+
+	return l
+}
+
+func (l *listener) acceptLoop() {
+	tlsConfig := l.config.TLSConfig()
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			l.err = err
+			close(l.failed)
+			return
+		}
+
+		go l.handshake(tls.Server(conn, tlsConfig))
+	}
+}
+
+func (l *listener) handshake(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		atomic.AddUint32(&l.config.handshakeErrors, 1)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- conn:
+	case <-l.failed:
+		conn.Close()
+	}
+}
+
+// Accept waits for connection with completed handshake
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.failed:
+		return nil, l.err
+	}
+}
@@ -0,0 +1,260 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates certificate signed by parent. Self-signed CA is created if parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves certificate and key in PEM files
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if keyFile != "" {
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// dial connects to listener, completes handshake and returns common name of server certificate
+func dial(addr string, ca *testCert, client *testCert) (string, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	config := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	if client != nil {
+		config.Certificates = []tls.Certificate{client.tlsCertificate()}
+	}
+
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// server verifies client certificate after client finished handshake. Read waits for result
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := conn.Read(buf); err != nil {
+		return "", err
+	}
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+// echo accepts connections and writes back first 4 bytes
+func echo(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+			buf := make([]byte, 4)
+			if _, err := conn.Read(buf); err == nil {
+				conn.Write(buf)
+			}
+		}(conn)
+	}
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := New(TLSOptions{})
+	assert.NoError(err)
+	assert.Nil(c)
+
+	_, err = New(TLSOptions{Cert: "server.crt"})
+	assert.Error(err)
+
+	_, err = New(TLSOptions{Cert: "not-exists.crt", Key: "not-exists.key"})
+	assert.Error(err)
+}
+
+func TestListener(t *testing.T) {
+	qa.Root(t, func(root string) {
+		assert := assert.New(t)
+
+		ca := newTestCert(t, "ca", nil)
+		server := newTestCert(t, "server", ca)
+		client := newTestCert(t, "client", ca)
+		other := newTestCert(t, "other", newTestCert(t, "other-ca", nil))
+
+		options := TLSOptions{
+			Cert: filepath.Join(root, "server.crt"),
+			Key:  filepath.Join(root, "server.key"),
+			CA:   filepath.Join(root, "ca.crt"),
+		}
+		server.write(t, options.Cert, options.Key)
+		ca.write(t, options.CA, "")
+
+		c, err := New(options)
+		assert.NoError(err)
+
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(err)
+		l := NewListener(tcpListener, c)
+		defer l.Close()
+		go echo(l)
+
+		addr := tcpListener.Addr().String()
+
+		name, err := dial(addr, ca, client)
+		assert.NoError(err)
+		assert.Equal("server", name)
+		assert.Equal(uint32(0), c.HandshakeErrors())
+
+		// client without certificate and with certificate of unknown CA are rejected
+		_, err = dial(addr, ca, nil)
+		assert.Error(err)
+		_, err = dial(addr, ca, other)
+		assert.Error(err)
+
+		// server side of handshake can finish after client got error
+		for i := 0; i < 100 && atomic.LoadUint32(&c.handshakeErrors) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(uint32(2), c.HandshakeErrors())
+		assert.Equal(uint32(0), c.HandshakeErrors())
+
+		// new certificate is used after reload, broken files keep previous one
+		newServer := newTestCert(t, "new-server", ca)
+		newServer.write(t, options.Cert, options.Key)
+		assert.NoError(c.Reload())
+
+		name, err = dial(addr, ca, client)
+		assert.NoError(err)
+		assert.Equal("new-server", name)
+
+		assert.NoError(ioutil.WriteFile(options.Cert, []byte("broken"), 0600))
+		assert.Error(c.Reload())
+
+		name, err = dial(addr, ca, client)
+		assert.NoError(err)
+		assert.Equal("new-server", name)
+
+		// accept returns error after inner listener is closed
+		tcpListener.Close()
+		_, err = l.Accept()
+		assert.Error(err)
+	})
+}
+
+func TestClientConfig(t *testing.T) {
+	qa.Root(t, func(root string) {
+		assert := assert.New(t)
+
+		ca := newTestCert(t, "ca", nil)
+		node := newTestCert(t, "node", ca)
+
+		// peers share certificate and CA
+		options := TLSOptions{
+			Cert: filepath.Join(root, "node.crt"),
+			Key:  filepath.Join(root, "node.key"),
+			CA:   filepath.Join(root, "ca.crt"),
+		}
+		node.write(t, options.Cert, options.Key)
+		ca.write(t, options.CA, "")
+
+		c, err := New(options)
+		if !assert.NoError(err) {
+			return
+		}
+
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(err)
+		l := NewListener(tcpListener, c)
+		defer l.Close()
+		go echo(l)
+
+		config := c.ClientConfig()
+		config.ServerName = "127.0.0.1"
+		conn, err := tls.Dial("tcp", tcpListener.Addr().String(), config)
+		if !assert.NoError(err) {
+			return
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_, err = conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal("node", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	})
+}
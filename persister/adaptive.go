@@ -0,0 +1,264 @@
+package persister
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/go-carbon/helper"
+)
+
+const adaptiveTick = 10 * time.Millisecond
+const adaptiveWindow = time.Second
+const adaptiveMaxSamples = 100000
+
+// AdaptiveThrottle is a soft rate limiter of whisper updates with rate adjusted every second toward
+// target p99 latency of update. Rate is lowered by 25% if p99 latency of last second or iowait of system
+// is over target and raised by 25% if p99 latency is under half of target and rate was fully used.
+// Without maxRate throttle starts without limit and first limit is 75% of throughput measured when latency
+// or iowait got over target
+type AdaptiveThrottle struct {
+	helper.Stoppable
+	C chan bool
+
+	rate          int64 // current rate, changing via atomic
+	unlimited     int32 // 1 until first overload without maxRate, changing via atomic
+	targetLatency time.Duration
+	maxIOWait     float64 // percent, 0 - not checked
+	minRate       int
+	maxRate       int // 0 - no limit
+	cpuStat       func() (iowait uint64, total uint64, err error)
+
+	mu        sync.Mutex
+	latencies []time.Duration // samples of current window
+	used      int             // tokens taken in current window
+
+	lastP99    time.Duration
+	lastIOWait float64
+	prevIOWait uint64
+	prevTotal  uint64
+}
+
+// NewAdaptiveThrottle creates throttle with rate between minRate and maxRate (0 - no limit). Initial rate is maxRate or no limit
+func NewAdaptiveThrottle(targetLatency time.Duration, maxIOWait float64, minRate int, maxRate int) *AdaptiveThrottle {
+	if minRate < 1 {
+		minRate = 1
+	}
+	if maxRate > 0 && maxRate < minRate {
+		maxRate = minRate
+	}
+
+	var unlimited int32
+	if maxRate == 0 {
+		unlimited = 1
+	}
+
+	return &AdaptiveThrottle{
+		C:             make(chan bool),
+		rate:          int64(maxRate),
+		unlimited:     unlimited,
+		targetLatency: targetLatency,
+		maxIOWait:     maxIOWait,
+		minRate:       minRate,
+		maxRate:       maxRate,
+		cpuStat:       readCPUStat,
+	}
+}
+
+// Rate returns current updates per second, 0 - no limit
+func (t *AdaptiveThrottle) Rate() int {
+	return int(atomic.LoadInt64(&t.rate))
+}
+
+// Observe registers latency of one update
+func (t *AdaptiveThrottle) Observe(latency time.Duration) {
+	t.mu.Lock()
+	if len(t.latencies) < adaptiveMaxSamples {
+		t.latencies = append(t.latencies, latency)
+	}
+	t.mu.Unlock()
+}
+
+// Start sending tokens and adjusting rate
+func (t *AdaptiveThrottle) Start() error {
+	return t.StartFunc(func() error {
+		t.prevIOWait, t.prevTotal, _ = t.cpuStat()
+
+		t.Go(t.send)
+		t.Go(func(exit chan bool) {
+			ticker := time.NewTicker(adaptiveWindow)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					t.adjust()
+				case <-exit:
+					return
+				}
+			}
+		})
+		return nil
+	})
+}
+
+// send writes tokens to C with current rate. Tokens are not accumulated while nobody reads C
+func (t *AdaptiveThrottle) send(exit chan bool) {
+	ticker := time.NewTicker(adaptiveTick)
+	defer ticker.Stop()
+
+	var credit float64
+	for {
+		if atomic.LoadInt32(&t.unlimited) == 1 {
+			select {
+			case t.C <- true:
+				t.mu.Lock()
+				t.used++
+				t.mu.Unlock()
+			case <-exit:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+			rate := float64(atomic.LoadInt64(&t.rate))
+			credit += rate * adaptiveTick.Seconds()
+
+			// allow burst of 100ms
+			if burst := rate / 10; credit > burst && credit > 1 {
+				credit = burst
+			}
+
+			for ; credit >= 1; credit-- {
+				select {
+				case t.C <- true:
+					t.mu.Lock()
+					t.used++
+					t.mu.Unlock()
+				case <-exit:
+					return
+				}
+			}
+		case <-exit:
+			return
+		}
+	}
+}
+
+// adjust changes rate by latency and iowait of last window
+func (t *AdaptiveThrottle) adjust() {
+	t.mu.Lock()
+	latencies := t.latencies
+	used := t.used
+	t.latencies = nil
+	t.used = 0
+	t.mu.Unlock()
+
+	var p99 time.Duration
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p99 = latencies[(len(latencies)*99)/100]
+	}
+
+	var ioWait float64
+	if iowait, total, err := t.cpuStat(); err == nil {
+		if total > t.prevTotal {
+			ioWait = float64(iowait-t.prevIOWait) * 100 / float64(total-t.prevTotal)
+		}
+		t.prevIOWait, t.prevTotal = iowait, total
+	}
+
+	t.mu.Lock()
+	t.lastP99 = p99
+	t.lastIOWait = ioWait
+	t.mu.Unlock()
+
+	rate := int(atomic.LoadInt64(&t.rate))
+	overload := p99 > t.targetLatency || (t.maxIOWait > 0 && ioWait > t.maxIOWait)
+	unlimited := atomic.LoadInt32(&t.unlimited) == 1
+
+	switch {
+	case unlimited && !overload:
+		return
+	case unlimited:
+		rate = used * 3 / 4
+	case overload:
+		rate = rate * 3 / 4
+	case p99 < t.targetLatency/2 && used >= rate*9/10:
+		rate = rate*5/4 + 1
+	}
+
+	if rate < t.minRate {
+		rate = t.minRate
+	}
+	if t.maxRate > 0 && rate > t.maxRate {
+		rate = t.maxRate
+	}
+
+	atomic.StoreInt64(&t.rate, int64(rate))
+	atomic.StoreInt32(&t.unlimited, 0)
+}
+
+// Stat callback
+func (t *AdaptiveThrottle) Stat(send helper.StatCallback) {
+	t.mu.Lock()
+	p99 := t.lastP99
+	ioWait := t.lastIOWait
+	t.mu.Unlock()
+
+	send("updateLatencyP99Ms", float64(p99)/float64(time.Millisecond))
+	send("iowait", ioWait)
+}
+
+// readCPUStat returns iowait and total cpu time from /proc/stat. Works on linux only
+func readCPUStat() (iowait uint64, total uint64, err error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	return parseCPUStat(file)
+}
+
+// parseCPUStat returns iowait and total cpu time from content of /proc/stat
+func parseCPUStat(r io.Reader) (iowait uint64, total uint64, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[0] != "cpu" {
+			continue
+		}
+
+		// cpu user nice system idle iowait irq softirq steal guest guest_nice
+		// guest time is already counted in user and nice time
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, 0, err
+			}
+			if i == 4 {
+				iowait = value
+			}
+			total += value
+		}
+		return iowait, total, nil
+	}
+
+	if err = scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("cpu line not found in /proc/stat")
+}
@@ -0,0 +1,110 @@
+package persister
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptiveThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	var iowait, total uint64
+	cpuStat := func() (uint64, uint64, error) {
+		return iowait, total, nil
+	}
+
+	// without max rate throttle starts without limit
+	th := NewAdaptiveThrottle(10*time.Millisecond, 0, 10, 0)
+	assert.Equal(0, th.Rate())
+
+	th.used = 5000
+	th.Observe(time.Millisecond)
+	th.adjust()
+	assert.Equal(0, th.Rate())
+
+	// first limit is 75% of throughput measured on overload
+	th.used = 4000
+	th.Observe(time.Second)
+	th.adjust()
+	assert.Equal(3000, th.Rate())
+
+	th = NewAdaptiveThrottle(10*time.Millisecond, 20, 10, 1000)
+	th.cpuStat = cpuStat
+	assert.Equal(1000, th.Rate())
+
+	observe := func(latency time.Duration, count int) {
+		for i := 0; i < count; i++ {
+			th.Observe(latency)
+		}
+	}
+
+	// p99 latency over target
+	observe(time.Millisecond, 90)
+	observe(50*time.Millisecond, 10)
+	th.adjust()
+	assert.Equal(750, th.Rate())
+
+	// low latency, but rate is not used
+	observe(time.Millisecond, 100)
+	th.adjust()
+	assert.Equal(750, th.Rate())
+
+	// low latency and rate is used
+	observe(time.Millisecond, 100)
+	th.used = 700
+	th.adjust()
+	assert.Equal(938, th.Rate())
+
+	// never over max
+	th.used = 1000
+	th.adjust()
+	assert.Equal(1000, th.Rate())
+
+	// iowait over target
+	iowait, total = 30, 100
+	th.adjust()
+	assert.Equal(750, th.Rate())
+
+	stat := make(map[string]float64)
+	th.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(float64(30), stat["iowait"])
+
+	// never under min
+	for i := 0; i < 50; i++ {
+		observe(time.Second, 1)
+		th.adjust()
+	}
+	assert.Equal(10, th.Rate())
+}
+
+func TestParseCPUStat(t *testing.T) {
+	assert := assert.New(t)
+
+	iowait, total, err := parseCPUStat(strings.NewReader(
+		"cpu  100 10 50 1000 40 5 5 0 30 3\ncpu0 50 5 25 500 20 2 3 0 15 2\n"))
+	assert.NoError(err)
+	assert.Equal(uint64(40), iowait)
+	// guest and guest_nice are not counted twice
+	assert.Equal(uint64(1210), total)
+
+	_, _, err = parseCPUStat(strings.NewReader("intr 1 2 3\n"))
+	assert.Error(err)
+}
+
+func TestAdaptiveThrottleSend(t *testing.T) {
+	th := NewAdaptiveThrottle(time.Second, 0, 1000, 1000)
+	th.Start()
+	defer th.Stop()
+
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		<-th.C
+	}
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("200 tokens with rate 1000 received in %s", elapsed)
+	}
+}
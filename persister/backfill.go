@@ -0,0 +1,159 @@
+package persister
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+// BackfillResult is outcome of backfill of one metric
+type BackfillResult struct {
+	Metric   string `json:"metric"`
+	Written  int    `json:"written"`
+	Rejected int    `json:"rejected"`
+	Error    string `json:"error,omitempty"`
+}
+
+type backfillTask struct {
+	values *points.Points
+	result chan *BackfillResult
+}
+
+// SetBackfill enables pool of workers writing historic points directly to whisper files, bypassing cache.
+// Pool has own throttling of maxUpdatesPerSecond (0 - no limit)
+func (p *Whisper) SetBackfill(workers int, maxUpdatesPerSecond int) {
+	p.backfillWorkers = workers
+	p.backfillMaxUpdates = maxUpdatesPerSecond
+}
+
+// Backfill writes points of metric to all archives of whisper file. Missing file is created with matched schema.
+// Points older than max retention of file or from future are rejected. Call blocks until points are written
+func (p *Whisper) Backfill(values *points.Points) *BackfillResult {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.backfillQueue == nil {
+		return &BackfillResult{Metric: values.Metric, Error: "backfill is not running"}
+	}
+
+	task := &backfillTask{values: values, result: make(chan *BackfillResult, 1)}
+	p.backfillQueue <- task
+	return <-task.result
+}
+
+func (p *Whisper) backfillWorker(queue chan *backfillTask, throttle chan bool) func(exit chan bool) {
+	return func(exit chan bool) {
+		for {
+			select {
+			case <-throttle:
+			case <-exit:
+				return
+			}
+
+			select {
+			case task := <-queue:
+				task.result <- p.backfill(task.values)
+			case <-exit:
+				return
+			}
+		}
+	}
+}
+
+// validBackfillMetric checks that plain metric name can't point outside of root path. Paths of tagged metrics are hashed
+func validBackfillMetric(metric string, tagsEnabled bool) bool {
+	if tagsEnabled && strings.IndexByte(metric, ';') >= 0 {
+		return true
+	}
+	if metric == "" || strings.ContainsAny(metric, "/\x00") {
+		return false
+	}
+	for _, node := range strings.Split(metric, ".") {
+		if node == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Whisper) backfill(values *points.Points) *BackfillResult {
+	metric := values.Metric
+	result := &BackfillResult{Metric: metric}
+	atomic.AddUint32(&p.backfillRequests, 1)
+
+	fail := func(err error) *BackfillResult {
+		atomic.AddUint32(&p.backfillErrors, 1)
+		result.Error = err.Error()
+		return result
+	}
+
+	if !validBackfillMetric(metric, p.tagsEnabled) {
+		return fail(fmt.Errorf("invalid metric name"))
+	}
+
+	mutexIndex := fnv32(metric) % storeMutexCount
+	p.storeMutex[mutexIndex].Lock()
+	defer p.storeMutex[mutexIndex].Unlock()
+
+	path := MetricPath(p.rootPath, metric, p.tagsEnabled, p.hashFilenames)
+
+	w, err := whisper.OpenWithOptions(path, &whisper.Options{
+		FLock:      p.flock,
+		Compressed: p.compressed,
+	})
+	if err != nil && os.IsNotExist(err) {
+		w, err = p.create(metric, path)
+	}
+	if err != nil {
+		return fail(fmt.Errorf("open %s: %s", path, err))
+	}
+	defer w.Close()
+
+	// points are split by archives here: UpdateMany moves newest point of every archive to next one
+	now := int(time.Now().Unix())
+	retentions := w.Retentions()
+	archives := make([][]*whisper.TimeSeriesPoint, len(retentions))
+
+POINTS:
+	for _, r := range values.Data {
+		age := now - int(r.Timestamp)
+		if age >= 0 {
+			for i := range retentions {
+				if age < retentions[i].MaxRetention() {
+					archives[i] = append(archives[i], &whisper.TimeSeriesPoint{Time: int(r.Timestamp), Value: r.Value})
+					continue POINTS
+				}
+			}
+		}
+		result.Rejected++
+	}
+	atomic.AddUint32(&p.backfillRejected, uint32(result.Rejected))
+
+	for i, data := range archives {
+		if len(data) == 0 {
+			continue
+		}
+		if err := p.updateManyForArchive(w, path, data, retentions[i].MaxRetention()); err != nil {
+			return fail(err)
+		}
+		result.Written += len(data)
+	}
+
+	if result.Written == 0 {
+		return result
+	}
+
+	atomic.AddUint32(&p.backfillPoints, uint32(result.Written))
+
+	if p.tagsEnabled && p.taggedFn != nil && strings.IndexByte(metric, ';') >= 0 {
+		p.taggedFn(metric, false)
+	}
+
+	return result
+}
@@ -0,0 +1,76 @@
+package persister
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestBackfill(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		schemas, err := parseSchemas(t, `
+[default]
+pattern = .*
+retentions = 1m:1h,10m:1d
+`)
+		if !assert.NoError(err) {
+			return
+		}
+
+		// cache is empty
+		recv := func(exit chan bool) string {
+			<-exit
+			return ""
+		}
+
+		p := NewWhisper(root, schemas, NewWhisperAggregation(), recv, nil, nil)
+		p.SetBackfill(2, 0)
+
+		now := time.Now().Unix()
+		now -= now % 600
+		values := points.OnePoint("hello.world", 1, now-120).
+			Add(2, now-7200).
+			Add(3, now-3*86400).
+			Add(4, now+3600)
+
+		// not started
+		assert.NotEqual("", p.Backfill(values).Error)
+
+		p.Start()
+		result := p.Backfill(values)
+		p.Stop()
+
+		assert.Equal(&BackfillResult{Metric: "hello.world", Written: 2, Rejected: 2}, result)
+
+		w, err := whisper.Open(filepath.Join(root, "hello", "world.wsp"))
+		if !assert.NoError(err) {
+			return
+		}
+		defer w.Close()
+
+		ts, err := w.Fetch(int(now-180), int(now-60))
+		if assert.NoError(err) {
+			assert.Equal(1.0, ts.Values()[0])
+		}
+
+		// point outside of high precision archive is written to archive of lower precision
+		ts, err = w.Fetch(int(now-8000), int(now-6000))
+		if assert.NoError(err) {
+			assert.Equal(int64(600), int64(ts.Step()))
+			assert.Contains(ts.Values(), 2.0)
+		}
+
+		assert.Equal("backfill is not running", p.Backfill(values).Error)
+
+		assert.Equal("invalid metric name", p.backfill(points.OnePoint("hello/../../world", 1, now)).Error)
+		assert.Equal("invalid metric name", p.backfill(points.OnePoint("hello..world", 1, now)).Error)
+	})
+}
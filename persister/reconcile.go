@@ -0,0 +1,180 @@
+package persister
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+	"go.uber.org/zap"
+)
+
+var errWalkStopped = errors.New("walk stopped")
+
+// WalkMetrics calls callback for whisper file of every plain metric in rootPath. Tagged metrics are skipped,
+// because their names can not be restored from file names. Files are passed no faster than throttle allows.
+// Returns nil when all files are passed or callback error
+func WalkMetrics(rootPath string, throttle chan bool, exit chan bool, callback func(metric string, path string) error) error {
+	rootPath = filepath.Clean(rootPath)
+
+	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() {
+			if info.Name() == "_tagged" && filepath.Dir(path) == rootPath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(path, ".wsp") {
+			return nil
+		}
+
+		if throttle != nil {
+			select {
+			case <-throttle:
+			case <-exit:
+				return errWalkStopped
+			}
+		}
+
+		rel, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return nil
+		}
+
+		return callback(strings.Replace(strings.TrimSuffix(rel, ".wsp"), string(filepath.Separator), ".", -1), path)
+	})
+
+	if err == errWalkStopped {
+		return nil
+	}
+	return err
+}
+
+// AggregationChange is difference of whisper file header from storage aggregation
+type AggregationChange struct {
+	Path            string
+	Metric          string
+	Method          whisper.AggregationMethod
+	NewMethod       whisper.AggregationMethod
+	XFilesFactor    float32
+	NewXFilesFactor float32
+}
+
+func (c *AggregationChange) String() string {
+	return fmt.Sprintf("%s: aggregationMethod %s -> %s, xFilesFactor %g -> %g",
+		c.Path, c.Method, c.NewMethod, c.XFilesFactor, c.NewXFilesFactor)
+}
+
+// ReconcileAggregation compares aggregation method and xFilesFactor in header of whisper file of metric with
+// storage aggregation and updates header unless dryRun is set. Returns nil change if header matches aggregation
+func ReconcileAggregation(path string, metric string, aggregation *WhisperAggregation, flock bool, dryRun bool) (*AggregationChange, error) {
+	aggr := aggregation.match(metric)
+	if aggr == nil {
+		return nil, nil
+	}
+
+	w, err := whisper.OpenWithOptions(path, &whisper.Options{FLock: flock})
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	method, err := AggregationMethod(w)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &AggregationChange{
+		Path:            path,
+		Metric:          metric,
+		Method:          method,
+		NewMethod:       aggr.aggregationMethod,
+		XFilesFactor:    w.XFilesFactor(),
+		NewXFilesFactor: float32(aggr.xFilesFactor),
+	}
+
+	if change.Method == change.NewMethod && change.XFilesFactor == change.NewXFilesFactor {
+		return nil, nil
+	}
+
+	if dryRun {
+		return change, nil
+	}
+
+	return change, SetAggregation(w, path, change.NewMethod, change.NewXFilesFactor, flock)
+}
+
+// SetAggregation changes aggregation method and xFilesFactor of opened whisper file in path.
+// Header of plain file is updated in place, compressed file is rewritten
+func SetAggregation(w *whisper.Whisper, path string, method whisper.AggregationMethod, xFilesFactor float32, flock bool) error {
+	if w.IsCompressed() {
+		// header of compressed file is protected by checksum, so file is rewritten
+		return RewriteFile(w, path, FileRetentions(w), method, xFilesFactor, &whisper.Options{
+			FLock:      flock,
+			Compressed: true,
+		})
+	}
+
+	// header of plain whisper file starts with aggregation method, max retention and xFilesFactor
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(method))
+	if _, err := w.File().WriteAt(b[:], 0); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(b[:], math.Float32bits(xFilesFactor))
+	_, err := w.File().WriteAt(b[:], 8)
+	return err
+}
+
+// SetAggregationReconcile enables background update of aggregation method and xFilesFactor of existing whisper
+// files to storage aggregation. Data dir is checked every interval, no more than maxFilesPerSecond files per second (0 - no limit)
+func (p *Whisper) SetAggregationReconcile(interval time.Duration, maxFilesPerSecond int) {
+	p.aggrInterval = interval
+	p.aggrMaxFilesPerSecond = maxFilesPerSecond
+}
+
+// aggregationReconcileWorker checks headers of all whisper files every interval
+func (p *Whisper) aggregationReconcileWorker(exit chan bool) {
+	throttle := NewThrottleTicker(p.aggrMaxFilesPerSecond)
+	defer throttle.Stop()
+
+	for {
+		WalkMetrics(p.rootPath, throttle.C, exit, func(metric string, path string) error {
+			mutexIndex := fnv32(metric) % storeMutexCount
+			p.storeMutex[mutexIndex].Lock()
+			change, err := ReconcileAggregation(path, metric, p.aggregation, p.flock, false)
+			p.storeMutex[mutexIndex].Unlock()
+
+			atomic.AddUint32(&p.aggrChecked, 1)
+
+			if err != nil {
+				atomic.AddUint32(&p.aggrErrors, 1)
+				p.logger.Error("failed to update aggregation of whisper file", zap.String("path", path), zap.Error(err))
+				return nil
+			}
+
+			if change != nil {
+				atomic.AddUint32(&p.aggrUpdated, 1)
+				p.logger.Info("whisper file aggregation updated", zap.String("change", change.String()))
+			}
+			return nil
+		})
+
+		select {
+		case <-time.After(p.aggrInterval):
+		case <-exit:
+			return
+		}
+	}
+}
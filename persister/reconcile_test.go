@@ -0,0 +1,96 @@
+package persister
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/go-graphite/go-whisper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+)
+
+func TestReconcileAggregation(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		aggrFile := filepath.Join(root, "aggregation.conf")
+		ioutil.WriteFile(aggrFile, []byte(`
+[sum]
+pattern = \.count$
+xFilesFactor = 0.1
+aggregationMethod = sum
+`), 0644)
+
+		aggregation, err := ReadWhisperAggregation(aggrFile)
+		if !assert.NoError(err) {
+			return
+		}
+
+		retentions, _ := ParseRetentionDefs("1m:1h,10m:1d")
+		create := func(path string, compressed bool) {
+			assert.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+			w, err := whisper.CreateWithOptions(path, retentions, whisper.Average, 0.5, &whisper.Options{Compressed: compressed})
+			if assert.NoError(err) {
+				w.Close()
+			}
+		}
+
+		dataDir := filepath.Join(root, "data")
+		create(filepath.Join(dataDir, "app", "requests.count.wsp"), false)
+		create(filepath.Join(dataDir, "app", "errors.count.wsp"), true)
+		create(filepath.Join(dataDir, "app", "cpu.wsp"), false)
+		create(filepath.Join(dataDir, "_tagged", "abc", "def", "x.count.wsp"), false)
+
+		var metrics []string
+		assert.NoError(WalkMetrics(dataDir, nil, nil, func(metric string, path string) error {
+			metrics = append(metrics, metric)
+			return nil
+		}))
+		sort.Strings(metrics)
+		assert.Equal([]string{"app.cpu", "app.errors.count", "app.requests.count"}, metrics)
+
+		check := func(name string) (string, float32) {
+			w, err := whisper.Open(filepath.Join(dataDir, "app", name+".wsp"))
+			if !assert.NoError(err) {
+				return "", 0
+			}
+			defer w.Close()
+			return w.AggregationMethod(), w.XFilesFactor()
+		}
+
+		for _, dryRun := range []bool{true, false} {
+			for _, metric := range []string{"app.requests.count", "app.errors.count"} {
+				path := filepath.Join(dataDir, "app", metric[len("app."):]+".wsp")
+
+				change, err := ReconcileAggregation(path, metric, aggregation, false, dryRun)
+				assert.NoError(err)
+				if assert.NotNil(change) {
+					assert.Equal(whisper.Average, change.Method)
+					assert.Equal(whisper.Sum, change.NewMethod)
+					assert.Equal(float32(0.1), change.NewXFilesFactor)
+				}
+			}
+
+			method, xff := check("requests.count")
+			if dryRun {
+				assert.Equal("Average", method)
+				assert.Equal(float32(0.5), xff)
+			} else {
+				assert.Equal("Sum", method)
+				assert.Equal(float32(0.1), xff)
+			}
+		}
+
+		method, xff := check("errors.count")
+		assert.Equal("Sum", method)
+		assert.Equal(float32(0.1), xff)
+
+		change, err := ReconcileAggregation(filepath.Join(dataDir, "app", "cpu.wsp"), "app.cpu", aggregation, false, false)
+		assert.NoError(err)
+		assert.Nil(change)
+	})
+}
@@ -0,0 +1,178 @@
+package persister
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+	"go.uber.org/zap"
+)
+
+// SetResize enables background resize of existing whisper files to retentions of storage schemas.
+// Data dir is checked every interval, no more than maxFilesPerSecond files per second (0 - no limit)
+func (p *Whisper) SetResize(interval time.Duration, maxFilesPerSecond int) {
+	p.resizeInterval = interval
+	p.resizeMaxFilesPerSecond = maxFilesPerSecond
+}
+
+// RetentionsEqual checks that whisper file has same archives as retentions of schema
+func RetentionsEqual(current []whisper.Retention, retentions whisper.Retentions) bool {
+	if len(current) != len(retentions) {
+		return false
+	}
+	for i := range current {
+		if current[i].SecondsPerPoint() != retentions[i].SecondsPerPoint() ||
+			current[i].NumberOfPoints() != retentions[i].NumberOfPoints() {
+			return false
+		}
+	}
+	return true
+}
+
+// AggregationMethod returns aggregation method of opened whisper file
+func AggregationMethod(w *whisper.Whisper) (whisper.AggregationMethod, error) {
+	switch w.AggregationMethod() {
+	case "Average":
+		return whisper.Average, nil
+	case "Sum":
+		return whisper.Sum, nil
+	case "Last":
+		return whisper.Last, nil
+	case "Max":
+		return whisper.Max, nil
+	case "Min":
+		return whisper.Min, nil
+	}
+	return 0, fmt.Errorf("unknown aggregation method %#v", w.AggregationMethod())
+}
+
+// RewriteFile replaces whisper file in path with new file with given retentions, aggregation method and xFilesFactor.
+// Points of all archives of src are copied from lowest precision archive to highest, like whisper-resize.py does.
+// New file is written next to old one and renamed over it, so readers see old or new file only
+func RewriteFile(src *whisper.Whisper, path string, retentions whisper.Retentions, method whisper.AggregationMethod, xFilesFactor float32, options *whisper.Options) error {
+	now := int(time.Now().Unix())
+	current := src.Retentions()
+
+	series := make([][]*whisper.TimeSeriesPoint, len(current))
+	for i := len(current) - 1; i >= 0; i-- {
+		ts, err := src.Fetch(now-current[i].MaxRetention(), now)
+		if err != nil {
+			return err
+		}
+		if ts == nil {
+			continue
+		}
+		for _, point := range ts.PointPointers() {
+			if !math.IsNaN(point.Value) {
+				series[i] = append(series[i], point)
+			}
+		}
+	}
+
+	tmpPath := path + ".rewrite"
+	os.Remove(tmpPath)
+
+	dst, err := whisper.CreateWithOptions(tmpPath, retentions, method, xFilesFactor, options)
+	if err != nil {
+		return err
+	}
+
+	for i := len(series) - 1; i >= 0; i-- {
+		if len(series[i]) == 0 {
+			continue
+		}
+		if err = dst.UpdateMany(series[i]); err != nil {
+			break
+		}
+	}
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// resizeMetric rewrites whisper file of metric if its archives differ from schema.
+// Store of metric waits until file is replaced
+func (p *Whisper) resizeMetric(metric string, path string) error {
+	schema, ok := p.schemas.Match(metric)
+	if !ok {
+		return nil
+	}
+
+	mutexIndex := fnv32(metric) % storeMutexCount
+	p.storeMutex[mutexIndex].Lock()
+	defer p.storeMutex[mutexIndex].Unlock()
+
+	w, err := whisper.OpenWithOptions(path, &whisper.Options{FLock: p.flock})
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	atomic.AddUint32(&p.resizeChecked, 1)
+
+	if RetentionsEqual(w.Retentions(), schema.Retentions) {
+		return nil
+	}
+
+	method, err := AggregationMethod(w)
+	if err != nil {
+		return err
+	}
+
+	err = RewriteFile(w, path, schema.Retentions, method, w.XFilesFactor(), &whisper.Options{
+		Sparse:     p.sparse,
+		FLock:      p.flock,
+		Compressed: w.IsCompressed(),
+	})
+	if err != nil {
+		return err
+	}
+
+	atomic.AddUint32(&p.resized, 1)
+	p.logger.Info("whisper file resized",
+		zap.String("path", path),
+		zap.String("retention", schema.RetentionStr),
+		zap.String("schema", schema.Name),
+	)
+	return nil
+}
+
+// resizeWorker checks archives of all whisper files every resize interval
+func (p *Whisper) resizeWorker(exit chan bool) {
+	throttle := NewThrottleTicker(p.resizeMaxFilesPerSecond)
+	defer throttle.Stop()
+
+	for {
+		WalkMetrics(p.rootPath, throttle.C, exit, func(metric string, path string) error {
+			if err := p.resizeMetric(metric, path); err != nil {
+				atomic.AddUint32(&p.resizeErrors, 1)
+				p.logger.Error("failed to resize whisper file", zap.String("path", path), zap.Error(err))
+			}
+			return nil
+		})
+
+		select {
+		case <-exit:
+			return
+		default:
+		}
+		atomic.AddUint32(&p.resizePasses, 1)
+
+		select {
+		case <-time.After(p.resizeInterval):
+		case <-exit:
+			return
+		}
+	}
+}
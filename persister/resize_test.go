@@ -0,0 +1,77 @@
+package persister
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+)
+
+func TestResizeMetric(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		schemas, err := parseSchemas(t, `
+[default]
+pattern = .*
+retentions = 1m:2h,10m:1d
+`)
+		if !assert.NoError(err) {
+			return
+		}
+
+		path := filepath.Join(root, "hello", "world.wsp")
+		assert.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+
+		old, _ := ParseRetentionDefs("1m:1h")
+		w, err := whisper.Create(path, old, whisper.Sum, 0.3)
+		if !assert.NoError(err) {
+			return
+		}
+
+		now := int(time.Now().Unix())
+		points := make([]*whisper.TimeSeriesPoint, 0)
+		for i := 1; i <= 10; i++ {
+			points = append(points, &whisper.TimeSeriesPoint{Time: now - i*60, Value: float64(i)})
+		}
+		assert.NoError(w.UpdateMany(points))
+		w.Close()
+
+		p := NewWhisper(root, schemas, nil, nil, nil, nil)
+		assert.NoError(p.resizeMetric("hello.world", path))
+
+		w, err = whisper.Open(path)
+		if !assert.NoError(err) {
+			return
+		}
+		defer w.Close()
+
+		assert.True(RetentionsEqual(w.Retentions(), schemas[0].Retentions))
+		assert.Equal("Sum", w.AggregationMethod())
+		assert.Equal(float32(0.3), w.XFilesFactor())
+
+		ts, err := w.Fetch(now-3600, now)
+		assert.NoError(err)
+		sum := 0.0
+		for _, v := range ts.Values() {
+			if !math.IsNaN(v) {
+				sum += v
+			}
+		}
+		assert.Equal(float64(55), sum)
+
+		// file with same archives is not rewritten
+		stat, _ := os.Stat(path)
+		assert.NoError(p.resizeMetric("hello.world", path))
+		stat2, _ := os.Stat(path)
+		assert.Equal(stat.ModTime(), stat2.ModTime())
+		assert.Equal(uint32(2), p.resizeChecked)
+		assert.Equal(uint32(1), p.resized)
+	})
+}
@@ -0,0 +1,157 @@
+package persister
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+)
+
+// FileRetentions returns archives of opened whisper file as retentions for creating of new file
+func FileRetentions(w *whisper.Whisper) whisper.Retentions {
+	current := w.Retentions()
+	retentions := make(whisper.Retentions, len(current))
+	for i := range current {
+		r := whisper.NewRetention(current[i].SecondsPerPoint(), current[i].NumberOfPoints())
+		retentions[i] = &r
+	}
+	return retentions
+}
+
+// FetchArchive returns all intervals of archive of whisper file, including empty ones. Result is nil for empty file
+func FetchArchive(w *whisper.Whisper, archive int, now int) (*whisper.TimeSeries, error) {
+	current := w.Retentions()
+	if archive < 0 || archive >= len(current) {
+		return nil, fmt.Errorf("archive %d not found", archive)
+	}
+	return w.Fetch(now-current[archive].MaxRetention(), now)
+}
+
+// valueAt returns value of interval of series with timestamp or NaN
+func valueAt(series *whisper.TimeSeries, timestamp int) float64 {
+	if series == nil || timestamp < series.FromTime() {
+		return math.NaN()
+	}
+	values := series.Values()
+	i := (timestamp - series.FromTime()) / series.Step()
+	if i >= len(values) {
+		return math.NaN()
+	}
+	return values[i]
+}
+
+// copyPoints writes points of src to dst archive by archive, from highest precision to lowest, like whisper-fill.py does.
+// Points of lower precision archive are taken only for time range not covered by higher precision archives of dst
+func copyPoints(src *whisper.Whisper, dst *whisper.Whisper, gapsOnly bool) (int, error) {
+	now := int(time.Now().Unix())
+	until := now
+	copied := 0
+
+	for _, r := range dst.Retentions() {
+		from := now - r.MaxRetention()
+		if from >= until {
+			continue
+		}
+
+		dstSeries, err := dst.Fetch(from, until)
+		if err != nil {
+			return copied, err
+		}
+		srcSeries, err := src.Fetch(from, until)
+		if err != nil {
+			return copied, err
+		}
+		until = from
+
+		if dstSeries == nil || srcSeries == nil {
+			continue
+		}
+
+		points := make([]*whisper.TimeSeriesPoint, 0)
+		for i, value := range dstSeries.Values() {
+			timestamp := dstSeries.FromTime() + i*dstSeries.Step()
+			srcValue := valueAt(srcSeries, timestamp)
+
+			if math.IsNaN(srcValue) || srcValue == value || (gapsOnly && !math.IsNaN(value)) {
+				continue
+			}
+			points = append(points, &whisper.TimeSeriesPoint{Time: timestamp, Value: srcValue})
+		}
+
+		if len(points) == 0 {
+			continue
+		}
+		if err = dst.UpdateMany(points); err != nil {
+			return copied, err
+		}
+		copied += len(points)
+	}
+
+	return copied, nil
+}
+
+// FillFile copies points of src into empty intervals of dst. Returns number of written points
+func FillFile(src *whisper.Whisper, dst *whisper.Whisper) (int, error) {
+	return copyPoints(src, dst, true)
+}
+
+// MergeFile copies all points of src into dst, points of dst are overwritten. Returns number of written points
+func MergeFile(src *whisper.Whisper, dst *whisper.Whisper) (int, error) {
+	return copyPoints(src, dst, false)
+}
+
+// PointDiff is interval with different values in two whisper files. Missing value is NaN
+type PointDiff struct {
+	Timestamp int
+	Value1    float64
+	Value2    float64
+}
+
+// ArchiveDiff is result of comparing of one archive of two whisper files
+type ArchiveDiff struct {
+	Archive int
+	Total   int // intervals with value in any file
+	Points  []PointDiff
+}
+
+// DiffFiles compares all archives of two whisper files with same retentions
+func DiffFiles(w1 *whisper.Whisper, w2 *whisper.Whisper) ([]ArchiveDiff, error) {
+	if !RetentionsEqual(w1.Retentions(), FileRetentions(w2)) {
+		return nil, fmt.Errorf("files have different archives")
+	}
+
+	now := int(time.Now().Unix())
+	result := make([]ArchiveDiff, 0, len(w1.Retentions()))
+
+	for i := range w1.Retentions() {
+		s1, err := FetchArchive(w1, i, now)
+		if err != nil {
+			return nil, err
+		}
+		s2, err := FetchArchive(w2, i, now)
+		if err != nil {
+			return nil, err
+		}
+
+		diff := ArchiveDiff{Archive: i}
+		if s1 != nil {
+			for j, v1 := range s1.Values() {
+				timestamp := s1.FromTime() + j*s1.Step()
+				v2 := valueAt(s2, timestamp)
+
+				if math.IsNaN(v1) && math.IsNaN(v2) {
+					continue
+				}
+				diff.Total++
+
+				if v1 != v2 {
+					diff.Points = append(diff.Points, PointDiff{Timestamp: timestamp, Value1: v1, Value2: v2})
+				}
+			}
+		}
+		result = append(result, diff)
+	}
+
+	return result, nil
+}
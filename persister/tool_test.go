@@ -0,0 +1,88 @@
+package persister
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-graphite/go-whisper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+)
+
+func TestFillMergeDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		retentions, _ := ParseRetentionDefs("1m:1h,10m:1d")
+		now := int(time.Now().Unix())
+		ts := func(i int) int {
+			return now - now%60 - i*60
+		}
+
+		create := func(name string, values map[int]float64) *whisper.Whisper {
+			w, err := whisper.Create(filepath.Join(root, name), retentions, whisper.Average, 0)
+			if !assert.NoError(err) {
+				t.FailNow()
+			}
+			points := make([]*whisper.TimeSeriesPoint, 0)
+			for i, v := range values {
+				points = append(points, &whisper.TimeSeriesPoint{Time: ts(i), Value: v})
+			}
+			assert.NoError(w.UpdateMany(points))
+			return w
+		}
+
+		values := func(w *whisper.Whisper) map[int]float64 {
+			series, err := FetchArchive(w, 0, now)
+			assert.NoError(err)
+			result := make(map[int]float64)
+			for _, p := range series.Points() {
+				if !math.IsNaN(p.Value) {
+					result[(now-now%60-p.Time)/60] = p.Value
+				}
+			}
+			return result
+		}
+
+		src := create("src.wsp", map[int]float64{1: 10, 2: 20, 3: 30})
+		defer src.Close()
+
+		dst := create("dst.wsp", map[int]float64{2: 200, 4: 400})
+		defer dst.Close()
+
+		diffs, err := DiffFiles(src, dst)
+		assert.NoError(err)
+		if assert.Equal(2, len(diffs)) {
+			assert.Equal(4, diffs[0].Total)
+			assert.Equal(4, len(diffs[0].Points))
+		}
+
+		written, err := FillFile(src, dst)
+		assert.NoError(err)
+		assert.True(written >= 2, "written: %d", written)
+		assert.Equal(map[int]float64{1: 10, 2: 200, 3: 30, 4: 400}, values(dst))
+
+		_, err = MergeFile(src, dst)
+		assert.NoError(err)
+		assert.Equal(map[int]float64{1: 10, 2: 20, 3: 30, 4: 400}, values(dst))
+
+		diffs, err = DiffFiles(src, dst)
+		assert.NoError(err)
+		if assert.Equal(2, len(diffs)) && assert.Equal(1, len(diffs[0].Points)) {
+			assert.Equal(ts(4), diffs[0].Points[0].Timestamp)
+			assert.True(math.IsNaN(diffs[0].Points[0].Value1))
+			assert.Equal(400.0, diffs[0].Points[0].Value2)
+		}
+
+		other, _ := ParseRetentionDefs("1m:2h")
+		w, err := whisper.Create(filepath.Join(root, "other.wsp"), other, whisper.Average, 0)
+		if assert.NoError(err) {
+			defer w.Close()
+			_, err = DiffFiles(src, w)
+			assert.Error(err)
+		}
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	whisper "github.com/go-graphite/go-whisper"
 	"go.uber.org/zap"
@@ -28,6 +29,9 @@ type Whisper struct {
 	recv                    func(chan bool) string
 	pop                     func(string) (*points.Points, bool)
 	confirm                 func(*points.Points)
+	overflowNext            func() string
+	overflowPop             func(string) (*points.Points, bool)
+	overflowConfirm         func(*points.Points)
 	tagsEnabled             bool
 	taggedFn                func(string, bool)
 	schemas                 WhisperSchemas
@@ -48,6 +52,30 @@ type Whisper struct {
 	hardMaxCreatesPerSecond bool
 	throttleTicker          *ThrottleTicker
 	maxCreatesTicker        *ThrottleTicker
+	adaptiveTargetLatency   time.Duration
+	adaptiveMaxIOWait       float64
+	adaptiveMinUpdates      int
+	adaptive                *AdaptiveThrottle
+	throttle                chan bool
+	resizeInterval          time.Duration
+	resizeMaxFilesPerSecond int
+	resizeChecked           uint32 // counter
+	resized                 uint32 // counter
+	resizeErrors            uint32 // counter
+	resizePasses            uint32 // counter
+	aggrInterval            time.Duration
+	aggrMaxFilesPerSecond   int
+	aggrChecked             uint32 // counter
+	aggrUpdated             uint32 // counter
+	aggrErrors              uint32 // counter
+	backfillWorkers         int
+	backfillMaxUpdates      int
+	backfillQueue           chan *backfillTask
+	backfillThrottle        *ThrottleTicker
+	backfillRequests        uint32 // counter
+	backfillPoints          uint32 // counter
+	backfillRejected        uint32 // counter
+	backfillErrors          uint32 // counter
 	storeMutex              [storeMutexCount]sync.Mutex
 	mockStore               func() (StoreFunc, func())
 	logger                  *zap.Logger
@@ -96,6 +124,14 @@ func (p *Whisper) SetHardMaxCreatesPerSecond(hardMaxCreatesPerSecond bool) {
 	p.hardMaxCreatesPerSecond = hardMaxCreatesPerSecond
 }
 
+// SetAdaptiveThrottling enables adjusting of updates per second toward target p99 latency of update and max iowait
+// percent of system (0 - not checked). Rate is kept between minUpdatesPerSecond and max-updates-per-second
+func (p *Whisper) SetAdaptiveThrottling(targetLatency time.Duration, maxIOWait float64, minUpdatesPerSecond int) {
+	p.adaptiveTargetLatency = targetLatency
+	p.adaptiveMaxIOWait = maxIOWait
+	p.adaptiveMinUpdates = minUpdatesPerSecond
+}
+
 // GetMaxUpdatesPerSecond returns current throttling speed
 func (p *Whisper) GetMaxUpdatesPerSecond() int {
 	return p.maxUpdatesPerSecond
@@ -136,6 +172,13 @@ func (p *Whisper) SetTagsEnabled(v bool) {
 	p.tagsEnabled = v
 }
 
+// SetOverflow sets on-disk buffer of points which did not fit into cache. Buffer is drained before cache
+func (p *Whisper) SetOverflow(next func() string, pop func(string) (*points.Points, bool), confirm func(*points.Points)) {
+	p.overflowNext = next
+	p.overflowPop = pop
+	p.overflowConfirm = confirm
+}
+
 func (p *Whisper) SetTaggedFn(fn func(string, bool)) {
 	p.taggedFn = fn
 }
@@ -150,18 +193,28 @@ func fnv32(key string) uint32 {
 	return hash
 }
 
-func (p *Whisper) updateMany(w *whisper.Whisper, path string, points []*whisper.TimeSeriesPoint) {
+func (p *Whisper) updateMany(w *whisper.Whisper, path string, points []*whisper.TimeSeriesPoint) error {
+	return p.updateManyForArchive(w, path, points, -1)
+}
+
+// updateManyForArchive writes points to archive with given max retention, -1 spreads points over all archives
+func (p *Whisper) updateManyForArchive(w *whisper.Whisper, path string, points []*whisper.TimeSeriesPoint, archive int) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			p.logger.Error("UpdateMany panic recovered",
 				zap.String("path", path),
 				zap.String("traceback", fmt.Sprint(r)),
 			)
+			err = fmt.Errorf("UpdateMany panic: %v", r)
 		}
 	}()
 
-	// start = time.Now()
-	if err := w.UpdateMany(points); err != nil {
+	start := time.Now()
+	err = w.UpdateManyForArchive(points, archive)
+	if p.adaptive != nil {
+		p.adaptive.Observe(time.Since(start))
+	}
+	if err != nil {
 		p.logger.Error("fail to update metric",
 			zap.String("path", path),
 			zap.Error(err),
@@ -171,9 +224,30 @@ func (p *Whisper) updateMany(w *whisper.Whisper, path string, points []*whisper.
 		atomic.AddUint32(&p.extended, 1)
 		p.logger.Info("cwhisper file has extended", zap.String("path", path))
 	}
+	return err
+}
+
+// MetricPath returns path of whisper file for metric
+func MetricPath(rootPath string, metric string, tagsEnabled bool, hashFilenames bool) string {
+	if tagsEnabled && strings.IndexByte(metric, ';') >= 0 {
+		return tags.FilePath(rootPath, metric, hashFilenames) + ".wsp"
+	}
+	return filepath.Join(rootPath, strings.Replace(metric, ".", "/", -1)+".wsp")
 }
 
 func (p *Whisper) store(metric string) {
+	p.storeFrom(metric, p.pop, p.confirm)
+}
+
+// LockMetric holds store lock of metric until returned unlock is called, so file of metric is not written by persister
+func (p *Whisper) LockMetric(metric string) (unlock func()) {
+	mutexIndex := fnv32(metric) % storeMutexCount
+	p.storeMutex[mutexIndex].Lock()
+	return p.storeMutex[mutexIndex].Unlock
+}
+
+// storeFrom writes points of metric taken with pop to whisper file
+func (p *Whisper) storeFrom(metric string, pop func(string) (*points.Points, bool), confirm func(*points.Points)) {
 	// avoid concurrent store same metric
 	// @TODO: may be flock?
 	// start := time.Now()
@@ -182,12 +256,7 @@ func (p *Whisper) store(metric string) {
 	// atomic.AddUint64(&p.blockAvoidConcurrentNs, uint64(time.Since(start).Nanoseconds()))
 	defer p.storeMutex[mutexIndex].Unlock()
 
-	var path string
-	if p.tagsEnabled && strings.IndexByte(metric, ';') >= 0 {
-		path = tags.FilePath(p.rootPath, metric, p.hashFilenames) + ".wsp"
-	} else {
-		path = filepath.Join(p.rootPath, strings.Replace(metric, ".", "/", -1)+".wsp")
-	}
+	path := MetricPath(p.rootPath, metric, p.tagsEnabled, p.hashFilenames)
 
 	w, err := whisper.OpenWithOptions(path, &whisper.Options{
 		FLock:      p.flock,
@@ -198,14 +267,14 @@ func (p *Whisper) store(metric string) {
 		if !os.IsNotExist(err) {
 			p.logger.Error("failed to open whisper file", zap.String("path", path), zap.Error(err))
 			if pathErr, isPathErr := err.(*os.PathError); isPathErr && pathErr.Err == syscall.ENAMETOOLONG {
-				p.pop(metric)
+				pop(metric)
 			}
 			return
 		}
 
 		if t := p.maxCreatesThrottling(); t != throttlingOff {
 			if t == throttlingHard {
-				p.pop(metric)
+				pop(metric)
 			}
 
 			atomic.AddUint32(&p.throttledCreates, 1)
@@ -218,73 +287,17 @@ func (p *Whisper) store(metric string) {
 			return
 		}
 
-		schema, ok := p.schemas.Match(metric)
-		if !ok {
-			p.logger.Error("no storage schema defined for metric", zap.String("metric", metric))
+		if w, err = p.create(metric, path); err != nil {
 			return
 		}
-
-		aggr := p.aggregation.match(metric)
-		if aggr == nil {
-			p.logger.Error("no storage aggregation defined for metric", zap.String("metric", metric))
-			return
-		}
-
-		if err = os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm); err != nil {
-			p.logger.Error("mkdir failed",
-				zap.String("dir", filepath.Dir(path)),
-				zap.Error(err),
-				zap.String("path", path),
-			)
-			return
-		}
-
-		compressed := p.compressed
-		if schema.Compressed != nil {
-			compressed = *schema.Compressed
-		}
-		w, err = whisper.CreateWithOptions(path, schema.Retentions, aggr.aggregationMethod, float32(aggr.xFilesFactor), &whisper.Options{
-			Sparse:     p.sparse,
-			FLock:      p.flock,
-			Compressed: compressed,
-		})
-		if err != nil {
-			p.logger.Error("create new whisper file failed",
-				zap.String("path", path),
-				zap.Error(err),
-				zap.String("retention", schema.RetentionStr),
-				zap.String("schema", schema.Name),
-				zap.String("aggregation", aggr.name),
-				zap.Float64("xFilesFactor", aggr.xFilesFactor),
-				zap.String("method", aggr.aggregationMethodStr),
-				zap.Bool("compressed", compressed),
-			)
-			return
-		}
-
-		if p.tagsEnabled && p.taggedFn != nil && strings.IndexByte(metric, ';') >= 0 {
-			p.taggedFn(metric, true)
-		}
-
-		p.createLogger.Debug("created",
-			zap.String("path", path),
-			zap.String("retention", schema.RetentionStr),
-			zap.String("schema", schema.Name),
-			zap.String("aggregation", aggr.name),
-			zap.Float64("xFilesFactor", aggr.xFilesFactor),
-			zap.String("method", aggr.aggregationMethodStr),
-			zap.Bool("compressed", compressed),
-		)
-
-		atomic.AddUint32(&p.created, 1)
 	}
 
-	values, exists := p.pop(metric)
+	values, exists := pop(metric)
 	if !exists {
 		return
 	}
-	if p.confirm != nil {
-		defer p.confirm(values)
+	if confirm != nil {
+		defer confirm(values)
 	}
 
 	points := make([]*whisper.TimeSeriesPoint, len(values.Data))
@@ -306,6 +319,22 @@ func (p *Whisper) store(metric string) {
 	}
 }
 
+// storeOverflow writes points of metric from overflow. Taken points are confirmed after write, even if they were dropped
+func (p *Whisper) storeOverflow(metric string) {
+	var taken *points.Points
+	p.storeFrom(metric, func(metric string) (*points.Points, bool) {
+		values, exists := p.overflowPop(metric)
+		if exists {
+			taken = values
+		}
+		return values, exists
+	}, nil)
+
+	if taken != nil {
+		p.overflowConfirm(taken)
+	}
+}
+
 type throttleMode int
 
 const (
@@ -350,6 +379,71 @@ func (p *Whisper) maxCreatesThrottling() throttleMode {
 	}
 }
 
+// create makes new whisper file of metric in path with matched storage schema and aggregation
+func (p *Whisper) create(metric string, path string) (*whisper.Whisper, error) {
+	schema, ok := p.schemas.Match(metric)
+	if !ok {
+		p.logger.Error("no storage schema defined for metric", zap.String("metric", metric))
+		return nil, fmt.Errorf("no storage schema defined for metric")
+	}
+
+	aggr := p.aggregation.match(metric)
+	if aggr == nil {
+		p.logger.Error("no storage aggregation defined for metric", zap.String("metric", metric))
+		return nil, fmt.Errorf("no storage aggregation defined for metric")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm); err != nil {
+		p.logger.Error("mkdir failed",
+			zap.String("dir", filepath.Dir(path)),
+			zap.Error(err),
+			zap.String("path", path),
+		)
+		return nil, err
+	}
+
+	compressed := p.compressed
+	if schema.Compressed != nil {
+		compressed = *schema.Compressed
+	}
+	w, err := whisper.CreateWithOptions(path, schema.Retentions, aggr.aggregationMethod, float32(aggr.xFilesFactor), &whisper.Options{
+		Sparse:     p.sparse,
+		FLock:      p.flock,
+		Compressed: compressed,
+	})
+	if err != nil {
+		p.logger.Error("create new whisper file failed",
+			zap.String("path", path),
+			zap.Error(err),
+			zap.String("retention", schema.RetentionStr),
+			zap.String("schema", schema.Name),
+			zap.String("aggregation", aggr.name),
+			zap.Float64("xFilesFactor", aggr.xFilesFactor),
+			zap.String("method", aggr.aggregationMethodStr),
+			zap.Bool("compressed", compressed),
+		)
+		return nil, err
+	}
+
+	if p.tagsEnabled && p.taggedFn != nil && strings.IndexByte(metric, ';') >= 0 {
+		p.taggedFn(metric, true)
+	}
+
+	p.createLogger.Debug("created",
+		zap.String("path", path),
+		zap.String("retention", schema.RetentionStr),
+		zap.String("schema", schema.Name),
+		zap.String("aggregation", aggr.name),
+		zap.Float64("xFilesFactor", aggr.xFilesFactor),
+		zap.String("method", aggr.aggregationMethodStr),
+		zap.Bool("compressed", compressed),
+	)
+
+	atomic.AddUint32(&p.created, 1)
+
+	return w, nil
+}
+
 func (p *Whisper) worker(exit chan bool) {
 	storeFunc := p.store
 	var doneCb func()
@@ -361,13 +455,21 @@ LOOP:
 	for {
 		// start := time.Now()
 		select {
-		case <-p.throttleTicker.C:
+		case <-p.throttle:
 			// atomic.AddUint64(&p.blockThrottleNs, uint64(time.Since(start).Nanoseconds()))
 			// pass
 		case <-exit:
 			return
 		}
 
+		// points spilled to disk by cache are written before points of cache
+		if p.overflowNext != nil {
+			if metric := p.overflowNext(); metric != "" {
+				p.storeOverflow(metric)
+				continue
+			}
+		}
+
 		// start = time.Now()
 		metric := p.recv(exit)
 		// atomic.AddUint64(&p.blockQueueGetNs, uint64(time.Since(start).Nanoseconds()))
@@ -411,9 +513,35 @@ func (p *Whisper) Stat(send helper.StatCallback) {
 	send("maxCreatesPerSecond", float64(p.maxCreatesPerSecond))
 
 	send("maxUpdatesPerSecond", float64(p.maxUpdatesPerSecond))
+	if p.adaptive != nil {
+		send("effectiveUpdatesPerSecond", float64(p.adaptive.Rate()))
+		p.adaptive.Stat(send)
+	} else {
+		send("effectiveUpdatesPerSecond", float64(p.maxUpdatesPerSecond))
+	}
 	send("workers", float64(p.workersCount))
 	send("extended", float64(extended))
 
+	if p.resizeInterval > 0 {
+		helper.SendAndSubstractUint32("resizeChecked", &p.resizeChecked, send)
+		helper.SendAndSubstractUint32("resized", &p.resized, send)
+		helper.SendAndSubstractUint32("resizeErrors", &p.resizeErrors, send)
+		helper.SendAndSubstractUint32("resizePasses", &p.resizePasses, send)
+	}
+
+	if p.aggrInterval > 0 {
+		helper.SendAndSubstractUint32("aggregationChecked", &p.aggrChecked, send)
+		helper.SendAndSubstractUint32("aggregationUpdated", &p.aggrUpdated, send)
+		helper.SendAndSubstractUint32("aggregationErrors", &p.aggrErrors, send)
+	}
+
+	if p.backfillWorkers > 0 {
+		helper.SendAndSubstractUint32("backfillRequests", &p.backfillRequests, send)
+		helper.SendAndSubstractUint32("backfillPoints", &p.backfillPoints, send)
+		helper.SendAndSubstractUint32("backfillRejected", &p.backfillRejected, send)
+		helper.SendAndSubstractUint32("backfillErrors", &p.backfillErrors, send)
+	}
+
 	// helper.SendAndSubstractUint64("blockThrottleNs", &p.blockThrottleNs, send)
 	// helper.SendAndSubstractUint64("blockQueueGetNs", &p.blockQueueGetNs, send)
 	// helper.SendAndSubstractUint64("blockAvoidConcurrentNs", &p.blockAvoidConcurrentNs, send)
@@ -424,7 +552,14 @@ func (p *Whisper) Stat(send helper.StatCallback) {
 // Start worker
 func (p *Whisper) Start() error {
 	return p.StartFunc(func() error {
-		p.throttleTicker = NewThrottleTicker(p.maxUpdatesPerSecond)
+		if p.adaptiveTargetLatency > 0 {
+			p.adaptive = NewAdaptiveThrottle(p.adaptiveTargetLatency, p.adaptiveMaxIOWait, p.adaptiveMinUpdates, p.maxUpdatesPerSecond)
+			p.adaptive.Start()
+			p.throttle = p.adaptive.C
+		} else {
+			p.throttleTicker = NewThrottleTicker(p.maxUpdatesPerSecond)
+			p.throttle = p.throttleTicker.C
+		}
 		if p.hardMaxCreatesPerSecond {
 			p.maxCreatesTicker = NewHardThrottleTicker(p.maxCreatesPerSecond)
 		} else {
@@ -435,13 +570,37 @@ func (p *Whisper) Start() error {
 			p.Go(p.worker)
 		}
 
+		if p.resizeInterval > 0 {
+			p.Go(p.resizeWorker)
+		}
+
+		if p.aggrInterval > 0 {
+			p.Go(p.aggregationReconcileWorker)
+		}
+
+		if p.backfillWorkers > 0 {
+			p.backfillQueue = make(chan *backfillTask)
+			p.backfillThrottle = NewThrottleTicker(p.backfillMaxUpdates)
+			for i := 0; i < p.backfillWorkers; i++ {
+				p.Go(p.backfillWorker(p.backfillQueue, p.backfillThrottle.C))
+			}
+		}
+
 		return nil
 	})
 }
 
 func (p *Whisper) Stop() {
 	p.StopFunc(func() {
-		p.throttleTicker.Stop()
+		if p.adaptive != nil {
+			p.adaptive.Stop()
+		} else {
+			p.throttleTicker.Stop()
+		}
 		p.maxCreatesTicker.Stop()
+		if p.backfillThrottle != nil {
+			p.backfillThrottle.Stop()
+			p.backfillQueue = nil
+		}
 	})
 }
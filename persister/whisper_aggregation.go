@@ -10,6 +10,8 @@ import (
 	"strconv"
 
 	whisper "github.com/go-graphite/go-whisper"
+
+	"github.com/lomik/go-carbon/helper"
 )
 
 type whisperAggregationItem struct {
@@ -42,7 +44,7 @@ func NewWhisperAggregation() *WhisperAggregation {
 
 // ReadWhisperAggregation ...
 func ReadWhisperAggregation(filename string) (*WhisperAggregation, error) {
-	config, err := parseIniFile(filename)
+	config, err := helper.ParseIniFile(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -68,20 +70,9 @@ func ReadWhisperAggregation(filename string) (*WhisperAggregation, error) {
 		}
 
 		item.aggregationMethodStr = section["aggregationmethod"]
-		switch item.aggregationMethodStr {
-		case "average", "avg":
-			item.aggregationMethod = whisper.Average
-		case "sum":
-			item.aggregationMethod = whisper.Sum
-		case "last":
-			item.aggregationMethod = whisper.Last
-		case "max":
-			item.aggregationMethod = whisper.Max
-		case "min":
-			item.aggregationMethod = whisper.Min
-		default:
-			return nil, fmt.Errorf("unknown aggregation method '%s'",
-				section["aggregationmethod"])
+		item.aggregationMethod, err = ParseAggregationMethod(item.aggregationMethodStr)
+		if err != nil {
+			return nil, err
 		}
 
 		result.Data = append(result.Data, item)
@@ -90,6 +81,23 @@ func ReadWhisperAggregation(filename string) (*WhisperAggregation, error) {
 	return result, nil
 }
 
+// ParseAggregationMethod parses aggregation method name of storage-aggregation.conf
+func ParseAggregationMethod(method string) (whisper.AggregationMethod, error) {
+	switch method {
+	case "average", "avg":
+		return whisper.Average, nil
+	case "sum":
+		return whisper.Sum, nil
+	case "last":
+		return whisper.Last, nil
+	case "max":
+		return whisper.Max, nil
+	case "min":
+		return whisper.Min, nil
+	}
+	return 0, fmt.Errorf("unknown aggregation method '%s'", method)
+}
+
 // Match find schema for metric
 func (a *WhisperAggregation) match(metric string) *whisperAggregationItem {
 	for _, s := range a.Data {
@@ -12,6 +12,8 @@ import (
 	"strings"
 
 	"github.com/go-graphite/go-whisper"
+
+	"github.com/lomik/go-carbon/helper"
 )
 
 // Schema represents one schema setting
@@ -75,7 +77,7 @@ func ParseRetentionDefs(retentionDefs string) (whisper.Retentions, error) {
 // schemas structure
 // see https://graphite.readthedocs.io/en/0.9.9/config-carbon.html#storage-schemas-conf
 func ReadWhisperSchemas(filename string) (WhisperSchemas, error) {
-	config, err := parseIniFile(filename)
+	config, err := helper.ParseIniFile(filename)
 	if err != nil {
 		return nil, err
 	}
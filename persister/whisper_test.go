@@ -2,8 +2,13 @@ package persister
 
 import (
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
 	"github.com/lomik/go-carbon/points"
 )
 
@@ -85,3 +90,45 @@ func TestMaxCreatesHardThrottlingMany(t *testing.T) {
 		}
 	}
 }
+
+func TestStoreOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		schemas, err := parseSchemas(t, `
+[default]
+pattern = .*
+retentions = 1m:1h
+`)
+		if !assert.NoError(err) {
+			return
+		}
+
+		p := NewWhisper(root, schemas, NewWhisperAggregation(), nil, nil, nil)
+		p.maxCreatesTicker = NewSoftThrottleTicker(0)
+
+		overflow := map[string]*points.Points{"hello.world": points.OnePoint("hello.world", 42, 1500000000)}
+		var confirmed []*points.Points
+		p.SetOverflow(
+			func() string { return "" },
+			func(metric string) (*points.Points, bool) {
+				values, exists := overflow[metric]
+				delete(overflow, metric)
+				return values, exists
+			},
+			func(values *points.Points) {
+				// points are confirmed after write
+				_, err := os.Stat(filepath.Join(root, "hello", "world.wsp"))
+				assert.NoError(err)
+				confirmed = append(confirmed, values)
+			},
+		)
+
+		p.storeOverflow("hello.world")
+		assert.Equal(1, len(confirmed))
+
+		// nothing is confirmed if points were not taken
+		p.storeOverflow("hello.world")
+		assert.Equal(1, len(confirmed))
+	})
+}
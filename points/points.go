@@ -20,6 +20,7 @@ type Point struct {
 type Points struct {
 	Metric string
 	Data   []Point
+	Tenant string // name of tenant set by receiver, empty for default tenant
 }
 
 // New creates new instance of Points
@@ -50,6 +51,7 @@ func (p *Points) Copy() *Points {
 	return &Points{
 		Metric: p.Metric,
 		Data:   p.Data,
+		Tenant: p.Tenant,
 	}
 }
 
@@ -41,6 +41,15 @@ func ReadPlain(r io.Reader, callback func(*Points)) error {
 	return nil
 }
 
+// truncated converts io.EOF in the middle of record to io.ErrUnexpectedEOF
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadBinary reads points written by WriteBinaryTo. Record cut by end of data returns io.ErrUnexpectedEOF
 func ReadBinary(r io.Reader, callback func(*Points)) error {
 	reader := bufio.NewReaderSize(r, MB)
 	var p *Points
@@ -71,22 +80,31 @@ func ReadBinary(r io.Reader, callback func(*Points)) error {
 			return err
 		}
 
-		io.ReadAtLeast(reader, buf[:l], int(l))
+		if l < 0 {
+			return fmt.Errorf("negative metric name length: %d", l)
+		}
+
+		if _, err = io.ReadFull(reader, buf[:l]); err != nil {
+			return truncated(err)
+		}
 
 		cnt, err := binary.ReadVarint(reader)
+		if err != nil {
+			return truncated(err)
+		}
 
 		var v, t, v0, t0 int64
 
 		for i := int64(0); i < cnt; i++ {
 			v0, err = binary.ReadVarint(reader)
 			if err != nil {
-				return err
+				return truncated(err)
 			}
 			v += v0
 
 			t0, err = binary.ReadVarint(reader)
 			if err != nil {
-				return err
+				return truncated(err)
 			}
 			t += t0
 
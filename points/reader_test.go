@@ -3,6 +3,7 @@ package points
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -83,7 +84,9 @@ func TestWriteRead(t *testing.T) {
 
 			errorMessage := fmt.Sprintf("test %d", testID)
 
-			if tt.expectedError {
+			if tt.expectedError && tt.method == "binary" {
+				assert.Equal(io.ErrUnexpectedEOF, err, errorMessage)
+			} else if tt.expectedError {
 				assert.Error(err, errorMessage)
 			} else {
 				assert.NoError(err, errorMessage)
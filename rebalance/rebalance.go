@@ -0,0 +1,249 @@
+// Package rebalance moves whisper files of metrics owned by other nodes of consistent hash cluster to their owners
+package rebalance
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	whisper "github.com/go-graphite/go-whisper"
+
+	"github.com/lomik/go-carbon/carbonserver"
+	"github.com/lomik/go-carbon/helper/hashing"
+	"github.com/lomik/go-carbon/persister"
+)
+
+// Result of rebalance run
+type Result struct {
+	Checked int
+	Moved   int
+	Failed  int
+	Skipped int // tagged files, they are not rebalanced
+}
+
+// Rebalancer walks whisper data dir of local node and streams files of metrics, which belong to other nodes,
+// to /metrics/merge/ endpoint of their carbonserver. Local file is removed only after all owners confirm merge.
+// Points written to local file by running go-carbon would be lost, so files are moved only if carbonserver of local node is down
+type Rebalancer struct {
+	dataDir           string
+	cluster           *hashing.Cluster
+	maxFilesPerSecond int
+	dryRun            bool
+	flock             bool
+	token             string
+	scheme            string
+	client            *http.Client
+}
+
+// New creates rebalancer of dataDir of local node of cluster
+func New(dataDir string, cluster *hashing.Cluster) *Rebalancer {
+	return &Rebalancer{
+		dataDir: dataDir,
+		cluster: cluster,
+		scheme:  "http",
+		client:  &http.Client{Timeout: time.Minute},
+	}
+}
+
+// SetMaxFilesPerSecond limits moved files per second. 0 - no limit
+func (r *Rebalancer) SetMaxFilesPerSecond(maxFilesPerSecond int) {
+	r.maxFilesPerSecond = maxFilesPerSecond
+}
+
+// SetDryRun enables reporting of files to move without moving them
+func (r *Rebalancer) SetDryRun(dryRun bool) {
+	r.dryRun = dryRun
+}
+
+// SetFLock enables flock of local files while they are sent
+func (r *Rebalancer) SetFLock(flock bool) {
+	r.flock = flock
+}
+
+// SetToken sets bearer token for carbonserver with authentication
+func (r *Rebalancer) SetToken(token string) {
+	r.token = token
+}
+
+// SetScheme sets scheme of carbonserver of nodes: http or https
+func (r *Rebalancer) SetScheme(scheme string) {
+	r.scheme = scheme
+}
+
+// SetTLS sets client config of https connections to carbonserver of nodes
+func (r *Rebalancer) SetTLS(config *tls.Config) {
+	r.client.Transport = &http.Transport{TLSClientConfig: config}
+}
+
+// SetTimeout sets timeout of sending of one file
+func (r *Rebalancer) SetTimeout(timeout time.Duration) {
+	r.client.Timeout = timeout
+}
+
+// Owners returns nodes of metric. Result is nil if metric belongs to local node
+func (r *Rebalancer) Owners(metric string) []hashing.NodeAddress {
+	owners, local := r.cluster.Owners(metric)
+	if local {
+		return nil
+	}
+	return owners
+}
+
+// checkStopped returns error if carbonserver of local node accepts connections
+func (r *Rebalancer) checkStopped() error {
+	self := r.cluster.Self()
+	conn, err := net.DialTimeout("tcp", self.Address, time.Second)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	return fmt.Errorf("carbonserver of local node %s is running, stop go-carbon before rebalance", self.Address)
+}
+
+// Run moves all files of data dir which belong to other nodes. Every moved file is reported to out.
+// Tagged files are not moved, their number is reported to out
+func (r *Rebalancer) Run(out io.Writer) (*Result, error) {
+	if !r.dryRun {
+		if err := r.checkStopped(); err != nil {
+			return nil, err
+		}
+	}
+
+	throttle := persister.NewThrottleTicker(r.maxFilesPerSecond)
+	defer throttle.Stop()
+
+	result := &Result{}
+
+	err := persister.WalkMetrics(r.dataDir, nil, nil, func(metric string, path string) error {
+		result.Checked++
+
+		owners := r.Owners(metric)
+		if owners == nil {
+			return nil
+		}
+
+		names := make([]string, len(owners))
+		for i, n := range owners {
+			names[i] = n.String()
+		}
+
+		if r.dryRun {
+			result.Moved++
+			fmt.Fprintf(out, "%s: would be moved to %s\n", metric, strings.Join(names, ", "))
+			return nil
+		}
+
+		<-throttle.C
+
+		if err := r.move(metric, path, owners); err != nil {
+			result.Failed++
+			fmt.Fprintf(out, "%s: %s\n", metric, err.Error())
+			return nil
+		}
+
+		result.Moved++
+		fmt.Fprintf(out, "%s: moved to %s\n", metric, strings.Join(names, ", "))
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// WalkMetrics skips tagged files, names of them can be hashed
+	tagged := filepath.Join(r.dataDir, "_tagged")
+	filepath.Walk(tagged, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, ".wsp") {
+			result.Skipped++
+		}
+		return nil
+	})
+	if result.Skipped > 0 {
+		fmt.Fprintf(out, "%s: %d tagged files skipped, tagged metrics are not rebalanced\n", tagged, result.Skipped)
+	}
+
+	return result, nil
+}
+
+// move sends file of metric to all owners and removes it
+func (r *Rebalancer) move(metric string, path string, owners []hashing.NodeAddress) error {
+	// whisper file is opened to hold flock while file is sent
+	w, err := whisper.OpenWithOptions(path, &whisper.Options{FLock: r.flock})
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err = w.File().Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(w.File())
+	if err != nil {
+		return err
+	}
+
+	for _, n := range owners {
+		if err = r.send(n, metric, data); err != nil {
+			return fmt.Errorf("send to %s failed: %s", n.String(), err.Error())
+		}
+	}
+
+	if err = os.Remove(path); err != nil {
+		return err
+	}
+
+	// remove empty directories of moved metrics
+	for dir := filepath.Dir(path); dir != filepath.Clean(r.dataDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// send posts whisper file to merge endpoint of node and checks confirmation
+func (r *Rebalancer) send(n hashing.NodeAddress, metric string, data []byte) error {
+	u := fmt.Sprintf("%s://%s/metrics/merge/?target=%s", r.scheme, n.Address, url.QueryEscape(metric))
+
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var confirm carbonserver.MergeResponse
+	if err = json.Unmarshal(body, &confirm); err != nil {
+		return fmt.Errorf("bad response: %s", err.Error())
+	}
+	if confirm.Metric != metric {
+		return fmt.Errorf("merge of %#v confirmed instead of %#v", confirm.Metric, metric)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package rebalance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	whisper "github.com/go-graphite/go-whisper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/carbonserver"
+	"github.com/lomik/go-carbon/helper/hashing"
+	"github.com/lomik/go-carbon/helper/qa"
+)
+
+func TestRebalance(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		var mu sync.Mutex
+		received := make(map[string]int)
+		fail := ""
+
+		server := httptest.NewTLSServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+			metric := req.URL.Query().Get("target")
+			body, _ := ioutil.ReadAll(req.Body)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if metric == fail {
+				http.Error(wr, "disk full", http.StatusInternalServerError)
+				return
+			}
+			received[metric] = len(body)
+			data, _ := json.Marshal(&carbonserver.MergeResponse{Metric: metric, Created: true})
+			wr.Write(data)
+		}))
+		defer server.Close()
+
+		self, err := hashing.ParseNodeAddress("127.0.0.1:2:a")
+		assert.NoError(err)
+		other, err := hashing.ParseNodeAddress(strings.TrimPrefix(server.URL, "https://") + ":b")
+		assert.NoError(err)
+
+		retentions, _ := whisper.ParseRetentionDefs("1m:1h")
+		var metrics []string
+		for i := 0; i < 20; i++ {
+			metric := fmt.Sprintf("servers.host%d.cpu", i)
+			path := filepath.Join(root, "servers", fmt.Sprintf("host%d", i), "cpu.wsp")
+			assert.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+			w, err := whisper.Create(path, retentions, whisper.Average, 0.5)
+			if assert.NoError(err) {
+				w.Close()
+			}
+			metrics = append(metrics, metric)
+		}
+
+		// tagged files are skipped
+		tagged := filepath.Join(root, "_tagged", "a", "b", "cpu;host=a.wsp")
+		assert.NoError(os.MkdirAll(filepath.Dir(tagged), 0755))
+		assert.NoError(ioutil.WriteFile(tagged, []byte{}, 0644))
+
+		cluster, err := hashing.NewCluster("jump_fnv1a", 1, self, []hashing.NodeAddress{self, other})
+		if !assert.NoError(err) {
+			return
+		}
+
+		r := New(root, cluster)
+		r.SetMaxFilesPerSecond(0)
+		r.SetScheme("https")
+		r.SetTLS(server.Client().Transport.(*http.Transport).TLSClientConfig)
+
+		var moved []string
+		for _, metric := range metrics {
+			if owners := r.Owners(metric); owners != nil {
+				assert.Equal([]hashing.NodeAddress{other}, owners)
+				moved = append(moved, metric)
+			}
+		}
+		assert.True(len(moved) > 0 && len(moved) < len(metrics), "moved: %d", len(moved))
+		sort.Strings(moved)
+
+		// dry run
+		r.SetDryRun(true)
+		out := new(bytes.Buffer)
+		result, err := r.Run(out)
+		assert.NoError(err)
+		assert.Equal(&Result{Checked: 20, Moved: len(moved), Skipped: 1}, result)
+		assert.Equal(0, len(received))
+		assert.True(strings.Contains(out.String(), moved[0]+": would be moved to "+other.String()), out.String())
+		assert.True(strings.Contains(out.String(), "1 tagged files skipped"), out.String())
+
+		// local node is running
+		local, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(err) {
+			return
+		}
+		running, _ := hashing.ParseNodeAddress(local.Addr().String())
+		runningCluster, err := hashing.NewCluster("jump_fnv1a", 1, running, []hashing.NodeAddress{running, other})
+		if assert.NoError(err) {
+			_, err = New(root, runningCluster).Run(new(bytes.Buffer))
+			assert.Error(err)
+		}
+		local.Close()
+		assert.Equal(0, len(received))
+
+		// failed metric is kept
+		fail = moved[0]
+		r.SetDryRun(false)
+		result, err = r.Run(new(bytes.Buffer))
+		assert.NoError(err)
+		assert.Equal(&Result{Checked: 20, Moved: len(moved) - 1, Failed: 1, Skipped: 1}, result)
+
+		var sent []string
+		for metric, size := range received {
+			sent = append(sent, metric)
+			assert.True(size > 0)
+		}
+		sort.Strings(sent)
+		assert.Equal(moved[1:], sent)
+
+		for _, metric := range moved {
+			path := filepath.Join(root, strings.Replace(metric, ".", "/", -1)+".wsp")
+			_, err := os.Stat(path)
+			if metric == fail {
+				assert.NoError(err)
+				continue
+			}
+			assert.True(os.IsNotExist(err), metric)
+			// empty directory is removed
+			_, err = os.Stat(filepath.Dir(path))
+			assert.True(os.IsNotExist(err), metric)
+		}
+	})
+}
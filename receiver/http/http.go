@@ -30,6 +30,7 @@ func init() {
 type Options struct {
 	Listen         string `toml:"listen"`
 	MaxMessageSize uint32 `toml:"max-message-size"`
+	TenantHeader   string `toml:"tenant-header"`
 }
 
 func NewOptions() *Options {
@@ -44,6 +45,7 @@ type HTTP struct {
 	out             func(*points.Points)
 	name            string // name for store metrics
 	maxMessageSize  uint32
+	tenantHeader    string // header with tenant name of points, disabled if empty
 	metricsReceived uint32
 	errors          uint32
 	listener        *net.TCPListener
@@ -76,6 +78,7 @@ func newHTTP(name string, options *Options, store func(*points.Points)) (*HTTP,
 		out:            store,
 		name:           name,
 		maxMessageSize: options.MaxMessageSize,
+		tenantHeader:   options.TenantHeader,
 		logger:         zapwriter.Logger(name),
 		listener:       tcpListener,
 		closed:         make(chan struct{}),
@@ -152,9 +155,17 @@ func (rcv *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var tenant string
+	if rcv.tenantHeader != "" {
+		tenant = r.Header.Get(rcv.tenantHeader)
+	}
+
 	cnt := 0
 	for i := 0; i < len(data); i++ {
 		cnt += len(data[i].Data)
+		if tenant != "" {
+			data[i].Tenant = tenant
+		}
 		rcv.out(data[i])
 	}
 
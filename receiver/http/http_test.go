@@ -90,3 +90,44 @@ func TestHttp(t *testing.T) {
 		}
 	}
 }
+
+func TestHttpTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	received := make([]*points.Points, 0)
+
+	r, err := receiver.New("http", map[string]interface{}{
+		"protocol":      "http",
+		"listen":        "127.0.0.1:0",
+		"tenant":        "listener",
+		"tenant-header": "X-Carbon-Tenant",
+	},
+		func(p *points.Points) {
+			received = append(received, p)
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	url := fmt.Sprintf("http://%s/", r.(*HTTP).Addr())
+
+	for _, tenant := range []string{"", "team-a"} {
+		req, err := http.NewRequest("POST", url, bytes.NewReader([]byte("hello.world 42 1422698155\n")))
+		assert.NoError(err)
+		if tenant != "" {
+			req.Header.Set("X-Carbon-Tenant", tenant)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		assert.Equal(200, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	if assert.Equal(2, len(received)) {
+		assert.Equal("listener", received[0].Tenant)
+		assert.Equal("team-a", received[1].Tenant)
+	}
+}
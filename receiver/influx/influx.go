@@ -0,0 +1,317 @@
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+	"github.com/lomik/go-carbon/receiver/parse"
+	"github.com/lomik/zapwriter"
+)
+
+func init() {
+	receiver.Register(
+		"influx",
+		func() interface{} { return NewOptions() },
+		func(name string, options interface{}, store func(*points.Points)) (receiver.Receiver, error) {
+			return newInflux(name, options.(*Options), store)
+		},
+	)
+}
+
+type Options struct {
+	HTTPListen     string `toml:"http-listen"`
+	TCPListen      string `toml:"tcp-listen"`
+	UDPListen      string `toml:"udp-listen"`
+	Precision      string `toml:"precision"`
+	Template       string `toml:"template"`
+	MaxMessageSize uint32 `toml:"max-message-size"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		HTTPListen:     ":8086",
+		Precision:      "ns",
+		MaxMessageSize: 67108864, // 64 Mb
+	}
+}
+
+// Influx receive metrics in influx line protocol from HTTP /write requests, TCP connections and UDP packets
+type Influx struct {
+	helper.Stoppable
+	out             func(*points.Points)
+	name            string // name for store metrics
+	precision       time.Duration
+	template        []string
+	maxMessageSize  uint32
+	metricsReceived uint32
+	errors          uint32
+	httpListener    *net.TCPListener
+	tcpListener     *net.TCPListener
+	udpConn         *net.UDPConn
+	logger          *zap.Logger
+}
+
+// HTTPAddr returns binded HTTP socket address. For bind port 0 in tests
+func (rcv *Influx) HTTPAddr() net.Addr {
+	if rcv.httpListener == nil {
+		return nil
+	}
+	return rcv.httpListener.Addr()
+}
+
+// TCPAddr returns binded TCP socket address. For bind port 0 in tests
+func (rcv *Influx) TCPAddr() net.Addr {
+	if rcv.tcpListener == nil {
+		return nil
+	}
+	return rcv.tcpListener.Addr()
+}
+
+// UDPAddr returns binded UDP socket address. For bind port 0 in tests
+func (rcv *Influx) UDPAddr() net.Addr {
+	if rcv.udpConn == nil {
+		return nil
+	}
+	return rcv.udpConn.LocalAddr()
+}
+
+func newInflux(name string, options *Options, store func(*points.Points)) (*Influx, error) {
+	if options.HTTPListen == "" && options.TCPListen == "" && options.UDPListen == "" {
+		return nil, fmt.Errorf("at least one of http-listen, tcp-listen, udp-listen should be set")
+	}
+
+	precision, err := parse.InfluxPrecision(options.Precision)
+	if err != nil {
+		return nil, err
+	}
+
+	rcv := &Influx{
+		out:            store,
+		name:           name,
+		precision:      precision,
+		maxMessageSize: options.MaxMessageSize,
+		logger:         zapwriter.Logger(name),
+	}
+
+	if options.Template != "" {
+		rcv.template = strings.Split(options.Template, ".")
+	}
+
+	err = rcv.StartFunc(func() error {
+		if options.HTTPListen != "" {
+			if err := rcv.listenHTTP(options.HTTPListen); err != nil {
+				return err
+			}
+		}
+		if options.TCPListen != "" {
+			if err := rcv.listenTCP(options.TCPListen); err != nil {
+				return err
+			}
+		}
+		if options.UDPListen != "" {
+			if err := rcv.listenUDP(options.UDPListen); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rcv, nil
+}
+
+func (rcv *Influx) Stat(send helper.StatCallback) {
+	helper.SendAndSubstractUint32("metricsReceived", &rcv.metricsReceived, send)
+	helper.SendAndSubstractUint32("errors", &rcv.errors, send)
+}
+
+// sanitize replaces path separators in tag values
+var sanitize = strings.NewReplacer(".", "_", " ", "_")
+
+// metricName returns tagged name measurement.field;tag=value or path by template.
+// Field "value" is omitted. Template segments {measurement}, {field} and {<tag>} are replaced
+// with values, segments of absent tags are skipped
+func (rcv *Influx) metricName(p *parse.InfluxPoint, field string) (string, error) {
+	if rcv.template == nil {
+		return p.Name(field)
+	}
+
+	segments := make([]string, 0, len(rcv.template))
+	for _, segment := range rcv.template {
+		if len(segment) < 3 || segment[0] != '{' || segment[len(segment)-1] != '}' {
+			segments = append(segments, segment)
+			continue
+		}
+
+		switch key := segment[1 : len(segment)-1]; key {
+		case "measurement":
+			segments = append(segments, p.Measurement)
+		case "field":
+			segments = append(segments, field)
+		default:
+			for _, tag := range p.Tags {
+				if tag.Key == key && tag.Value != "" {
+					segments = append(segments, sanitize.Replace(tag.Value))
+					break
+				}
+			}
+		}
+	}
+
+	return strings.Join(segments, "."), nil
+}
+
+// handleLine parses line and sends one point per field. Returns false on parse error
+func (rcv *Influx) handleLine(line []byte, precision time.Duration, now int64) bool {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return true
+	}
+
+	p, err := parse.InfluxLine(line, precision, now)
+	if err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		rcv.logger.Info("parse failed", zap.Error(err))
+		return false
+	}
+
+	for _, field := range p.Fields {
+		name, err := rcv.metricName(p, field.Key)
+		if err != nil {
+			atomic.AddUint32(&rcv.errors, 1)
+			rcv.logger.Info("parse failed", zap.Error(err))
+			return false
+		}
+
+		atomic.AddUint32(&rcv.metricsReceived, 1)
+		rcv.out(points.OnePoint(name, field.Value, p.Timestamp))
+	}
+
+	return true
+}
+
+func (rcv *Influx) listenHTTP(listen string) error {
+	addr, err := net.ResolveTCPAddr("tcp", listen)
+	if err != nil {
+		return err
+	}
+
+	rcv.httpListener, err = net.ListenTCP("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", rcv.writeHandler)
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	s := &http.Server{
+		Handler:        mux,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	rcv.Go(func(exit chan bool) {
+		<-exit
+		s.Close()
+	})
+
+	rcv.Go(func(exit chan bool) {
+		s.Serve(rcv.httpListener)
+	})
+
+	return nil
+}
+
+func (rcv *Influx) writeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, fmt.Sprintf("Method %#v is not supported", r.Method), http.StatusBadRequest)
+		return
+	}
+
+	if r.ContentLength > int64(rcv.maxMessageSize) {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, fmt.Sprintf("Message too long. Max allowed message size is %#v", rcv.maxMessageSize), http.StatusBadRequest)
+		return
+	}
+
+	precision := rcv.precision
+	if r.URL.Query().Get("precision") != "" {
+		var err error
+		if precision, err = parse.InfluxPrecision(r.URL.Query().Get("precision")); err != nil {
+			atomic.AddUint32(&rcv.errors, 1)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(rcv.maxMessageSize)))
+	if err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, fmt.Sprintf("Read request failed: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Unix()
+	failed := 0
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if !rcv.handleLine(line, precision, now) {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		http.Error(w, fmt.Sprintf("Parse failed for %d lines", failed), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rcv *Influx) listenTCP(listen string) error {
+	var err error
+	rcv.tcpListener, err = receiver.ListenTCP(rcv.Go, listen, rcv.logger, rcv.handleConnection)
+	return err
+}
+
+func (rcv *Influx) handleConnection(exit chan bool, conn net.Conn) {
+	defer conn.Close()
+
+	unfinished, err := receiver.ReadLines(exit, conn, func(line []byte) bool {
+		rcv.handleLine(line, rcv.precision, time.Now().Unix())
+		return true
+	})
+	if err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		rcv.logger.Error("read error", zap.Error(err))
+	} else if len(unfinished) > 0 {
+		rcv.logger.Warn("unfinished line", zap.String("line", string(unfinished)))
+	}
+}
+
+func (rcv *Influx) listenUDP(listen string) error {
+	var err error
+	rcv.udpConn, err = receiver.ListenUDPLines(rcv.Go, listen, rcv.logger, &rcv.errors, func(line []byte) {
+		rcv.handleLine(line, rcv.precision, time.Now().Unix())
+	})
+	return err
+}
@@ -0,0 +1,129 @@
+package influx
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+)
+
+func TestInfluxHTTP(t *testing.T) {
+	assert := assert.New(t)
+	c := &qa.Collector{}
+
+	r, err := receiver.New("influx", map[string]interface{}{
+		"protocol":    "influx",
+		"http-listen": "127.0.0.1:0",
+		"precision":   "s",
+	}, c.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	url := fmt.Sprintf("http://%s/write", r.(*Influx).HTTPAddr())
+
+	resp, err := http.Post(url, "text/plain", strings.NewReader(
+		"cpu,host=a,dc=ams usage_idle=90,usage_user=5i 1422698155\n"+
+			"mem,host=a value=42 1422698155\n"+
+			"broken\n",
+	))
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post(url+"?precision=ms", "text/plain", strings.NewReader("mem,host=b value=43 1422698155000"))
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+
+	received := c.Wait(t, 4)
+	assert.Equal([]*points.Points{
+		points.OnePoint("cpu.usage_idle;dc=ams;host=a", 90, 1422698155),
+		points.OnePoint("cpu.usage_user;dc=ams;host=a", 5, 1422698155),
+		points.OnePoint("mem;host=a", 42, 1422698155),
+		points.OnePoint("mem;host=b", 43, 1422698155),
+	}, received)
+
+	stat := make(map[string]float64)
+	r.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(float64(4), stat["metricsReceived"])
+	assert.Equal(float64(1), stat["errors"])
+}
+
+func TestInfluxTCPAndUDP(t *testing.T) {
+	assert := assert.New(t)
+	c := &qa.Collector{}
+
+	r, err := receiver.New("influx", map[string]interface{}{
+		"protocol":    "influx",
+		"http-listen": "",
+		"tcp-listen":  "127.0.0.1:0",
+		"udp-listen":  "127.0.0.1:0",
+		"precision":   "s",
+		"template":    "servers.{dc}.{host}.{measurement}.{field}",
+	}, c.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	assert.Nil(r.(*Influx).HTTPAddr())
+
+	conn, err := net.Dial("tcp", r.(*Influx).TCPAddr().String())
+	assert.NoError(err)
+	fmt.Fprint(conn, "cpu,host=web1.example.com,dc=ams idle=90 1422698155\n")
+	conn.Close()
+
+	c.Wait(t, 1)
+
+	conn, err = net.Dial("udp", r.(*Influx).UDPAddr().String())
+	assert.NoError(err)
+	fmt.Fprint(conn, "cpu,host=web2 idle=80 1422698155")
+	conn.Close()
+
+	received := c.Wait(t, 2)
+	assert.Equal([]*points.Points{
+		points.OnePoint("servers.ams.web1_example_com.cpu.idle", 90, 1422698155),
+		points.OnePoint("servers.web2.cpu.idle", 80, 1422698155),
+	}, received)
+}
+
+func TestStopInflux(t *testing.T) {
+	assert := assert.New(t)
+
+	options := map[string]interface{}{
+		"protocol":    "influx",
+		"http-listen": "127.0.0.1:0",
+		"tcp-listen":  "127.0.0.1:0",
+		"udp-listen":  "127.0.0.1:0",
+	}
+
+	for i := 0; i < 10; i++ {
+		opts := make(map[string]interface{})
+		for k, v := range options {
+			opts[k] = v
+		}
+
+		r, err := receiver.New("influx", opts, nil)
+		if !assert.NoError(err) {
+			return
+		}
+
+		// listen same ports in next iteration
+		options["http-listen"] = r.(*Influx).HTTPAddr().String()
+		options["tcp-listen"] = r.(*Influx).TCPAddr().String()
+		options["udp-listen"] = r.(*Influx).UDPAddr().String()
+		r.Stop()
+	}
+
+	_, err := receiver.New("influx", map[string]interface{}{"protocol": "influx", "http-listen": ""}, nil)
+	assert.Error(err)
+}
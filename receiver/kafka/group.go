@@ -0,0 +1,638 @@
+package kafka
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/zapwriter"
+)
+
+// groupProtocol is name of partition assignment strategy. All members of group should use the same
+const groupProtocol = "roundrobin"
+
+func newKafkaGroup(name string, options *Options, store func(*points.Points)) (*Kafka, error) {
+	ver, err := sarama.ParseKafkaVersion(options.KafkaVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ver.IsAtLeast(sarama.V0_9_0_0) {
+		return nil, fmt.Errorf("consumer-group requires kafka-version 0.9.0.0 or newer")
+	}
+
+	switch {
+	case options.SessionTimeout == nil || options.SessionTimeout.Duration <= 0:
+		return nil, fmt.Errorf("session-timeout should be positive")
+	case options.HeartbeatInterval == nil || options.HeartbeatInterval.Duration <= 0:
+		return nil, fmt.Errorf("heartbeat-interval should be positive")
+	case options.HeartbeatInterval.Duration >= options.SessionTimeout.Duration:
+		return nil, fmt.Errorf("heartbeat-interval should be less than session-timeout")
+	case options.CommitInterval == nil || options.CommitInterval.Duration <= 0:
+		return nil, fmt.Errorf("commit-interval should be positive")
+	case options.TopicRefreshInterval == nil || options.TopicRefreshInterval.Duration <= 0:
+		return nil, fmt.Errorf("topic-refresh-interval should be positive")
+	}
+
+	rcv := &Kafka{
+		out:                  store,
+		name:                 name,
+		protocol:             options.Protocol,
+		logger:               zapwriter.Logger(name),
+		closed:               make(chan struct{}),
+		reconnectInterval:    options.ReconnectInterval.Duration,
+		version:              ver,
+		compression:          options.Compression,
+		maxMessageSize:       options.MaxMessageSize,
+		protocolHeader:       options.ProtocolHeader,
+		compressionHeader:    options.CompressionHeader,
+		lag:                  make(map[string]int64),
+		group:                options.ConsumerGroup,
+		sessionTimeout:       options.SessionTimeout.Duration,
+		heartbeatInterval:    options.HeartbeatInterval.Duration,
+		commitInterval:       options.CommitInterval.Duration,
+		topicRefreshInterval: options.TopicRefreshInterval.Duration,
+		connectOptions: optionsKafka{
+			brokers:       options.Brokers,
+			initialOffset: options.InitialOffset,
+		},
+	}
+
+	if options.TopicRegex != "" {
+		rcv.topicRegex, err = regexp.Compile(options.TopicRegex)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(options.Topics) > 0 {
+		rcv.topics = options.Topics
+	} else {
+		rcv.topics = []string{options.Topic}
+	}
+
+	rcv.waitGroup.Add(1)
+	go func() {
+		rcv.groupWorker()
+		rcv.waitGroup.Done()
+	}()
+
+	return rcv, nil
+}
+
+// groupWorker connects to kafka and consumes assigned partitions until receiver is stopped
+func (rcv *Kafka) groupWorker() {
+	for {
+		err := rcv.groupConnect()
+		if err == nil {
+			return
+		}
+
+		rcv.logger.Error("consumer group failed",
+			zap.String("group", rcv.group),
+			zap.Duration("reconnect_interval", rcv.reconnectInterval),
+			zap.Error(err),
+		)
+
+		select {
+		case <-rcv.closed:
+			return
+		case <-time.After(rcv.reconnectInterval):
+		}
+	}
+}
+
+// groupConnect returns nil only if receiver is stopped
+func (rcv *Kafka) groupConnect() error {
+	config := sarama.NewConfig()
+	config.Version = rcv.version
+	config.Metadata.RefreshFrequency = rcv.topicRefreshInterval
+
+	rcv.logger.Info("connecting to kafka", zap.String("group", rcv.group))
+
+	client, err := sarama.NewClient(rcv.connectOptions.brokers, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	memberID := ""
+	for {
+		topics, err := rcv.groupTopics(client)
+		if err != nil {
+			return err
+		}
+
+		coordinator, err := client.Coordinator(rcv.group)
+		if err != nil {
+			return err
+		}
+
+		join := &sarama.JoinGroupRequest{
+			GroupId:        rcv.group,
+			SessionTimeout: int32(rcv.sessionTimeout / time.Millisecond),
+			MemberId:       memberID,
+			ProtocolType:   "consumer",
+		}
+		if rcv.version.IsAtLeast(sarama.V0_10_1_0) {
+			join.Version = 1
+			join.RebalanceTimeout = join.SessionTimeout
+		}
+		if err = join.AddGroupProtocolMetadata(groupProtocol, &sarama.ConsumerGroupMemberMetadata{Topics: topics}); err != nil {
+			return err
+		}
+
+		joined, err := coordinator.JoinGroup(join)
+		if err != nil {
+			client.RefreshCoordinator(rcv.group)
+			return err
+		}
+
+		switch joined.Err {
+		case sarama.ErrNoError:
+		case sarama.ErrUnknownMemberId:
+			memberID = ""
+			continue
+		default:
+			return joined.Err
+		}
+		memberID = joined.MemberId
+
+		syncGroup := &sarama.SyncGroupRequest{
+			GroupId:      rcv.group,
+			GenerationId: joined.GenerationId,
+			MemberId:     memberID,
+		}
+
+		if joined.LeaderId == joined.MemberId {
+			if err = rcv.groupPlan(client, joined, syncGroup); err != nil {
+				return err
+			}
+		}
+
+		synced, err := coordinator.SyncGroup(syncGroup)
+		if err != nil {
+			return err
+		}
+
+		switch synced.Err {
+		case sarama.ErrNoError:
+		case sarama.ErrRebalanceInProgress, sarama.ErrIllegalGeneration:
+			continue
+		case sarama.ErrUnknownMemberId:
+			memberID = ""
+			continue
+		default:
+			return synced.Err
+		}
+
+		assignment, err := synced.GetMemberAssignment()
+		if err != nil {
+			return err
+		}
+
+		rcv.logger.Info("joined consumer group",
+			zap.String("group", rcv.group),
+			zap.String("member", memberID),
+			zap.Int32("generation", joined.GenerationId),
+			zap.Any("partitions", assignment.Topics),
+		)
+
+		rebalance, err := rcv.groupSession(client, coordinator, joined.GenerationId, memberID, topics, assignment.Topics)
+		if err != nil {
+			return err
+		}
+
+		if !rebalance {
+			// receiver stopped, partitions can be reassigned immediately
+			_, err = coordinator.LeaveGroup(&sarama.LeaveGroupRequest{
+				GroupId:  rcv.group,
+				MemberId: memberID,
+			})
+			if err != nil {
+				rcv.logger.Warn("failed to leave consumer group", zap.Error(err))
+			}
+			return nil
+		}
+	}
+}
+
+// groupTopics returns sorted list of topics to subscribe
+func (rcv *Kafka) groupTopics(client sarama.Client) ([]string, error) {
+	if rcv.topicRegex == nil {
+		return rcv.topics, nil
+	}
+
+	all, err := client.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make([]string, 0)
+	for _, topic := range all {
+		if rcv.topicRegex.MatchString(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+
+	return topics, nil
+}
+
+// groupPlan fills assignments of all group members. Called by group leader only
+func (rcv *Kafka) groupPlan(client sarama.Client, joined *sarama.JoinGroupResponse, syncGroup *sarama.SyncGroupRequest) error {
+	members, err := joined.GetMembers()
+	if err != nil {
+		return err
+	}
+
+	subscriptions := make(map[string][]string, len(members))
+	partitions := make(map[string][]int32)
+	for memberID, meta := range members {
+		subscriptions[memberID] = meta.Topics
+		for _, topic := range meta.Topics {
+			if _, ok := partitions[topic]; ok {
+				continue
+			}
+			if partitions[topic], err = client.Partitions(topic); err != nil {
+				return err
+			}
+		}
+	}
+
+	for memberID, topics := range groupAssign(subscriptions, partitions) {
+		err = syncGroup.AddGroupAssignmentMember(memberID, &sarama.ConsumerGroupMemberAssignment{Topics: topics})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// groupAssign distributes partitions between members with round robin. Partition is assigned only
+// to member subscribed on its topic. Every member gets assignment, probably empty
+func groupAssign(subscriptions map[string][]string, partitions map[string][]int32) map[string]map[string][]int32 {
+	members := make([]string, 0, len(subscriptions))
+	subscribed := make(map[string]map[string]bool, len(subscriptions))
+	for memberID, topics := range subscriptions {
+		members = append(members, memberID)
+		subscribed[memberID] = make(map[string]bool, len(topics))
+		for _, topic := range topics {
+			subscribed[memberID][topic] = true
+		}
+	}
+	sort.Strings(members)
+
+	topics := make([]string, 0, len(partitions))
+	for topic := range partitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	res := make(map[string]map[string][]int32, len(members))
+	for _, memberID := range members {
+		res[memberID] = make(map[string][]int32)
+	}
+
+	next := 0
+	for _, topic := range topics {
+		topicPartitions := append([]int32(nil), partitions[topic]...)
+		sort.Slice(topicPartitions, func(i, j int) bool { return topicPartitions[i] < topicPartitions[j] })
+
+		for _, partition := range topicPartitions {
+			for i := 0; i < len(members); i++ {
+				memberID := members[next%len(members)]
+				next++
+				if subscribed[memberID][topic] {
+					res[memberID][topic] = append(res[memberID][topic], partition)
+					break
+				}
+			}
+		}
+	}
+
+	return res
+}
+
+// groupOffsets keeps offsets of handled messages of group session. Offsets are committed with generation
+// and member id of session: sarama OffsetManager commits with undefined generation, which is not checked
+// by coordinator against group membership
+type groupOffsets struct {
+	sync.Mutex
+	group        string
+	generationID int32
+	memberID     string
+	marked       map[string]map[int32]int64 // next offset to consume
+	committed    map[string]map[int32]int64
+}
+
+func newGroupOffsets(group string, generationID int32, memberID string) *groupOffsets {
+	return &groupOffsets{
+		group:        group,
+		generationID: generationID,
+		memberID:     memberID,
+		marked:       make(map[string]map[int32]int64),
+		committed:    make(map[string]map[int32]int64),
+	}
+}
+
+// mark saves offset of next message to consume from partition
+func (o *groupOffsets) mark(topic string, partition int32, offset int64) {
+	o.Lock()
+	if o.marked[topic] == nil {
+		o.marked[topic] = make(map[int32]int64)
+	}
+	o.marked[topic][partition] = offset
+	o.Unlock()
+}
+
+// commitRequest returns request with offsets marked since last commit or nil if there are no such offsets
+func (o *groupOffsets) commitRequest() *sarama.OffsetCommitRequest {
+	o.Lock()
+	defer o.Unlock()
+
+	req := &sarama.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           o.group,
+		ConsumerGroupGeneration: o.generationID,
+		ConsumerID:              o.memberID,
+		RetentionTime:           -1, // broker default
+	}
+
+	empty := true
+	for topic, partitions := range o.marked {
+		for partition, offset := range partitions {
+			if committed, ok := o.committed[topic][partition]; ok && committed == offset {
+				continue
+			}
+			req.AddBlock(topic, partition, offset, 0, "")
+			empty = false
+		}
+	}
+
+	if empty {
+		return nil
+	}
+	return req
+}
+
+// setCommitted saves offsets of successfully committed request
+func (o *groupOffsets) setCommitted(req *sarama.OffsetCommitRequest, resp *sarama.OffsetCommitResponse) {
+	o.Lock()
+	defer o.Unlock()
+
+	for topic, partitions := range resp.Errors {
+		for partition, kerr := range partitions {
+			if kerr != sarama.ErrNoError {
+				continue
+			}
+			offset, _, err := req.Offset(topic, partition)
+			if err != nil {
+				continue
+			}
+			if o.committed[topic] == nil {
+				o.committed[topic] = make(map[int32]int64)
+			}
+			o.committed[topic][partition] = offset
+		}
+	}
+}
+
+// groupFetchOffsets returns committed offsets of assigned partitions. Partitions without committed offset are omitted
+func (rcv *Kafka) groupFetchOffsets(coordinator *sarama.Broker, assignment map[string][]int32) (map[string]map[int32]int64, error) {
+	req := &sarama.OffsetFetchRequest{
+		Version:       1,
+		ConsumerGroup: rcv.group,
+	}
+	for topic, partitions := range assignment {
+		for _, partition := range partitions {
+			req.AddPartition(topic, partition)
+		}
+	}
+
+	resp, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]map[int32]int64)
+	for topic, partitions := range assignment {
+		offsets[topic] = make(map[int32]int64)
+		for _, partition := range partitions {
+			block := resp.GetBlock(topic, partition)
+			if block == nil {
+				return nil, sarama.ErrIncompleteResponse
+			}
+			if block.Err != sarama.ErrNoError {
+				return nil, block.Err
+			}
+			if block.Offset >= 0 {
+				offsets[topic][partition] = block.Offset
+			}
+		}
+	}
+
+	return offsets, nil
+}
+
+// groupCommit commits marked offsets. Returns true if group rebalance is required
+func (rcv *Kafka) groupCommit(coordinator *sarama.Broker, offsets *groupOffsets) (bool, error) {
+	req := offsets.commitRequest()
+	if req == nil {
+		return false, nil
+	}
+
+	resp, err := coordinator.CommitOffset(req)
+	if err != nil {
+		return false, err
+	}
+	offsets.setCommitted(req, resp)
+
+	for _, partitions := range resp.Errors {
+		for _, kerr := range partitions {
+			switch kerr {
+			case sarama.ErrNoError:
+			case sarama.ErrIllegalGeneration, sarama.ErrUnknownMemberId, sarama.ErrRebalanceInProgress:
+				rcv.logger.Info("consumer group rebalance", zap.String("reason", kerr.Error()))
+				return true, nil
+			default:
+				return false, kerr
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// groupSession consumes assigned partitions, commits offsets and sends heartbeats. Returns true if group rebalance is required
+func (rcv *Kafka) groupSession(client sarama.Client, coordinator *sarama.Broker, generationID int32, memberID string, topics []string, assignment map[string][]int32) (bool, error) {
+	committed, err := rcv.groupFetchOffsets(coordinator, assignment)
+	if err != nil {
+		return false, err
+	}
+
+	offsets := newGroupOffsets(rcv.group, generationID, memberID)
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return false, err
+	}
+	defer consumer.Close()
+
+	rcv.lagLock.Lock()
+	rcv.lag = make(map[string]int64)
+	rcv.lagLock.Unlock()
+
+	// offsets of messages handled before stop are committed after all workers are finished
+	defer func() {
+		if _, err := rcv.groupCommit(coordinator, offsets); err != nil {
+			rcv.logger.Warn("failed to commit offsets", zap.Error(err))
+		}
+	}()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	defer wg.Wait()
+	defer close(stop)
+
+	// closed partition consumer stalls its partition until next rebalance, so group is rejoined
+	failed := make(chan struct{}, 1)
+
+	for topic, partitions := range assignment {
+		for _, partition := range partitions {
+			offset, ok := committed[topic][partition]
+			if !ok {
+				offset = -1
+			}
+
+			pc, err := rcv.groupConsumePartition(client, consumer, topic, partition, offset)
+			if err != nil {
+				return false, err
+			}
+
+			wg.Add(1)
+			go func(topic string, partition int32) {
+				rcv.partitionWorker(stop, failed, topic, partition, pc, offsets)
+				wg.Done()
+			}(topic, partition)
+		}
+	}
+
+	heartbeat := time.NewTicker(rcv.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	commit := time.NewTicker(rcv.commitInterval)
+	defer commit.Stop()
+
+	for {
+		select {
+		case <-rcv.closed:
+			return false, nil
+		case <-failed:
+			rcv.logger.Info("consumer group rebalance", zap.String("reason", "partition consumer closed"))
+			return true, nil
+		case <-commit.C:
+			rebalance, err := rcv.groupCommit(coordinator, offsets)
+			if err != nil || rebalance {
+				return rebalance, err
+			}
+		case <-heartbeat.C:
+			resp, err := coordinator.Heartbeat(&sarama.HeartbeatRequest{
+				GroupId:      rcv.group,
+				GenerationId: generationID,
+				MemberId:     memberID,
+			})
+			if err != nil {
+				return false, err
+			}
+
+			if resp.Err != sarama.ErrNoError {
+				rcv.logger.Info("consumer group rebalance", zap.String("reason", resp.Err.Error()))
+				return true, nil
+			}
+
+			if rcv.topicRegex != nil {
+				current, err := rcv.groupTopics(client)
+				if err != nil {
+					return false, err
+				}
+				if fmt.Sprint(current) != fmt.Sprint(topics) {
+					rcv.logger.Info("consumer group rebalance", zap.String("reason", "topics changed"))
+					return true, nil
+				}
+			}
+		}
+	}
+}
+
+// groupConsumePartition starts consuming from committed offset. Partitions without committed offset (negative)
+// are consumed from initial-offset
+func (rcv *Kafka) groupConsumePartition(client sarama.Client, consumer sarama.Consumer, topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	initialOffset := rcv.connectOptions.initialOffset
+	if offset < 0 {
+		switch initialOffset {
+		case OffsetOldest:
+			offset = sarama.OffsetOldest
+		case OffsetNewest:
+			offset = sarama.OffsetNewest
+		default:
+			// initial-offset is timestamp in nanoseconds, kafka expects milliseconds
+			var err error
+			offset, err = client.GetOffset(topic, partition, int64(initialOffset)/int64(time.Millisecond))
+			if err != nil {
+				rcv.logger.Error("failed to get offset, falling back to 'oldest'",
+					zap.String("topic", topic),
+					zap.Int32("partition", partition),
+					zap.Error(err),
+				)
+				offset = sarama.OffsetOldest
+			}
+		}
+	}
+
+	pc, err := consumer.ConsumePartition(topic, partition, offset)
+	if err == sarama.ErrOffsetOutOfRange {
+		rcv.logger.Warn("offset is out of range, falling back to 'oldest'",
+			zap.String("topic", topic),
+			zap.Int32("partition", partition),
+			zap.Int64("offset", offset),
+		)
+		pc, err = consumer.ConsumePartition(topic, partition, sarama.OffsetOldest)
+	}
+
+	return pc, err
+}
+
+// partitionWorker handles messages and marks offsets for commit until stop is closed.
+// Sends to failed if messages channel is closed by consumer
+func (rcv *Kafka) partitionWorker(stop chan struct{}, failed chan struct{}, topic string, partition int32, pc sarama.PartitionConsumer, offsets *groupOffsets) {
+	defer pc.Close()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				rcv.logger.Error("partition consumer closed",
+					zap.String("topic", topic),
+					zap.Int32("partition", partition),
+				)
+				select {
+				case failed <- struct{}{}:
+				default:
+				}
+				return
+			}
+
+			rcv.handleMessage(msg)
+			offsets.mark(msg.Topic, msg.Partition, msg.Offset+1)
+			rcv.setLag(msg.Topic, msg.Partition, pc.HighWaterMarkOffset(), msg.Offset)
+		}
+	}
+}
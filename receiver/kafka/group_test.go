@@ -0,0 +1,212 @@
+package kafka
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/zapwriter"
+)
+
+func TestGroupAssign(t *testing.T) {
+	assert := assert.New(t)
+
+	subscriptions := map[string][]string{
+		"m1": {"a", "b"},
+		"m2": {"a", "b"},
+		"m3": {"b"},
+	}
+	partitions := map[string][]int32{
+		"a": {3, 2, 1, 0},
+		"b": {0, 1},
+		"c": {0},
+	}
+
+	assert.Equal(map[string]map[string][]int32{
+		"m1": {"a": {0, 2}, "b": {1}},
+		"m2": {"a": {1, 3}},
+		"m3": {"b": {0}},
+	}, groupAssign(subscriptions, partitions))
+
+	// member without partitions gets empty assignment
+	assert.Equal(map[string]map[string][]int32{
+		"m1": {"c": {0}},
+		"m2": {},
+	}, groupAssign(map[string][]string{"m1": {"c"}, "m2": {"c"}}, map[string][]int32{"c": {0}}))
+}
+
+func TestConsumerGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	join := &sarama.JoinGroupRequest{}
+	assert.NoError(join.AddGroupProtocolMetadata(groupProtocol, &sarama.ConsumerGroupMemberMetadata{Topics: []string{"graphite"}}))
+
+	syncGroup := &sarama.SyncGroupRequest{}
+	assert.NoError(syncGroup.AddGroupAssignmentMember("m1", &sarama.ConsumerGroupMemberAssignment{
+		Topics: map[string][]int32{"graphite": {0, 1}},
+	}))
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("graphite", 0, broker.BrokerID()).
+			SetLeader("graphite", 1, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "carbon", broker),
+		"JoinGroupRequest": sarama.NewMockWrapper(&sarama.JoinGroupResponse{
+			Version:       1,
+			GenerationId:  1,
+			GroupProtocol: groupProtocol,
+			LeaderId:      "m1",
+			MemberId:      "m1",
+			Members:       map[string][]byte{"m1": join.OrderedGroupProtocols[0].Metadata},
+		}),
+		"SyncGroupRequest": sarama.NewMockWrapper(&sarama.SyncGroupResponse{
+			MemberAssignment: syncGroup.GroupAssignments["m1"],
+		}),
+		"HeartbeatRequest":  sarama.NewMockWrapper(&sarama.HeartbeatResponse{}),
+		"LeaveGroupRequest": sarama.NewMockWrapper(&sarama.LeaveGroupResponse{}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("carbon", "graphite", 0, 5, "", sarama.ErrNoError).
+			SetOffset("carbon", "graphite", 1, -1, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("graphite", 0, sarama.OffsetOldest, 0).
+			SetOffset("graphite", 0, sarama.OffsetNewest, 10).
+			SetOffset("graphite", 1, sarama.OffsetOldest, 0).
+			SetOffset("graphite", 1, sarama.OffsetNewest, 10),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).SetVersion(4).
+			SetMessage("graphite", 0, 5, sarama.StringEncoder("\nfive 5 1422698155\n")).
+			SetMessage("graphite", 1, 0, sarama.StringEncoder("\nzero 0 1422698155\n")).
+			SetHighWaterMark("graphite", 0, 10).
+			SetHighWaterMark("graphite", 1, 10),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+
+	var lock sync.Mutex
+	received := make(map[string]float64)
+
+	options := NewOptions()
+	options.Brokers = []string{broker.Addr()}
+	options.ConsumerGroup = "carbon"
+	options.HeartbeatInterval = &Duration{Duration: 50 * time.Millisecond}
+	options.CommitInterval = &Duration{Duration: 50 * time.Millisecond}
+
+	rcv, err := newKafka("kafka", options, func(p *points.Points) {
+		lock.Lock()
+		received[p.Metric] = p.Data[0].Value
+		lock.Unlock()
+	})
+	assert.NoError(err)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		lock.Lock()
+		n := len(received)
+		lock.Unlock()
+		if n == 2 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("received %v", received)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	assert.Equal(map[string]float64{"five": 5, "zero": 0}, received)
+
+	stat := make(map[string]float64)
+	rcv.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(float64(2), stat["metricsReceived"])
+	assert.Equal(float64(4), stat["lag.graphite.0"])
+	assert.Equal(float64(9), stat["lag.graphite.1"])
+
+	rcv.Stop()
+
+	// offsets of consumed messages are committed to kafka
+	committed := make(map[int32]int64)
+	left := false
+	for _, rr := range broker.History() {
+		switch req := rr.Request.(type) {
+		case *sarama.OffsetCommitRequest:
+			// offsets are committed by member of current generation
+			assert.Equal(int16(2), req.Version)
+			assert.Equal(int32(1), req.ConsumerGroupGeneration)
+			assert.Equal("m1", req.ConsumerID)
+			for partition := int32(0); partition < 2; partition++ {
+				if offset, _, err := req.Offset("graphite", partition); err == nil {
+					committed[partition] = offset
+				}
+			}
+		case *sarama.LeaveGroupRequest:
+			left = true
+		}
+	}
+	assert.Equal(map[int32]int64{0: 6, 1: 1}, committed)
+	assert.True(left)
+}
+
+func TestConsumerGroupOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	options := NewOptions()
+	options.ConsumerGroup = "carbon"
+	options.HeartbeatInterval = &Duration{Duration: time.Minute}
+	_, err := newKafka("kafka", options, nil)
+	assert.Error(err)
+
+	options = NewOptions()
+	options.ConsumerGroup = "carbon"
+	options.KafkaVersion = "0.8.2.0"
+	_, err = newKafka("kafka", options, nil)
+	assert.Error(err)
+
+	options = NewOptions()
+	options.ConsumerGroup = "carbon"
+	options.TopicRegex = "("
+	_, err = newKafka("kafka", options, nil)
+	assert.Error(err)
+}
+
+// closedPartitionConsumer is partition consumer with closed messages channel
+type closedPartitionConsumer struct {
+	sarama.PartitionConsumer
+	messages chan *sarama.ConsumerMessage
+}
+
+func (pc *closedPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+func (pc *closedPartitionConsumer) Close() error                             { return nil }
+
+func TestPartitionWorkerClosed(t *testing.T) {
+	rcv := &Kafka{logger: zapwriter.Logger("kafka")}
+
+	pc := &closedPartitionConsumer{messages: make(chan *sarama.ConsumerMessage)}
+	close(pc.messages)
+
+	failed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		rcv.partitionWorker(make(chan struct{}), failed, "graphite", 0, pc, newGroupOffsets("carbon", 1, "m1"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("worker is not finished")
+	}
+
+	select {
+	case <-failed:
+	default:
+		t.Fatal("rejoin is not requested")
+	}
+}
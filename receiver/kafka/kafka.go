@@ -5,15 +5,20 @@ import (
 
 	"go.uber.org/zap"
 
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/Shopify/sarama"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
 	"github.com/lomik/go-carbon/helper"
 	"github.com/lomik/go-carbon/helper/atomicfiles"
 	"github.com/lomik/go-carbon/points"
@@ -65,7 +70,7 @@ func (o *Offset) UnmarshalText(text []byte) error {
 	return nil
 }
 
-var supportedProtocols = []string{"plain", "protobuf", "pickle"}
+var supportedProtocols = []string{"plain", "protobuf", "pickle", "influx", "opentsdb"}
 
 // Protocol is a special type to allow user to define wire protocol in Config file as a simple text.
 type Protocol int
@@ -79,6 +84,10 @@ func (p *Protocol) MarshalText() ([]byte, error) {
 		return []byte("protobuf"), nil
 	case ProtocolPickle:
 		return []byte("pickle"), nil
+	case ProtocolInflux:
+		return []byte("influx"), nil
+	case ProtocolOpenTSDB:
+		return []byte("opentsdb"), nil
 	}
 	return nil, fmt.Errorf("Unsupported offset type %v, supported offsets: %v", p, supportedProtocols)
 }
@@ -94,6 +103,10 @@ func (p *Protocol) UnmarshalText(text []byte) error {
 		*p = ProtocolProtobuf
 	case "pickle":
 		*p = ProtocolPickle
+	case "influx":
+		*p = ProtocolInflux
+	case "opentsdb":
+		*p = ProtocolOpenTSDB
 	default:
 		return fmt.Errorf("Unsupported protocol type %v, supported: %v", protocolName, supportedProtocols)
 	}
@@ -109,6 +122,10 @@ func (p *Protocol) ToString() string {
 		return "protobuf"
 	case ProtocolPickle:
 		return "pickle"
+	case ProtocolInflux:
+		return "influx"
+	case ProtocolOpenTSDB:
+		return "opentsdb"
 	}
 	return "unsupported"
 }
@@ -125,8 +142,44 @@ const (
 	ProtocolProtobuf = 1
 	// ProtocolPickle represents pickled messages
 	ProtocolPickle = 2
+	// ProtocolInflux represents influx line protocol with nanosecond timestamps
+	ProtocolInflux = 3
+	// ProtocolOpenTSDB represents OpenTSDB telnet put commands
+	ProtocolOpenTSDB = 4
 )
 
+var supportedCompressions = []string{"none", "gzip", "snappy"}
+
+// decompress unpacks message body compressed by producer. Supports the same compressions as tcp receiver.
+// Unpacked body larger than maxSize is rejected
+func decompress(compression string, body []byte, maxSize uint32) ([]byte, error) {
+	var r io.Reader
+	switch compression {
+	case "", "none":
+		return body, nil
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case "snappy":
+		r = snappy.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("Unsupported compression %v, supported: %v", compression, supportedCompressions)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > int(maxSize) {
+		return nil, fmt.Errorf("Message too long. Max allowed message size is %d", maxSize)
+	}
+	return data, nil
+}
+
 // Duration wrapper time.Duration for TOML
 type Duration struct {
 	time.Duration
@@ -152,12 +205,25 @@ type Options struct {
 	Topic             string    `toml:"topic"`
 	Partition         int32     `toml:"partition"`
 	Protocol          Protocol  `toml:"parse-protocol"`
+	Compression       string    `toml:"compression"`
+	MaxMessageSize    uint32    `toml:"max-message-size"`
+	ProtocolHeader    string    `toml:"protocol-header"`
+	CompressionHeader string    `toml:"compression-header"`
 	StateFile         string    `toml:"state-file"`
 	InitialOffset     Offset    `toml:"initial-offset"`
 	StateSaveInterval *Duration `toml:"state-save-interval"`
 	ReconnectInterval *Duration `toml:"reconnect-interval"`
 	FetchInterval     *Duration `toml:"fetch-interval"`
 	KafkaVersion      string    `toml:"kafka-version"`
+
+	// consumer group mode, used if ConsumerGroup is set
+	ConsumerGroup        string    `toml:"consumer-group"`
+	Topics               []string  `toml:"topics"`
+	TopicRegex           string    `toml:"topic-regex"`
+	SessionTimeout       *Duration `toml:"session-timeout"`
+	HeartbeatInterval    *Duration `toml:"heartbeat-interval"`
+	CommitInterval       *Duration `toml:"commit-interval"`
+	TopicRefreshInterval *Duration `toml:"topic-refresh-interval"`
 }
 
 // NewOptions returns Options struct filled with default values.
@@ -167,11 +233,17 @@ func NewOptions() *Options {
 		Topic:             "graphite",
 		Partition:         0,
 		Protocol:          ProtocolPlain,
+		MaxMessageSize:    67108864, // 64 Mb
 		InitialOffset:     OffsetOldest,
 		StateSaveInterval: &Duration{Duration: 60 * time.Second},
 		ReconnectInterval: &Duration{Duration: 60 * time.Second},
 		FetchInterval:     &Duration{Duration: 250 * time.Millisecond},
 		KafkaVersion:      "0.11.0.0",
+
+		SessionTimeout:       &Duration{Duration: 30 * time.Second},
+		HeartbeatInterval:    &Duration{Duration: 3 * time.Second},
+		CommitInterval:       &Duration{Duration: time.Second},
+		TopicRefreshInterval: &Duration{Duration: time.Minute},
 	}
 }
 
@@ -211,6 +283,22 @@ type Kafka struct {
 	protocol          Protocol
 	statsAsCounters   bool
 	version           sarama.KafkaVersion
+	compression       string
+	maxMessageSize    uint32
+	protocolHeader    string
+	compressionHeader string
+
+	// consumer group mode
+	group                string
+	topics               []string
+	topicRegex           *regexp.Regexp
+	sessionTimeout       time.Duration
+	heartbeatInterval    time.Duration
+	commitInterval       time.Duration
+	topicRefreshInterval time.Duration
+
+	lagLock sync.Mutex
+	lag     map[string]int64 // stat name -> lag of partition
 }
 
 func (s *state) SaveState() error {
@@ -241,6 +329,14 @@ func (s *state) LoadState() error {
 }
 
 func newKafka(name string, options *Options, store func(*points.Points)) (*Kafka, error) {
+	if _, err := decompress(options.Compression, nil, 0); err != nil {
+		return nil, err
+	}
+
+	if options.ConsumerGroup != "" {
+		return newKafkaGroup(name, options, store)
+	}
+
 	logger := zapwriter.Logger(name)
 	state := &state{
 		Offset: 0,
@@ -298,11 +394,16 @@ func newKafka(name string, options *Options, store func(*points.Points)) (*Kafka
 			partition:     options.Partition,
 			initialOffset: options.InitialOffset,
 		},
-		version: ver,
+		version:           ver,
+		compression:       options.Compression,
+		maxMessageSize:    options.MaxMessageSize,
+		protocolHeader:    options.ProtocolHeader,
+		compressionHeader: options.CompressionHeader,
+		lag:               make(map[string]int64),
 	}
 
+	rcv.waitGroup.Add(1)
 	go func() {
-		rcv.waitGroup.Add(1)
 		rcv.connect()
 		rcv.waitGroup.Done()
 	}()
@@ -372,8 +473,8 @@ func (rcv *Kafka) consume() {
 
 	rcv.logger.Info("connected to kafka")
 
+	rcv.waitGroup.Add(1)
 	go func() {
-		rcv.waitGroup.Add(1)
 		rcv.worker()
 		rcv.waitGroup.Done()
 	}()
@@ -414,6 +515,96 @@ func (rcv *Kafka) Stat(send helper.StatCallback) {
 		atomic.AddUint64(&rcv.metricsReceived, -metricsReceived)
 		atomic.AddUint64(&rcv.errors, -errors)
 	}
+
+	rcv.lagLock.Lock()
+	for metric, lag := range rcv.lag {
+		send(metric, float64(lag))
+	}
+	rcv.lagLock.Unlock()
+}
+
+// setLag saves number of messages in partition after offset. Sent in Stat as lag.<topic>.<partition>
+func (rcv *Kafka) setLag(topic string, partition int32, highWaterMark int64, offset int64) {
+	lag := highWaterMark - offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+
+	metric := fmt.Sprintf("lag.%s.%d", strings.Replace(topic, ".", "_", -1), partition)
+
+	rcv.lagLock.Lock()
+	rcv.lag[metric] = lag
+	rcv.lagLock.Unlock()
+}
+
+func protocolParser(protocol Protocol) func([]byte) ([]*points.Points, error) {
+	switch protocol {
+	case ProtocolProtobuf:
+		return parse.Protobuf
+	case ProtocolPickle:
+		return parse.Pickle
+	case ProtocolInflux:
+		return parse.Influx
+	case ProtocolOpenTSDB:
+		return parse.OpenTSDB
+	}
+	return parse.Plain
+}
+
+// parseMessage decompresses and parses message. Protocol and compression can be overridden by message headers
+func (rcv *Kafka) parseMessage(msg *sarama.ConsumerMessage) ([]*points.Points, Protocol, error) {
+	protocol := rcv.protocol
+	compression := rcv.compression
+
+	for _, h := range msg.Headers {
+		switch {
+		case rcv.protocolHeader != "" && string(h.Key) == rcv.protocolHeader:
+			if err := protocol.UnmarshalText(h.Value); err != nil {
+				return nil, protocol, err
+			}
+		case rcv.compressionHeader != "" && string(h.Key) == rcv.compressionHeader:
+			compression = string(h.Value)
+		}
+	}
+
+	body, err := decompress(compression, msg.Value, rcv.maxMessageSize)
+	if err != nil {
+		return nil, protocol, err
+	}
+
+	payload, err := protocolParser(protocol)(body)
+	return payload, protocol, err
+}
+
+// handleMessage parses message and sends points. Returns false on parse error. Bad lines of line protocols
+// are skipped and counted as errors
+func (rcv *Kafka) handleMessage(msg *sarama.ConsumerMessage) bool {
+	payload, protocol, err := rcv.parseMessage(msg)
+	if linesErr, ok := err.(*parse.LinesError); ok {
+		atomic.AddUint64(&rcv.errors, uint64(linesErr.Failed))
+		rcv.logger.Info("bad lines in message",
+			zap.String("protocol", protocol.ToString()),
+			zap.Error(err),
+		)
+		err = nil
+	}
+	if err != nil {
+		atomic.AddUint64(&rcv.errors, 1)
+		rcv.logger.Error("failed to parse message",
+			zap.String("protocol", protocol.ToString()),
+			zap.Error(err),
+		)
+		return false
+	}
+
+	metricsReceived := 0
+	for _, p := range payload {
+		metricsReceived += len(p.Data)
+		rcv.out(p)
+	}
+
+	atomic.AddUint64(&rcv.metricsReceived, uint64(metricsReceived))
+	return true
 }
 
 func (rcv *Kafka) saveState() {
@@ -435,15 +626,6 @@ func (rcv *Kafka) worker() {
 	saveTimer := time.NewTicker(rcv.stateSaveInterval)
 	fetchTimer := time.NewTicker(rcv.fetchInterval)
 	rcv.logger.Info("Worker started")
-	protocolParser := parse.Plain
-	switch rcv.protocol {
-	case ProtocolProtobuf:
-		protocolParser = parse.Protobuf
-	case ProtocolPlain:
-		protocolParser = parse.Plain
-	case ProtocolPickle:
-		protocolParser = parse.Pickle
-	}
 	for {
 		select {
 		case <-rcv.closed:
@@ -461,32 +643,17 @@ func (rcv *Kafka) worker() {
 			rcv.saveState()
 		case <-fetchTimer.C:
 			rcv.Lock()
-			var payload []*points.Points
-			var err error
 			msgChan := rcv.consumer.Messages()
 			for {
 				messageReceived := true
 				select {
 				case msg := <-msgChan:
-					payload, err = protocolParser(msg.Value)
-
-					if err != nil {
-						atomic.AddUint64(&rcv.errors, 1)
-						rcv.logger.Error("failed to parse message",
-							zap.String("protocol", rcv.protocol.ToString()),
-							zap.Error(err),
-						)
+					rcv.setLag(msg.Topic, msg.Partition, rcv.consumer.HighWaterMarkOffset(), msg.Offset)
+					if !rcv.handleMessage(msg) {
 						continue
 					}
 
-					metricsReceived := 0
-					for _, p := range payload {
-						metricsReceived += len(p.Data)
-						rcv.out(p)
-					}
-
 					atomic.StoreInt64(&rcv.kafkaState.Offset, msg.Offset)
-					atomic.AddUint64(&rcv.metricsReceived, uint64(metricsReceived))
 				default:
 					messageReceived = false
 				}
@@ -0,0 +1,160 @@
+package kafka
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/gogo/protobuf/proto"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper/carbonpb"
+	"github.com/lomik/go-carbon/points"
+)
+
+func gzipBody(body []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+func snappyBody(body []byte) []byte {
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestParseMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	protobufBody, err := proto.Marshal(&carbonpb.Payload{
+		Metrics: []*carbonpb.Metric{{
+			Metric: "hello.world",
+			Points: []carbonpb.Point{{Timestamp: 1422698155, Value: 42}},
+		}},
+	})
+	assert.NoError(err)
+
+	plainBody := []byte("hello.world 42 1422698155\n")
+	expected := []*points.Points{points.OnePoint("hello.world", 42, 1422698155)}
+
+	header := func(key, value string) *sarama.RecordHeader {
+		return &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+	}
+
+	table := []struct {
+		compression string
+		msg         *sarama.ConsumerMessage
+		expected    []*points.Points
+	}{
+		{"", &sarama.ConsumerMessage{Value: plainBody}, expected},
+		{"gzip", &sarama.ConsumerMessage{Value: gzipBody(plainBody)}, expected},
+		{"snappy", &sarama.ConsumerMessage{Value: snappyBody(plainBody)}, expected},
+		{"gzip", &sarama.ConsumerMessage{Value: plainBody}, nil},
+		{"", &sarama.ConsumerMessage{
+			Value:   protobufBody,
+			Headers: []*sarama.RecordHeader{header("protocol", "protobuf")},
+		}, expected},
+		{"", &sarama.ConsumerMessage{
+			Value:   gzipBody(protobufBody),
+			Headers: []*sarama.RecordHeader{header("protocol", "protobuf"), header("compression", "gzip")},
+		}, expected},
+		{"gzip", &sarama.ConsumerMessage{
+			Value:   snappyBody([]byte("put hello.world 1422698155 42\n")),
+			Headers: []*sarama.RecordHeader{header("protocol", "opentsdb"), header("compression", "snappy")},
+		}, expected},
+		{"", &sarama.ConsumerMessage{
+			Value:   []byte("hello world=42 1422698155000000000\n"),
+			Headers: []*sarama.RecordHeader{header("protocol", "influx")},
+		}, expected},
+		{"gzip", &sarama.ConsumerMessage{
+			Value:   plainBody,
+			Headers: []*sarama.RecordHeader{header("compression", "none")},
+		}, expected},
+		{"", &sarama.ConsumerMessage{
+			Value:   plainBody,
+			Headers: []*sarama.RecordHeader{header("protocol", "unknown")},
+		}, nil},
+		{"", &sarama.ConsumerMessage{
+			Value:   plainBody,
+			Headers: []*sarama.RecordHeader{header("compression", "lz4")},
+		}, nil},
+	}
+
+	for i, tt := range table {
+		rcv := &Kafka{
+			protocol:          ProtocolPlain,
+			compression:       tt.compression,
+			maxMessageSize:    1024,
+			protocolHeader:    "protocol",
+			compressionHeader: "compression",
+		}
+
+		payload, _, err := rcv.parseMessage(tt.msg)
+		if tt.expected == nil {
+			assert.Error(err, i)
+			continue
+		}
+		assert.NoError(err, i)
+		assert.Equal(tt.expected, payload, i)
+	}
+
+	// headers are ignored if not configured
+	rcv := &Kafka{protocol: ProtocolPlain}
+	payload, _, err := rcv.parseMessage(&sarama.ConsumerMessage{
+		Value:   plainBody,
+		Headers: []*sarama.RecordHeader{header("protocol", "protobuf")},
+	})
+	assert.NoError(err)
+	assert.Equal(expected, payload)
+
+	// decompressed message is limited by max-message-size
+	rcv = &Kafka{protocol: ProtocolPlain, compression: "gzip", maxMessageSize: uint32(len(plainBody)) - 1}
+	_, _, err = rcv.parseMessage(&sarama.ConsumerMessage{Value: gzipBody(plainBody)})
+	assert.Error(err)
+}
+
+func TestHandleMessageBadLines(t *testing.T) {
+	assert := assert.New(t)
+
+	var received []*points.Points
+	rcv := &Kafka{
+		protocol: ProtocolInflux,
+		out:      func(p *points.Points) { received = append(received, p) },
+		logger:   zap.NewNop(),
+	}
+
+	// bad lines are skipped and counted
+	assert.True(rcv.handleMessage(&sarama.ConsumerMessage{
+		Value: []byte("broken\nhello world=42 1422698155000000000\nhello\n"),
+	}))
+	assert.Equal([]*points.Points{points.OnePoint("hello.world", 42, 1422698155)}, received)
+	assert.Equal(uint64(2), rcv.errors)
+	assert.Equal(uint64(1), rcv.metricsReceived)
+}
+
+func TestProtocol(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, name := range supportedProtocols {
+		var p Protocol
+		assert.NoError(p.UnmarshalText([]byte(name)))
+		assert.Equal(name, p.ToString())
+
+		text, err := p.MarshalText()
+		assert.NoError(err)
+		assert.Equal(name, string(text))
+	}
+
+	options := NewOptions()
+	options.Compression = "lz4"
+	_, err := newKafka("kafka", options, nil)
+	assert.Error(err)
+}
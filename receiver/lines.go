@@ -0,0 +1,124 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ListenTCP listens address and calls serve for every accepted connection in goroutine started by run.
+// Usually run is Go of receiver helper.Stoppable. Listener is closed on exit
+func ListenTCP(run func(callable func(exit chan bool)), listen string, logger *zap.Logger, serve func(exit chan bool, conn net.Conn)) (*net.TCPListener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	run(func(exit chan bool) {
+		<-exit
+		listener.Close()
+	})
+
+	run(func(exit chan bool) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if strings.Contains(err.Error(), "use of closed network connection") {
+					break
+				}
+				logger.Warn("failed to accept connection", zap.Error(err))
+				continue
+			}
+
+			run(func(exit chan bool) {
+				serve(exit, conn)
+			})
+		}
+	})
+
+	return listener, nil
+}
+
+// ReadLines reads connection line by line until EOF, exit or handle returns false. Connection is closed on exit
+// and after 2 minutes without data. Returns last line without trailing newline
+func ReadLines(exit chan bool, conn net.Conn, handle func(line []byte) bool) ([]byte, error) {
+	finished := make(chan bool)
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-finished:
+		case <-exit:
+			conn.Close()
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !handle(line) {
+			return nil, nil
+		}
+	}
+}
+
+// ListenUDPLines listens address and calls handle for every line of received packets in goroutine started by run.
+// Read errors are logged and counted in errors. Connection is closed on exit
+func ListenUDPLines(run func(callable func(exit chan bool)), listen string, logger *zap.Logger, errors *uint32, handle func(line []byte)) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	run(func(exit chan bool) {
+		<-exit
+		conn.Close()
+	})
+
+	run(func(exit chan bool) {
+		var buf [65535]byte
+
+		for {
+			rlen, _, err := conn.ReadFromUDP(buf[:])
+			if err != nil {
+				if strings.Contains(err.Error(), "use of closed network connection") {
+					break
+				}
+				atomic.AddUint32(errors, 1)
+				logger.Error("read error", zap.Error(err))
+				continue
+			}
+
+			for _, line := range bytes.Split(buf[:rlen], []byte{'\n'}) {
+				handle(line)
+			}
+		}
+	})
+
+	return conn, nil
+}
@@ -0,0 +1,322 @@
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+	"github.com/lomik/go-carbon/receiver/parse"
+	"github.com/lomik/go-carbon/tags"
+	"github.com/lomik/zapwriter"
+)
+
+func init() {
+	receiver.Register(
+		"opentsdb",
+		func() interface{} { return NewOptions() },
+		func(name string, options interface{}, store func(*points.Points)) (receiver.Receiver, error) {
+			return newOpenTSDB(name, options.(*Options), store)
+		},
+	)
+}
+
+type Options struct {
+	TCPListen      string `toml:"tcp-listen"`
+	HTTPListen     string `toml:"http-listen"`
+	MaxMessageSize uint32 `toml:"max-message-size"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		TCPListen:      ":4242",
+		MaxMessageSize: 67108864, // 64 Mb
+	}
+}
+
+// OpenTSDB receive metrics from telnet put commands over TCP and from HTTP /api/put requests
+type OpenTSDB struct {
+	helper.Stoppable
+	out             func(*points.Points)
+	name            string // name for store metrics
+	maxMessageSize  uint32
+	metricsReceived uint32
+	errors          uint32
+	active          int32 // counter
+	tcpListener     *net.TCPListener
+	httpListener    *net.TCPListener
+	logger          *zap.Logger
+}
+
+// TCPAddr returns binded TCP socket address. For bind port 0 in tests
+func (rcv *OpenTSDB) TCPAddr() net.Addr {
+	if rcv.tcpListener == nil {
+		return nil
+	}
+	return rcv.tcpListener.Addr()
+}
+
+// HTTPAddr returns binded HTTP socket address. For bind port 0 in tests
+func (rcv *OpenTSDB) HTTPAddr() net.Addr {
+	if rcv.httpListener == nil {
+		return nil
+	}
+	return rcv.httpListener.Addr()
+}
+
+func newOpenTSDB(name string, options *Options, store func(*points.Points)) (*OpenTSDB, error) {
+	if options.TCPListen == "" && options.HTTPListen == "" {
+		return nil, fmt.Errorf("at least one of tcp-listen, http-listen should be set")
+	}
+
+	rcv := &OpenTSDB{
+		out:            store,
+		name:           name,
+		maxMessageSize: options.MaxMessageSize,
+		logger:         zapwriter.Logger(name),
+	}
+
+	err := rcv.StartFunc(func() error {
+		if options.TCPListen != "" {
+			if err := rcv.listenTCP(options.TCPListen); err != nil {
+				return err
+			}
+		}
+		if options.HTTPListen != "" {
+			if err := rcv.listenHTTP(options.HTTPListen); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rcv, nil
+}
+
+func (rcv *OpenTSDB) Stat(send helper.StatCallback) {
+	helper.SendAndSubstractUint32("metricsReceived", &rcv.metricsReceived, send)
+	send("active", float64(atomic.LoadInt32(&rcv.active)))
+	helper.SendAndSubstractUint32("errors", &rcv.errors, send)
+}
+
+func (rcv *OpenTSDB) listenTCP(listen string) error {
+	var err error
+	rcv.tcpListener, err = receiver.ListenTCP(rcv.Go, listen, rcv.logger, rcv.handleConnection)
+	return err
+}
+
+// handleConnection reads telnet commands. Errors are written back to client like OpenTSDB does
+func (rcv *OpenTSDB) handleConnection(exit chan bool, conn net.Conn) {
+	atomic.AddInt32(&rcv.active, 1)
+	defer atomic.AddInt32(&rcv.active, -1)
+
+	defer conn.Close()
+
+	unfinished, err := receiver.ReadLines(exit, conn, func(line []byte) bool {
+		return rcv.handleCommand(conn, line)
+	})
+	if err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		rcv.logger.Error("read error", zap.Error(err))
+	} else if len(unfinished) > 0 {
+		rcv.logger.Warn("unfinished line", zap.String("line", string(unfinished)))
+	}
+}
+
+// handleCommand executes one telnet command. Returns false if client closes session
+func (rcv *OpenTSDB) handleCommand(conn net.Conn, line []byte) bool {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return true
+	}
+
+	command := line
+	if i := bytes.IndexByte(line, ' '); i > 0 {
+		command = line[:i]
+	}
+
+	switch string(command) {
+	case "put":
+		name, value, timestamp, err := parse.OpenTSDBLine(line)
+		if err == nil {
+			err = rcv.put(name, value, timestamp)
+		}
+		if err != nil {
+			atomic.AddUint32(&rcv.errors, 1)
+			rcv.logger.Info("parse failed",
+				zap.Error(err),
+				zap.String("peer", conn.RemoteAddr().String()),
+			)
+			fmt.Fprintf(conn, "put: illegal argument: %s\n", err.Error())
+		}
+	case "version":
+		// collectors (tcollector) use it as connection check
+		fmt.Fprint(conn, "go-carbon opentsdb receiver\n")
+	case "exit":
+		return false
+	default:
+		atomic.AddUint32(&rcv.errors, 1)
+		fmt.Fprintf(conn, "unknown command: %s\n", string(command))
+	}
+
+	return true
+}
+
+// put normalizes name and sends point
+func (rcv *OpenTSDB) put(name string, value float64, timestamp int64) error {
+	name, err := tags.Normalize(name)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddUint32(&rcv.metricsReceived, 1)
+	rcv.out(points.OnePoint(name, value, timestamp))
+	return nil
+}
+
+func (rcv *OpenTSDB) listenHTTP(listen string) error {
+	addr, err := net.ResolveTCPAddr("tcp", listen)
+	if err != nil {
+		return err
+	}
+
+	rcv.httpListener, err = net.ListenTCP("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/put", rcv.putHandler)
+
+	s := &http.Server{
+		Handler:        mux,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	rcv.Go(func(exit chan bool) {
+		<-exit
+		s.Close()
+	})
+
+	rcv.Go(func(exit chan bool) {
+		s.Serve(rcv.httpListener)
+	})
+
+	return nil
+}
+
+type dataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     json.RawMessage   `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type putResponse struct {
+	Success int `json:"success"`
+	Failed  int `json:"failed"`
+}
+
+func (rcv *OpenTSDB) putHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, fmt.Sprintf("Method %#v is not supported", r.Method), http.StatusBadRequest)
+		return
+	}
+
+	if r.ContentLength > int64(rcv.maxMessageSize) {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, fmt.Sprintf("Message too long. Max allowed message size is %#v", rcv.maxMessageSize), http.StatusBadRequest)
+		return
+	}
+
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			atomic.AddUint32(&rcv.errors, 1)
+			http.Error(w, fmt.Sprintf("Read request failed: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, int64(rcv.maxMessageSize)))
+	if err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, fmt.Sprintf("Read request failed: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// body is single data point or array of data points
+	var dps []dataPoint
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &dps)
+	} else {
+		dps = make([]dataPoint, 1)
+		err = json.Unmarshal(body, &dps[0])
+	}
+
+	if err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, "Parse failed", http.StatusBadRequest)
+		return
+	}
+
+	var resp putResponse
+	for _, dp := range dps {
+		if err := rcv.putDataPoint(&dp); err != nil {
+			resp.Failed++
+			atomic.AddUint32(&rcv.errors, 1)
+			rcv.logger.Info("parse failed", zap.Error(err), zap.String("metric", dp.Metric))
+			continue
+		}
+		resp.Success++
+	}
+
+	if resp.Failed == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	data, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(data)
+}
+
+func (rcv *OpenTSDB) putDataPoint(dp *dataPoint) error {
+	if dp.Metric == "" {
+		return fmt.Errorf("empty metric name")
+	}
+
+	// value can be number or string with number
+	raw := bytes.Trim(dp.Value, `"`)
+	value, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil || math.IsNaN(value) {
+		return fmt.Errorf("bad value %#v", string(dp.Value))
+	}
+
+	return rcv.put(parse.OpenTSDBName(dp.Metric, dp.Tags), value, parse.OpenTSDBTimestamp(dp.Timestamp))
+}
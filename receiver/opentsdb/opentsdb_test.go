@@ -0,0 +1,135 @@
+package opentsdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+)
+
+func TestTelnet(t *testing.T) {
+	assert := assert.New(t)
+	c := &qa.Collector{}
+
+	r, err := receiver.New("opentsdb", map[string]interface{}{
+		"protocol":   "opentsdb",
+		"tcp-listen": "127.0.0.1:0",
+	}, c.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	assert.Nil(r.(*OpenTSDB).HTTPAddr())
+
+	conn, err := net.Dial("tcp", r.(*OpenTSDB).TCPAddr().String())
+	assert.NoError(err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	fmt.Fprint(conn, "version\n")
+	line, err := reader.ReadString('\n')
+	assert.NoError(err)
+	assert.Contains(line, "go-carbon")
+
+	fmt.Fprint(conn, "put sys.cpu.user 1356998400 42.5 host=web01 cpu=0\n")
+	fmt.Fprint(conn, "put sys.cpu.user 1356998400\n")
+	line, err = reader.ReadString('\n')
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(line, "put: illegal argument"), line)
+
+	received := c.Wait(t, 1)
+	assert.Equal([]*points.Points{points.OnePoint("sys.cpu.user;cpu=0;host=web01", 42.5, 1356998400)}, received)
+
+	stat := make(map[string]float64)
+	r.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(float64(1), stat["metricsReceived"])
+	assert.Equal(float64(1), stat["errors"])
+	assert.Equal(float64(1), stat["active"])
+}
+
+func TestHTTPPut(t *testing.T) {
+	assert := assert.New(t)
+	c := &qa.Collector{}
+
+	r, err := receiver.New("opentsdb", map[string]interface{}{
+		"protocol":    "opentsdb",
+		"tcp-listen":  "",
+		"http-listen": "127.0.0.1:0",
+	}, c.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	assert.Nil(r.(*OpenTSDB).TCPAddr())
+	url := fmt.Sprintf("http://%s/api/put", r.(*OpenTSDB).HTTPAddr())
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(
+		`{"metric": "sys.cpu.nice", "timestamp": 1346846400, "value": 18, "tags": {"host": "web01", "dc": "lga"}}`,
+	))
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprint(gz, `[
+		{"metric": "sys.cpu.nice", "timestamp": 1346846400000, "value": "9.5", "tags": {"host": "web02"}},
+		{"metric": "sys.cpu.nice", "timestamp": 1346846400, "value": "abc", "tags": {"host": "web03"}},
+		{"metric": "", "timestamp": 1346846400, "value": 1}
+	]`)
+	gz.Close()
+
+	req, err := http.NewRequest("POST", url, &buf)
+	assert.NoError(err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	received := c.Wait(t, 2)
+	assert.Equal([]*points.Points{
+		points.OnePoint("sys.cpu.nice;dc=lga;host=web01", 18, 1346846400),
+		points.OnePoint("sys.cpu.nice;host=web02", 9.5, 1346846400),
+	}, received)
+
+	stat := make(map[string]float64)
+	r.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(float64(2), stat["metricsReceived"])
+	assert.Equal(float64(2), stat["errors"])
+}
+
+func TestStopOpenTSDB(t *testing.T) {
+	assert := assert.New(t)
+
+	tcpListen := "127.0.0.1:0"
+	httpListen := "127.0.0.1:0"
+
+	for i := 0; i < 10; i++ {
+		r, err := receiver.New("opentsdb", map[string]interface{}{
+			"protocol":    "opentsdb",
+			"tcp-listen":  tcpListen,
+			"http-listen": httpListen,
+		}, nil)
+		if !assert.NoError(err) {
+			return
+		}
+
+		// listen same ports in next iteration
+		tcpListen = r.(*OpenTSDB).TCPAddr().String()
+		httpListen = r.(*OpenTSDB).HTTPAddr().String()
+		r.Stop()
+	}
+}
@@ -0,0 +1,29 @@
+package parse
+
+import "fmt"
+
+// LinesError is returned by line protocol parsers which skip bad lines. Points of good lines are returned with it
+type LinesError struct {
+	Failed int   // number of skipped lines
+	Err    error // error of first skipped line
+}
+
+func (e *LinesError) Error() string {
+	return fmt.Sprintf("%d bad lines skipped, first error: %s", e.Failed, e.Err.Error())
+}
+
+// add counts bad line
+func (e *LinesError) add(err error) {
+	if e.Failed == 0 {
+		e.Err = err
+	}
+	e.Failed++
+}
+
+// result returns error if any line was skipped
+func (e *LinesError) result() error {
+	if e.Failed == 0 {
+		return nil
+	}
+	return e
+}
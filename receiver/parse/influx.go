@@ -0,0 +1,250 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/tags"
+)
+
+// InfluxTag is tag of influx line protocol message
+type InfluxTag struct {
+	Key   string
+	Value string
+}
+
+// InfluxField is numeric field of influx line protocol message
+type InfluxField struct {
+	Key   string
+	Value float64
+}
+
+// InfluxPoint is parsed line of influx line protocol. String fields are skipped
+type InfluxPoint struct {
+	Measurement string
+	Tags        []InfluxTag
+	Fields      []InfluxField
+	Timestamp   int64 // unix time in seconds
+}
+
+// InfluxPrecision returns duration of timestamp unit. Supports influxdb /write precision values
+func InfluxPrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown precision %#v, should be one of: ns, us, ms, s, m, h", precision)
+}
+
+// influxSplit splits s by separator. Escaped with backslash separators are ignored,
+// separators inside double quotes are ignored if quotes is true
+func influxSplit(s []byte, sep byte, quotes bool) [][]byte {
+	res := make([][]byte, 0, 4)
+	escaped := false
+	quoted := false
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(res, s[start:])
+}
+
+// influxUnescape removes backslashes before escaped characters
+func influxUnescape(s []byte) string {
+	if bytes.IndexByte(s, '\\') < 0 {
+		return string(s)
+	}
+
+	res := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		res = append(res, s[i])
+	}
+	return string(res)
+}
+
+// influxKeyValue splits k=v pair by first unescaped equal sign
+func influxKeyValue(s []byte) (string, []byte, error) {
+	kv := influxSplit(s, '=', false)
+	if len(kv) < 2 || len(kv[0]) == 0 {
+		return "", nil, fmt.Errorf("bad key-value pair: %#v", string(s))
+	}
+	return influxUnescape(kv[0]), s[len(kv[0])+1:], nil
+}
+
+// influxFieldValue parses field value. Returns ok=false for string values
+func influxFieldValue(s []byte) (float64, bool, error) {
+	if len(s) == 0 {
+		return 0, false, fmt.Errorf("empty field value")
+	}
+
+	if s[0] == '"' {
+		return 0, false, nil
+	}
+
+	switch string(s) {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(unsafeString(s[:len(s)-1]), 10, 64)
+		return float64(v), err == nil, err
+	case 'u':
+		v, err := strconv.ParseUint(unsafeString(s[:len(s)-1]), 10, 64)
+		return float64(v), err == nil, err
+	}
+
+	v, err := strconv.ParseFloat(unsafeString(s), 64)
+	if err != nil {
+		return 0, false, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false, fmt.Errorf("bad field value: %#v", string(s))
+	}
+	return v, true, nil
+}
+
+// InfluxLine parses one line of influx line protocol: measurement,tag=v field=1 ts
+// Timestamp is in units of precision, now is used for lines without timestamp
+func InfluxLine(line []byte, precision time.Duration, now int64) (*InfluxPoint, error) {
+	line = bytes.Trim(line, " \n\r")
+
+	parts := influxSplit(line, ' ', true)
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("bad message: %#v", string(line))
+	}
+
+	keys := influxSplit(parts[0], ',', false)
+	if len(keys[0]) == 0 {
+		return nil, fmt.Errorf("bad message: %#v, no measurement", string(line))
+	}
+
+	p := &InfluxPoint{
+		Measurement: influxUnescape(keys[0]),
+		Tags:        make([]InfluxTag, 0, len(keys)-1),
+		Timestamp:   now,
+	}
+
+	for _, tag := range keys[1:] {
+		key, value, err := influxKeyValue(tag)
+		if err != nil {
+			return nil, fmt.Errorf("bad message: %#v, %s", string(line), err.Error())
+		}
+		p.Tags = append(p.Tags, InfluxTag{Key: key, Value: influxUnescape(value)})
+	}
+
+	fields := influxSplit(parts[1], ',', true)
+	p.Fields = make([]InfluxField, 0, len(fields))
+	for _, field := range fields {
+		key, value, err := influxKeyValue(field)
+		if err != nil {
+			return nil, fmt.Errorf("bad message: %#v, %s", string(line), err.Error())
+		}
+
+		v, ok, err := influxFieldValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad message: %#v, %s", string(line), err.Error())
+		}
+		if ok {
+			p.Fields = append(p.Fields, InfluxField{Key: key, Value: v})
+		}
+	}
+
+	if len(parts) == 3 {
+		ts, err := strconv.ParseInt(unsafeString(parts[2]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad message: %#v, %s", string(line), err.Error())
+		}
+		p.Timestamp = ts * int64(precision) / int64(time.Second)
+	}
+
+	return p, nil
+}
+
+// Name returns tagged name of field: measurement.field;tag=value. Field "value" is omitted
+func (p *InfluxPoint) Name(field string) (string, error) {
+	name := p.Measurement
+	if field != "value" {
+		name += "." + field
+	}
+	if len(p.Tags) == 0 {
+		return name, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	for _, tag := range p.Tags {
+		buf.WriteByte(';')
+		buf.WriteString(tag.Key)
+		buf.WriteByte('=')
+		buf.WriteString(tag.Value)
+	}
+	return tags.Normalize(buf.String())
+}
+
+// Influx parses lines of influx line protocol with nanosecond timestamps. Returns one point per field.
+// Bad lines are skipped and reported with *LinesError
+func Influx(body []byte) ([]*points.Points, error) {
+	result := make([]*points.Points, 0, 4)
+	now := time.Now().Unix()
+	var failed LinesError
+
+LineLoop:
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		p, err := InfluxLine(line, time.Nanosecond, now)
+		if err != nil {
+			failed.add(err)
+			continue
+		}
+
+		linePoints := make([]*points.Points, 0, len(p.Fields))
+		for _, field := range p.Fields {
+			name, err := p.Name(field.Key)
+			if err != nil {
+				failed.add(err)
+				continue LineLoop
+			}
+			linePoints = append(linePoints, points.OnePoint(name, field.Value, p.Timestamp))
+		}
+		result = append(result, linePoints...)
+	}
+
+	return result, failed.result()
+}
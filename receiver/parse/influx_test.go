@@ -0,0 +1,101 @@
+package parse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestInfluxLine(t *testing.T) {
+	table := []struct {
+		line     string
+		expected *InfluxPoint
+	}{
+		{line: ""},
+		{line: "cpu"},
+		{line: ",host=a value=1"},
+		{line: "cpu,host value=1"},
+		{line: "cpu value="},
+		{line: "cpu value=abc"},
+		{line: "cpu value=1 abc"},
+		{line: "cpu value=1 1422642189 extra"},
+		{line: "cpu value=NaN"},
+		{
+			line:     "cpu value=42.5 1422642189000000000\n",
+			expected: &InfluxPoint{Measurement: "cpu", Tags: []InfluxTag{}, Fields: []InfluxField{{"value", 42.5}}, Timestamp: 1422642189},
+		},
+		{
+			line: "cpu,host=server01,region=us-west usage_idle=90i,usage_user=5u,up=t,name=\"a b,c=d\"",
+			expected: &InfluxPoint{
+				Measurement: "cpu",
+				Tags:        []InfluxTag{{"host", "server01"}, {"region", "us-west"}},
+				Fields:      []InfluxField{{"usage_idle", 90}, {"usage_user", 5}, {"up", 1}},
+				Timestamp:   100,
+			},
+		},
+		{
+			line: `disk\ io,path=C:\\,label=a\ b\,c value=1,free\=space=0 1422642189000000000`,
+			expected: &InfluxPoint{
+				Measurement: "disk io",
+				Tags:        []InfluxTag{{"path", `C:\`}, {"label", "a b,c"}},
+				Fields:      []InfluxField{{"value", 1}, {"free=space", 0}},
+				Timestamp:   1422642189,
+			},
+		},
+	}
+
+	for _, tt := range table {
+		p, err := InfluxLine([]byte(tt.line), time.Nanosecond, 100)
+		if tt.expected == nil {
+			assert.Error(t, err, tt.line)
+			continue
+		}
+		assert.NoError(t, err, tt.line)
+		assert.Equal(t, tt.expected, p, tt.line)
+	}
+}
+
+func TestInfluxPrecision(t *testing.T) {
+	for _, precision := range []string{"ns", "us", "ms", "s", "m", "h"} {
+		d, err := InfluxPrecision(precision)
+		assert.NoError(t, err)
+
+		p, err := InfluxLine([]byte("cpu value=1 1"), d, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(d/time.Second), p.Timestamp, precision)
+	}
+
+	_, err := InfluxPrecision("d")
+	assert.Error(t, err)
+}
+
+func TestInflux(t *testing.T) {
+	run(t, []testcase{
+		{"empty", []byte(""), []*points.Points{}, false},
+		{"comment", []byte("# comment\n\n"), []*points.Points{}, false},
+		{"tagged",
+			[]byte("cpu,host=b,dc=a value=1,idle=2i 1422642189000000000\nmem free=3 1422642189000000000\n"),
+			[]*points.Points{
+				points.OnePoint("cpu;dc=a;host=b", 1, 1422642189),
+				points.OnePoint("cpu.idle;dc=a;host=b", 2, 1422642189),
+				points.OnePoint("mem.free", 3, 1422642189),
+			},
+			false,
+		},
+		{"bad line", []byte("cpu value=1 1\ncpu\n"), nil, true},
+	}, Influx)
+}
+
+func TestInfluxBadLines(t *testing.T) {
+	assert := assert.New(t)
+
+	// points of good lines are returned with error
+	result, err := Influx([]byte("cpu\nmem free=3 1422642189000000000\ncpu,host value=1 1\n"))
+	assert.Equal([]*points.Points{points.OnePoint("mem.free", 3, 1422642189)}, result)
+	if linesErr, ok := err.(*LinesError); assert.True(ok) {
+		assert.Equal(2, linesErr.Failed)
+	}
+}
@@ -0,0 +1,90 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/tags"
+)
+
+// OpenTSDBTimestamp converts OpenTSDB timestamp in seconds or milliseconds to seconds
+func OpenTSDBTimestamp(ts int64) int64 {
+	// OpenTSDB treats timestamps with more than 10 digits as milliseconds
+	if ts > 9999999999 {
+		return ts / 1000
+	}
+	return ts
+}
+
+// OpenTSDBName returns name with tags: metric;tag1=value1;tag2=value2. Result is not normalized
+func OpenTSDBName(metric string, tags map[string]string) string {
+	var buf bytes.Buffer
+	buf.WriteString(metric)
+	for k, v := range tags {
+		buf.WriteByte(';')
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(v)
+	}
+	return buf.String()
+}
+
+// OpenTSDBLine parses telnet put command: put metric timestamp value tag1=value1 tag2=value2
+// Returned name has tags in order of line and should be normalized
+func OpenTSDBLine(line []byte) (string, float64, int64, error) {
+	fields := bytes.Fields(line)
+	if len(fields) < 4 || string(fields[0]) != "put" {
+		return "", 0, 0, fmt.Errorf("bad message: %#v", string(line))
+	}
+
+	ts, err := strconv.ParseInt(unsafeString(fields[2]), 10, 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("bad message: %#v", string(line))
+	}
+
+	value, err := strconv.ParseFloat(unsafeString(fields[3]), 64)
+	if err != nil || math.IsNaN(value) {
+		return "", 0, 0, fmt.Errorf("bad message: %#v", string(line))
+	}
+
+	var buf bytes.Buffer
+	buf.Write(fields[1])
+	for _, tag := range fields[4:] {
+		if i := bytes.IndexByte(tag, '='); i < 1 || i == len(tag)-1 {
+			return "", 0, 0, fmt.Errorf("bad message: %#v, invalid tag %#v", string(line), string(tag))
+		}
+		buf.WriteByte(';')
+		buf.Write(tag)
+	}
+
+	return buf.String(), value, OpenTSDBTimestamp(ts), nil
+}
+
+// OpenTSDB parses telnet put commands separated by newline. Names are normalized.
+// Bad lines are skipped and reported with *LinesError
+func OpenTSDB(body []byte) ([]*points.Points, error) {
+	result := make([]*points.Points, 0, 4)
+	var failed LinesError
+
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		name, value, timestamp, err := OpenTSDBLine(line)
+		if err == nil {
+			name, err = tags.Normalize(name)
+		}
+		if err != nil {
+			failed.add(err)
+			continue
+		}
+
+		result = append(result, points.OnePoint(name, value, timestamp))
+	}
+
+	return result, failed.result()
+}
@@ -0,0 +1,80 @@
+package parse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestOpenTSDBLine(t *testing.T) {
+	table := []struct {
+		b         string
+		name      string
+		value     float64
+		timestamp int64
+	}{
+		{b: ""},
+		{b: "put"},
+		{b: "put sys.cpu.user 1356998400"},
+		{b: "get sys.cpu.user 1356998400 42"},
+		{b: "put sys.cpu.user abc 42 host=a"},
+		{b: "put sys.cpu.user 1356998400 abc host=a"},
+		{b: "put sys.cpu.user 1356998400 NaN host=a"},
+		{b: "put sys.cpu.user 1356998400 42 host"},
+		{b: "put sys.cpu.user 1356998400 42 =a"},
+		{b: "put sys.cpu.user 1356998400 42 host="},
+		{"put sys.cpu.user 1356998400 42.5\n", "sys.cpu.user", 42.5, 1356998400},
+		{"put sys.cpu.user 1356998400 42 host=web01 cpu=0\r\n", "sys.cpu.user;host=web01;cpu=0", 42, 1356998400},
+		{"put sys.cpu.user 1356998400500 -1 host=web01", "sys.cpu.user;host=web01", -1, 1356998400},
+	}
+
+	for _, p := range table {
+		name, value, timestamp, err := OpenTSDBLine([]byte(p.b))
+		if p.name == "" {
+			if err == nil {
+				t.Fatalf("error expected for %#v", p.b)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%#v: %s", p.b, err)
+		}
+		if name != p.name {
+			t.Fatalf("%#v != %#v", name, p.name)
+		}
+		if value != p.value {
+			t.Fatalf("%#v != %#v", value, p.value)
+		}
+		if timestamp != p.timestamp {
+			t.Fatalf("%d != %d", timestamp, p.timestamp)
+		}
+	}
+}
+
+func TestOpenTSDB(t *testing.T) {
+	run(t, []testcase{
+		{"empty", []byte("\n"), []*points.Points{}, false},
+		{"put",
+			[]byte("put sys.cpu 1356998400 42 host=b dc=a\nput sys.mem 1356998400500 1\n"),
+			[]*points.Points{
+				points.OnePoint("sys.cpu;dc=a;host=b", 42, 1356998400),
+				points.OnePoint("sys.mem", 1, 1356998400),
+			},
+			false,
+		},
+		{"bad line", []byte("put sys.cpu 1356998400 42\nput sys.cpu\n"), nil, true},
+	}, OpenTSDB)
+}
+
+func TestOpenTSDBBadLines(t *testing.T) {
+	assert := assert.New(t)
+
+	// points of good lines are returned with error
+	result, err := OpenTSDB([]byte("put sys.cpu\nput sys.mem 1356998400 1\n"))
+	assert.Equal([]*points.Points{points.OnePoint("sys.mem", 1, 1356998400)}, result)
+	if linesErr, ok := err.(*LinesError); assert.True(ok) {
+		assert.Equal(1, linesErr.Failed)
+	}
+}
@@ -0,0 +1,222 @@
+package prometheus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/klauspost/compress/snappy"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/helper/prompb"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+	"github.com/lomik/go-carbon/tags"
+	"github.com/lomik/zapwriter"
+)
+
+func init() {
+	receiver.Register(
+		"prometheus_remote_write",
+		func() interface{} { return NewOptions() },
+		func(name string, options interface{}, store func(*points.Points)) (receiver.Receiver, error) {
+			return newRemoteWrite(name, options.(*Options), store)
+		},
+	)
+}
+
+type Options struct {
+	Listen         string `toml:"listen"`
+	MaxMessageSize uint32 `toml:"max-message-size"`
+}
+
+func NewOptions() *Options {
+	return &Options{
+		Listen:         ":2006",
+		MaxMessageSize: 67108864, // 64 Mb
+	}
+}
+
+// RemoteWrite receive metrics from prometheus remote_write requests
+type RemoteWrite struct {
+	out             func(*points.Points)
+	name            string // name for store metrics
+	maxMessageSize  uint32
+	metricsReceived uint32
+	errors          uint32
+	listener        *net.TCPListener
+	server          *http.Server
+	logger          *zap.Logger
+	closed          chan struct{}
+}
+
+// Addr returns binded socket address. For bind port 0 in tests
+func (rcv *RemoteWrite) Addr() net.Addr {
+	if rcv.listener == nil {
+		return nil
+	}
+	return rcv.listener.Addr()
+}
+
+func newRemoteWrite(name string, options *Options, store func(*points.Points)) (*RemoteWrite, error) {
+
+	addr, err := net.ResolveTCPAddr("tcp", options.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	tcpListener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rcv := &RemoteWrite{
+		out:            store,
+		name:           name,
+		maxMessageSize: options.MaxMessageSize,
+		logger:         zapwriter.Logger(name),
+		listener:       tcpListener,
+		closed:         make(chan struct{}),
+	}
+
+	s := &http.Server{
+		Addr:           options.Listen,
+		Handler:        rcv,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	rcv.server = s
+
+	go func() {
+		s.Serve(tcpListener)
+		close(rcv.closed)
+	}()
+
+	return rcv, err
+}
+
+func (rcv *RemoteWrite) Stop() {
+	rcv.listener.Close()
+	rcv.server.Close()
+	<-rcv.closed
+}
+
+func (rcv *RemoteWrite) Stat(send helper.StatCallback) {
+	helper.SendAndSubstractUint32("metricsReceived", &rcv.metricsReceived, send)
+	helper.SendAndSubstractUint32("errors", &rcv.errors, send)
+}
+
+// MetricName converts prometheus labels to go-carbon tagged name: name;k1=v1;k2=v2
+func MetricName(labels []prompb.Label) (string, error) {
+	var name string
+	tagList := make([]string, 0, len(labels))
+
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		// prometheus treats empty label value as missing label
+		if l.Value == "" {
+			continue
+		}
+		tagList = append(tagList, l.Name+"="+l.Value)
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("metric name not found in labels %v", labels)
+	}
+
+	if len(tagList) == 0 {
+		return name, nil
+	}
+
+	return tags.Normalize(name + ";" + strings.Join(tagList, ";"))
+}
+
+func (rcv *RemoteWrite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, fmt.Sprintf("Method %#v is not supported", r.Method), http.StatusBadRequest)
+		return
+	}
+
+	if r.ContentLength > int64(rcv.maxMessageSize) {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, fmt.Sprintf("Message too long. Max allowed message size is %#v", rcv.maxMessageSize), http.StatusBadRequest)
+		return
+	}
+
+	// ContentLength is not set for chunked requests
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(rcv.maxMessageSize)))
+	if err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, fmt.Sprintf("Read request failed: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if n, err := snappy.DecodedLen(compressed); err != nil || n > int(rcv.maxMessageSize) {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, "Snappy decode failed", http.StatusBadRequest)
+		return
+	}
+
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, "Snappy decode failed", http.StatusBadRequest)
+		return
+	}
+
+	var req prompb.WriteRequest
+	if err = proto.Unmarshal(body, &req); err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		http.Error(w, "Parse failed", http.StatusBadRequest)
+		return
+	}
+
+	cnt := 0
+	for _, ts := range req.Timeseries {
+		name, err := MetricName(ts.Labels)
+		if err != nil {
+			atomic.AddUint32(&rcv.errors, 1)
+			rcv.logger.Debug("bad series", zap.Error(err))
+			continue
+		}
+
+		p := &points.Points{
+			Metric: name,
+			Data:   make([]points.Point, 0, len(ts.Samples)),
+		}
+
+		for _, s := range ts.Samples {
+			// stale marker means series is gone, there is nothing to store in whisper
+			if prompb.IsStaleNaN(s.Value) {
+				continue
+			}
+			p.Data = append(p.Data, points.Point{
+				Value:     s.Value,
+				Timestamp: s.Timestamp / 1000,
+			})
+		}
+
+		if len(p.Data) == 0 {
+			continue
+		}
+
+		cnt += len(p.Data)
+		rcv.out(p)
+	}
+
+	atomic.AddUint32(&rcv.metricsReceived, uint32(cnt))
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,144 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/prompb"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+)
+
+func TestMetricName(t *testing.T) {
+	assert := assert.New(t)
+
+	table := []struct {
+		labels   []prompb.Label
+		expected string
+		err      bool
+	}{
+		{[]prompb.Label{{Name: "__name__", Value: "up"}}, "up", false},
+		{
+			[]prompb.Label{{Name: "job", Value: "node"}, {Name: "__name__", Value: "up"}, {Name: "instance", Value: "host:9100"}},
+			"up;instance=host:9100;job=node",
+			false,
+		},
+		{[]prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: ""}}, "up", false},
+		{[]prompb.Label{{Name: "job", Value: "node"}}, "", true},
+		{[]prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a;b"}}, "", true},
+	}
+
+	for _, tt := range table {
+		name, err := MetricName(tt.labels)
+		if tt.err {
+			assert.Error(err)
+			continue
+		}
+		assert.NoError(err)
+		assert.Equal(tt.expected, name)
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	received := make([]*points.Points, 0)
+
+	r, err := receiver.New("prometheus", map[string]interface{}{
+		"protocol": "prometheus_remote_write",
+		"listen":   "127.0.0.1:0",
+	},
+		func(p *points.Points) {
+			received = append(received, p)
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	url := fmt.Sprintf("http://%s/api/v1/write", r.(*RemoteWrite).Addr())
+
+	req := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1422698155000}, {Value: 0, Timestamp: 1422698215123}},
+			},
+			{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "gone"}},
+				Samples: []prompb.Sample{{Value: math.Float64frombits(prompb.StaleNaN), Timestamp: 1422698155000}},
+			},
+			{
+				Labels:  []prompb.Label{{Name: "job", Value: "no_name"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1422698155000}},
+			},
+		},
+	}
+
+	body, err := proto.Marshal(req)
+	assert.NoError(err)
+
+	resp, err := http.Post(url, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, body)))
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+
+	if assert.Equal(1, len(received)) {
+		assert.True(points.OnePoint("up;job=node", 1, 1422698155).Add(0, 1422698215).Eq(received[0]))
+	}
+
+	// not snappy
+	resp, err = http.Post(url, "application/x-protobuf", bytes.NewReader([]byte("hello.world 42 1422698155\n")))
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	stat := make(map[string]float64)
+	r.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(float64(2), stat["metricsReceived"])
+	assert.Equal(float64(2), stat["errors"])
+}
+
+func TestStopListener(t *testing.T) {
+	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	r, err := newRemoteWrite("test", &Options{Listen: addr.String(), MaxMessageSize: 1024}, func(*points.Points) {})
+	assert.NoError(t, err)
+
+	listen := r.Addr().String()
+	r.Stop()
+
+	r, err = newRemoteWrite("test", &Options{Listen: listen, MaxMessageSize: 1024}, func(*points.Points) {})
+	assert.NoError(t, err)
+	r.Stop()
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := newRemoteWrite("test", &Options{Listen: "127.0.0.1:0", MaxMessageSize: 16}, func(*points.Points) {})
+	if !assert.NoError(err) {
+		return
+	}
+	defer r.Stop()
+
+	// chunked request without content length
+	req := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(make([]byte, 1024)))
+	req.ContentLength = -1
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+	assert.Contains(rr.Body.String(), "Read request failed")
+}
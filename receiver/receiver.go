@@ -75,6 +75,18 @@ func New(name string, opts map[string]interface{}, store func(*points.Points)) (
 
 	delete(opts, "protocol")
 
+	// points of receiver with tenant option are stored to this tenant
+	if tenant, _ := opts["tenant"].(string); tenant != "" {
+		next := store
+		store = func(p *points.Points) {
+			if p.Tenant == "" {
+				p.Tenant = tenant
+			}
+			next(p)
+		}
+	}
+	delete(opts, "tenant")
+
 	protocolMapMutex.Lock()
 	protocol, ok := protocolMap[protocolName]
 	protocolMapMutex.Unlock()
@@ -0,0 +1,399 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/go-carbon/receiver"
+	"github.com/lomik/zapwriter"
+)
+
+func init() {
+	receiver.Register(
+		"statsd",
+		func() interface{} { return NewOptions() },
+		func(name string, options interface{}, store func(*points.Points)) (receiver.Receiver, error) {
+			return newStatsd(name, options.(*Options), store)
+		},
+	)
+}
+
+// Duration wrapper time.Duration for TOML
+type Duration struct {
+	time.Duration
+}
+
+var _ toml.TextMarshaler = &Duration{}
+
+// UnmarshalText from TOML
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText encode text with TOML format
+func (d *Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Options contains all receiver's options that can be changed by user
+type Options struct {
+	Listen        string    `toml:"listen"`
+	TCPListen     string    `toml:"tcp-listen"`
+	FlushInterval *Duration `toml:"flush-interval"`
+	Percentiles   []float64 `toml:"percentiles"`
+	Prefix        string    `toml:"prefix"`
+}
+
+// NewOptions returns Options struct filled with default values.
+func NewOptions() *Options {
+	return &Options{
+		Listen:        ":8125",
+		FlushInterval: &Duration{Duration: 10 * time.Second},
+		Percentiles:   []float64{90},
+		Prefix:        "stats",
+	}
+}
+
+// Statsd receive metrics in StatsD format from UDP packets and TCP connections,
+// aggregates them and sends aggregated points every flush interval
+type Statsd struct {
+	helper.Stoppable
+	out             func(*points.Points)
+	name            string // name for store metrics
+	flushInterval   time.Duration
+	percentiles     []float64
+	prefix          string
+	metricsReceived uint32
+	errors          uint32
+	udpConn         *net.UDPConn
+	tcpListener     *net.TCPListener
+	logger          *zap.Logger
+
+	mu            sync.Mutex
+	counters      map[string]float64
+	timers        map[string][]float64
+	timerCounters map[string]float64
+	gauges        map[string]float64
+	sets          map[string]map[string]struct{}
+}
+
+// UDPAddr returns binded UDP socket address. For bind port 0 in tests
+func (rcv *Statsd) UDPAddr() net.Addr {
+	if rcv.udpConn == nil {
+		return nil
+	}
+	return rcv.udpConn.LocalAddr()
+}
+
+// TCPAddr returns binded TCP socket address. For bind port 0 in tests
+func (rcv *Statsd) TCPAddr() net.Addr {
+	if rcv.tcpListener == nil {
+		return nil
+	}
+	return rcv.tcpListener.Addr()
+}
+
+func newStatsd(name string, options *Options, store func(*points.Points)) (*Statsd, error) {
+	if options.Listen == "" && options.TCPListen == "" {
+		return nil, fmt.Errorf("at least one of listen, tcp-listen should be set")
+	}
+
+	if options.FlushInterval == nil || options.FlushInterval.Duration <= 0 {
+		return nil, fmt.Errorf("flush-interval should be positive")
+	}
+
+	for _, p := range options.Percentiles {
+		if p <= 0 || p > 100 {
+			return nil, fmt.Errorf("bad percentile %v, should be in (0, 100]", p)
+		}
+	}
+
+	prefix := strings.Trim(options.Prefix, ".")
+	if prefix != "" {
+		prefix += "."
+	}
+
+	rcv := &Statsd{
+		out:           store,
+		name:          name,
+		flushInterval: options.FlushInterval.Duration,
+		percentiles:   options.Percentiles,
+		prefix:        prefix,
+		logger:        zapwriter.Logger(name),
+		counters:      make(map[string]float64),
+		timers:        make(map[string][]float64),
+		timerCounters: make(map[string]float64),
+		gauges:        make(map[string]float64),
+		sets:          make(map[string]map[string]struct{}),
+	}
+
+	err := rcv.StartFunc(func() error {
+		if options.Listen != "" {
+			if err := rcv.listenUDP(options.Listen); err != nil {
+				return err
+			}
+		}
+		if options.TCPListen != "" {
+			if err := rcv.listenTCP(options.TCPListen); err != nil {
+				return err
+			}
+		}
+
+		rcv.Go(rcv.flushWorker)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rcv, nil
+}
+
+func (rcv *Statsd) Stat(send helper.StatCallback) {
+	helper.SendAndSubstractUint32("metricsReceived", &rcv.metricsReceived, send)
+	helper.SendAndSubstractUint32("errors", &rcv.errors, send)
+}
+
+var sanitizeRe = regexp.MustCompile(`[^a-zA-Z_\-0-9.]`)
+
+// sanitize cleans metric name like statsd does
+func sanitize(name string) string {
+	name = strings.Join(strings.Fields(name), "_")
+	name = strings.Replace(name, "/", "-", -1)
+	return sanitizeRe.ReplaceAllString(name, "")
+}
+
+// handleLine parses and aggregates one line: <name>:<value>|<type>[|@<sample rate>]
+func (rcv *Statsd) handleLine(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+
+	i := bytes.IndexByte(line, ':')
+	if i < 1 {
+		return fmt.Errorf("bad message: %#v", string(line))
+	}
+
+	name := sanitize(string(line[:i]))
+	if name == "" {
+		return fmt.Errorf("bad message: %#v, empty name", string(line))
+	}
+
+	fields := strings.Split(string(line[i+1:]), "|")
+	if len(fields) < 2 {
+		return fmt.Errorf("bad message: %#v", string(line))
+	}
+
+	rawValue, typ := fields[0], fields[1]
+
+	sampleRate := 1.0
+	for _, f := range fields[2:] {
+		if !strings.HasPrefix(f, "@") {
+			// dogstatsd tags and other extensions are ignored
+			continue
+		}
+		rate, err := strconv.ParseFloat(f[1:], 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return fmt.Errorf("bad message: %#v, invalid sample rate", string(line))
+		}
+		sampleRate = rate
+	}
+
+	if typ == "s" {
+		rcv.mu.Lock()
+		set, ok := rcv.sets[name]
+		if !ok {
+			set = make(map[string]struct{})
+			rcv.sets[name] = set
+		}
+		set[rawValue] = struct{}{}
+		rcv.mu.Unlock()
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("bad message: %#v, invalid value", string(line))
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	switch typ {
+	case "c":
+		rcv.counters[name] += value / sampleRate
+	case "ms", "h":
+		rcv.timers[name] = append(rcv.timers[name], value)
+		rcv.timerCounters[name] += 1 / sampleRate
+	case "g":
+		// signed value modifies gauge
+		if rawValue[0] == '+' || rawValue[0] == '-' {
+			rcv.gauges[name] += value
+		} else {
+			rcv.gauges[name] = value
+		}
+	default:
+		return fmt.Errorf("bad message: %#v, unknown type %#v", string(line), typ)
+	}
+
+	return nil
+}
+
+func (rcv *Statsd) handle(line []byte) {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
+
+	if err := rcv.handleLine(line); err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		rcv.logger.Info("parse failed", zap.Error(err))
+		return
+	}
+	atomic.AddUint32(&rcv.metricsReceived, 1)
+}
+
+// percentileName returns suffix for percentile: 90 -> 90, 99.9 -> 99_9
+func percentileName(p float64) string {
+	return strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
+
+// flush sends aggregated values and resets counters, timers and sets. Gauges keep last value
+func (rcv *Statsd) flush(now int64) {
+	rcv.mu.Lock()
+	counters, timers, timerCounters, sets := rcv.counters, rcv.timers, rcv.timerCounters, rcv.sets
+	rcv.counters = make(map[string]float64)
+	rcv.timers = make(map[string][]float64)
+	rcv.timerCounters = make(map[string]float64)
+	rcv.sets = make(map[string]map[string]struct{})
+
+	gauges := make(map[string]float64, len(rcv.gauges))
+	for name, value := range rcv.gauges {
+		gauges[name] = value
+	}
+	rcv.mu.Unlock()
+
+	interval := rcv.flushInterval.Seconds()
+	send := func(name string, value float64) {
+		rcv.out(points.OnePoint(rcv.prefix+name, value, now))
+	}
+
+	for name, count := range counters {
+		send("counters."+name+".count", count)
+		send("counters."+name+".rate", count/interval)
+	}
+
+	for name, values := range timers {
+		sort.Float64s(values)
+		count := len(values)
+
+		cumulative := make([]float64, count)
+		sum := 0.0
+		for i, v := range values {
+			sum += v
+			cumulative[i] = sum
+		}
+		mean := sum / float64(count)
+
+		variance := 0.0
+		for _, v := range values {
+			variance += (v - mean) * (v - mean)
+		}
+
+		median := values[count/2]
+		if count%2 == 0 {
+			median = (values[count/2-1] + values[count/2]) / 2
+		}
+
+		prefix := "timers." + name + "."
+		send(prefix+"count", timerCounters[name])
+		send(prefix+"count_ps", timerCounters[name]/interval)
+		send(prefix+"lower", values[0])
+		send(prefix+"upper", values[count-1])
+		send(prefix+"sum", sum)
+		send(prefix+"mean", mean)
+		send(prefix+"median", median)
+		send(prefix+"std", math.Sqrt(variance/float64(count)))
+
+		for _, p := range rcv.percentiles {
+			n := int(math.Floor(p/100*float64(count) + 0.5))
+			if n == 0 {
+				continue
+			}
+			suffix := percentileName(p)
+			send(prefix+"count_"+suffix, float64(n))
+			send(prefix+"upper_"+suffix, values[n-1])
+			send(prefix+"sum_"+suffix, cumulative[n-1])
+			send(prefix+"mean_"+suffix, cumulative[n-1]/float64(n))
+		}
+	}
+
+	for name, value := range gauges {
+		send("gauges."+name, value)
+	}
+
+	for name, set := range sets {
+		send("sets."+name+".count", float64(len(set)))
+	}
+}
+
+func (rcv *Statsd) flushWorker(exit chan bool) {
+	ticker := time.NewTicker(rcv.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exit:
+			rcv.flush(time.Now().Unix())
+			return
+		case <-ticker.C:
+			rcv.flush(time.Now().Unix())
+		}
+	}
+}
+
+func (rcv *Statsd) listenUDP(listen string) error {
+	var err error
+	rcv.udpConn, err = receiver.ListenUDPLines(rcv.Go, listen, rcv.logger, &rcv.errors, rcv.handle)
+	return err
+}
+
+func (rcv *Statsd) listenTCP(listen string) error {
+	var err error
+	rcv.tcpListener, err = receiver.ListenTCP(rcv.Go, listen, rcv.logger, rcv.handleConnection)
+	return err
+}
+
+func (rcv *Statsd) handleConnection(exit chan bool, conn net.Conn) {
+	defer conn.Close()
+
+	unfinished, err := receiver.ReadLines(exit, conn, func(line []byte) bool {
+		rcv.handle(line)
+		return true
+	})
+	if err != nil {
+		atomic.AddUint32(&rcv.errors, 1)
+		rcv.logger.Error("read error", zap.Error(err))
+		return
+	}
+
+	// last line without newline is complete statsd message
+	rcv.handle(unfinished)
+}
@@ -0,0 +1,188 @@
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/receiver"
+)
+
+// names returns sorted names of stored metrics
+func names(c *qa.Collector) []string {
+	res := make([]string, 0)
+	for name := range c.Last() {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func newTestStatsd(t *testing.T, c *qa.Collector, options map[string]interface{}) *Statsd {
+	opts := map[string]interface{}{
+		"protocol":       "statsd",
+		"listen":         "127.0.0.1:0",
+		"flush-interval": "10s",
+	}
+	for k, v := range options {
+		opts[k] = v
+	}
+
+	r, err := receiver.New("statsd", opts, c.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.(*Statsd)
+}
+
+func TestAggregate(t *testing.T) {
+	assert := assert.New(t)
+	c := &qa.Collector{}
+
+	r := newTestStatsd(t, c, map[string]interface{}{"percentiles": []float64{90, 99.9}})
+	defer r.Stop()
+
+	lines := []string{
+		"hits:1|c",
+		"hits:2|c|@0.5",
+		"my app/req time:10|ms",
+		"my app/req time:30|ms|@0.5",
+		"my app/req time:20|ms",
+		"temp:20|g",
+		"temp:+5|g",
+		"temp:-10|g",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+		"tagged:1|c|#env:prod",
+	}
+	for _, line := range lines {
+		assert.NoError(r.handleLine([]byte(line)), line)
+	}
+
+	for _, line := range []string{"hits", "hits:1", "hits:a|c", "hits:1|x", "hits:1|c|@2", ":1|c"} {
+		assert.Error(r.handleLine([]byte(line)), line)
+	}
+
+	r.flush(1422698155)
+	received := c.Last()
+
+	expected := map[string]float64{
+		"stats.counters.hits.count":   5,
+		"stats.counters.hits.rate":    0.5,
+		"stats.counters.tagged.count": 1,
+		"stats.counters.tagged.rate":  0.1,
+
+		"stats.timers.my_app-req_time.count":    4,
+		"stats.timers.my_app-req_time.count_ps": 0.4,
+		"stats.timers.my_app-req_time.lower":    10,
+		"stats.timers.my_app-req_time.upper":    30,
+		"stats.timers.my_app-req_time.sum":      60,
+		"stats.timers.my_app-req_time.mean":     20,
+		"stats.timers.my_app-req_time.median":   20,
+		"stats.timers.my_app-req_time.std":      8.16496580927726,
+
+		"stats.timers.my_app-req_time.count_90": 3,
+		"stats.timers.my_app-req_time.upper_90": 30,
+		"stats.timers.my_app-req_time.sum_90":   60,
+		"stats.timers.my_app-req_time.mean_90":  20,
+
+		"stats.timers.my_app-req_time.count_99_9": 3,
+		"stats.timers.my_app-req_time.upper_99_9": 30,
+		"stats.timers.my_app-req_time.sum_99_9":   60,
+		"stats.timers.my_app-req_time.mean_99_9":  20,
+
+		"stats.gauges.temp":      15,
+		"stats.sets.users.count": 2,
+	}
+
+	for name, value := range expected {
+		assert.InDelta(value, received[name], 1e-9, name)
+	}
+	assert.Equal(len(expected), len(received), fmt.Sprint(names(c)))
+
+	// counters, timers and sets are reset, gauges are kept
+	c.Reset()
+	r.flush(1422698165)
+	assert.Equal([]string{"stats.gauges.temp"}, names(c))
+}
+
+func TestPercentile(t *testing.T) {
+	assert := assert.New(t)
+	c := &qa.Collector{}
+
+	r := newTestStatsd(t, c, map[string]interface{}{"prefix": ""})
+	defer r.Stop()
+
+	for i := 1; i <= 10; i++ {
+		assert.NoError(r.handleLine([]byte(fmt.Sprintf("t:%d|ms", i))))
+	}
+	r.flush(1422698155)
+	received := c.Last()
+
+	assert.Equal(float64(9), received["timers.t.count_90"])
+	assert.Equal(float64(9), received["timers.t.upper_90"])
+	assert.Equal(float64(45), received["timers.t.sum_90"])
+	assert.Equal(float64(5), received["timers.t.mean_90"])
+	assert.Equal(5.5, received["timers.t.median"])
+}
+
+func TestUDPAndTCP(t *testing.T) {
+	assert := assert.New(t)
+	c := &qa.Collector{}
+
+	r := newTestStatsd(t, c, map[string]interface{}{
+		"tcp-listen":     "127.0.0.1:0",
+		"flush-interval": "50ms",
+	})
+	defer r.Stop()
+
+	conn, err := net.Dial("udp", r.UDPAddr().String())
+	assert.NoError(err)
+	fmt.Fprint(conn, "udp.hits:1|c\nudp.hits:1|c\nbroken")
+	conn.Close()
+
+	conn, err = net.Dial("tcp", r.TCPAddr().String())
+	assert.NoError(err)
+	fmt.Fprint(conn, "tcp.hits:3|c\ntcp.gauge:7|g")
+	conn.Close()
+
+	timeout := time.After(5 * time.Second)
+	for len(names(c)) < 5 {
+		select {
+		case <-timeout:
+			t.Fatalf("received %v", names(c))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	received := c.Last()
+	assert.Equal(float64(2), received["stats.counters.udp.hits.count"])
+	assert.Equal(float64(3), received["stats.counters.tcp.hits.count"])
+	assert.Equal(float64(7), received["stats.gauges.tcp.gauge"])
+
+	stat := make(map[string]float64)
+	r.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(float64(4), stat["metricsReceived"])
+	assert.Equal(float64(1), stat["errors"])
+}
+
+func TestOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, opts := range []map[string]interface{}{
+		{"listen": "", "tcp-listen": ""},
+		{"flush-interval": "0s"},
+		{"percentiles": []float64{0}},
+		{"percentiles": []float64{101}},
+	} {
+		opts["protocol"] = "statsd"
+		_, err := receiver.New("statsd", opts, nil)
+		assert.Error(err, fmt.Sprint(opts))
+	}
+}
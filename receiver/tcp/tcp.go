@@ -15,6 +15,7 @@ import (
 	"github.com/klauspost/compress/gzip"
 	"github.com/klauspost/compress/snappy"
 	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/helper/tlsconfig"
 	"github.com/lomik/go-carbon/points"
 	"github.com/lomik/go-carbon/receiver"
 	"github.com/lomik/go-carbon/receiver/parse"
@@ -53,6 +54,7 @@ type Options struct {
 	Enabled     bool   `toml:"enabled"`
 	BufferSize  int    `toml:"buffer-size"`
 	Compression string `toml:"compression"`
+	tlsconfig.TLSOptions
 }
 
 func NewOptions() *Options {
@@ -68,6 +70,7 @@ type FramingOptions struct {
 	MaxMessageSize uint32 `toml:"max-message-size"`
 	Enabled        bool   `toml:"enabled"`
 	BufferSize     int    `toml:"buffer-size"`
+	tlsconfig.TLSOptions
 }
 
 func NewFramingOptions() *FramingOptions {
@@ -94,6 +97,7 @@ type TCP struct {
 	buffer          chan *points.Points
 	logger          *zap.Logger
 	decompressor    decompressor
+	tls             *tlsconfig.Config
 }
 
 // Addr returns binded socket address. For bind port 0 in tests
@@ -126,6 +130,10 @@ func newTCP(name string, options *Options, store func(*points.Points)) (*TCP, er
 
 	r.decompressor = newDecompressor(options.Compression)
 
+	if r.tls, err = tlsconfig.New(options.TLSOptions); err != nil {
+		return nil, err
+	}
+
 	err = r.Listen(addr)
 	if err != nil {
 		return nil, err
@@ -165,6 +173,10 @@ func newFraming(parser string, name string, options *FramingOptions, store func(
 		r.buffer = make(chan *points.Points, options.BufferSize)
 	}
 
+	if r.tls, err = tlsconfig.New(options.TLSOptions); err != nil {
+		return nil, err
+	}
+
 	err = r.Listen(addr)
 	if err != nil {
 		return nil, err
@@ -316,6 +328,18 @@ func (rcv *TCP) Stat(send helper.StatCallback) {
 		send("bufferLen", float64(len(rcv.buffer)))
 		send("bufferCap", float64(cap(rcv.buffer)))
 	}
+
+	if rcv.tls != nil {
+		send("tlsHandshakeErrors", float64(rcv.tls.HandshakeErrors()))
+	}
+}
+
+// ReloadTLS reads certificate files again. Used on SIGHUP
+func (rcv *TCP) ReloadTLS() error {
+	if rcv.tls == nil {
+		return nil
+	}
+	return rcv.tls.Reload()
 }
 
 // Listen bind port. Receive messages and send to out channel
@@ -327,6 +351,11 @@ func (rcv *TCP) Listen(addr *net.TCPAddr) error {
 			return err
 		}
 
+		var listener net.Listener = tcpListener
+		if rcv.tls != nil {
+			listener = tlsconfig.NewListener(tcpListener, rcv.tls)
+		}
+
 		rcv.Go(func(exit chan bool) {
 			<-exit
 			tcpListener.Close()
@@ -361,7 +390,7 @@ func (rcv *TCP) Listen(addr *net.TCPAddr) error {
 
 			for {
 
-				conn, err := tcpListener.Accept()
+				conn, err := listener.Accept()
 				if err != nil {
 					if strings.Contains(err.Error(), "use of closed network connection") {
 						break
@@ -0,0 +1,174 @@
+// Package rewrite renames and drops incoming metrics before they are stored in cache.
+// Rules are read from file in storage-schemas.conf like format:
+//
+//	[strip-prefix]
+//	pattern = ^prefix\.(.*)$
+//	action = replace
+//	replace = $1
+//	continue = true
+//
+//	[drop-debug]
+//	pattern = \.debug\.
+//	action = drop
+//
+// Rules are applied in file order. First matched rule stops processing unless it has continue = true
+package rewrite
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+)
+
+// Rule actions
+const (
+	ActionReplace = "replace"
+	ActionDrop    = "drop"
+)
+
+// Rule is one rewrite rule
+type Rule struct {
+	Name     string
+	Pattern  *regexp.Regexp
+	Action   string
+	Replace  string
+	Continue bool
+
+	hits uint32 // counter
+}
+
+// Rules is ordered list of rules
+type Rules []*Rule
+
+// ReadRules reads rules file
+func ReadRules(filename string) (Rules, error) {
+	config, err := helper.ParseIniFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(Rules, 0, len(config))
+
+	for _, section := range config {
+		rule := &Rule{Name: section["name"]}
+
+		if section["pattern"] == "" {
+			return nil, fmt.Errorf("empty pattern for [%s]", rule.Name)
+		}
+
+		rule.Pattern, err = regexp.Compile(section["pattern"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pattern %#v for [%s]: %s",
+				section["pattern"], rule.Name, err.Error())
+		}
+
+		rule.Action = section["action"]
+		if rule.Action == "" {
+			rule.Action = ActionReplace
+		}
+
+		switch rule.Action {
+		case ActionReplace:
+			rule.Replace = section["replace"]
+		case ActionDrop:
+			// pass
+		default:
+			return nil, fmt.Errorf("unknown action %#v for [%s], should be one of: replace, drop",
+				section["action"], rule.Name)
+		}
+
+		if section["continue"] != "" {
+			rule.Continue, err = strconv.ParseBool(section["continue"])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse continue %#v for [%s]: %s",
+					section["continue"], rule.Name, err.Error())
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Rewriter applies rules to points before store. Rules can be replaced on the fly
+type Rewriter struct {
+	rules atomic.Value // Rules
+
+	stat struct {
+		rewritten uint32 // counter
+		dropped   uint32 // counter
+	}
+}
+
+// New creates Rewriter without rules
+func New() *Rewriter {
+	r := &Rewriter{}
+	r.rules.Store(Rules(nil))
+	return r
+}
+
+// SetRules replaces rules. Hit counters of previous rules are reset
+func (r *Rewriter) SetRules(rules Rules) {
+	r.rules.Store(rules)
+}
+
+// Rewrite returns new metric name. Empty result means that metric should be dropped
+func (r *Rewriter) Rewrite(metric string) string {
+	for _, rule := range r.rules.Load().(Rules) {
+		if !rule.Pattern.MatchString(metric) {
+			continue
+		}
+
+		atomic.AddUint32(&rule.hits, 1)
+
+		if rule.Action == ActionDrop {
+			return ""
+		}
+
+		metric = rule.Pattern.ReplaceAllString(metric, rule.Replace)
+
+		if metric == "" || !rule.Continue {
+			break
+		}
+	}
+
+	return metric
+}
+
+// Store wraps store func with rules
+func (r *Rewriter) Store(store func(*points.Points)) func(*points.Points) {
+	return func(p *points.Points) {
+		if len(r.rules.Load().(Rules)) == 0 {
+			store(p)
+			return
+		}
+
+		metric := r.Rewrite(p.Metric)
+		if metric == "" {
+			atomic.AddUint32(&r.stat.dropped, uint32(len(p.Data)))
+			return
+		}
+
+		if metric != p.Metric {
+			atomic.AddUint32(&r.stat.rewritten, uint32(len(p.Data)))
+			p.Metric = metric
+		}
+
+		store(p)
+	}
+}
+
+// Stat callback
+func (r *Rewriter) Stat(send helper.StatCallback) {
+	helper.SendAndSubstractUint32("rewritten", &r.stat.rewritten, send)
+	helper.SendAndSubstractUint32("dropped", &r.stat.dropped, send)
+
+	for _, rule := range r.rules.Load().(Rules) {
+		helper.SendAndSubstractUint32(fmt.Sprintf("rule.%s.hits", rule.Name), &rule.hits, send)
+	}
+}
@@ -0,0 +1,99 @@
+package rewrite
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func readRules(t *testing.T, root string, body string) (Rules, error) {
+	filename := filepath.Join(root, "rewrite.conf")
+	if err := ioutil.WriteFile(filename, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ReadRules(filename)
+}
+
+func TestRewrite(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		rules, err := readRules(t, root, `
+[strip]
+pattern = ^prefix\.(.*)$
+replace = $1
+continue = true
+
+[debug]
+pattern = \.debug\.
+action = drop
+
+[cpu]
+pattern = ^servers\.([^.]+)\.cpu$
+action = replace
+replace = cpu;host=$1
+`)
+		assert.NoError(err)
+		assert.Equal(3, len(rules))
+
+		r := New()
+		r.SetRules(rules)
+
+		table := []struct {
+			metric   string
+			expected string
+		}{
+			{"prefix.hello.world", "hello.world"},
+			{"prefix.servers.web1.cpu", "cpu;host=web1"},
+			{"servers.web1.cpu", "cpu;host=web1"},
+			{"app.debug.count", ""},
+			{"prefix.app.debug.count", ""},
+			{"servers.web1.mem", "servers.web1.mem"},
+		}
+
+		for _, tt := range table {
+			assert.Equal(tt.expected, r.Rewrite(tt.metric), tt.metric)
+		}
+
+		stored := make([]string, 0)
+		store := r.Store(func(p *points.Points) {
+			stored = append(stored, p.Metric)
+		})
+
+		store(points.OnePoint("prefix.hello.world", 1, 10))
+		store(points.OnePoint("app.debug.count", 1, 10))
+		store(points.OnePoint("servers.web1.mem", 1, 10))
+		assert.Equal([]string{"hello.world", "servers.web1.mem"}, stored)
+
+		stat := make(map[string]float64)
+		r.Stat(func(metric string, value float64) {
+			stat[metric] = value
+		})
+
+		assert.Equal(float64(1), stat["rewritten"])
+		assert.Equal(float64(1), stat["dropped"])
+		assert.Equal(float64(4), stat["rule.strip.hits"])
+		assert.Equal(float64(3), stat["rule.debug.hits"])
+		assert.Equal(float64(2), stat["rule.cpu.hits"])
+	})
+}
+
+func TestReadRulesError(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		_, err := readRules(t, root, "[bad]\npattern = (\n")
+		assert.Error(err)
+
+		_, err = readRules(t, root, "[bad]\npattern = .*\naction = move\n")
+		assert.Error(err)
+
+		_, err = readRules(t, root, "[bad]\naction = drop\n")
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,208 @@
+package index
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Filter restricts access to metrics. Metric is allowed if its name starts with one of Prefixes
+// or if it is tagged metric with tag values matched by all TagValues. Nil filter allows all metrics
+type Filter struct {
+	Prefixes  []string
+	TagValues []*TagValueExpr
+
+	res []*regexp.Regexp // compiled values of OpMatch and OpNotMatch expressions
+}
+
+// NewFilter parses tag value expressions like in seriesByTag: tag=value, tag!=value, tag=~regexp, tag!=~regexp
+func NewFilter(prefixes []string, tagValues []string) (*Filter, error) {
+	f := &Filter{
+		Prefixes:  prefixes,
+		TagValues: make([]*TagValueExpr, 0, len(tagValues)),
+		res:       make([]*regexp.Regexp, 0, len(tagValues)),
+	}
+
+	for _, expr := range tagValues {
+		if !strings.Contains(expr, "=") {
+			return nil, fmt.Errorf("invalid tag expression %#v", expr)
+		}
+
+		tve := NewTagValueExpr(expr)
+		if tve.Tag == "" {
+			return nil, fmt.Errorf("invalid tag expression %#v", expr)
+		}
+
+		var re *regexp.Regexp
+		if tve.Op == OpMatch || tve.Op == OpNotMatch {
+			var err error
+			if re, err = regexp.Compile(tve.Value); err != nil {
+				return nil, fmt.Errorf("invalid tag expression %#v: %s", expr, err.Error())
+			}
+		}
+
+		f.TagValues = append(f.TagValues, tve)
+		f.res = append(f.res, re)
+	}
+
+	return f, nil
+}
+
+// prefixAllowed checks metric name (without tags) against prefixes
+func (f *Filter) prefixAllowed(name string) bool {
+	for _, prefix := range f.Prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed checks plain metric name or tagged name like name;tag1=value1;tag2=value2
+func (f *Filter) Allowed(metric string) bool {
+	if f == nil {
+		return true
+	}
+
+	i := strings.IndexByte(metric, ';')
+	if i < 0 {
+		return f.prefixAllowed(metric)
+	}
+
+	if f.prefixAllowed(metric[:i]) {
+		return true
+	}
+
+	if len(f.TagValues) == 0 {
+		return false
+	}
+
+	tags := make(map[string]string)
+	for _, tv := range strings.Split(metric[i+1:], ";") {
+		kv := strings.SplitN(tv, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		}
+	}
+
+	for j, tve := range f.TagValues {
+		value, ok := tags[tve.Tag]
+		if !ok {
+			return false
+		}
+
+		var matched bool
+		switch tve.Op {
+		case OpEq:
+			matched = value == tve.Value
+		case OpNotEq:
+			matched = value != tve.Value
+		case OpMatch:
+			matched = f.res[j].MatchString(value)
+		case OpNotMatch:
+			matched = !f.res[j].MatchString(value)
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Visible returns true if metric or directory should be shown in find results. Directories on the way
+// to allowed prefixes are visible
+func (f *Filter) Visible(name string, isDir bool) bool {
+	if f.Allowed(name) {
+		return true
+	}
+
+	if !isDir {
+		return false
+	}
+
+	for _, prefix := range f.Prefixes {
+		if strings.HasPrefix(prefix, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMatcher checks index nodes against filter
+type filterMatcher struct {
+	filter *Filter
+	ids    map[uint64]bool // paths matched by filter tag values
+}
+
+// newFilterMatcher returns nil matcher for nil filter. Called with locked index
+func (t *TagIndex) newFilterMatcher(f *Filter) *filterMatcher {
+	if f == nil {
+		return nil
+	}
+
+	m := &filterMatcher{filter: f, ids: make(map[uint64]bool)}
+	if len(f.TagValues) > 0 {
+		for _, id := range t.matchTagValues(f.TagValues) {
+			m.ids[id] = true
+		}
+	}
+
+	return m
+}
+
+// allowed checks metric name and path id
+func (m *filterMatcher) allowed(metric string, pathID uint64) bool {
+	return m.filter.prefixAllowed(metric) || m.ids[pathID]
+}
+
+// count returns number of allowed metrics with tag value
+func (m *filterMatcher) count(tv *TagValueInode) int {
+	enum, err := tv.Metrics.SeekFirst()
+	if err != nil {
+		return 0
+	}
+
+	var count int
+	for {
+		_, minode, err := enum.Next()
+		if err != nil {
+			break
+		}
+
+		if m.filter.prefixAllowed(minode.Metric) {
+			count++
+			continue
+		}
+
+		for _, id := range minode.PathIDs {
+			if m.ids[id] {
+				count++
+				break
+			}
+		}
+	}
+
+	return count
+}
+
+// tagAllowed returns true if tag has value with allowed metric
+func (m *filterMatcher) tagAllowed(ti *TagInode) bool {
+	enum, err := ti.Values.SeekFirst()
+	if err != nil {
+		return false
+	}
+
+	for {
+		_, tv, err := enum.Next()
+		if err != nil {
+			break
+		}
+		if m.count(tv) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,90 @@
+package index
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFilterAllowed(t *testing.T) {
+	f, err := NewFilter([]string{"team_a.", "common."}, []string{"team=a", "dc=~^ams"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		metric  string
+		allowed bool
+	}{
+		{"team_a.cpu", true},
+		{"common.load", true},
+		{"team_b.cpu", false},
+		{"team_a.cpu;team=b", true},
+		{"cpu;team=a;dc=ams1", true},
+		{"cpu;team=a;dc=sf", false},
+		{"cpu;team=a", false},
+		{"cpu;team=b;dc=ams1", false},
+	}
+
+	for _, tt := range table {
+		if got := f.Allowed(tt.metric); got != tt.allowed {
+			t.Errorf("%s: got %v, want %v", tt.metric, got, tt.allowed)
+		}
+	}
+
+	if !f.Visible("team_a", true) || f.Visible("team_a", false) || f.Visible("team_b", true) {
+		t.Error("parent directories of prefixes should be visible")
+	}
+
+	var all *Filter
+	if !all.Allowed("any.metric") || !all.Visible("any", true) {
+		t.Error("nil filter should allow all metrics")
+	}
+
+	for _, expr := range []string{"team", "=a", "team=~("} {
+		if _, err := NewFilter(nil, []string{expr}); err == nil {
+			t.Errorf("%s: error expected", expr)
+		}
+	}
+}
+
+func TestFilterIndex(t *testing.T) {
+	index := NewTagIndex()
+	for _, m := range []struct{ metric, team, host string }{
+		{"cpu", "a", "a1"},
+		{"cpu", "b", "b1"},
+		{"team_b.mem", "b", "b2"},
+	} {
+		path := fmt.Sprintf("%s;host=%s;team=%s", m.metric, m.host, m.team)
+		index.Insert(path, "host", m.host, m.metric, path)
+		index.Insert(path, "team", m.team, m.metric, path)
+	}
+
+	f, err := NewFilter([]string{"team_b."}, []string{"team=a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, m := range index.ListMetrics(nil, []*TagValueExpr{{"host", "", OpNotEq}}, 0, f) {
+		paths = append(paths, m.Path)
+	}
+	if want := []string{"cpu;host=a1;team=a", "team_b.mem;host=b2;team=b"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("ListMetrics: got %v, want %v", paths, want)
+	}
+
+	stat := index.StatTag("host", "", 100, f)
+	if want := []TagStatValue{{Count: 1, Value: "a1"}, {Count: 1, Value: "b2"}}; !reflect.DeepEqual(stat.Values, want) {
+		t.Errorf("StatTag: got %v, want %v", stat.Values, want)
+	}
+
+	if got := index.ListTags("", 100, f); !reflect.DeepEqual(got, []string{"host", "team"}) {
+		t.Errorf("ListTags: got %v", got)
+	}
+
+	// tag without allowed metrics is hidden
+	f, _ = NewFilter(nil, []string{"team=c"})
+	if got := index.ListTags("", 100, f); len(got) != 0 {
+		t.Errorf("ListTags: got %v", got)
+	}
+}
@@ -65,6 +65,7 @@ func NewTagIndex() *TagIndex {
 		paths:       newStringID(),
 		tvs:         newStringID(),
 		path2Metric: map[uint64]string{},
+		metricList:  map[string]struct{}{},
 	}
 	return ti
 }
@@ -73,7 +74,10 @@ func NewTagIndex() *TagIndex {
 func (ti *TagIndex) Insert(originalPath, tag, val, metric, path string) {
 	ti.Lock()
 	defer ti.Unlock()
-	if _, ok := ti.metricList[originalPath]; ok {
+
+	// every tag of the same file is inserted separately
+	key := originalPath + ";" + tag
+	if _, ok := ti.metricList[key]; ok {
 		return
 	}
 
@@ -117,23 +121,28 @@ func (ti *TagIndex) Insert(originalPath, tag, val, metric, path string) {
 	}
 	ti.path2Metric[pid] = metric
 
-	ti.metricList[originalPath] = struct{}{}
+	ti.metricList[key] = struct{}{}
 }
 
-func (t *TagIndex) ListTags(filter string, limit int) []string {
+// ListTags returns tag names. Tags without metrics allowed by access filter are skipped
+func (t *TagIndex) ListTags(filter string, limit int, access *Filter) []string {
 	t.RLock()
 	defer t.RUnlock()
 	enum, err := t.SeekFirst()
 	if err != nil {
 		return nil
 	}
+	m := t.newFilterMatcher(access)
 	var result []string
 	var count int
 	for {
-		node, _, err := enum.Next()
+		node, ti, err := enum.Next()
 		if err != nil {
 			break
 		}
+		if m != nil && !m.tagAllowed(ti) {
+			continue
+		}
 		result = append(result, node)
 		count++
 		if count > limit {
@@ -154,7 +163,8 @@ type TagStatValue struct {
 	Value string
 }
 
-func (t *TagIndex) StatTag(name string, valFilter string, limit int) *TagStat {
+// StatTag returns values of tag with number of metrics. Only metrics allowed by access filter are counted
+func (t *TagIndex) StatTag(name string, valFilter string, limit int, access *Filter) *TagStat {
 	t.RLock()
 	defer t.RUnlock()
 	ti, ok := t.Get(name)
@@ -166,6 +176,7 @@ func (t *TagIndex) StatTag(name string, valFilter string, limit int) *TagStat {
 		return nil
 	}
 
+	m := t.newFilterMatcher(access)
 	var ts TagStat
 	ts.Tag = name
 	for {
@@ -174,7 +185,13 @@ func (t *TagIndex) StatTag(name string, valFilter string, limit int) *TagStat {
 			break
 		}
 		if valFilter == "" || strings.HasPrefix(val, valFilter) {
-			ts.Values = append(ts.Values, TagStatValue{Count: tv.Metrics.Len(), Value: val})
+			count := tv.Metrics.Len()
+			if m != nil {
+				if count = m.count(tv); count == 0 {
+					continue
+				}
+			}
+			ts.Values = append(ts.Values, TagStatValue{Count: count, Value: val})
 			if len(ts.Values) >= limit {
 				break
 			}
@@ -223,47 +240,31 @@ type Metric struct {
 	Path string
 }
 
-func (t *TagIndex) ListMetrics(metricExpr *TagValueExpr, tves []*TagValueExpr, limit int) []Metric {
+// ListMetrics returns metrics matched by expressions. Metrics not allowed by access filter are skipped
+func (t *TagIndex) ListMetrics(metricExpr *TagValueExpr, tves []*TagValueExpr, limit int, access *Filter) []Metric {
 	t.RLock()
 	defer t.RUnlock()
-	var tvis [][]*TagValueInode
-	for _, tve := range tves {
-		tvis = append(tvis, t.findTagValue(tve))
-	}
 
 	var metrics []uint64
 
-	joinedTvis := joinTagValueInodes(tvis)
-	for _, tvis := range joinedTvis {
-		sort.Slice(tvis, func(i, j int) bool { return tvis[i].Metrics.Len() < tvis[j].Metrics.Len() })
-
-		// TODO(xhu): switch to skip list?
-		recorder := make(map[uint64]int, tvis[0].Metrics.Len())
-
-		for i, index := range tvis {
-			enum, err := index.Metrics.SeekFirst()
-			if err != nil {
-				continue
-			}
-			for {
-				_, minode, err := enum.Next()
-				if err != nil {
-					break
-				}
-				// TODO(xhu): exclude metrics that has tags (empty value in TagValueExpr)
-				for _, id := range minode.PathIDs {
-					if recorder[id] == i {
-						recorder[id] += 1
-					}
-				}
-			}
+	// without tag expressions metric name expression is checked against all known metrics
+	if len(tves) == 0 && metricExpr != nil {
+		for id := range t.path2Metric {
+			metrics = append(metrics, id)
 		}
+	}
+
+	metrics = append(metrics, t.matchTagValues(tves)...)
 
-		for m := range recorder {
-			metrics = append(metrics, m)
+	var metricRe *regexp.Regexp
+	if metricExpr != nil && (metricExpr.Op == OpMatch || metricExpr.Op == OpNotMatch) {
+		var err error
+		if metricRe, err = regexp.Compile(metricExpr.Value); err != nil {
+			return nil
 		}
 	}
 
+	m := t.newFilterMatcher(access)
 	result := make([]Metric, 0, len(metrics))
 	sort.Slice(metrics, func(i, j int) bool { return metrics[i] < metrics[j] })
 	for i, metric := range metrics {
@@ -272,6 +273,10 @@ func (t *TagIndex) ListMetrics(metricExpr *TagValueExpr, tves []*TagValueExpr, l
 		}
 
 		metricStr := t.path2Metric[metric]
+		if m != nil && !m.allowed(metricStr, metric) {
+			continue
+		}
+
 		if metricExpr == nil {
 			result = append(result, Metric{Name: metricStr, Path: t.paths.getString(metric)})
 			continue
@@ -287,9 +292,13 @@ func (t *TagIndex) ListMetrics(metricExpr *TagValueExpr, tves []*TagValueExpr, l
 				result = append(result, Metric{Name: metricStr, Path: t.paths.getString(metric)})
 			}
 		case OpMatch:
-			// TODO(xhu)
+			if metricRe.MatchString(metricStr) {
+				result = append(result, Metric{Name: metricStr, Path: t.paths.getString(metric)})
+			}
 		case OpNotMatch:
-			// TODO(xhu)
+			if !metricRe.MatchString(metricStr) {
+				result = append(result, Metric{Name: metricStr, Path: t.paths.getString(metric)})
+			}
 		default:
 			result = append(result, Metric{Name: metricStr, Path: t.paths.getString(metric)})
 		}
@@ -298,9 +307,60 @@ func (t *TagIndex) ListMetrics(metricExpr *TagValueExpr, tves []*TagValueExpr, l
 	return result
 }
 
+// matchTagValues returns ids of paths with tag values matched by all expressions. Ids can be duplicated.
+// Called with locked index
+func (t *TagIndex) matchTagValues(tves []*TagValueExpr) []uint64 {
+	var tvis [][]*TagValueInode
+	for _, tve := range tves {
+		tvi := t.findTagValue(tve)
+		if len(tvi) == 0 {
+			// expression without matched values can't be satisfied
+			return nil
+		}
+		tvis = append(tvis, tvi)
+	}
+
+	var metrics []uint64
+
+	joinedTvis := joinTagValueInodes(tvis)
+	for _, tvis := range joinedTvis {
+		sort.Slice(tvis, func(i, j int) bool { return tvis[i].Metrics.Len() < tvis[j].Metrics.Len() })
+
+		// TODO(xhu): switch to skip list?
+		recorder := make(map[uint64]int, tvis[0].Metrics.Len())
+
+		for i, index := range tvis {
+			enum, err := index.Metrics.SeekFirst()
+			if err != nil {
+				continue
+			}
+			for {
+				_, minode, err := enum.Next()
+				if err != nil {
+					break
+				}
+				// TODO(xhu): exclude metrics that has tags (empty value in TagValueExpr)
+				for _, id := range minode.PathIDs {
+					if recorder[id] == i {
+						recorder[id] += 1
+					}
+				}
+			}
+		}
+
+		for m, cnt := range recorder {
+			// metric should have all tag values from combination
+			if cnt == len(tvis) {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+
+	return metrics
+}
+
+// findTagValue returns values of tag matched by expression. Called with locked index
 func (t *TagIndex) findTagValue(tve *TagValueExpr) []*TagValueInode {
-	t.RLock()
-	defer t.RUnlock()
 	ti, ok := t.Get(tve.Tag)
 	if !ok {
 		return nil
@@ -311,6 +371,14 @@ func (t *TagIndex) findTagValue(tve *TagValueExpr) []*TagValueInode {
 	if err != nil {
 		return tvi
 	}
+
+	var r *regexp.Regexp
+	if tve.Op == OpMatch || tve.Op == OpNotMatch {
+		if r, err = regexp.Compile(tve.Value); err != nil {
+			return tvi
+		}
+	}
+
 	vid, ok := t.tvs.str2ID[tve.Value]
 	for {
 		_, tv, err := enum.Next()
@@ -326,38 +394,15 @@ func (t *TagIndex) findTagValue(tve *TagValueExpr) []*TagValueInode {
 				tvi = append(tvi, tv)
 			}
 		case OpNotEq:
-			if !ok {
-				break
-			}
-			if tv.ID != vid {
+			if !ok || tv.ID != vid {
 				tvi = append(tvi, tv)
 			}
 		case OpMatch:
-			if !ok {
-				break
-			}
-
-			r, err := regexp.Compile(tve.Value)
-			if err != nil {
-				break
-			}
-
-			// TODO: Check the implementation of regexp
-			if r.MatchString(tve.Value) {
+			if r.MatchString(tv.Value) {
 				tvi = append(tvi, tv)
 			}
 		case OpNotMatch:
-			if !ok {
-				break
-			}
-
-			r, err := regexp.Compile(tve.Value)
-			if err != nil {
-				break
-			}
-
-			// TODO: Check the implementation of regexp
-			if !r.MatchString(tve.Value) {
+			if !r.MatchString(tv.Value) {
 				tvi = append(tvi, tv)
 			}
 		}
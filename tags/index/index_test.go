@@ -10,6 +10,7 @@ import (
 	"os"
 	"reflect"
 	"runtime/pprof"
+	"strings"
 	"testing"
 	"time"
 
@@ -95,9 +96,9 @@ func TestIndex(t *testing.T) {
 		dc := string(rec[1])
 		machine := string(rec[2])
 		overlapped := string(rec[3])
-		index.Insert("dc", dc, metric, tags.FilePath("", metric, false))
-		index.Insert("machine", machine, metric, tags.FilePath("", metric, false))
-		index.Insert("overlapped", overlapped, metric, tags.FilePath("", metric, false))
+		index.Insert(tags.FilePath("", metric, false), "dc", dc, metric, tags.FilePath("", metric, false))
+		index.Insert(tags.FilePath("", metric, false), "machine", machine, metric, tags.FilePath("", metric, false))
+		index.Insert(tags.FilePath("", metric, false), "overlapped", overlapped, metric, tags.FilePath("", metric, false))
 	}
 	t.Logf("index took %s", time.Now().Sub(start))
 
@@ -110,17 +111,96 @@ func TestIndex(t *testing.T) {
 	start = time.Now()
 	t.Logf(
 		"list tiny (%d) took %s",
-		len(index.ListMetrics(&TagValueExpr{}, []*TagValueExpr{{"dc", "ams", "="}, {"machine", "8704f178-04ce-4f13-b166-a890ad8ebc8c", "="}}, 0)),
+		len(index.ListMetrics(&TagValueExpr{}, []*TagValueExpr{{"dc", "ams", "="}, {"machine", "8704f178-04ce-4f13-b166-a890ad8ebc8c", "="}}, 0, nil)),
 		time.Now().Sub(start),
 	)
 
 	start = time.Now()
 	t.Logf(
 		"list big (%d) took %s",
-		len(index.ListMetrics(&TagValueExpr{}, []*TagValueExpr{{"dc", "ams", "="}, {"overlapped", "overlapped", "="}}, 0)),
+		len(index.ListMetrics(&TagValueExpr{}, []*TagValueExpr{{"dc", "ams", "="}, {"overlapped", "overlapped", "="}}, 0, nil)),
 		time.Now().Sub(start),
 	)
 
 	pprof.StopCPUProfile()
 	profile.Close()
 }
+
+func TestListMetricsExpr(t *testing.T) {
+	index := NewTagIndex()
+	for _, m := range []struct{ metric, dc, host string }{
+		{"cpu", "ams", "a"},
+		{"cpu", "sf", "b"},
+		{"mem", "ams", "a"},
+	} {
+		path := fmt.Sprintf("%s;dc=%s;host=%s", m.metric, m.dc, m.host)
+		index.Insert(path, "dc", m.dc, m.metric, path)
+		index.Insert(path, "host", m.host, m.metric, path)
+	}
+
+	list := func(metricExpr *TagValueExpr, tves ...*TagValueExpr) []string {
+		var res []string
+		for _, m := range index.ListMetrics(metricExpr, tves, 0, nil) {
+			res = append(res, m.Path)
+		}
+		return res
+	}
+
+	table := []struct {
+		got  []string
+		want []string
+	}{
+		{list(nil, &TagValueExpr{"dc", "ams", OpEq}), []string{"cpu;dc=ams;host=a", "mem;dc=ams;host=a"}},
+		{list(nil, &TagValueExpr{"dc", "ams", OpEq}, &TagValueExpr{"host", "b", OpEq}), nil},
+		{list(nil, &TagValueExpr{"dc", "^a", OpMatch}, &TagValueExpr{"host", "a", OpEq}), []string{"cpu;dc=ams;host=a", "mem;dc=ams;host=a"}},
+		{list(nil, &TagValueExpr{"dc", "^a", OpNotMatch}), []string{"cpu;dc=sf;host=b"}},
+		{list(&TagValueExpr{"name", "cpu", OpEq}, &TagValueExpr{"dc", "ams", OpNotEq}), []string{"cpu;dc=sf;host=b"}},
+		{list(&TagValueExpr{"name", "^m", OpMatch}), []string{"mem;dc=ams;host=a"}},
+	}
+
+	for i, tt := range table {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%d: got %v, want %v", i, tt.got, tt.want)
+		}
+	}
+}
+
+func TestListMetricsMatchAll(t *testing.T) {
+	index := NewTagIndex()
+	for _, path := range []string{"cpu;dc=ams", "cpu;dc=sf;host=b", "disk;host=b"} {
+		arr := strings.Split(path, ";")
+		for _, tv := range arr[1:] {
+			kv := strings.SplitN(tv, "=", 2)
+			index.Insert(path, kv[0], kv[1], arr[0], path)
+		}
+	}
+
+	list := func(metricExpr *TagValueExpr, tves ...*TagValueExpr) []string {
+		var res []string
+		for _, m := range index.ListMetrics(metricExpr, tves, 0, nil) {
+			res = append(res, m.Path)
+		}
+		return res
+	}
+
+	table := []struct {
+		got  []string
+		want []string
+	}{
+		// previously metric matched by first expression only was listed
+		{list(nil, &TagValueExpr{"dc", "sf", OpEq}, &TagValueExpr{"host", "a", OpEq}), nil},
+		{list(nil, &TagValueExpr{"host", "b", OpEq}, &TagValueExpr{"dc", "sf", OpEq}), []string{"cpu;dc=sf;host=b"}},
+		// value missing in index
+		{list(nil, &TagValueExpr{"dc", "nyc", OpNotEq}), []string{"cpu;dc=ams", "cpu;dc=sf;host=b"}},
+		// previously regexp was matched against itself instead of tag values
+		{list(nil, &TagValueExpr{"dc", "^s", OpMatch}), []string{"cpu;dc=sf;host=b"}},
+		{list(nil, &TagValueExpr{"dc", "[", OpMatch}), nil},
+		{list(&TagValueExpr{"name", "^c", OpNotMatch}, &TagValueExpr{"host", "b", OpEq}), []string{"disk;host=b"}},
+	}
+
+	for i, tt := range table {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%d: got %v, want %v", i, tt.got, tt.want)
+		}
+	}
+}
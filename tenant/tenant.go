@@ -0,0 +1,134 @@
+// Package tenant routes incoming points to stores of tenants. Tenant of points is selected by:
+//
+//   - Tenant field of points, set by receiver with tenant option or by tenant header of http receiver
+//   - metric name prefix of tenant. Prefix is removed from metric name
+//
+// Points without tenant are passed to default store. Points of unknown tenant are dropped
+package tenant
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+)
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ValidateName checks that tenant name can be used in file paths and metric names
+func ValidateName(name string) error {
+	if !nameRe.MatchString(name) {
+		return fmt.Errorf("invalid tenant name %#v, only letters, digits, '_' and '-' are allowed", name)
+	}
+	return nil
+}
+
+// Tenant is destination of points
+type Tenant struct {
+	Name   string
+	Prefix string // optional metric name prefix
+	Store  func(*points.Points)
+}
+
+type routes struct {
+	byName   map[string]*Tenant
+	byPrefix []*Tenant // longest prefix first
+}
+
+// Router passes points to store of tenant. Tenants can be replaced on the fly
+type Router struct {
+	routes atomic.Value // *routes
+
+	stat struct {
+		unknown uint32 // counter
+	}
+}
+
+// New creates Router without tenants
+func New() *Router {
+	r := &Router{}
+	r.routes.Store(&routes{})
+	return r
+}
+
+// SetTenants replaces tenants
+func (r *Router) SetTenants(tenants []*Tenant) error {
+	rt := &routes{byName: make(map[string]*Tenant)}
+
+	for _, t := range tenants {
+		if _, exists := rt.byName[t.Name]; exists {
+			return fmt.Errorf("tenant %#v already defined", t.Name)
+		}
+		rt.byName[t.Name] = t
+
+		if t.Prefix == "" {
+			continue
+		}
+		for _, other := range rt.byPrefix {
+			if other.Prefix == t.Prefix {
+				return fmt.Errorf("prefix %#v of tenant %#v already used by tenant %#v", t.Prefix, t.Name, other.Name)
+			}
+		}
+		rt.byPrefix = append(rt.byPrefix, t)
+	}
+
+	sort.SliceStable(rt.byPrefix, func(i, j int) bool {
+		return len(rt.byPrefix[i].Prefix) > len(rt.byPrefix[j].Prefix)
+	})
+
+	r.routes.Store(rt)
+	return nil
+}
+
+// Route returns tenant of points or nil for default tenant. Tenant prefix is removed from metric name.
+// ok is false if tenant of points is unknown
+func (r *Router) Route(p *points.Points) (t *Tenant, ok bool) {
+	rt := r.routes.Load().(*routes)
+
+	if p.Tenant != "" {
+		t, ok = rt.byName[p.Tenant]
+		return t, ok
+	}
+
+	for _, t := range rt.byPrefix {
+		if strings.HasPrefix(p.Metric, t.Prefix) && len(p.Metric) > len(t.Prefix) {
+			p.Metric = p.Metric[len(t.Prefix):]
+			p.Tenant = t.Name
+			return t, true
+		}
+	}
+
+	return nil, true
+}
+
+// Store wraps default store func with routing to tenants
+func (r *Router) Store(store func(*points.Points)) func(*points.Points) {
+	return func(p *points.Points) {
+		if len(r.routes.Load().(*routes).byName) == 0 {
+			store(p)
+			return
+		}
+
+		t, ok := r.Route(p)
+		if !ok {
+			atomic.AddUint32(&r.stat.unknown, uint32(len(p.Data)))
+			return
+		}
+
+		if t == nil {
+			store(p)
+			return
+		}
+
+		t.Store(p)
+	}
+}
+
+// Stat callback
+func (r *Router) Stat(send helper.StatCallback) {
+	helper.SendAndSubstractUint32("unknownTenantDropped", &r.stat.unknown, send)
+}
@@ -0,0 +1,60 @@
+package tenant
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestRouter(t *testing.T) {
+	assert := assert.New(t)
+
+	received := make(map[string][]string)
+	store := func(name string) func(*points.Points) {
+		return func(p *points.Points) {
+			received[name] = append(received[name], p.Metric)
+		}
+	}
+
+	r := New()
+	s := r.Store(store("default"))
+
+	// without tenants tenant field is ignored
+	s(&points.Points{Metric: "hello.world", Tenant: "a", Data: []points.Point{{Value: 1}}})
+	assert.Equal([]string{"hello.world"}, received["default"])
+
+	assert.NoError(r.SetTenants([]*Tenant{
+		{Name: "a", Prefix: "team_a.", Store: store("a")},
+		{Name: "aa", Prefix: "team_a.sub.", Store: store("aa")},
+		{Name: "b", Store: store("b")},
+	}))
+
+	for _, p := range []*points.Points{
+		{Metric: "team_a.cpu"},
+		{Metric: "team_a.sub.cpu;host=a1"},
+		{Metric: "team_a.", Data: []points.Point{{Value: 1}}},
+		{Metric: "team_a.cpu", Tenant: "b"},
+		{Metric: "cpu", Tenant: "unknown", Data: []points.Point{{Value: 1}, {Value: 2}}},
+		{Metric: "other.cpu"},
+	} {
+		s(p)
+	}
+
+	assert.Equal([]string{"cpu"}, received["a"])
+	assert.Equal([]string{"cpu;host=a1"}, received["aa"])
+	assert.Equal([]string{"team_a.cpu"}, received["b"])
+	assert.Equal([]string{"hello.world", "team_a.", "other.cpu"}, received["default"])
+
+	stat := make(map[string]float64)
+	r.Stat(func(metric string, value float64) { stat[metric] = value })
+	assert.Equal(float64(2), stat["unknownTenantDropped"])
+
+	assert.Error(r.SetTenants([]*Tenant{{Name: "a"}, {Name: "a"}}))
+	assert.Error(r.SetTenants([]*Tenant{{Name: "a", Prefix: "p."}, {Name: "b", Prefix: "p."}}))
+
+	assert.NoError(ValidateName("team-a_1"))
+	assert.Error(ValidateName("team.a"))
+	assert.Error(ValidateName(""))
+}
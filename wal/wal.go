@@ -0,0 +1,446 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/go-carbon/helper"
+	"github.com/lomik/go-carbon/points"
+	"github.com/lomik/zapwriter"
+)
+
+// Fsync policies
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNone     = "none"
+)
+
+const segmentPrefix = "wal."
+const segmentSuffix = ".bin"
+
+var errClosed = errors.New("wal is closed")
+
+type segment struct {
+	id      int64 // creation time in nanoseconds, strictly increasing
+	path    string
+	created time.Time
+}
+
+// WAL is a segmented write-ahead log of all points accepted by cache.
+// Closed segments are removed when cache confirms that all points from them are persisted
+type WAL struct {
+	helper.Stoppable
+	path          string
+	segmentSize   int64
+	fsync         string
+	fsyncInterval time.Duration
+	retention     time.Duration
+	watermark     func() int64
+	logger        *zap.Logger
+
+	writeMutex  sync.Mutex
+	closed      bool
+	current     *segment
+	file        *os.File
+	writer      *bufio.Writer
+	written     int64 // bytes in current segment
+	lastID      int64
+	oldSegments []*segment    // closed segments, sorted by id
+	pending     map[int64]int // writes not released by caller yet, by segment id
+	seq         uint64        // number of writes, used by group commit
+
+	syncMutex sync.Mutex // serializes group commits of fsync always policy
+	synced    uint64     // seq of last durable write. Protected by syncMutex
+
+	stat struct {
+		pointsWritten uint32 // counter
+		writeErrors   uint32 // counter
+		fsyncs        uint32 // counter
+		truncated     uint32 // counter
+		expired       uint32 // counter
+	}
+}
+
+// New creates WAL in path. Watermark function should return id of oldest segment with unconfirmed points or 0
+func New(path string, watermark func() int64) *WAL {
+	return &WAL{
+		path:          path,
+		segmentSize:   64 * 1024 * 1024,
+		fsync:         FsyncInterval,
+		fsyncInterval: time.Second,
+		watermark:     watermark,
+		logger:        zapwriter.Logger("wal"),
+		pending:       make(map[int64]int),
+	}
+}
+
+// SetSegmentSize sets max size of one segment file in bytes
+func (w *WAL) SetSegmentSize(size int64) {
+	w.segmentSize = size
+}
+
+// SetFsync sets fsync policy and flush interval
+func (w *WAL) SetFsync(policy string, interval time.Duration) error {
+	switch policy {
+	case FsyncAlways, FsyncInterval, FsyncNone:
+		w.fsync = policy
+	default:
+		return fmt.Errorf("unknown wal fsync policy %#v, should be one of: always, interval, none", policy)
+	}
+	if interval > 0 {
+		w.fsyncInterval = interval
+	}
+	return nil
+}
+
+// SetRetention sets max age of segments. Older segments are removed even if they contain unconfirmed points
+func (w *WAL) SetRetention(retention time.Duration) {
+	w.retention = retention
+}
+
+func segmentID(filename string) (int64, bool) {
+	if !strings.HasPrefix(filename, segmentPrefix) || !strings.HasSuffix(filename, segmentSuffix) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(filename[len(segmentPrefix):len(filename)-len(segmentSuffix)], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// ListSegments returns sorted full paths of all segment files in dir
+func ListSegments(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	type item struct {
+		id   int64
+		path string
+	}
+	list := make([]item, 0)
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if id, ok := segmentID(file.Name()); ok {
+			list = append(list, item{id: id, path: filepath.Join(dir, file.Name())})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	res := make([]string, len(list))
+	for i := 0; i < len(list); i++ {
+		res[i] = list[i].path
+	}
+	return res, nil
+}
+
+// Write appends points to current segment and returns id of segment.
+// Segment of successful write is not truncated until Release is called with its id, after caller has registered points.
+// With fsync always policy call blocks until points are on disk. Concurrent writes share one fsync
+func (w *WAL) Write(p *points.Points) (int64, error) {
+	w.writeMutex.Lock()
+
+	if w.closed {
+		w.writeMutex.Unlock()
+		atomic.AddUint32(&w.stat.writeErrors, 1)
+		return 0, errClosed
+	}
+
+	if w.current == nil {
+		if err := w.openSegment(); err != nil {
+			w.writeMutex.Unlock()
+			atomic.AddUint32(&w.stat.writeErrors, 1)
+			w.logger.Error("can't create segment", zap.Error(err))
+			return 0, err
+		}
+	}
+
+	id := w.current.id
+	path := w.current.path
+
+	n, err := p.WriteBinaryTo(w.writer)
+	w.written += int64(n)
+	if err != nil {
+		w.writeMutex.Unlock()
+		atomic.AddUint32(&w.stat.writeErrors, 1)
+		w.logger.Error("write failed", zap.String("path", path), zap.Error(err))
+		return id, err
+	}
+	atomic.AddUint32(&w.stat.pointsWritten, uint32(len(p.Data)))
+
+	w.pending[id]++
+	w.seq++
+	seq := w.seq
+
+	if w.written >= w.segmentSize {
+		w.closeSegment()
+	}
+	w.writeMutex.Unlock()
+
+	if w.fsync == FsyncAlways {
+		if err = w.groupSync(seq); err != nil {
+			w.Release(id)
+			atomic.AddUint32(&w.stat.writeErrors, 1)
+			w.logger.Error("fsync failed", zap.String("path", path), zap.Error(err))
+			return id, err
+		}
+	}
+
+	return id, nil
+}
+
+// Release allows truncation of segment after successful Write
+func (w *WAL) Release(id int64) {
+	w.writeMutex.Lock()
+	if w.pending[id] <= 1 {
+		delete(w.pending, id)
+	} else {
+		w.pending[id]--
+	}
+	w.writeMutex.Unlock()
+}
+
+// groupSync makes all writes up to seq durable. Writers waiting for running fsync are covered by next one
+func (w *WAL) groupSync(seq uint64) error {
+	w.syncMutex.Lock()
+	defer w.syncMutex.Unlock()
+
+	if w.synced >= seq {
+		return nil
+	}
+
+	w.writeMutex.Lock()
+	file, upto := w.file, w.seq
+	var err error
+	if w.writer != nil {
+		err = w.writer.Flush()
+	}
+	w.writeMutex.Unlock()
+
+	// fsync runs without writeMutex, so writes of next group are not blocked
+	if err == nil && file != nil {
+		atomic.AddUint32(&w.stat.fsyncs, 1)
+		if err = file.Sync(); err != nil {
+			w.writeMutex.Lock()
+			if w.file != file {
+				// segment was closed meanwhile, closeSegment has synced it
+				err = nil
+			}
+			w.writeMutex.Unlock()
+		}
+	}
+
+	if err == nil {
+		w.synced = upto
+	}
+	return err
+}
+
+func (w *WAL) openSegment() error {
+	id := time.Now().UnixNano()
+	if id <= w.lastID {
+		id = w.lastID + 1
+	}
+
+	seg := &segment{
+		id:      id,
+		path:    filepath.Join(w.path, fmt.Sprintf("%s%d%s", segmentPrefix, id, segmentSuffix)),
+		created: time.Now(),
+	}
+
+	file, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.lastID = id
+	w.current = seg
+	w.file = file
+	w.writer = bufio.NewWriterSize(file, 65536)
+	w.written = 0
+
+	return nil
+}
+
+// sync flushes buffer and calls fsync if policy allows. Called with locked writeMutex
+func (w *WAL) sync() error {
+	if w.writer == nil {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if w.fsync == FsyncNone {
+		return nil
+	}
+	atomic.AddUint32(&w.stat.fsyncs, 1)
+	return w.file.Sync()
+}
+
+// closeSegment closes current segment. Called with locked writeMutex
+func (w *WAL) closeSegment() {
+	if w.current == nil {
+		return
+	}
+
+	if err := w.sync(); err != nil {
+		atomic.AddUint32(&w.stat.writeErrors, 1)
+		w.logger.Error("fsync failed", zap.String("path", w.current.path), zap.Error(err))
+	}
+
+	if err := w.file.Close(); err != nil {
+		w.logger.Error("close failed", zap.String("path", w.current.path), zap.Error(err))
+	}
+
+	w.oldSegments = append(w.oldSegments, w.current)
+	w.current = nil
+	w.file = nil
+	w.writer = nil
+	w.written = 0
+}
+
+// truncate removes closed segments without unconfirmed points and segments older than retention
+func (w *WAL) truncate() {
+	w.writeMutex.Lock()
+	candidates := w.oldSegments
+	// segments with writes not registered by caller yet are kept. Checked before watermark,
+	// so it includes points of released writes
+	for i, seg := range candidates {
+		if w.pending[seg.id] > 0 {
+			candidates = candidates[:i]
+			break
+		}
+	}
+	w.writeMutex.Unlock()
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	// all writes to candidates are finished and registered in cache
+	var watermark int64
+	if w.watermark != nil {
+		watermark = w.watermark()
+	}
+
+	now := time.Now()
+	removed := 0
+
+	for _, seg := range candidates {
+		if watermark != 0 && seg.id >= watermark {
+			if w.retention <= 0 || now.Sub(seg.created) < w.retention {
+				break
+			}
+			atomic.AddUint32(&w.stat.expired, 1)
+			w.logger.Warn("segment with unconfirmed points removed by retention",
+				zap.String("path", seg.path),
+				zap.Duration("age", now.Sub(seg.created)),
+			)
+		} else {
+			atomic.AddUint32(&w.stat.truncated, 1)
+		}
+
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			w.logger.Error("remove failed", zap.String("path", seg.path), zap.Error(err))
+			break
+		}
+		removed++
+	}
+
+	if removed == 0 {
+		return
+	}
+
+	w.writeMutex.Lock()
+	w.oldSegments = w.oldSegments[removed:]
+	w.writeMutex.Unlock()
+}
+
+func (w *WAL) worker(exit chan bool) {
+	ticker := time.NewTicker(w.fsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exit:
+			return
+		case <-ticker.C:
+			w.writeMutex.Lock()
+			if !w.closed && w.current != nil {
+				if err := w.sync(); err != nil {
+					atomic.AddUint32(&w.stat.writeErrors, 1)
+					w.logger.Error("fsync failed", zap.String("path", w.current.path), zap.Error(err))
+				}
+			}
+			w.writeMutex.Unlock()
+
+			w.truncate()
+		}
+	}
+}
+
+// Stat callback
+func (w *WAL) Stat(send helper.StatCallback) {
+	w.writeMutex.Lock()
+	segments := len(w.oldSegments)
+	if w.current != nil {
+		segments++
+	}
+	w.writeMutex.Unlock()
+
+	send("segments", float64(segments))
+
+	helper.SendAndSubstractUint32("pointsWritten", &w.stat.pointsWritten, send)
+	helper.SendAndSubstractUint32("writeErrors", &w.stat.writeErrors, send)
+	helper.SendAndSubstractUint32("fsyncs", &w.stat.fsyncs, send)
+	helper.SendAndSubstractUint32("truncatedSegments", &w.stat.truncated, send)
+	helper.SendAndSubstractUint32("expiredSegments", &w.stat.expired, send)
+}
+
+// Start creates directory and runs background fsync and truncate worker
+func (w *WAL) Start() error {
+	return w.StartFunc(func() error {
+		if err := os.MkdirAll(w.path, 0755); err != nil {
+			return err
+		}
+
+		w.writeMutex.Lock()
+		w.closed = false
+		w.writeMutex.Unlock()
+
+		w.Go(w.worker)
+		return nil
+	})
+}
+
+// Stop flushes and closes current segment. Segments stay on disk and will be restored on next start
+func (w *WAL) Stop() {
+	w.StopFunc(func() {
+		w.writeMutex.Lock()
+		w.closeSegment()
+		w.closed = true
+		w.writeMutex.Unlock()
+	})
+}
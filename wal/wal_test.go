@@ -0,0 +1,165 @@
+package wal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/go-carbon/helper/qa"
+	"github.com/lomik/go-carbon/points"
+)
+
+func TestWriteRotateTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		var watermark int64
+
+		w := New(root, func() int64 { return watermark })
+		w.SetSegmentSize(64)
+		assert.NoError(w.SetFsync(FsyncNone, 0))
+		assert.NoError(w.Start())
+
+		ids := make([]int64, 0)
+		for i := 0; i < 10; i++ {
+			id, err := w.Write(points.OnePoint(fmt.Sprintf("hello.world.%d", i), 42, 1470687039))
+			assert.NoError(err)
+			ids = append(ids, id)
+		}
+
+		segments, err := ListSegments(root)
+		assert.NoError(err)
+		assert.True(len(segments) > 1)
+
+		// oldest segment is not confirmed
+		watermark = ids[0]
+		w.truncate()
+
+		after, err := ListSegments(root)
+		assert.NoError(err)
+		assert.Equal(segments, after)
+
+		// everything is confirmed, but not registered by caller
+		w.Stop()
+		watermark = 0
+		w.truncate()
+
+		after, err = ListSegments(root)
+		assert.NoError(err)
+		assert.Equal(segments, after)
+
+		for _, id := range ids {
+			w.Release(id)
+		}
+		w.truncate()
+
+		after, err = ListSegments(root)
+		assert.NoError(err)
+		assert.Equal(0, len(after))
+
+		_, err = w.Write(points.OnePoint("hello.world", 42, 1470687039))
+		assert.Error(err)
+	})
+}
+
+func TestRetention(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		w := New(root, func() int64 { return 1 })
+		w.SetSegmentSize(1)
+		w.SetRetention(1)
+		assert.NoError(w.Start())
+		defer w.Stop()
+
+		id, err := w.Write(points.OnePoint("hello.world", 42, 1470687039))
+		assert.NoError(err)
+		w.Release(id)
+
+		w.truncate()
+
+		segments, err := ListSegments(root)
+		assert.NoError(err)
+		assert.Equal(0, len(segments))
+	})
+}
+
+func TestReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		w := New(root, nil)
+		assert.NoError(w.SetFsync(FsyncAlways, 0))
+		assert.NoError(w.Start())
+
+		expected := []*points.Points{
+			points.OnePoint("m1", 1, 1470687039).Add(2, 1470687040),
+			points.OnePoint("m2", 3, 1470687039),
+		}
+
+		for _, p := range expected {
+			_, err := w.Write(p)
+			assert.NoError(err)
+		}
+
+		w.Stop()
+
+		segments, err := ListSegments(root)
+		assert.NoError(err)
+		assert.Equal(1, len(segments))
+
+		restored := make([]*points.Points, 0)
+		assert.NoError(points.ReadFromFile(segments[0], func(p *points.Points) {
+			restored = append(restored, p)
+		}))
+
+		assert.Equal(len(expected), len(restored))
+		for i := 0; i < len(expected); i++ {
+			assert.True(expected[i].Eq(restored[i]))
+		}
+	})
+}
+
+func TestGroupSync(t *testing.T) {
+	assert := assert.New(t)
+
+	qa.Root(t, func(root string) {
+		w := New(root, nil)
+		w.SetSegmentSize(256)
+		assert.NoError(w.SetFsync(FsyncAlways, 0))
+		assert.NoError(w.Start())
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					id, err := w.Write(points.OnePoint(fmt.Sprintf("hello.world.%d", i), float64(j), 1470687039))
+					assert.NoError(err)
+					w.Release(id)
+				}
+			}(i)
+		}
+		wg.Wait()
+		w.Stop()
+
+		assert.True(w.stat.fsyncs > 0)
+		assert.Equal(uint32(0), w.stat.writeErrors)
+		assert.Equal(uint64(400), w.synced)
+		assert.Equal(0, len(w.pending))
+
+		segments, err := ListSegments(root)
+		assert.NoError(err)
+
+		count := 0
+		for _, segment := range segments {
+			assert.NoError(points.ReadFromFile(segment, func(p *points.Points) {
+				count++
+			}))
+		}
+		assert.Equal(400, count)
+	})
+}